@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+)
+
+// Measures the packets per second the data path of this host achieves for the data packets of
+// ScheduleVersion, which are generated with the PRG, and of the current version, which are
+// copied from templates. The measurements are the benchmarks of bwtestlib, see MeasureDataPath.
+func runBenchmark() error {
+	fmt.Println("Data path packets per second (bandwidth of the sender):")
+	fmt.Printf("%8s %8s %12s %12s %12s %12s\n", "Size", "Version", "Generate", "Verify", "Send", "Send Mbps")
+	for _, size := range BenchPacketSizes {
+		for _, version := range BenchVersions {
+			b, err := MeasureDataPath(size, version)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%8d %8d %12.0f %12.0f %12.0f %12.1f\n", b.PacketSize, b.Version, b.Generate,
+				b.Verify, b.Send, b.Send*float64(b.PacketSize*8)/1e6)
+		}
+	}
+	return nil
+}
@@ -5,8 +5,8 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"os"
@@ -16,10 +16,12 @@ import (
 	"time"
 	"unicode"
 
+	log "github.com/inconshreveable/log15"
 	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
-	"github.com/scionproto/scion/go/lib/spath"
 )
 
 const (
@@ -38,13 +40,27 @@ var (
 	sciondFromIA   *bool
 )
 
+func Check(e error) {
+	if e != nil {
+		LogFatal("Fatal error. Exiting.", "err", e)
+	}
+}
+
+// If set, FatalHook is called by LogFatal with its arguments before the application exits, e.g. to
+// report the error in a structured output
+var FatalHook func(msg string, a ...interface{})
+
+func LogFatal(msg string, a ...interface{}) {
+	log.Crit(msg, a...)
+	if FatalHook != nil {
+		FatalHook(msg, a...)
+	}
+	os.Exit(1)
+}
+
 func prepareAESKey() []byte {
-	key := make([]byte, 16)
-	n, err := rand.Read(key)
+	key, err := NewPrgKey()
 	Check(err)
-	if n != 16 {
-		Check(fmt.Errorf("Did not obtain 16 bytes of random information, only received %d", n))
-	}
 	return key
 }
 
@@ -67,9 +83,203 @@ func printUsage() {
 	fmt.Println("\tWhen only the cs or sc flag is set, the other flag is set to the same value.")
 	fmt.Println("-i specifies if the client is used in interactive mode, " +
 		"when true the user is prompted for a path choice")
+	fmt.Println("-pathAlgo specifies the path policy that chooses the path otherwise, e.g. shortest, mtu, expiry, " +
+		"or constraints and a weighted preference such as \"avoid 17-ffaa:0:1102; min_mtu 1400; 2*shortest + expiry\". " +
+		"-path_policy_file loads the policy from a file, one clause per line. See the README for the policy language.")
+	fmt.Println("-path selects the path without prompting, by a prefix of at least 8 digits of its fingerprint, which " +
+		"is printed in the list of paths, or by a hop predicate (ISD-AS#IF, * for any) for each of its hops, e.g. " +
+		"-path \"17-ffaa:0:1102#1 17-ffaa:0:1107#*\". The client exits if no path matches, if several do, the " +
+		"path policy chooses among them.")
+	fmt.Println("-psk_file specifies a file with pre-shared keys, one \"name hexkey\" per line, " +
+		"to authenticate with servers that require it, -psk_name selects the key (default: the first one)")
+	fmt.Println("-paths specifies the number of paths for a multipath bwtest, 0 for all paths. The packets " +
+		"of both directions are split evenly across the paths, and the results are reported per path and " +
+		"in aggregate")
+	fmt.Println("\tWith -disjoint, only paths that do not share an interface are used, e.g. -paths 0 -disjoint " +
+		"uses all disjoint paths")
+	fmt.Println("-search searches the maximum achievable bandwidth of the path in both directions with a " +
+		"sequence of bwtests: starting from the bandwidth given by -cs and -sc, the bandwidth is doubled until " +
+		"a test fails, then the search narrows down on the bandwidth between the highest successful and the " +
+		"lowest failed test. The duration and packet size of each test are taken from -cs and -sc.")
+	fmt.Println("\tA test fails if its loss rate exceeds -search_loss percent (default 5) or if less than " +
+		"90% of the attempted bandwidth is achieved")
+	fmt.Println("-survey runs a bwtest with the parameters of -cs and -sc over each path the path policy accepts, " +
+		"one after the other, and prints the paths ranked by the bandwidth of the slower direction, loss rate and " +
+		"round-trip time. If the server is at its rate limit, the survey waits as long as the server asks.")
+	fmt.Println("-failover switches the data connection to another path the path policy accepts when its path " +
+		"fails during the bwtest, i.e. on SCMP errors, sustained loss or when the path is about to expire. The " +
+		"results list the paths used and when and why the data connection switched.")
+	fmt.Println("-pacing selects how the senders pace their packets: fixed (default) sends at the fixed rate " +
+		"given by -cs and -sc, aimd and bbr adapt the rate to the feedback of the receiver with an AIMD (like " +
+		"TCP Reno) or a BBR-like controller. With adaptive pacing, the rates given by -cs and -sc are the " +
+		"maximum rates, and the loss rate is relative to the packets that were sent.")
+	fmt.Println("-schedule selects when the directions run: concurrent (default) runs both at the same time, " +
+		"cs_first and sc_first run them one after the other, cs_only and sc_only run a single direction")
+	fmt.Println("\t-cs_offset and -sc_offset delay the start of the client->server and server->client " +
+		"directions, e.g. -sc_offset 500ms. With cs_first or sc_first, the offset of the second direction is " +
+		"added to the end of the first one.")
+	fmt.Println("-json writes the test parameters, the paths, the results of both directions and any error " +
+		"as a JSON document to stdout, all other output goes to stderr")
+	fmt.Println("-list_paths lists the paths to the server with their fingerprint, hop count, MTU, expiration " +
+		"time, next hop and rank under the path policy, and exits. With -json, the list is written as a JSON " +
+		"document.")
+	fmt.Println("-bench measures how many data packets per second this host can generate, verify and send, " +
+		"without using the network, and exits")
+	fmt.Println("-fetch fetches the client->server result of an earlier bwtest from the server, e.g. after the " +
+		"fetch failed. The key is printed when the result is missing, the server must keep the results with " +
+		"-results_file.")
 	fmt.Println("Default test parameters are: ", DefaultBwtestParameters)
 }
 
+// Prints the delay, jitter, loss and reordering statistics and the percentiles of the
+// interarrival times and delays, which are only available if both client and server support them
+func printStatistics(res *BwtestResult) {
+	if res.LossBursts < 0 {
+		return
+	}
+	if res.Jitter >= 0 {
+		// The clocks of client and server are not synchronized, so only delays relative to the
+		// smallest one are meaningful
+		fmt.Printf("One-way delay relative to min: average %.3fms, max %.3fms\n",
+			float64(res.OWDavg-res.OWDmin)/1e6, float64(res.OWDmax-res.OWDmin)/1e6)
+		fmt.Printf("Jitter: %.3fms\n", float64(res.Jitter)/1e6)
+	}
+	fmt.Printf("Loss bursts: %d, longest loss burst: %d packets\n", res.LossBursts, res.MaxLossBurst)
+	fmt.Printf("Reordered packets: %d, duplicate packets: %d\n", res.Reordered, res.Duplicates)
+	if res.CorruptedPackets > 0 || res.WrongSizePackets > 0 {
+		fmt.Printf("Corrupted packets: %d, packets of wrong size: %d\n", res.CorruptedPackets, res.WrongSizePackets)
+	}
+	if len(res.CorruptedRanges) > 0 {
+		fmt.Println("Corrupted byte ranges:", formatCorruptedRanges(res.CorruptedRanges))
+	}
+	if res.IPAHist != nil && res.IPAHist.Total > 0 {
+		fmt.Println("Interarrival time percentiles:", formatPercentiles(res.IPAHist))
+	}
+	if res.OWDHist != nil && res.OWDHist.Total > 0 {
+		fmt.Println("One-way delay relative to min percentiles:", formatPercentiles(res.OWDHist))
+	}
+}
+
+// Formats the corrupted ranges as "offset-last (packets)"
+func formatCorruptedRanges(ranges []CorruptedRange) string {
+	s := make([]string, len(ranges))
+	for i, r := range ranges {
+		s[i] = fmt.Sprintf("%d-%d (%d)", r.Offset, r.Offset+r.Length-1, r.Count)
+	}
+	return strings.Join(s, ", ")
+}
+
+// Prints the result of one direction of the bwtest with parameters bwp
+func printResult(bwp *BwtestParameters, res *BwtestResult) {
+	att := attemptedBandwidth(bwp)
+	ach := achievedBandwidth(bwp, res)
+	fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
+	fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
+	fmt.Println("Loss rate:", int64(lossRate(bwp, res)), "%")
+	if bwp.Pacing != PacingFixed {
+		if res.NumPacketsSent >= 0 {
+			fmt.Printf("Pacing: %s, packets sent: %d\n", PacingString(bwp.Pacing), res.NumPacketsSent)
+		} else {
+			fmt.Printf("Pacing: %s is not supported by the server, fixed pacing was used\n", PacingString(bwp.Pacing))
+		}
+	}
+	variance := res.IPAvar
+	average := res.IPAavg
+	fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
+		variance/1e6, average/1e6)
+	fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
+		res.IPAmin/1e6, res.IPAmax/1e6)
+	printStatistics(res)
+}
+
+// Prints how to fetch the missing client->server result of the direction with parameters bwp later
+func printFetchHint(bwp *BwtestParameters) {
+	fmt.Printf("The result can be fetched later with -fetch %x\n", bwp.PrgKey)
+}
+
+// Fetches the client->server result of an earlier bwtest, identified by the hex encoded PRG key
+// of that direction, and prints it. The parameters of the bwtest are not known, so only the
+// counts and statistics of the result are printed.
+func fetchResult(clientCCAddr, serverCCAddr *snet.Addr, hexKey string, policy pathpolicy.PathPolicy, psk *PSK) error {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return fmt.Errorf("Error, invalid key %q: %v", hexKey, err)
+	}
+	client := &Client{
+		Local:      clientCCAddr,
+		PathPolicy: policy,
+		PSK:        psk,
+		Logf: func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		},
+	}
+	res, err := client.Fetch(context.Background(), serverCCAddr, key)
+	if err != nil {
+		return fmt.Errorf("Error, could not fetch the result: %v", err)
+	}
+	fmt.Println("\nC->S results")
+	fmt.Printf("Packets received: %d, correctly received: %d\n", res.NumPacketsReceived, res.CorrectlyReceived)
+	if res.NumPacketsSent >= 0 {
+		fmt.Printf("Packets sent: %d\n", res.NumPacketsSent)
+	}
+	fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
+		res.IPAvar/1e6, res.IPAavg/1e6)
+	fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
+		res.IPAmin/1e6, res.IPAmax/1e6)
+	printStatistics(res)
+	return nil
+}
+
+func attemptedBandwidth(bwp *BwtestParameters) int64 {
+	return int64(float64(8*bwp.PacketSize*bwp.NumPackets) / bwp.BwtestDuration.Seconds())
+}
+
+func achievedBandwidth(bwp *BwtestParameters, res *BwtestResult) int64 {
+	return int64(float64(8*bwp.PacketSize*res.CorrectlyReceived) / bwp.BwtestDuration.Seconds())
+}
+
+// Returns the number of packets sent in the direction with parameters bwp. With adaptive pacing,
+// the sender stops after the duration of the bwtest, so the number is taken from the receiver.
+func sentPackets(bwp *BwtestParameters, res *BwtestResult) int64 {
+	if bwp.Pacing != PacingFixed && res.NumPacketsSent >= 0 {
+		return res.NumPacketsSent
+	}
+	return bwp.NumPackets
+}
+
+// Returns the loss rate in percent
+func lossRate(bwp *BwtestParameters, res *BwtestResult) float64 {
+	sent := sentPackets(bwp, res)
+	if sent == 0 {
+		return 0
+	}
+	return float64(sent-res.CorrectlyReceived) * 100 / float64(sent)
+}
+
+// Prints the throughput and loss of each path of a multipath bwtest side by side
+func printPathComparison(pathTests []*pathTest) {
+	fmt.Println("\nPath comparison:")
+	for i, pt := range pathTests {
+		fmt.Printf("[%2d] %s\n", i, pt.pathEntry.Path.String())
+		var dirs []string
+		if pt.res != nil {
+			dirs = append(dirs, fmt.Sprintf("S->C: %.2f Mbps, loss %d %%",
+				float64(achievedBandwidth(&pt.serverBwp, pt.res))/1000000, int64(lossRate(&pt.serverBwp, pt.res))))
+		}
+		if pt.sres != nil {
+			dirs = append(dirs, fmt.Sprintf("C->S: %.2f Mbps, loss %d %%",
+				float64(achievedBandwidth(&pt.clientBwp, pt.sres))/1000000, int64(lossRate(&pt.clientBwp, pt.sres))))
+		}
+		fmt.Println("     " + strings.Join(dirs, ", "))
+	}
+}
+
+func formatPercentiles(h *Histogram) string {
+	return fmt.Sprintf("p50 %.3fms, p90 %.3fms, p99 %.3fms, p99.9 %.3fms",
+		float64(h.Percentile(50))/1e6, float64(h.Percentile(90))/1e6,
+		float64(h.Percentile(99))/1e6, float64(h.Percentile(99.9))/1e6)
+}
+
 // Input format (time duration,packet size,number of packets,target bandwidth), no spaces, question mark ? is wildcard
 // The value of the wildcard is computed from the other values, if more than one wildcard is used,
 // all but the last one are set to the defaults values
@@ -154,7 +364,7 @@ func parseBwtestParameters(s string) BwtestParameters {
 		}
 	}
 	key := prepareAESKey()
-	return BwtestParameters{time.Second * time.Duration(a1), a2, a3, key, 0}
+	return BwtestParameters{time.Second * time.Duration(a1), a2, a3, key, 0, PacingFixed, 0}
 }
 
 func parseBandwidth(bw string) int64 {
@@ -253,15 +463,6 @@ func main() {
 		clientCCAddr *snet.Addr
 		// Address of server control channel (CC)
 		serverCCAddr *snet.Addr
-		// Control channel connection
-		CCConn *snet.Conn
-
-		// Address of client data channel (DC)
-		clientDCAddr *snet.Addr
-		// Address of server data channel (DC)
-		serverDCAddr *snet.Addr
-		// Data channel connection
-		DCConn *snet.Conn
 
 		clientBwpStr string
 		clientBwp    BwtestParameters
@@ -269,11 +470,29 @@ func main() {
 		serverBwp    BwtestParameters
 		interactive  bool
 		pathAlgo     string
-
-		err   error
-		tzero time.Time // initialized to "zero" time
-
-		receiveDone sync.Mutex // used to signal when the HandleDCConnReceive goroutine has completed
+		policyFile   string
+		pathSpec     string
+		policy       pathpolicy.PathPolicy
+		pskFile      string
+		pskName      string
+		psk          *PSK
+		numPaths     int
+		disjoint     bool
+		search       bool
+		searchLoss   float64
+		survey       bool
+		failover     bool
+		listPaths    bool
+		jsonOutput   bool
+		pacingStr    string
+		pacing       byte
+		schedule     string
+		csOffset     time.Duration
+		scOffset     time.Duration
+		bench        bool
+		fetchKey     string
+
+		err error
 	)
 
 	flag.StringVar(&sciondPath, "sciond", "", "Path to sciond socket")
@@ -285,7 +504,26 @@ func main() {
 	flag.StringVar(&serverBwpStr, "sc", DefaultBwtestParameters, "Server->Client test parameter")
 	flag.StringVar(&clientBwpStr, "cs", DefaultBwtestParameters, "Client->Server test parameter")
 	flag.BoolVar(&interactive, "i", false, "Interactive mode")
-	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\")")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path policy, e.g. \"shortest\", \"mtu\", \"expiry\" or \"min_mtu 1400; 2*shortest + expiry\"")
+	flag.StringVar(&policyFile, "path_policy_file", "", "File with the path policy, instead of -pathAlgo")
+	flag.StringVar(&pathSpec, "path", "", "Path to use, given by its fingerprint or by its hops, e.g. \"1-ff00:0:110#1 1-ff00:0:111#2\"")
+	flag.StringVar(&pskFile, "psk_file", "", "File with pre-shared keys to authenticate with the server")
+	flag.StringVar(&pskName, "psk_name", "", "Name of the pre-shared key to use, by default the first key in the file")
+	flag.IntVar(&numPaths, "paths", 1, "Number of paths to split the bwtest across, 0 for all paths")
+	flag.BoolVar(&disjoint, "disjoint", false, "Only use paths that do not share an interface")
+	flag.BoolVar(&search, "search", false, "Search the maximum achievable bandwidth in both directions")
+	flag.Float64Var(&searchLoss, "search_loss", DefaultSearchLoss, "Maximum loss rate in percent of a successful capacity search step")
+	flag.BoolVar(&survey, "survey", false, "Run a bwtest over each path to the server, one after the other, and rank the paths")
+	flag.BoolVar(&failover, "failover", false, "Switch the data connection to another path when its path fails")
+	flag.BoolVar(&listPaths, "list_paths", false, "List the paths to the server and exit")
+	flag.BoolVar(&jsonOutput, "json", false, "Write the parameters and results as a JSON document to stdout")
+	flag.StringVar(&pacingStr, "pacing", "fixed", "Pacing of the senders: fixed, aimd or bbr")
+	flag.StringVar(&schedule, "schedule", scheduleConcurrent,
+		"When the directions run: concurrent, cs_first, sc_first, cs_only or sc_only")
+	flag.DurationVar(&csOffset, "cs_offset", 0, "Delay of the start of the client->server direction")
+	flag.DurationVar(&scOffset, "sc_offset", 0, "Delay of the start of the server->client direction")
+	flag.BoolVar(&bench, "bench", false, "Measure the packets per second of the local data path and exit")
+	flag.StringVar(&fetchKey, "fetch", "", "Fetch the client->server result of an earlier bwtest by its hex encoded key and exit")
 
 	flag.Parse()
 	flagset := make(map[string]bool)
@@ -297,6 +535,49 @@ func main() {
 		printUsage()
 		os.Exit(0)
 	}
+	if bench {
+		Check(runBenchmark())
+		os.Exit(0)
+	}
+
+	var report *jsonReport
+	if jsonOutput {
+		// All other output goes to stderr, so that stdout only contains the JSON document
+		report = &jsonReport{Client: clientCCAddrStr, Server: serverCCAddrStr, Paths: []*jsonPathReport{}}
+		jsonOut := os.Stdout
+		os.Stdout = os.Stderr
+		log.Root().SetHandler(log.StreamHandler(os.Stderr, log.LogfmtFormat()))
+		FatalHook = func(msg string, a ...interface{}) {
+			report.setFatal(msg, a...)
+			report.write(jsonOut)
+		}
+		defer report.write(jsonOut)
+	}
+
+	policy, err = pathpolicy.New(pathAlgo, policyFile)
+	Check(err)
+	if len(pathSpec) > 0 {
+		if interactive {
+			Check(fmt.Errorf("Error, only one of -i and -path can be specified"))
+		}
+		spec, err := pathpolicy.ParseSpecifier(pathSpec)
+		Check(err)
+		policy = pathpolicy.Restrict(policy, spec)
+	}
+
+	if len(pskFile) > 0 {
+		keys, err := LoadPSKFile(pskFile)
+		Check(err)
+		for i := range keys {
+			if len(pskName) == 0 || keys[i].Name == pskName {
+				psk = &keys[i]
+				break
+			}
+		}
+		if psk == nil {
+			Check(fmt.Errorf("Error, pre-shared key %q not found in %s", pskName, pskFile))
+		}
+	}
 
 	// Create SCION UDP socket
 	if len(clientCCAddrStr) > 0 {
@@ -322,24 +603,86 @@ func main() {
 	} else if sciondPath == "" {
 		sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
-	err = snet.Init(clientCCAddr.IA, sciondPath, dispatcherPath)
+	err = transport.Init(clientCCAddr.IA, sciondPath, dispatcherPath)
 	Check(err)
 
-	var pathEntry *sciond.PathReplyEntry
-	if !serverCCAddr.IA.Eq(clientCCAddr.IA) {
-		pathEntry = ChoosePath(interactive, pathAlgo, *clientCCAddr, *serverCCAddr)
-		if pathEntry == nil {
+	if len(fetchKey) > 0 {
+		Check(fetchResult(clientCCAddr, serverCCAddr, fetchKey, policy, psk))
+		return
+	}
+	if listPaths {
+		if serverCCAddr.IA.Eq(clientCCAddr.IA) {
+			Check(fmt.Errorf("Error, client and server are in the same AS, there are no paths to list"))
+		}
+		paths := pathpolicy.List(policy, transport.DefNetwork.PathResolver().Query(clientCCAddr.IA, serverCCAddr.IA))
+		if len(paths) == 0 {
 			LogFatal("No paths available to remote destination")
 		}
-		serverCCAddr.Path = spath.New(pathEntry.Path.FwdPath)
-		serverCCAddr.Path.InitOffsets()
-		serverCCAddr.NextHopHost = pathEntry.HostInfo.Host()
-		serverCCAddr.NextHopPort = pathEntry.HostInfo.Port
+		if report != nil {
+			report.Available = paths
+			return
+		}
+		PrintPaths(serverCCAddr.IA, paths)
+		return
 	}
 
-	CCConn, err = snet.DialSCION("udp4", clientCCAddr, serverCCAddr)
+	multipath := numPaths != 1 || disjoint
+	if numPaths < 0 {
+		Check(fmt.Errorf("Error, the number of paths must not be negative"))
+	}
+	if survey {
+		switch {
+		case serverCCAddr.IA.Eq(clientCCAddr.IA):
+			Check(fmt.Errorf("Error, client and server are in the same AS, there are no paths to survey"))
+		case interactive:
+			Check(fmt.Errorf("Error, only one of -i and -survey can be specified"))
+		case search:
+			Check(fmt.Errorf("Error, only one of -search and -survey can be specified"))
+		case multipath:
+			Check(fmt.Errorf("Error, the survey tests one path at a time, -paths and -disjoint are not supported"))
+		}
+	}
+	if failover && (survey || search) {
+		Check(fmt.Errorf("Error, -failover measures the paths it switches to, it cannot be used with -survey or -search"))
+	}
+	// A nil path entry stands for the direct connection within the same AS
+	pathEntries := []*sciond.PathReplyEntry{nil}
+	if !serverCCAddr.IA.Eq(clientCCAddr.IA) {
+		if report != nil {
+			report.Available = pathpolicy.List(policy,
+				transport.DefNetwork.PathResolver().Query(clientCCAddr.IA, serverCCAddr.IA))
+		}
+		if survey {
+			// All paths the path policy accepts, in the order it prefers them
+			pathEntries = ChoosePaths(false, policy, *clientCCAddr, *serverCCAddr, 0, false)
+		} else if multipath {
+			pathEntries = ChoosePaths(interactive, policy, *clientCCAddr, *serverCCAddr, numPaths, disjoint)
+		} else {
+			pathEntries = []*sciond.PathReplyEntry{ChoosePath(interactive, policy, *clientCCAddr, *serverCCAddr)}
+		}
+		if len(pathEntries) == 0 || pathEntries[0] == nil {
+			if len(pathSpec) > 0 {
+				Check(fmt.Errorf("Error, no path to %v matches the path %q", serverCCAddr.IA, pathSpec))
+			}
+			LogFatal("No paths available to remote destination")
+		}
+	} else if multipath {
+		fmt.Println("Client and server are in the same AS, using a single path")
+	}
+	if len(pathEntries) == 1 {
+		multipath = false
+	}
+	if search && multipath {
+		Check(fmt.Errorf("Error, the capacity search only supports a single path"))
+	}
+	pacing, err = ParsePacing(pacingStr)
 	Check(err)
-	// fmt.Println("clientCCAddr -> serverCCAddr", clientCCAddr, "->", serverCCAddr)
+	if search && pacing != PacingFixed {
+		Check(fmt.Errorf("Error, the capacity search only supports fixed pacing"))
+	}
+	if search && (schedule != scheduleConcurrent || csOffset != 0 || scOffset != 0) {
+		Check(fmt.Errorf("Error, the capacity search only supports the concurrent schedule without offsets"))
+	}
 
 	ci := strings.LastIndex(serverCCAddrStr, ":")
 	if ci < 0 {
@@ -365,213 +708,175 @@ func main() {
 	// fmt.Println("clientISDASIP:", clientISDASIP)
 	// fmt.Println("clientPort:", clientPort)
 
-	// Address of client data channel (DC)
-	clientDCAddr, err = snet.AddrFromString(clientISDASIP + ":" + strconv.Itoa(int(clientPort)+1))
-	Check(err)
-	// Address of server data channel (DC)
-	serverDCAddr, err = snet.AddrFromString(serverISDASIP + ":" + strconv.Itoa(int(serverPort)+1))
-	Check(err)
-	// Set path on data connection
-	if !serverDCAddr.IA.Eq(clientDCAddr.IA) {
-		serverDCAddr.Path = spath.New(pathEntry.Path.FwdPath)
-		serverDCAddr.Path.InitOffsets()
-		serverDCAddr.NextHopHost = pathEntry.HostInfo.Host()
-		// log.Debug("Client DC", "Next Hop", serverDCAddr.NextHopHost, "Server Host",
-		// 	serverDCAddr.Host, "Server Port", serverDCAddr.L4Port)
-		fmt.Printf("Client DC \tNext Hop %v\tServer Host %v\t Server Port %v\n",
-			serverDCAddr.NextHopHost, serverDCAddr.Host, serverDCAddr.L4Port)
-		serverDCAddr.NextHopPort = pathEntry.HostInfo.Port
-	}
-
-	// Data channel connection
-	DCConn, err = snet.DialSCION("udp4", clientDCAddr, serverDCAddr)
-	Check(err)
-
-	// update default packet size to max MTU on the selected path
-	if pathEntry != nil {
-		InferedPktSize = int64(pathEntry.Path.Mtu)
-	} else {
+	// update default packet size to max MTU on the selected paths
+	InferedPktSize = DefaultPktSize
+	for i, pathEntry := range pathEntries {
 		// use default packet size when within same AS and pathEntry is not set
-		InferedPktSize = DefaultPktSize
+		if pathEntry != nil && (i == 0 || int64(pathEntry.Path.Mtu) < InferedPktSize) {
+			InferedPktSize = int64(pathEntry.Path.Mtu)
+		}
 	}
 	if !flagset["cs"] && flagset["sc"] { // Only one direction set, used same for reverse
 		clientBwpStr = serverBwpStr
 		fmt.Println("Only sc parameter set, using same values for cs")
 	}
 	clientBwp = parseBwtestParameters(clientBwpStr)
-	clientBwp.Port = uint16(clientPort + 1)
 	if !flagset["sc"] && flagset["cs"] { // Only one direction set, used same for reverse
 		serverBwpStr = clientBwpStr
 		fmt.Println("Only cs parameter set, using same values for sc")
 	}
 	serverBwp = parseBwtestParameters(serverBwpStr)
-	serverBwp.Port = uint16(serverPort + 1)
-	fmt.Println("\nTest parameters:")
-	fmt.Println("clientDCAddr -> serverDCAddr", clientDCAddr, "->", serverDCAddr)
-	fmt.Printf("client->server: %d seconds, %d bytes, %d packets\n",
-		int(clientBwp.BwtestDuration/time.Second), clientBwp.PacketSize, clientBwp.NumPackets)
-	fmt.Printf("server->client: %d seconds, %d bytes, %d packets\n",
-		int(serverBwp.BwtestDuration/time.Second), serverBwp.PacketSize, serverBwp.NumPackets)
-
-	t := time.Now()
-	expFinishTimeSend := t.Add(serverBwp.BwtestDuration + MaxRTT + GracePeriodSend)
-	expFinishTimeReceive := t.Add(clientBwp.BwtestDuration + MaxRTT + StragglerWaitPeriod)
-	res := BwtestResult{-1, -1, -1, -1, -1, -1, clientBwp.PrgKey, expFinishTimeReceive}
-	var resLock sync.Mutex
-	if expFinishTimeReceive.Before(expFinishTimeSend) {
-		// The receiver will close the DC connection, so it will wait long enough until the
-		// sender is also done
-		res.ExpectedFinishTime = expFinishTimeSend
-	}
-
-	receiveDone.Lock()
-	go HandleDCConnReceive(&serverBwp, DCConn, &res, &resLock, &receiveDone)
-
-	pktbuf := make([]byte, 2000)
-	pktbuf[0] = 'N' // Request for new bwtest
-	n := EncodeBwtestParameters(&clientBwp, pktbuf[1:])
-	l := n + 1
-	n = EncodeBwtestParameters(&serverBwp, pktbuf[l:])
-	l = l + n
-
-	var numtries int64 = 0
-	for numtries < MaxTries {
-		_, err = CCConn.Write(pktbuf[:l])
-		Check(err)
-
-		err = CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
-		Check(err)
-		n, err = CCConn.Read(pktbuf)
-		if err != nil {
-			// A timeout likely happened, see if we should adjust the expected finishing time
-			expFinishTimeReceive = time.Now().Add(clientBwp.BwtestDuration + MaxRTT + StragglerWaitPeriod)
-			resLock.Lock()
-			if res.ExpectedFinishTime.Before(expFinishTimeReceive) {
-				res.ExpectedFinishTime = expFinishTimeReceive
-			}
-			resLock.Unlock()
-
-			numtries++
-			continue
+	clientBwp.Pacing = pacing
+	serverBwp.Pacing = pacing
+	Check(applySchedule(schedule, &clientBwp, &serverBwp, csOffset, scOffset))
+
+	if survey {
+		fmt.Println("\nTest parameters of each path:")
+		fmt.Println("client->server:", formatDirection(&clientBwp))
+		fmt.Println("server->client:", formatDirection(&serverBwp))
+		if report != nil {
+			report.setParameters(&clientBwp, &serverBwp, nil)
 		}
-		// Remove read deadline
-		err = CCConn.SetReadDeadline(tzero)
-		Check(err)
-
-		if n != 2 {
-			fmt.Println("Incorrect server response, trying again")
-			time.Sleep(Timeout)
-			numtries++
-			continue
+		// The paths are tested one after the other, so they all use the same ports
+		newTest := func(i int, pathEntry *sciond.PathReplyEntry) *pathTest {
+			return newPathTest(fmt.Sprintf("Path %d: ", i), clientISDASIP, clientPort, serverISDASIP, serverPort,
+				pathEntry)
 		}
-		if pktbuf[0] != 'N' {
-			fmt.Println("Incorrect server response, trying again")
-			time.Sleep(Timeout)
-			numtries++
-			continue
-		}
-		if pktbuf[1] != 0 {
-			// The server asks us to wait for some amount of time
-			time.Sleep(time.Second * time.Duration(int(pktbuf[1])))
-			// Don't increase numtries in this case
-			continue
+		results := runSurvey(newTest, pathEntries, clientBwp, serverBwp, psk)
+		printSurvey(results)
+		if report != nil {
+			report.setSurvey(results)
 		}
-
-		// Everything was successful, exit the loop
-		break
+		return
 	}
 
-	if numtries == MaxTries {
-		Check(fmt.Errorf("Error, could not receive a server response, MaxTries attempted without success."))
+	if int(clientPort)+2*len(pathEntries) > 65536 {
+		Check(fmt.Errorf("Error, client port %d too large for %d paths", clientPort, len(pathEntries)))
+	}
+	// Each path has its own CC and DC, the CC of path i uses the client port plus 2*i
+	pathTests := make([]*pathTest, len(pathEntries))
+	for i, pathEntry := range pathEntries {
+		name := ""
+		if multipath {
+			name = fmt.Sprintf("Path %d: ", i)
+		}
+		pathTests[i] = newPathTest(name, clientISDASIP, clientPort+uint16(2*i), serverISDASIP, serverPort, pathEntry)
+		pathTests[i].failover, pathTests[i].policy = failover, policy
+	}
+	clientBwps := splitBwtestParameters(clientBwp, len(pathTests))
+	serverBwps := splitBwtestParameters(serverBwp, len(pathTests))
+	for i, pt := range pathTests {
+		pt.clientBwp = clientBwps[i]
+		pt.clientBwp.Port = clientPort + uint16(2*i) + 1
+		pt.serverBwp = serverBwps[i]
+		pt.serverBwp.Port = serverPort + 1
+	}
+	fmt.Println("\nTest parameters:")
+	for _, pt := range pathTests {
+		fmt.Println(pt.name+"clientDCAddr -> serverDCAddr", pt.clientDCAddr, "->", pt.serverDCAddr)
+	}
+	fmt.Println("client->server:", formatDirection(&clientBwp))
+	fmt.Println("server->client:", formatDirection(&serverBwp))
+	if multipath {
+		fmt.Printf("Each direction is split across %d paths\n", len(pathTests))
+	}
+	if pacing != PacingFixed {
+		fmt.Printf("Pacing: %s, the rates above are the maximum rates\n", PacingString(pacing))
+	}
+	if schedule != scheduleConcurrent {
+		fmt.Println("Schedule:", schedule)
+	}
+	if report != nil {
+		report.setParameters(&clientBwp, &serverBwp, pathTests)
 	}
 
-	go HandleDCConnSend(&clientBwp, DCConn)
-
-	receiveDone.Lock()
-
-	fmt.Println("\nS->C results")
-	att := 8 * serverBwp.PacketSize * serverBwp.NumPackets / int64(serverBwp.BwtestDuration/time.Second)
-	ach := 8 * serverBwp.PacketSize * res.CorrectlyReceived / int64(serverBwp.BwtestDuration/time.Second)
-	fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
-	fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
-	fmt.Println("Loss rate:", (serverBwp.NumPackets-res.CorrectlyReceived)*100/serverBwp.NumPackets, "%")
-	variance := res.IPAvar
-	average := res.IPAavg
-	fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
-		variance/1e6, average/1e6)
-	fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
-		res.IPAmin/1e6, res.IPAmax/1e6)
+	if search {
+		newTest := func() *pathTest {
+			return newPathTest("", clientISDASIP, clientPort, serverISDASIP, serverPort, pathEntries[0])
+		}
+		csSearch, scSearch := runCapacitySearch(newTest, pathTests[0].clientBwp, pathTests[0].serverBwp, psk, searchLoss)
+		if report != nil {
+			report.setSearch(searchLoss, csSearch, scSearch)
+		}
+		return
+	}
 
-	// Fetch results from server
-	numtries = 0
-	for numtries < MaxTries {
-		pktbuf[0] = 'R'
-		copy(pktbuf[1:], clientBwp.PrgKey)
-		_, err = CCConn.Write(pktbuf[:1+len(clientBwp.PrgKey)])
-		Check(err)
+	var wg sync.WaitGroup
+	for _, pt := range pathTests {
+		wg.Add(1)
+		go func(pt *pathTest) {
+			defer wg.Done()
+			pt.run(psk)
+		}(pt)
+	}
+	wg.Wait()
+	applyEffectiveParameters(pathTests, &clientBwp, &serverBwp)
 
-		err = CCConn.SetReadDeadline(time.Now().Add(MaxRTT))
-		Check(err)
-		n, err = CCConn.Read(pktbuf)
-		if err != nil {
-			numtries++
-			continue
+	if report != nil {
+		if multipath {
+			var results, sresults []*BwtestResult
+			for _, pt := range pathTests {
+				results = append(results, pt.res)
+				sresults = append(sresults, pt.sres)
+			}
+			report.setResults(pathTests, &clientBwp, &serverBwp, aggregateResults(sresults), aggregateResults(results))
+		} else {
+			pt := pathTests[0]
+			report.setResults(pathTests, &pt.clientBwp, &pt.serverBwp, pt.sres, pt.res)
 		}
-		// Remove read deadline
-		err = CCConn.SetReadDeadline(tzero)
-		Check(err)
+	}
 
-		if n < 2 {
-			numtries++
-			continue
+	if pathTests[0].version < ScheduleVersion && (clientBwp.StartOffset > 0 || serverBwp.StartOffset > 0) {
+		fmt.Println("\nThe server does not support start offsets, the directions ran concurrently")
+	}
+
+	if !multipath {
+		pt := pathTests[0]
+		pt.printPathSegments()
+		if serverBwp.NumPackets > 0 {
+			fmt.Println("\nS->C results")
+			printResult(&pt.serverBwp, pt.res)
 		}
-		if pktbuf[0] != 'R' {
-			numtries++
-			continue
+		if clientBwp.NumPackets == 0 {
+			return
 		}
-		if pktbuf[1] != byte(0) {
-			// Error case
-			if pktbuf[1] == byte(127) {
-				Check(fmt.Errorf("Results could not be found or PRG key was incorrect, abort"))
-			}
-			// pktbuf[1] contains number of seconds to wait for results
-			fmt.Println("We need to sleep for", pktbuf[1], "seconds before we can get the results")
-			time.Sleep(time.Duration(pktbuf[1]) * time.Second)
-			// We don't increment numtries as this was not a lost packet or other communication error
-			continue
+		if pt.sres == nil {
+			fmt.Println("Error, could not fetch server results, MaxTries attempted without success.")
+			printFetchHint(&pt.clientBwp)
+			return
 		}
+		fmt.Println("\nC->S results")
+		printResult(&pt.clientBwp, pt.sres)
+		return
+	}
 
-		sres, n1, err := DecodeBwtestResult(pktbuf[2:])
-		if err != nil {
-			fmt.Println("Decoding error, try again")
-			numtries++
-			continue
+	var results, sresults []*BwtestResult
+	for i, pt := range pathTests {
+		results = append(results, pt.res)
+		sresults = append(sresults, pt.sres)
+		pt.printPathSegments()
+		if serverBwp.NumPackets > 0 {
+			fmt.Printf("\nPath %d S->C results\n", i)
+			printResult(&pt.serverBwp, pt.res)
 		}
-		if n1+2 < n {
-			fmt.Println("Insufficient number of bytes received, try again")
-			time.Sleep(Timeout)
-			numtries++
+		if clientBwp.NumPackets == 0 {
 			continue
 		}
-		if !bytes.Equal(clientBwp.PrgKey, sres.PrgKey) {
-			fmt.Println("PRG Key returned from server incorrect, this should never happen")
-			numtries++
+		if pt.sres == nil {
+			fmt.Println("Error, could not fetch server results, MaxTries attempted without success.")
+			printFetchHint(&pt.clientBwp)
 			continue
 		}
-		fmt.Println("\nC->S results")
-		att = 8 * clientBwp.PacketSize * clientBwp.NumPackets / int64(clientBwp.BwtestDuration/time.Second)
-		ach = 8 * clientBwp.PacketSize * sres.CorrectlyReceived / int64(clientBwp.BwtestDuration/time.Second)
-		fmt.Printf("Attempted bandwidth: %d bps / %.2f Mbps\n", att, float64(att)/1000000)
-		fmt.Printf("Achieved bandwidth: %d bps / %.2f Mbps\n", ach, float64(ach)/1000000)
-		fmt.Println("Loss rate:", (clientBwp.NumPackets-sres.CorrectlyReceived)*100/clientBwp.NumPackets, "%")
-		variance := sres.IPAvar
-		average := sres.IPAavg
-		fmt.Printf("Interarrival time variance: %dms, average interarrival time: %dms\n",
-			variance/1e6, average/1e6)
-		fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
-			sres.IPAmin/1e6, sres.IPAmax/1e6)
-		return
+		fmt.Printf("\nPath %d C->S results\n", i)
+		printResult(&pt.clientBwp, pt.sres)
 	}
-
-	fmt.Println("Error, could not fetch server results, MaxTries attempted without success.")
+	if serverBwp.NumPackets > 0 {
+		fmt.Println("\nAggregate S->C results")
+		printResult(&serverBwp, aggregateResults(results))
+	}
+	if sres := aggregateResults(sresults); sres != nil {
+		fmt.Println("\nAggregate C->S results")
+		printResult(&clientBwp, sres)
+	}
+	printPathComparison(pathTests)
 }
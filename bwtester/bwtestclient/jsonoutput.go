@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+// jsonReport is the document written by the -json output mode, one per run of bwtestclient.
+// Durations are in ns and bandwidths in bps. For a single path, cs and sc are the results of the
+// path, for a multipath bwtest they are the aggregate of all paths. The parameters are the
+// requested ones, the effective parameters are the ones the server applied, which are lower if
+// the server reduced them to its limits. available_paths lists all paths to the server with
+// their rank under the path policy.
+type jsonReport struct {
+	Client       string            `json:"client"`
+	Server       string            `json:"server"`
+	Available    jsonPathList      `json:"available_paths,omitempty"`
+	CSParameters *jsonParameters   `json:"cs_parameters,omitempty"`
+	SCParameters *jsonParameters   `json:"sc_parameters,omitempty"`
+	CSEffective  *jsonParameters   `json:"cs_effective_parameters,omitempty"`
+	SCEffective  *jsonParameters   `json:"sc_effective_parameters,omitempty"`
+	Paths        []*jsonPathReport `json:"paths"`
+	CS           *jsonResult       `json:"cs,omitempty"`
+	SC           *jsonResult       `json:"sc,omitempty"`
+	Search       *jsonSearch       `json:"search,omitempty"`
+	Survey       jsonSurvey        `json:"survey,omitempty"`
+	Error        string            `json:"error,omitempty"`
+
+	writeOnce sync.Once
+}
+
+// jsonPathReport contains the parameters and results of one path of the bwtest
+type jsonPathReport struct {
+	Path         *jsonPath       `json:"path"` // null if client and server are in the same AS
+	CSParameters *jsonParameters `json:"cs_parameters,omitempty"`
+	SCParameters *jsonParameters `json:"sc_parameters,omitempty"`
+	CSEffective  *jsonParameters `json:"cs_effective_parameters,omitempty"`
+	SCEffective  *jsonParameters `json:"sc_effective_parameters,omitempty"`
+	CS           *jsonResult     `json:"cs,omitempty"`
+	SC           *jsonResult     `json:"sc,omitempty"`
+	Segments     []jsonSegment   `json:"segments,omitempty"` // Only if the DC switched paths
+}
+
+// jsonPath describes a path with its fingerprint, hops, MTU, expiry and next hop
+type jsonPath = pathpolicy.PathInfo
+
+// jsonPathList is the listing of the paths to the server, see pathpolicy.List
+type jsonPathList []*pathpolicy.ListedPath
+
+// jsonSegment is a path the DC used during the bwtest with -failover, reason is why the DC
+// switched to it and empty for the initial path, sent and received count data packets
+type jsonSegment struct {
+	Path     *jsonPath `json:"path"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason,omitempty"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+}
+
+type jsonParameters struct {
+	Duration    int64  `json:"duration"`
+	PacketSize  int64  `json:"packet_size"`
+	NumPackets  int64  `json:"num_packets"`
+	Bandwidth   int64  `json:"bandwidth"`
+	Pacing      string `json:"pacing"`
+	StartOffset int64  `json:"start_offset"`
+}
+
+// jsonResult contains the fields of a BwtestResult, statistics that are not available are -1 and
+// percentiles that are not available are omitted
+type jsonResult struct {
+	AttemptedBandwidth int64            `json:"attempted_bandwidth"`
+	AchievedBandwidth  int64            `json:"achieved_bandwidth"`
+	LossRate           float64          `json:"loss_rate"` // Percent, relative to num_packets_sent with adaptive pacing
+	NumPacketsSent     int64            `json:"num_packets_sent"`
+	NumPacketsReceived int64            `json:"num_packets_received"`
+	CorrectlyReceived  int64            `json:"correctly_received"`
+	IPAvar             int64            `json:"interarrival_var"`
+	IPAmin             int64            `json:"interarrival_min"`
+	IPAavg             int64            `json:"interarrival_avg"`
+	IPAmax             int64            `json:"interarrival_max"`
+	OWDmin             int64            `json:"owd_min"`
+	OWDavg             int64            `json:"owd_avg"`
+	OWDmax             int64            `json:"owd_max"`
+	Jitter             int64            `json:"jitter"`
+	Reordered          int64            `json:"reordered"`
+	Duplicates         int64            `json:"duplicates"`
+	LossBursts         int64            `json:"loss_bursts"`
+	MaxLossBurst       int64            `json:"max_loss_burst"`
+	CorruptedPackets   int64            `json:"corrupted_packets"`
+	WrongSizePackets   int64            `json:"wrong_size_packets"`
+	CorruptedRanges    []jsonRange      `json:"corrupted_ranges"`
+	IPAPercentiles     *jsonPercentiles `json:"interarrival_percentiles,omitempty"`
+	OWDPercentiles     *jsonPercentiles `json:"owd_percentiles,omitempty"` // Relative to owd_min
+}
+
+// jsonRange is a range of bytes that was corrupted in count packets
+type jsonRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Count  int64 `json:"count"`
+}
+
+type jsonPercentiles struct {
+	P50  int64 `json:"p50"`
+	P90  int64 `json:"p90"`
+	P99  int64 `json:"p99"`
+	P999 int64 `json:"p99.9"`
+}
+
+type jsonSearch struct {
+	MaxLoss float64              `json:"max_loss"`
+	CS      *jsonSearchDirection `json:"cs"`
+	SC      *jsonSearchDirection `json:"sc"`
+}
+
+// jsonSearchDirection is the capacity search of one direction, capacity is the highest bandwidth
+// that succeeded and failed the lowest one that failed, both are 0 if there is none. Limit is
+// the bandwidth the server reduced a step to, 0 if it did not.
+type jsonSearchDirection struct {
+	Capacity int64            `json:"capacity"`
+	Failed   int64            `json:"failed"`
+	Limit    int64            `json:"server_limit"`
+	Steps    []jsonSearchStep `json:"steps"`
+}
+
+type jsonSearchStep struct {
+	Attempted int64   `json:"attempted_bandwidth"`
+	Achieved  int64   `json:"achieved_bandwidth"`
+	LossRate  float64 `json:"loss_rate"`
+	OK        bool    `json:"ok"`
+}
+
+// jsonSurvey contains the paths of a survey, keyed by their fingerprint
+type jsonSurvey map[string]*jsonSurveyPath
+
+// jsonSurveyPath is the bwtest over one path of a survey. Rank is 1 for the best path and 0 if
+// the bwtest did not run, rtt is -1 if it is not available, see surveyPath.rtt.
+type jsonSurveyPath struct {
+	Rank        int             `json:"rank"`
+	Path        *jsonPath       `json:"path"`
+	CSEffective *jsonParameters `json:"cs_effective_parameters,omitempty"`
+	SCEffective *jsonParameters `json:"sc_effective_parameters,omitempty"`
+	CS          *jsonResult     `json:"cs,omitempty"`
+	SC          *jsonResult     `json:"sc,omitempty"`
+	RTT         int64           `json:"rtt"`
+	Error       string          `json:"error,omitempty"`
+}
+
+func newJSONPath(pathEntry *sciond.PathReplyEntry) *jsonPath {
+	if pathEntry == nil {
+		return nil
+	}
+	return pathpolicy.Describe(pathEntry)
+}
+
+func newJSONParameters(bwp *BwtestParameters) *jsonParameters {
+	return &jsonParameters{int64(bwp.BwtestDuration), bwp.PacketSize, bwp.NumPackets, attemptedBandwidth(bwp),
+		PacingString(bwp.Pacing), int64(bwp.StartOffset)}
+}
+
+// Returns the result of a direction with parameters bwp, nil if the result is missing
+func newJSONResult(bwp *BwtestParameters, res *BwtestResult) *jsonResult {
+	if res == nil {
+		return nil
+	}
+	return &jsonResult{
+		AttemptedBandwidth: attemptedBandwidth(bwp),
+		AchievedBandwidth:  achievedBandwidth(bwp, res),
+		LossRate:           lossRate(bwp, res),
+		NumPacketsSent:     res.NumPacketsSent,
+		NumPacketsReceived: res.NumPacketsReceived,
+		CorrectlyReceived:  res.CorrectlyReceived,
+		IPAvar:             res.IPAvar,
+		IPAmin:             res.IPAmin,
+		IPAavg:             res.IPAavg,
+		IPAmax:             res.IPAmax,
+		OWDmin:             res.OWDmin,
+		OWDavg:             res.OWDavg,
+		OWDmax:             res.OWDmax,
+		Jitter:             res.Jitter,
+		Reordered:          res.Reordered,
+		Duplicates:         res.Duplicates,
+		LossBursts:         res.LossBursts,
+		MaxLossBurst:       res.MaxLossBurst,
+		CorruptedPackets:   res.CorruptedPackets,
+		WrongSizePackets:   res.WrongSizePackets,
+		CorruptedRanges:    newJSONRanges(res.CorruptedRanges),
+		IPAPercentiles:     newJSONPercentiles(res.IPAHist),
+		OWDPercentiles:     newJSONPercentiles(res.OWDHist),
+	}
+}
+
+func newJSONRanges(ranges []CorruptedRange) []jsonRange {
+	r := []jsonRange{}
+	for _, cr := range ranges {
+		r = append(r, jsonRange{cr.Offset, cr.Length, cr.Count})
+	}
+	return r
+}
+
+func newJSONPercentiles(h *Histogram) *jsonPercentiles {
+	if h == nil || h.Total == 0 {
+		return nil
+	}
+	return &jsonPercentiles{h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Percentile(99.9)}
+}
+
+func newJSONSearchDirection(cs *capacitySearch) *jsonSearchDirection {
+	d := &jsonSearchDirection{Capacity: cs.lo, Failed: cs.hi, Limit: cs.limit, Steps: []jsonSearchStep{}}
+	for _, s := range cs.steps {
+		d.Steps = append(d.Steps, jsonSearchStep{s.attempted, s.achieved, s.loss, s.ok})
+	}
+	return d
+}
+
+// Adds the parameters of the bwtest and the paths of pathTests to the report
+func (r *jsonReport) setParameters(clientBwp, serverBwp *BwtestParameters, pathTests []*pathTest) {
+	r.CSParameters = newJSONParameters(clientBwp)
+	r.SCParameters = newJSONParameters(serverBwp)
+	r.Paths = []*jsonPathReport{}
+	for _, pt := range pathTests {
+		r.Paths = append(r.Paths, &jsonPathReport{
+			Path:         newJSONPath(pt.pathEntry),
+			CSParameters: newJSONParameters(&pt.clientBwp),
+			SCParameters: newJSONParameters(&pt.serverBwp),
+		})
+	}
+}
+
+// Adds the results of pathTests to the report, and the aggregate results of a multipath bwtest.
+// The parameters are the effective ones.
+func (r *jsonReport) setResults(pathTests []*pathTest, clientBwp, serverBwp *BwtestParameters,
+	sres, res *BwtestResult) {
+
+	for i, pt := range pathTests {
+		r.Paths[i].CSEffective = newJSONParameters(&pt.clientBwp)
+		r.Paths[i].SCEffective = newJSONParameters(&pt.serverBwp)
+		r.Paths[i].CS = newJSONResult(&pt.clientBwp, pt.sres)
+		r.Paths[i].SC = newJSONResult(&pt.serverBwp, pt.res)
+		if len(pt.segments) > 1 {
+			for _, seg := range pt.segments {
+				r.Paths[i].Segments = append(r.Paths[i].Segments, jsonSegment{newJSONPath(seg.Path),
+					seg.Start, seg.End, seg.Reason, seg.Sent, seg.Received})
+			}
+		}
+	}
+	r.CSEffective = newJSONParameters(clientBwp)
+	r.SCEffective = newJSONParameters(serverBwp)
+	r.CS = newJSONResult(clientBwp, sres)
+	r.SC = newJSONResult(serverBwp, res)
+	if r.CS == nil && clientBwp.NumPackets > 0 {
+		r.Error = "Could not fetch server results, MaxTries attempted without success"
+	}
+}
+
+func (r *jsonReport) setSearch(maxLoss float64, csSearch, scSearch *capacitySearch) {
+	r.Search = &jsonSearch{maxLoss, newJSONSearchDirection(csSearch), newJSONSearchDirection(scSearch)}
+}
+
+// Adds the paths of a survey to the report, the results are only set for the paths whose
+// bwtest ran
+func (r *jsonReport) setSurvey(survey []*surveyPath) {
+	r.Survey = make(jsonSurvey)
+	for _, sp := range survey {
+		pt := sp.pt
+		p := &jsonSurveyPath{Rank: sp.rank, Path: newJSONPath(pt.pathEntry), RTT: -1}
+		if sp.err != nil {
+			p.Error = sp.err.Error()
+		} else {
+			p.CSEffective = newJSONParameters(&pt.clientBwp)
+			p.SCEffective = newJSONParameters(&pt.serverBwp)
+			p.CS = newJSONResult(&pt.clientBwp, pt.sres)
+			p.SC = newJSONResult(&pt.serverBwp, pt.res)
+			p.RTT = sp.rtt()
+		}
+		r.Survey[p.Path.Fingerprint] = p
+	}
+}
+
+// Sets the error of the report from the arguments of LogFatal
+func (r *jsonReport) setFatal(msg string, a ...interface{}) {
+	r.Error = msg
+	for i := 0; i+1 < len(a); i += 2 {
+		r.Error += fmt.Sprintf(" %v=%v", a[i], a[i+1])
+	}
+}
+
+// Writes the report to w, only the first call writes it, so that an error during the bwtest
+// does not result in a second document
+func (r *jsonReport) write(w io.Writer) {
+	r.writeOnce.Do(func() {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintln(w, `{"error": "Could not encode the report"}`)
+		}
+	})
+}
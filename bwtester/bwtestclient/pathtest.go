@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// pathTest is the part of a bwtest that runs over a single path, with its own control and data
+// connections and PRG keys. A multipath bwtest consists of one pathTest per path, which run
+// concurrently and are separate sessions for the server.
+type pathTest struct {
+	name         string                 // Prefix of the messages of this path, empty for a single path
+	pathEntry    *sciond.PathReplyEntry // nil if client and server are in the same AS
+	clientCCAddr *snet.Addr
+	serverCCAddr *snet.Addr
+	clientDCAddr *snet.Addr
+	serverDCAddr *snet.Addr
+	clientBwp    BwtestParameters
+	serverBwp    BwtestParameters
+	// Results of the server->client and client->server directions, sres is nil if the result
+	// could not be fetched from the server
+	res  *BwtestResult
+	sres *BwtestResult
+	// Wire version used by the server
+	version byte
+	// With failover, the DC switches to another path that policy accepts when its path fails,
+	// segments are the paths it used
+	failover bool
+	policy   pathpolicy.PathPolicy
+	segments []PathSegment
+}
+
+// Returns a pathTest over pathEntry, using clientPort for the client's CC and the next port for
+// its DC
+func newPathTest(name string, clientISDASIP string, clientPort uint16, serverISDASIP string, serverPort uint16,
+	pathEntry *sciond.PathReplyEntry) *pathTest {
+
+	pt := &pathTest{name: name, pathEntry: pathEntry}
+	var err error
+	pt.clientCCAddr, err = snet.AddrFromString(clientISDASIP + ":" + strconv.Itoa(int(clientPort)))
+	Check(err)
+	pt.serverCCAddr, err = snet.AddrFromString(serverISDASIP + ":" + strconv.Itoa(int(serverPort)))
+	Check(err)
+	// Address of client data channel (DC)
+	pt.clientDCAddr, err = snet.AddrFromString(clientISDASIP + ":" + strconv.Itoa(int(clientPort)+1))
+	Check(err)
+	// Address of server data channel (DC)
+	pt.serverDCAddr, err = snet.AddrFromString(serverISDASIP + ":" + strconv.Itoa(int(serverPort)+1))
+	Check(err)
+	return pt
+}
+
+// Runs the bwtest over the path, see Client.Run. Exits if the bwtest fails, except if only the
+// server's result is missing. The parameters are replaced by the ones the server applied.
+func (pt *pathTest) run(psk *PSK) {
+	if err := pt.try(psk); err != nil {
+		Check(fmt.Errorf("%sError, %v", pt.name, err))
+	}
+}
+
+// Runs the bwtest over the path like run, but returns the error if the bwtest fails
+func (pt *pathTest) try(psk *PSK) error {
+	client := &Client{
+		Local:      pt.clientCCAddr,
+		Path:       pt.pathEntry,
+		PathPolicy: pt.policy,
+		Failover:   pt.failover,
+		PSK:        psk,
+		Logf: func(format string, a ...interface{}) {
+			fmt.Printf(pt.name+format+"\n", a...)
+		},
+	}
+	r, err := client.Run(context.Background(), pt.serverCCAddr, pt.clientBwp, pt.serverBwp)
+	if err != nil && err != ErrNoServerResult {
+		return err
+	}
+	pt.res, pt.sres, pt.version, pt.segments = r.SC, r.CS, r.Version, r.Segments
+	pt.clientBwp, pt.serverBwp = r.CSParams, r.SCParams
+	return nil
+}
+
+// Prints the paths the DC used if it switched paths during the bwtest: when and why it
+// switched, and the data packets sent and received on each path
+func (pt *pathTest) printPathSegments() {
+	if len(pt.segments) < 2 {
+		return
+	}
+	fmt.Printf("\n%sThe data connection used %d paths:\n", pt.name, len(pt.segments))
+	t0 := pt.segments[0].Start
+	for _, seg := range pt.segments {
+		reason := "initial path"
+		if len(seg.Reason) > 0 {
+			reason = "after " + seg.Reason
+		}
+		fmt.Printf("%.3fs-%.3fs %s (%s): sent %d, received %d packets\n", seg.Start.Sub(t0).Seconds(),
+			seg.End.Sub(t0).Seconds(), pathpolicy.Fingerprint(seg.Path), reason, seg.Sent, seg.Received)
+	}
+}
+
+// Splits the parameters of one direction of a multipath bwtest into the parameters for each of
+// the n paths: the packets are distributed evenly and each path uses its own PRG key. A
+// direction without packets has no packets on any path.
+func splitBwtestParameters(bwp BwtestParameters, n int) []BwtestParameters {
+	if bwp.NumPackets > 0 && bwp.NumPackets < int64(n) {
+		Check(fmt.Errorf("Error, cannot split %d packets across %d paths", bwp.NumPackets, n))
+	}
+	split := make([]BwtestParameters, n)
+	for i := range split {
+		split[i] = bwp
+		split[i].NumPackets = bwp.NumPackets / int64(n)
+		if int64(i) < bwp.NumPackets%int64(n) {
+			split[i].NumPackets++
+		}
+		if i > 0 {
+			split[i].PrgKey = prepareAESKey()
+		}
+	}
+	return split
+}
+
+// Returns the parameters of all paths of a multipath bwtest combined
+func aggregateParameters(bwps []BwtestParameters) BwtestParameters {
+	agg := bwps[0]
+	agg.NumPackets = 0
+	for _, bwp := range bwps {
+		agg.NumPackets += bwp.NumPackets
+	}
+	return agg
+}
+
+// Replaces the requested parameters of both directions by the ones the server applied on the
+// paths, and prints them if the server reduced them to its limits
+func applyEffectiveParameters(pathTests []*pathTest, clientBwp, serverBwp *BwtestParameters) {
+	var clientBwps, serverBwps []BwtestParameters
+	for _, pt := range pathTests {
+		clientBwps = append(clientBwps, pt.clientBwp)
+		serverBwps = append(serverBwps, pt.serverBwp)
+	}
+	csEffective, scEffective := aggregateParameters(clientBwps), aggregateParameters(serverBwps)
+	if sameParameters(clientBwp, &csEffective) && sameParameters(serverBwp, &scEffective) {
+		return
+	}
+	fmt.Println("\nThe server reduced the test parameters to its limits, effective parameters:")
+	fmt.Println("client->server:", formatDirection(&csEffective))
+	fmt.Println("server->client:", formatDirection(&scEffective))
+	*clientBwp, *serverBwp = csEffective, scEffective
+}
+
+// Returns true if a and b describe the same direction of a bwtest, regardless of port and key
+func sameParameters(a, b *BwtestParameters) bool {
+	return a.BwtestDuration == b.BwtestDuration && a.PacketSize == b.PacketSize &&
+		a.NumPackets == b.NumPackets && a.Pacing == b.Pacing && a.StartOffset == b.StartOffset
+}
+
+// Returns the results of all paths of a multipath bwtest combined, or nil if a result is
+// missing. Interarrival times and delays are combined from the statistics of the paths, the
+// aggregate has no histogram of the delays, since those of the paths are relative to different
+// minimum delays.
+func aggregateResults(results []*BwtestResult) *BwtestResult {
+	agg := NewBwtestResult(nil, time.Time{})
+	agg.NumPacketsReceived, agg.CorrectlyReceived, agg.NumPacketsSent = 0, 0, 0
+	agg.Reordered, agg.Duplicates, agg.LossBursts, agg.MaxLossBurst = 0, 0, 0, 0
+	agg.CorruptedPackets, agg.WrongSizePackets = 0, 0
+	agg.IPAHist = NewHistogram(DefaultSubBucketBits)
+	var ipaSum, owdSum, jitterSum float64
+	var ipaCount, owdCount int64
+	for _, res := range results {
+		if res == nil {
+			return nil
+		}
+		agg.NumPacketsReceived += res.NumPacketsReceived
+		agg.CorrectlyReceived += res.CorrectlyReceived
+		if res.NumPacketsSent < 0 || agg.NumPacketsSent < 0 {
+			agg.NumPacketsSent = -1
+		} else {
+			agg.NumPacketsSent += res.NumPacketsSent
+		}
+		if res.IPAmin >= 0 {
+			if agg.IPAmin < 0 || res.IPAmin < agg.IPAmin {
+				agg.IPAmin = res.IPAmin
+			}
+			if res.IPAmax > agg.IPAmax {
+				agg.IPAmax = res.IPAmax
+			}
+			ipaSum += float64(res.IPAavg) * float64(res.CorrectlyReceived)
+			ipaCount += res.CorrectlyReceived
+		}
+		if res.IPAHist != nil {
+			agg.IPAHist.Merge(res.IPAHist)
+		}
+		if res.CorruptedPackets < 0 || agg.CorruptedPackets < 0 {
+			agg.CorruptedPackets, agg.WrongSizePackets = -1, -1
+		} else {
+			agg.CorruptedPackets += res.CorruptedPackets
+			agg.WrongSizePackets += res.WrongSizePackets
+			agg.CorruptedRanges = MergeCorruptedRanges(agg.CorruptedRanges, res.CorruptedRanges)
+		}
+		if res.LossBursts < 0 || agg.LossBursts < 0 {
+			// The server does not support the statistics
+			agg.LossBursts = -1
+			continue
+		}
+		agg.Reordered += res.Reordered
+		agg.Duplicates += res.Duplicates
+		agg.LossBursts += res.LossBursts
+		if res.MaxLossBurst > agg.MaxLossBurst {
+			agg.MaxLossBurst = res.MaxLossBurst
+		}
+		if res.Jitter >= 0 {
+			// All delays are measured with the same pair of clocks, so they are comparable
+			if owdCount == 0 || res.OWDmin < agg.OWDmin {
+				agg.OWDmin = res.OWDmin
+			}
+			if owdCount == 0 || res.OWDmax > agg.OWDmax {
+				agg.OWDmax = res.OWDmax
+			}
+			owdSum += float64(res.OWDavg) * float64(res.CorrectlyReceived)
+			jitterSum += float64(res.Jitter) * float64(res.CorrectlyReceived)
+			owdCount += res.CorrectlyReceived
+		}
+	}
+	if ipaCount > 0 {
+		agg.IPAavg = int64(ipaSum / float64(ipaCount))
+		agg.IPAvar = agg.IPAmax - agg.IPAavg
+	}
+	if owdCount > 0 && agg.LossBursts >= 0 {
+		agg.OWDavg = int64(owdSum / float64(owdCount))
+		agg.Jitter = int64(jitterSum / float64(owdCount))
+	}
+	return agg
+}
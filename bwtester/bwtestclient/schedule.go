@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+)
+
+// Schedules of the two directions of a bwtest, see -schedule
+const (
+	scheduleConcurrent = "concurrent" // Both directions start right away
+	scheduleCSFirst    = "cs_first"   // The server->client direction starts when client->server ends
+	scheduleSCFirst    = "sc_first"   // The client->server direction starts when server->client ends
+	scheduleCSOnly     = "cs_only"    // Only the client->server direction is run
+	scheduleSCOnly     = "sc_only"    // Only the server->client direction is run
+)
+
+var schedules = []string{scheduleConcurrent, scheduleCSFirst, scheduleSCFirst, scheduleCSOnly, scheduleSCOnly}
+
+// Sets the start offsets and the number of packets of the client->server and server->client
+// directions according to the schedule. The offsets csOffset and scOffset are added to the
+// start of the directions, a direction that follows the other one starts when the other one ends.
+func applySchedule(schedule string, clientBwp, serverBwp *BwtestParameters, csOffset, scOffset time.Duration) error {
+	clientBwp.StartOffset = csOffset
+	serverBwp.StartOffset = scOffset
+	switch schedule {
+	case scheduleConcurrent:
+	case scheduleCSFirst:
+		serverBwp.StartOffset += clientBwp.StartOffset + clientBwp.BwtestDuration
+	case scheduleSCFirst:
+		clientBwp.StartOffset += serverBwp.StartOffset + serverBwp.BwtestDuration
+	case scheduleCSOnly:
+		serverBwp.NumPackets = 0
+		serverBwp.StartOffset = 0
+	case scheduleSCOnly:
+		clientBwp.NumPackets = 0
+		clientBwp.StartOffset = 0
+	default:
+		return fmt.Errorf("Error, unknown schedule %q, valid schedules are %s", schedule,
+			strings.Join(schedules, ", "))
+	}
+	for _, bwp := range []*BwtestParameters{clientBwp, serverBwp} {
+		if bwp.StartOffset < 0 || bwp.StartOffset > MaxStartOffset {
+			return fmt.Errorf("Error, start offset %v must not be negative and at most %v", bwp.StartOffset,
+				MaxStartOffset)
+		}
+	}
+	return nil
+}
+
+// Returns the description of the parameters of one direction for the test parameters output
+func formatDirection(bwp *BwtestParameters) string {
+	if bwp.NumPackets == 0 {
+		return "skipped"
+	}
+	s := fmt.Sprintf("%d seconds, %d bytes, %d packets", int(bwp.BwtestDuration/time.Second), bwp.PacketSize,
+		bwp.NumPackets)
+	if bwp.StartOffset > 0 {
+		s += fmt.Sprintf(", starting after %v", bwp.StartOffset)
+	}
+	return s
+}
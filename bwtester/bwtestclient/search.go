@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+)
+
+const (
+	// Default maximum loss rate of a successful step of the capacity search, in percent
+	DefaultSearchLoss = 5.0
+	// A step only succeeds if at least this fraction of the attempted bandwidth is achieved
+	minAchievedRatio = 0.9
+	// The search ends when the lowest failed bandwidth is within this fraction of the highest
+	// successful one
+	searchPrecision = 0.1
+	maxSearchSteps  = 24
+)
+
+// searchStep is one bwtest of a capacity search in one direction
+type searchStep struct {
+	attempted int64 // bps
+	achieved  int64 // bps, see searchAchievedBandwidth
+	loss      float64
+	ok        bool
+}
+
+// capacitySearch searches the bandwidth of one direction of a path: the attempted bandwidth is
+// doubled until a step fails, then the interval between the highest successful and the lowest
+// failed bandwidth is halved until it is narrow enough. If the first step fails, the bandwidth
+// is halved until a step succeeds. If the server reduces a step to its limits and the step
+// succeeds, the search ends at the limit, since the server does not allow a higher bandwidth.
+type capacitySearch struct {
+	bwp   BwtestParameters // Duration and packet size of the steps
+	lo    int64            // Highest bandwidth that succeeded, 0 if none did
+	hi    int64            // Lowest bandwidth that failed, 0 if none did
+	next  int64            // Bandwidth of the next step
+	limit int64            // Bandwidth the server reduced a step to, 0 if it did not
+	done  bool
+	steps []searchStep
+}
+
+func newCapacitySearch(bwp BwtestParameters) *capacitySearch {
+	return &capacitySearch{bwp: bwp, next: attemptedBandwidth(&bwp)}
+}
+
+// Returns the parameters of the next step. Once the search is done, the direction only sends
+// one packet per second, so that the other direction can be searched undisturbed.
+func (cs *capacitySearch) parameters() BwtestParameters {
+	bwp := cs.bwp
+	bwp.PrgKey = prepareAESKey()
+	bwp.NumPackets = cs.packets()
+	return bwp
+}
+
+// Returns the number of packets of the next step
+func (cs *capacitySearch) packets() int64 {
+	seconds := cs.bwp.BwtestDuration.Seconds()
+	n := int64(float64(cs.next) * seconds / float64(8*cs.bwp.PacketSize))
+	if cs.done {
+		n = int64(seconds)
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Records the step with the effective parameters bwp and result res (nil if the result is
+// missing), and chooses the bandwidth of the next step
+func (cs *capacitySearch) update(bwp *BwtestParameters, res *BwtestResult, maxLoss float64) {
+	if cs.done {
+		return
+	}
+	requested := cs.bwp
+	requested.NumPackets = cs.packets()
+	step := searchStep{attempted: attemptedBandwidth(bwp), loss: 100}
+	if step.attempted < attemptedBandwidth(&requested) {
+		// The server reduced the step to its limits
+		cs.limit = step.attempted
+	}
+	if res != nil {
+		step.achieved = searchAchievedBandwidth(bwp, res)
+		step.loss = float64(bwp.NumPackets-res.CorrectlyReceived) * 100 / float64(bwp.NumPackets)
+		step.ok = step.loss <= maxLoss && float64(step.achieved) >= minAchievedRatio*float64(step.attempted)
+	}
+	cs.steps = append(cs.steps, step)
+	if step.ok {
+		cs.lo = step.attempted
+		if cs.limit > 0 {
+			// Higher bandwidths would be reduced to the limit as well
+			cs.done = true
+			return
+		}
+	} else {
+		cs.hi = step.attempted
+	}
+	switch {
+	case cs.hi == 0:
+		cs.next = 2 * cs.lo
+	case cs.lo == 0:
+		cs.next = cs.hi / 2
+	default:
+		cs.next = (cs.lo + cs.hi) / 2
+	}
+	minBandwidth := int64(float64(8*cs.bwp.PacketSize) / cs.bwp.BwtestDuration.Seconds())
+	if len(cs.steps) >= maxSearchSteps || cs.next < minBandwidth ||
+		(cs.lo > 0 && cs.hi > 0 && float64(cs.hi-cs.lo) <= searchPrecision*float64(cs.hi)) {
+		cs.done = true
+	}
+}
+
+// Bandwidth at which the packets of a step arrived: the rate of the correctly received packets
+// over the duration of the test, limited by the rate given by the average interarrival time,
+// which exceeds the sending interval if the packets queue up at a bottleneck
+func searchAchievedBandwidth(bwp *BwtestParameters, res *BwtestResult) int64 {
+	ach := achievedBandwidth(bwp, res)
+	if res.IPAavg > 0 {
+		if rate := 8 * bwp.PacketSize * int64(time.Second) / res.IPAavg; rate < ach {
+			ach = rate
+		}
+	}
+	return ach
+}
+
+// Runs the capacity search in both directions, newTest returns the pathTest of each step.
+// Both directions are searched at the same time, each step is a bwtest with the bandwidths of
+// the two searches. Returns the searches of the client->server and server->client directions.
+func runCapacitySearch(newTest func() *pathTest, clientBwp, serverBwp BwtestParameters, psk *PSK,
+	maxLoss float64) (*capacitySearch, *capacitySearch) {
+
+	csSearch := newCapacitySearch(clientBwp)
+	scSearch := newCapacitySearch(serverBwp)
+	fmt.Printf("\nSearching the capacity of the path, accepting a loss rate of up to %.1f %%\n", maxLoss)
+	for step := 1; !csSearch.done || !scSearch.done; step++ {
+		pt := newTest()
+		pt.clientBwp = csSearch.parameters()
+		pt.clientBwp.Port = clientBwp.Port
+		pt.serverBwp = scSearch.parameters()
+		pt.serverBwp.Port = serverBwp.Port
+		pt.run(psk)
+
+		fmt.Printf("\nStep %d\n", step)
+		for _, dir := range []struct {
+			name   string
+			search *capacitySearch
+			bwp    *BwtestParameters
+			res    *BwtestResult
+		}{{"C->S", csSearch, &pt.clientBwp, pt.sres}, {"S->C", scSearch, &pt.serverBwp, pt.res}} {
+			if dir.search.done {
+				continue
+			}
+			dir.search.update(dir.bwp, dir.res, maxLoss)
+			s := dir.search.steps[len(dir.search.steps)-1]
+			result := "failed"
+			if s.ok {
+				result = "ok"
+			}
+			fmt.Printf("%s: attempted %.2f Mbps, achieved %.2f Mbps, loss %.1f %%: %s\n",
+				dir.name, float64(s.attempted)/1e6, float64(s.achieved)/1e6, s.loss, result)
+			if dir.search.limit == s.attempted {
+				fmt.Printf("%s: the server limits the bandwidth to %.2f Mbps\n", dir.name,
+					float64(s.attempted)/1e6)
+			}
+		}
+	}
+
+	fmt.Println("\nCapacity search results")
+	for _, dir := range []struct {
+		name   string
+		search *capacitySearch
+	}{{"C->S", csSearch}, {"S->C", scSearch}} {
+		cs := dir.search
+		switch {
+		case cs.limit > 0 && cs.lo == cs.limit:
+			fmt.Printf("%s capacity: at least %.2f Mbps, the limit of the server\n", dir.name,
+				float64(cs.lo)/1e6)
+		case cs.lo == 0:
+			fmt.Printf("%s capacity: no bandwidth succeeded, below %.2f Mbps\n", dir.name, float64(cs.hi)/1e6)
+		case cs.hi == 0:
+			fmt.Printf("%s capacity: at least %.2f Mbps, no bandwidth failed after %d steps\n",
+				dir.name, float64(cs.lo)/1e6, len(cs.steps))
+		default:
+			fmt.Printf("%s capacity: %.2f Mbps, %.2f Mbps failed, after %d steps\n",
+				dir.name, float64(cs.lo)/1e6, float64(cs.hi)/1e6, len(cs.steps))
+		}
+	}
+	return csSearch, scSearch
+}
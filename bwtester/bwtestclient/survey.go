@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+const (
+	// Longest time the survey waits for the server to accept the next bwtest after it rejected
+	// one because of its rate limits, if the server asks for a longer wait the survey ends
+	maxSurveyWait = 2 * time.Minute
+	// Number of times a path is retried after the server rejected its bwtest because of its
+	// rate limits
+	maxSurveyRetries = 3
+)
+
+// surveyPath is the bwtest over one path of a survey
+type surveyPath struct {
+	pt   *pathTest
+	rank int   // 1 for the best path, 0 if the bwtest did not run
+	err  error // nil if the bwtest ran
+}
+
+// Returns the achieved bandwidth of the slower direction, by which the paths are ranked. A
+// direction whose result is missing has no bandwidth.
+func (sp *surveyPath) bottleneck() int64 {
+	bw := int64(-1)
+	for _, dir := range []struct {
+		bwp *BwtestParameters
+		res *BwtestResult
+	}{{&sp.pt.clientBwp, sp.pt.sres}, {&sp.pt.serverBwp, sp.pt.res}} {
+		if dir.bwp.NumPackets == 0 {
+			continue
+		}
+		var ach int64
+		if dir.res != nil {
+			ach = achievedBandwidth(dir.bwp, dir.res)
+		}
+		if bw < 0 || ach < bw {
+			bw = ach
+		}
+	}
+	return bw
+}
+
+// Returns the loss rate of the direction with the higher loss, a direction whose result is
+// missing lost all packets
+func (sp *surveyPath) loss() float64 {
+	var loss float64
+	for _, dir := range []struct {
+		bwp *BwtestParameters
+		res *BwtestResult
+	}{{&sp.pt.clientBwp, sp.pt.sres}, {&sp.pt.serverBwp, sp.pt.res}} {
+		if dir.bwp.NumPackets == 0 {
+			continue
+		}
+		l := 100.0
+		if dir.res != nil {
+			l = lossRate(dir.bwp, dir.res)
+		}
+		if l > loss {
+			loss = l
+		}
+	}
+	return loss
+}
+
+// Returns the smallest round-trip time of the path, or -1 if a direction has no delays. The
+// clocks of client and server are not synchronized, but their offset cancels out in the sum of
+// the smallest one-way delays of both directions.
+func (sp *surveyPath) rtt() int64 {
+	res, sres := sp.pt.res, sp.pt.sres
+	if res == nil || sres == nil || res.Jitter < 0 || sres.Jitter < 0 {
+		return -1
+	}
+	return res.OWDmin + sres.OWDmin
+}
+
+// Runs a bwtest with the parameters clientBwp and serverBwp over each of the paths, one after
+// the other, newTest returns the pathTest of a path. If the server rejects a bwtest because of
+// its rate limits, the survey waits as long as the server asks, and ends if that is longer
+// than maxSurveyWait or if the server rejects it for another reason. Bwtests that fail otherwise
+// are recorded and the survey continues with the next path. Returns the paths ranked by the
+// bandwidth of their slower direction, then by loss rate and round-trip time, followed by the
+// paths whose bwtest did not run.
+func runSurvey(newTest func(i int, pathEntry *sciond.PathReplyEntry) *pathTest,
+	pathEntries []*sciond.PathReplyEntry, clientBwp, serverBwp BwtestParameters, psk *PSK) []*surveyPath {
+
+	fmt.Printf("\nSurveying %d paths\n", len(pathEntries))
+	var survey []*surveyPath
+	var stop error
+	for i, pathEntry := range pathEntries {
+		sp := &surveyPath{pt: newTest(i, pathEntry)}
+		survey = append(survey, sp)
+		if stop != nil {
+			sp.err = fmt.Errorf("Not tested: %v", stop)
+			continue
+		}
+		fmt.Printf("\n[%2d] %s %s\n", i, pathpolicy.Fingerprint(pathEntry), pathEntry.Path.String())
+		for retry := 0; ; retry++ {
+			sp.pt.clientBwp, sp.pt.serverBwp = clientBwp, serverBwp
+			sp.pt.clientBwp.PrgKey = prepareAESKey()
+			sp.pt.serverBwp.PrgKey = prepareAESKey()
+			sp.err = sp.pt.try(psk)
+			rerr, ok := sp.err.(*RejectedError)
+			if !ok {
+				break
+			}
+			if rerr.Reason != RejectRequestRate && rerr.Reason != RejectByteRate {
+				stop = sp.err
+				break
+			}
+			if rerr.RetryAfter == 0 || rerr.RetryAfter > maxSurveyWait || retry == maxSurveyRetries {
+				stop = sp.err
+				break
+			}
+			fmt.Printf("The server is at its rate limit, waiting %v\n", rerr.RetryAfter)
+			time.Sleep(rerr.RetryAfter)
+		}
+		if sp.err != nil {
+			fmt.Println("Error,", sp.err)
+			continue
+		}
+		fmt.Println(formatSurveyResult(sp))
+	}
+
+	sort.SliceStable(survey, func(i, j int) bool {
+		a, b := survey[i], survey[j]
+		if (a.err == nil) != (b.err == nil) {
+			return a.err == nil
+		}
+		if a.err != nil {
+			return false
+		}
+		if a.bottleneck() != b.bottleneck() {
+			return a.bottleneck() > b.bottleneck()
+		}
+		if a.loss() != b.loss() {
+			return a.loss() < b.loss()
+		}
+		return a.rtt() >= 0 && (b.rtt() < 0 || a.rtt() < b.rtt())
+	})
+	for i, sp := range survey {
+		if sp.err == nil {
+			sp.rank = i + 1
+		}
+	}
+	return survey
+}
+
+// Returns the throughput and loss of both directions of a path and its round-trip time
+func formatSurveyResult(sp *surveyPath) string {
+	pt := sp.pt
+	var dirs []string
+	for _, dir := range []struct {
+		name string
+		bwp  *BwtestParameters
+		res  *BwtestResult
+	}{{"C->S", &pt.clientBwp, pt.sres}, {"S->C", &pt.serverBwp, pt.res}} {
+		switch {
+		case dir.bwp.NumPackets == 0:
+		case dir.res == nil:
+			dirs = append(dirs, dir.name+": result missing")
+		default:
+			dirs = append(dirs, fmt.Sprintf("%s: %.2f Mbps, loss %.1f %%", dir.name,
+				float64(achievedBandwidth(dir.bwp, dir.res))/1e6, lossRate(dir.bwp, dir.res)))
+		}
+	}
+	if rtt := sp.rtt(); rtt >= 0 {
+		dirs = append(dirs, fmt.Sprintf("RTT %.3fms", float64(rtt)/1e6))
+	}
+	return strings.Join(dirs, ", ")
+}
+
+// Prints the ranked table of the paths of a survey
+func printSurvey(survey []*surveyPath) {
+	fmt.Println("\nSurvey results, ranked by the bandwidth of the slower direction:")
+	fmt.Printf("%4s  %-16s  %4s  %5s  %10s  %7s  %10s  %7s  %10s\n",
+		"Rank", "Fingerprint", "Hops", "MTU", "C->S Mbps", "Loss %", "S->C Mbps", "Loss %", "RTT ms")
+	for _, sp := range survey {
+		pt := sp.pt
+		rank := "-"
+		if sp.rank > 0 {
+			rank = fmt.Sprint(sp.rank)
+		}
+		fmt.Printf("%4s  %-16s  %4d  %5d", rank, pathpolicy.Fingerprint(pt.pathEntry),
+			len(pt.pathEntry.Path.Interfaces), pt.pathEntry.Path.Mtu)
+		if sp.err != nil {
+			fmt.Println("  " + sp.err.Error())
+			continue
+		}
+		for _, dir := range []struct {
+			bwp *BwtestParameters
+			res *BwtestResult
+		}{{&pt.clientBwp, pt.sres}, {&pt.serverBwp, pt.res}} {
+			if dir.bwp.NumPackets == 0 || dir.res == nil {
+				fmt.Printf("  %10s  %7s", "-", "-")
+				continue
+			}
+			fmt.Printf("  %10.2f  %7.1f", float64(achievedBandwidth(dir.bwp, dir.res))/1e6, lossRate(dir.bwp, dir.res))
+		}
+		if rtt := sp.rtt(); rtt >= 0 {
+			fmt.Printf("  %10.3f\n", float64(rtt)/1e6)
+		} else {
+			fmt.Printf("  %10s\n", "-")
+		}
+	}
+	fmt.Println("\nPaths:")
+	for _, sp := range survey {
+		fmt.Printf("%s %s\n", pathpolicy.Fingerprint(sp.pt.pathEntry), sp.pt.pathEntry.Path.String())
+	}
+}
@@ -0,0 +1,206 @@
+package bwtestlib
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Authentication methods of 'N' requests
+	AuthNone byte = 0
+	AuthPSK  byte = 1
+
+	// Requests whose timestamp differs by more than this from the server's clock are rejected
+	MaxAuthClockSkew time.Duration = time.Minute
+
+	// Response code of a rejected 'N' request, the response is followed by the reason and the
+	// number of seconds after which the client may try again (0 if trying again does not help).
+	// Clients that predate WireVersion 2 receive this code as the number of seconds to wait.
+	RejectedCode byte = 255
+
+	// Reasons for rejecting an 'N' request
+	RejectAuthRequired byte = 1 // The server requires authentication
+	RejectAuthFailed   byte = 2 // Unknown key, wrong MAC, timestamp out of range or replayed request
+	RejectNotAllowed   byte = 3 // The client's ISD-AS is not allowed to run bwtests
+	RejectRequestRate  byte = 4 // Too many bwtests from the client's ISD-AS
+	RejectByteRate     byte = 5 // Too many bytes sent to the client's ISD-AS
+	RejectShutdown     byte = 6 // The server is shutting down
+)
+
+// Length of the HMAC-SHA256 that authenticates a request
+const authMACLen = sha256.Size
+
+// Pre-shared key, the name tells the server which key the client used
+type PSK struct {
+	Name string
+	Key  []byte
+}
+
+// Loads pre-shared keys from a file that contains one key per line, consisting of the name of
+// the key and the hex encoded key, separated by white space. Empty lines and lines starting with
+// '#' are ignored.
+func LoadPSKFile(path string) ([]PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []PSK
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key name and hex encoded key", path, lineNo)
+		}
+		if len(fields[0]) > 255 {
+			return nil, fmt.Errorf("%s:%d: key name too long", path, lineNo)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("%s:%d: key must be hex encoded and at least 16 bytes long", path, lineNo)
+		}
+		keys = append(keys, PSK{Name: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+	return keys, nil
+}
+
+// Wire format of the authentication of an 'N' request (version 2), which follows the encoded
+// parameters. If the request is not authenticated, it is omitted.
+//
+//	0: uint8 authentication method, AuthPSK
+//	1: uint8 length of the key name
+//	2: key name
+//	.: int64 timestamp in ns since epoch, little endian
+//	.: HMAC-SHA256 with the key over the entire request up to and including the timestamp
+//
+// Appends the authentication with psk to the request in buf[:l], return the new length of the request
+func EncodeAuthPSK(buf []byte, l int, psk *PSK, t time.Time) (int, error) {
+	if len(psk.Name) > 255 {
+		return 0, fmt.Errorf("Pre-shared key name too long: %d bytes", len(psk.Name))
+	}
+	if need := l + 2 + len(psk.Name) + 8 + authMACLen; len(buf) < need {
+		return 0, &BufferError{"authentication", len(buf), need}
+	}
+	buf[l] = AuthPSK
+	buf[l+1] = byte(len(psk.Name))
+	l += 2
+	l += copy(buf[l:], psk.Name)
+	binary.LittleEndian.PutUint64(buf[l:], uint64(t.UnixNano()))
+	l += 8
+	mac := hmac.New(sha256.New, psk.Key)
+	mac.Write(buf[:l])
+	return l + copy(buf[l:], mac.Sum(nil)), nil
+}
+
+// Checks the authentication at buf[l:] of the request in buf, using the keys indexed by their
+// name. Returns AuthNone if the request is not authenticated, AuthPSK if it is correctly
+// authenticated, or an error. If replays is not nil, a request that was seen before is
+// rejected, otherwise it could be replayed as long as its timestamp is in range.
+func VerifyAuth(buf []byte, l int, keys map[string][]byte, t time.Time, replays *ReplayCache) (byte, error) {
+	if l == len(buf) {
+		return AuthNone, nil
+	}
+	if buf[l] != AuthPSK {
+		return AuthNone, fmt.Errorf("Unknown authentication method %d", buf[l])
+	}
+	if len(buf) < l+2 {
+		return AuthNone, fmt.Errorf("Authentication too short")
+	}
+	nameLen := int(buf[l+1])
+	if len(buf) != l+2+nameLen+8+authMACLen {
+		return AuthNone, fmt.Errorf("Incorrect authentication length %d", len(buf)-l)
+	}
+	name := string(buf[l+2 : l+2+nameLen])
+	key, ok := keys[name]
+	if !ok {
+		return AuthNone, fmt.Errorf("Unknown key %q", name)
+	}
+	tsOffset := l + 2 + nameLen
+	ts := time.Unix(0, int64(binary.LittleEndian.Uint64(buf[tsOffset:])))
+	if ts.Before(t.Add(-MaxAuthClockSkew)) || ts.After(t.Add(MaxAuthClockSkew)) {
+		return AuthNone, fmt.Errorf("Timestamp %v out of range", ts)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:tsOffset+8])
+	if !hmac.Equal(mac.Sum(nil), buf[tsOffset+8:]) {
+		return AuthNone, fmt.Errorf("Incorrect MAC with key %q", name)
+	}
+	if replays != nil && !replays.add(buf[tsOffset+8:], ts) {
+		return AuthNone, fmt.Errorf("Replayed request with key %q", name)
+	}
+	return AuthPSK, nil
+}
+
+// ReplayCache remembers the MACs of authenticated requests until their timestamps are out of
+// range, so that each request is only accepted once. Clients authenticate every request anew,
+// so their retries have different MACs.
+type ReplayCache struct {
+	mu   sync.Mutex
+	macs map[string]time.Time // Timestamp of the request, indexed by MAC
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{macs: make(map[string]time.Time)}
+}
+
+// Adds the MAC of a request with timestamp ts, returns false if it was added before
+func (rc *ReplayCache) add(mac []byte, ts time.Time) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.macs[string(mac)]; ok {
+		return false
+	}
+	rc.macs[string(mac)] = ts
+	return true
+}
+
+// Purge deletes the MACs of the requests whose timestamps are out of range at time t
+func (rc *ReplayCache) Purge(t time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for mac, ts := range rc.macs {
+		if ts.Before(t.Add(-MaxAuthClockSkew)) {
+			delete(rc.macs, mac)
+		}
+	}
+}
+
+// Returns a description of the reason for rejecting a request
+func RejectReasonString(reason byte) string {
+	switch reason {
+	case RejectAuthRequired:
+		return "authentication required"
+	case RejectAuthFailed:
+		return "authentication failed"
+	case RejectNotAllowed:
+		return "ISD-AS not allowed"
+	case RejectRequestRate:
+		return "too many bwtest requests"
+	case RejectByteRate:
+		return "too much data requested"
+	case RejectShutdown:
+		return "server shutting down"
+	default:
+		return fmt.Sprintf("unknown reason %d", reason)
+	}
+}
@@ -0,0 +1,198 @@
+package bwtestlib
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Packet sizes and versions of the data path benchmarks. The data packets of ScheduleVersion
+// are generated with the PRG, those of the current version are copied from templates.
+var (
+	BenchPacketSizes = []int64{64, 512, 1000, 1472}
+	BenchVersions    = []byte{ScheduleVersion, WireVersion}
+)
+
+// Number of packets per call of the send function in benchSend, few enough that they are sent
+// before the grace period of the sender ends
+const benchSendPackets = 1000
+
+// DataPathBenchmark is the result of MeasureDataPath, all rates are in packets per second
+type DataPathBenchmark struct {
+	PacketSize int64
+	Version    byte
+	Generate   float64 // Data packets generated and stamped by the sender
+	Verify     float64 // Data packets checked by the receiver
+	Send       float64 // Data packets sent by HandleDCConnSend, including the pacing
+}
+
+// MeasureDataPath measures how many data packets of the given size and version can be
+// generated, verified and sent per second, with the same functions as the benchmarks of the
+// package. The packets are sent into a connection that discards them, so the result is the
+// rate the host can achieve without the network.
+func MeasureDataPath(packetSize int64, version byte) (*DataPathBenchmark, error) {
+	res := &DataPathBenchmark{PacketSize: packetSize, Version: version}
+	for _, m := range []struct {
+		rate  *float64
+		bench func(b *testing.B, packetSize int64, version byte) error
+	}{{&res.Generate, benchGenerate}, {&res.Verify, benchVerify}, {&res.Send, benchSend}} {
+		var err error
+		r := testing.Benchmark(func(b *testing.B) {
+			if err = m.bench(b, packetSize, version); err != nil {
+				b.Fatal(err)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		*m.rate = float64(r.N) / r.T.Seconds()
+	}
+	return res, nil
+}
+
+// Returns the parameters of a bwtest with the largest possible number of data packets
+func benchParameters(packetSize int64) (*BwtestParameters, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &BwtestParameters{
+		BwtestDuration: MaxDuration,
+		PacketSize:     packetSize,
+		NumPackets:     MaxNumPackets,
+		PrgKey:         key,
+		Pacing:         PacingFixed,
+	}, nil
+}
+
+// Generates and stamps b.N data packets
+func benchGenerate(b *testing.B, packetSize int64, version byte) error {
+	bwp, err := benchParameters(packetSize)
+	if err != nil {
+		return err
+	}
+	dc, err := newDataCodec(bwp, version)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, packetSize)
+	b.SetBytes(packetSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dc.fill(int64(i)%bwp.NumPackets, buf)
+		dc.stamp(buf, time.Now().UnixNano())
+	}
+	return nil
+}
+
+// Checks b.N data packets, a batch of packets is checked over and over again
+func benchVerify(b *testing.B, packetSize int64, version byte) error {
+	bwp, err := benchParameters(packetSize)
+	if err != nil {
+		return err
+	}
+	dc, err := newDataCodec(bwp, version)
+	if err != nil {
+		return err
+	}
+	rc, err := newDataCodec(bwp, version)
+	if err != nil {
+		return err
+	}
+	pkts := make([][]byte, maxBatch)
+	for i := range pkts {
+		pkts[i] = make([]byte, packetSize)
+		dc.fill(int64(i), pkts[i])
+		dc.stamp(pkts[i], time.Now().UnixNano())
+	}
+	b.SetBytes(packetSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, status := rc.check(pkts[i%len(pkts)]); status != packetCorrect {
+			return fmt.Errorf("Data packet %d of version %d failed verification", i%len(pkts), version)
+		}
+	}
+	return nil
+}
+
+// Sends b.N data packets into a connection that discards them, the sender is asked to send all
+// packets right away so that it sends them as fast as it can
+func benchSend(b *testing.B, packetSize int64, version byte) error {
+	bwp, err := benchParameters(packetSize)
+	if err != nil {
+		return err
+	}
+	bwp.BwtestDuration = time.Nanosecond
+	var conn discardConn
+	b.SetBytes(packetSize)
+	b.ResetTimer()
+	// The sender stops at the end of its grace period, so it is called until enough packets are
+	// sent
+	for sent := int64(0); sent < int64(b.N); sent = atomic.LoadInt64(&conn.sent) {
+		bwp.NumPackets = int64(b.N) - sent
+		if bwp.NumPackets > benchSendPackets {
+			bwp.NumPackets = benchSendPackets
+		}
+		if err := sendDataPackets(context.Background(), bwp, &conn, version, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errDiscardRead = fmt.Errorf("Discarding connection does not receive packets")
+
+// discardConn is a transport.BatchConn that discards the packets written to it and never
+// receives any
+type discardConn struct {
+	sent int64
+}
+
+func (c *discardConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromSCION(b)
+	return n, err
+}
+
+func (c *discardConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.ReadFromSCION(b)
+	return n, nil, err
+}
+
+func (c *discardConn) ReadFromSCION(b []byte) (int, *snet.Addr, error) {
+	return 0, nil, errDiscardRead
+}
+
+func (c *discardConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return 0, errDiscardRead
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.sent, 1)
+	return len(b), nil
+}
+
+func (c *discardConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *discardConn) WriteToSCION(b []byte, raddr *snet.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *discardConn) WriteBatch(pkts [][]byte) (int, error) {
+	atomic.AddInt64(&c.sent, int64(len(pkts)))
+	return len(pkts), nil
+}
+
+func (c *discardConn) Close() error                       { return nil }
+func (c *discardConn) LocalAddr() net.Addr                { return nil }
+func (c *discardConn) RemoteAddr() net.Addr               { return nil }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,32 @@
+package bwtestlib
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Runs bench for each packet size and version of the data path benchmarks
+func benchDataPath(b *testing.B, bench func(b *testing.B, packetSize int64, version byte) error) {
+	for _, size := range BenchPacketSizes {
+		for _, version := range BenchVersions {
+			size, version := size, version
+			b.Run(fmt.Sprintf("size=%d/version=%d", size, version), func(b *testing.B) {
+				if err := bench(b, size, version); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	benchDataPath(b, benchGenerate)
+}
+
+func BenchmarkVerify(b *testing.B) {
+	benchDataPath(b, benchVerify)
+}
+
+func BenchmarkSend(b *testing.B) {
+	benchDataPath(b, benchSend)
+}
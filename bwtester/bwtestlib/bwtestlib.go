@@ -2,25 +2,25 @@ package bwtestlib
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/aes"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"math"
 	"os"
-	"runtime/debug"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 
-	"github.com/scionproto/scion/go/lib/common"
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
-	"github.com/scionproto/scion/go/lib/spath/spathmeta"
 )
 
 const (
@@ -35,12 +35,39 @@ const (
 	MinPacketSize int64 = 4
 	// Max packet size to avoid allocation of too large a buffer, make it large enough for jumbo frames++
 	MaxPacketSize int64 = 66000
+	// Max number of packets, which limits the memory used to track received packets, enough for
+	// 1000-byte packets at 10 Gbps during MaxDuration
+	MaxNumPackets int64 = 1 << 24
 	// Make sure the port number is a port the server application can connect to
 	MinPort uint16 = 1024
+	// Maximum delay of the start of a direction, enough to run the directions one after the other
+	MaxStartOffset time.Duration = MaxDuration
 
 	MaxTries int64         = 5 // Number of times to try to reach server
 	Timeout  time.Duration = time.Millisecond * 500
 	MaxRTT   time.Duration = time.Millisecond * 1000
+
+	// Version of the control messages and of the encoding of BwtestParameters and BwtestResult,
+	// it is sent right after the message type in 'N' and 'R' messages
+	// Version 2 adds the authentication of 'N' requests and the rejection response
+	// Version 3 adds the header of data packets and the delay and loss statistics of BwtestResult
+	// Version 4 adds the histograms of interarrival times and one-way delays of BwtestResult
+	// Version 5 adds adaptive pacing with feedback packets on the DC, see pacing.go
+	// Version 6 adds start offsets and directions without packets
+	// Version 7 replaces the PRG payload of data packets by templates and adds a keyed checksum
+	// Version 8 adds the corrupted and wrong size packets and the corrupted ranges of BwtestResult
+	// Version 9 adds the 64-bit sequence number and the session ID to the data packets
+	// Version 10 adds the effective parameters to the response of accepted 'N' requests
+	// Version 11 adds path probes on the DC, the server follows the path changes of the client
+	WireVersion byte = 11
+	// Version from which the start offsets of BwtestParameters are applied and a direction
+	// can have no packets
+	ScheduleVersion byte = 6
+	// Version of legacy clients, which send gob encoded structures without a version byte
+	LegacyVersion byte = 0
+	// Version from which the response of an accepted 'N' request contains the parameters the
+	// server applies, which may be lower than the requested ones
+	effectiveVersion byte = 10
 )
 
 type BwtestParameters struct {
@@ -49,6 +76,12 @@ type BwtestParameters struct {
 	NumPackets     int64
 	PrgKey         []byte
 	Port           uint16
+	// Pacing mode of the sender, available from version 5 on. With adaptive pacing, the rate
+	// given by BwtestDuration, PacketSize and NumPackets is the maximum rate.
+	Pacing byte
+	// Time between the start of the bwtest and the first packet of this direction, available
+	// from version 6 on. From version 6 on, NumPackets can also be 0 to skip the direction.
+	StartOffset time.Duration
 }
 
 type BwtestResult struct {
@@ -62,88 +95,170 @@ type BwtestResult struct {
 	// Only requests that contain the correct key can obtain the result
 	PrgKey             []byte
 	ExpectedFinishTime time.Time
+	// Statistics of the data packets, available from version 3 on. One-way delays (OWD) are
+	// only relative, since the clocks of sender and receiver are not synchronized, so they can
+	// also be negative. If the packets carried no timestamps, the jitter is -1.
+	OWDmin       int64
+	OWDavg       int64
+	OWDmax       int64
+	Jitter       int64 // Interarrival jitter as in RFC 3550
+	Reordered    int64 // Packets with a lower sequence number than an earlier packet
+	Duplicates   int64
+	LossBursts   int64 // Number of runs of consecutive lost packets
+	MaxLossBurst int64 // Length of the longest run of consecutive lost packets
+	// Histograms of the interarrival times and of the one-way delays relative to OWDmin in ns,
+	// available from version 4 on, nil otherwise
+	IPAHist *Histogram
+	OWDHist *Histogram
+	// Number of packets sent with adaptive pacing as far as the receiver can tell, i.e., the
+	// highest sequence number received plus one. Available from version 5 on, -1 otherwise.
+	NumPacketsSent int64
+	// Packets that were received but not counted as correct: packets with the expected size but
+	// not the expected content, and packets of the wrong size. Available from version 8 on, -1
+	// otherwise.
+	CorruptedPackets int64
+	WrongSizePackets int64
+	// The byte ranges that were corrupted most often, at most MaxCorruptedRanges of them,
+	// ordered by the number of packets. Available from version 8 on, nil otherwise.
+	CorruptedRanges []CorruptedRange
 }
 
-func Check(e error) {
-	if e != nil {
-		LogFatal("Fatal error. Exiting.", "err", e)
-	}
+// CorruptedRange is a range of bytes in which corrupted data packets differed from the
+// expected content
+type CorruptedRange struct {
+	Offset int64 // Offset of the first corrupted byte in the packet
+	Length int64
+	Count  int64 // Number of packets in which exactly this range was corrupted
 }
 
-func LogFatal(msg string, a ...interface{}) {
-	log.Crit(msg, a...)
-	os.Exit(1)
-}
-
-// TODO: make it more generic: func LogPanicAndRestart(f func(a ...interface{}), a ...interface{}) {
-func LogPanicAndRestart(f func(a *snet.Conn, b string, c []byte, d []byte), CCConn *snet.Conn, serverISDASIP string, receivePacketBuffer []byte, sendPacketBuffer []byte) {
-	if msg := recover(); msg != nil {
-		log.Crit("Panic", "msg", msg, "stack", string(debug.Stack()))
-		log.Debug("Recovering from panic.")
-		f(CCConn, serverISDASIP, receivePacketBuffer, sendPacketBuffer)
-	}
+// Returns a BwtestResult for a bwtest that has not completed yet
+func NewBwtestResult(prgKey []byte, expectedFinishTime time.Time) *BwtestResult {
+	return &BwtestResult{-1, -1, -1, -1, -1, -1, prgKey, expectedFinishTime, -1, -1, -1, -1, -1, -1, -1, -1, nil, nil, -1, -1, -1, nil}
 }
 
 // Fill buffer with AES PRG in counter mode
 // The value of the ith 16-byte block is simply an encryption of i under the key
-func PrgFill(key []byte, iv int, data []byte) {
-	i := uint32(iv)
+// Returns a KeyError if key is not a valid AES key
+func PrgFill(key []byte, iv int, data []byte) error {
 	aesCipher, err := aes.NewCipher(key)
-	Check(err)
-	pt := make([]byte, aes.BlockSize)
-	j := 0
-	for j <= len(data)-aes.BlockSize {
-		binary.LittleEndian.PutUint32(pt, i)
-		aesCipher.Encrypt(data, pt)
-		j = j + aes.BlockSize
-		i = i + uint32(aes.BlockSize)
-	}
-	// Check if fewer than BlockSize bytes are required for the final block
-	if j < len(data) {
-		binary.LittleEndian.PutUint32(pt, i)
-		aesCipher.Encrypt(pt, pt)
-		copy(data[j:], pt[:len(data)-j])
+	if err != nil {
+		return &KeyError{len(key)}
 	}
+	prgFill(aesCipher, iv, data)
+	return nil
 }
 
-// Encode BwtestResult into a sufficiently large byte buffer that is passed in, return the number of bytes written
-func EncodeBwtestResult(res *BwtestResult, buf []byte) int {
-	var bb bytes.Buffer
-	enc := gob.NewEncoder(&bb)
-	err := enc.Encode(*res)
-	Check(err)
-	copy(buf, bb.Bytes())
-	return bb.Len()
-}
+// Wire format of BwtestParameters (version 1), all integers are little endian:
+//
+//	 0: uint16 length of the encoding in bytes, including this field
+//	 2: int64  BwtestDuration in nanoseconds
+//	10: int64  PacketSize
+//	18: int64  NumPackets
+//	26: uint16 Port
+//	28: uint8  length of PrgKey
+//	29: PrgKey
+//
+// Version 5 appends the pacing mode after the PrgKey:
+//
+//	0: uint8  Pacing
+//
+// Version 6 appends the start offset after the pacing mode:
+//
+//	1: int64  StartOffset in nanoseconds
+//
+// Fields added in later versions are appended, decoders skip the bytes they do not know.
+const bwtestParametersV1Len = 29
 
-// Decode BwtestResult from byte buffer that is passed in, returns BwtestResult structure and number of bytes consumed
-func DecodeBwtestResult(buf []byte) (*BwtestResult, int, error) {
-	bb := bytes.NewBuffer(buf)
-	is := bb.Len()
-	dec := gob.NewDecoder(bb)
-	var v BwtestResult
-	err := dec.Decode(&v)
-	return &v, is - bb.Len(), err
-}
+// Wire format of BwtestResult (version 1), all integers are little endian:
+//
+//	 0: uint16 length of the encoding in bytes, including this field
+//	 2: int64  NumPacketsReceived
+//	10: int64  CorrectlyReceived
+//	18: int64  IPAvar
+//	26: int64  IPAmin
+//	34: int64  IPAavg
+//	42: int64  IPAmax
+//	50: int64  ExpectedFinishTime in nanoseconds since the Unix epoch
+//	58: uint8  length of PrgKey
+//	59: PrgKey
+//
+// Version 3 appends the statistics of the data packets after the PrgKey:
+//
+//	 0: int64  OWDmin
+//	 8: int64  OWDavg
+//	16: int64  OWDmax
+//	24: int64  Jitter
+//	32: int64  Reordered
+//	40: int64  Duplicates
+//	48: int64  LossBursts
+//	56: int64  MaxLossBurst
+//
+// Version 4 appends the histograms IPAHist and OWDHist after the statistics, see appendHistogram.
+//
+// Version 5 appends the int64 NumPacketsSent after the histograms.
+//
+// Version 8 appends the int64 CorruptedPackets and WrongSizePackets, followed by the unsigned
+// varint number of CorruptedRanges and the offset, length and count of each range, all as
+// unsigned varints.
+//
+// Fields added in later versions are appended, decoders skip the bytes they do not know.
+const bwtestResultV1Len = 59
+const bwtestResultStatsLen = 64
 
 // Encode BwtestParameters into a sufficiently large byte buffer that is passed in, return the number of bytes written
-func EncodeBwtestParameters(bwtp *BwtestParameters, buf []byte) int {
-	var bb bytes.Buffer
-	enc := gob.NewEncoder(&bb)
-	err := enc.Encode(*bwtp)
-	Check(err)
-	copy(buf, bb.Bytes())
-	return bb.Len()
+func EncodeBwtestParameters(bwtp *BwtestParameters, buf []byte) (int, error) {
+	l := bwtestParametersV1Len + len(bwtp.PrgKey) + 1 + 8
+	if err := checkPrgKey(bwtp.PrgKey); err != nil {
+		return 0, err
+	}
+	if len(buf) < l {
+		return 0, &BufferError{"BwtestParameters", len(buf), l}
+	}
+	binary.LittleEndian.PutUint16(buf[0:], uint16(l))
+	binary.LittleEndian.PutUint64(buf[2:], uint64(bwtp.BwtestDuration))
+	binary.LittleEndian.PutUint64(buf[10:], uint64(bwtp.PacketSize))
+	binary.LittleEndian.PutUint64(buf[18:], uint64(bwtp.NumPackets))
+	binary.LittleEndian.PutUint16(buf[26:], bwtp.Port)
+	buf[28] = byte(len(bwtp.PrgKey))
+	copy(buf[29:], bwtp.PrgKey)
+	buf[29+len(bwtp.PrgKey)] = bwtp.Pacing
+	binary.LittleEndian.PutUint64(buf[30+len(bwtp.PrgKey):], uint64(bwtp.StartOffset))
+	return l, nil
 }
 
 // Decode BwtestParameters from byte buffer that is passed in, returns BwtestParameters structure and number of bytes consumed
 func DecodeBwtestParameters(buf []byte) (*BwtestParameters, int, error) {
-	bb := bytes.NewBuffer(buf)
-	is := bb.Len()
-	dec := gob.NewDecoder(bb)
+	l, err := decodeLength(buf, bwtestParametersV1Len)
+	if err != nil {
+		return nil, 0, &DecodeError{"BwtestParameters", err.Error()}
+	}
 	var v BwtestParameters
-	err := dec.Decode(&v)
-	// Make sure that arguments are within correct parameter ranges
+	v.BwtestDuration = time.Duration(binary.LittleEndian.Uint64(buf[2:]))
+	v.PacketSize = int64(binary.LittleEndian.Uint64(buf[10:]))
+	v.NumPackets = int64(binary.LittleEndian.Uint64(buf[18:]))
+	v.Port = binary.LittleEndian.Uint16(buf[26:])
+	keyLen := int(buf[28])
+	if bwtestParametersV1Len+keyLen > l {
+		return nil, 0, &DecodeError{"BwtestParameters",
+			fmt.Sprintf("Invalid PrgKey length %d in BwtestParameters of length %d", keyLen, l)}
+	}
+	v.PrgKey = make([]byte, keyLen)
+	copy(v.PrgKey, buf[29:])
+	if err := checkPrgKey(v.PrgKey); err != nil {
+		return nil, 0, err
+	}
+	if o := bwtestParametersV1Len + keyLen; o < l {
+		v.Pacing = buf[o]
+		if o+1+8 <= l {
+			v.StartOffset = time.Duration(binary.LittleEndian.Uint64(buf[o+1:]))
+		}
+	}
+	clampBwtestParameters(&v)
+	return &v, l, nil
+}
+
+// Make sure that arguments are within correct parameter ranges
+func clampBwtestParameters(v *BwtestParameters) {
 	if v.BwtestDuration > MaxDuration {
 		v.BwtestDuration = MaxDuration
 	}
@@ -156,14 +271,264 @@ func DecodeBwtestParameters(buf []byte) (*BwtestParameters, int, error) {
 	if v.PacketSize > MaxPacketSize {
 		v.PacketSize = MaxPacketSize
 	}
+	if v.NumPackets < 0 {
+		v.NumPackets = 0
+	}
+	if v.NumPackets > MaxNumPackets {
+		v.NumPackets = MaxNumPackets
+	}
 	if v.Port < MinPort {
 		v.Port = MinPort
 	}
-	return &v, is - bb.Len(), err
+	if v.Pacing > PacingBBR {
+		v.Pacing = PacingFixed
+	}
+	if v.StartOffset < 0 {
+		v.StartOffset = 0
+	}
+	if v.StartOffset > MaxStartOffset {
+		v.StartOffset = MaxStartOffset
+	}
+}
+
+// Returns the time until which the side of a bwtest that sends the direction with parameters
+// send and receives the one with parameters receive needs to keep its DC open, if the bwtest
+// starts within delay after t. Directions without packets are not waited for.
+func ExpectedFinishTime(t time.Time, send, receive *BwtestParameters, delay time.Duration) time.Time {
+	eft := t.Add(delay)
+	if send.NumPackets > 0 {
+		if ft := t.Add(delay + send.StartOffset + send.BwtestDuration + GracePeriodSend); ft.After(eft) {
+			eft = ft
+		}
+	}
+	if receive.NumPackets > 0 {
+		if ft := t.Add(delay + receive.StartOffset + receive.BwtestDuration + StragglerWaitPeriod); ft.After(eft) {
+			eft = ft
+		}
+	}
+	return eft
+}
+
+// Encode BwtestResult into a sufficiently large byte buffer that is passed in, return the number of bytes written
+func EncodeBwtestResult(res *BwtestResult, buf []byte) (int, error) {
+	hists := appendHistogram(nil, res.IPAHist)
+	hists = appendHistogram(hists, res.OWDHist)
+	ranges := appendCorruptedRanges(nil, res.CorruptedRanges)
+	l := bwtestResultV1Len + len(res.PrgKey) + bwtestResultStatsLen + len(hists) + 8 + 16 + len(ranges)
+	if len(res.PrgKey) > math.MaxUint8 {
+		return 0, &KeyError{len(res.PrgKey)}
+	}
+	if len(buf) < l {
+		return 0, &BufferError{"BwtestResult", len(buf), l}
+	}
+	binary.LittleEndian.PutUint16(buf[0:], uint16(l))
+	binary.LittleEndian.PutUint64(buf[2:], uint64(res.NumPacketsReceived))
+	binary.LittleEndian.PutUint64(buf[10:], uint64(res.CorrectlyReceived))
+	binary.LittleEndian.PutUint64(buf[18:], uint64(res.IPAvar))
+	binary.LittleEndian.PutUint64(buf[26:], uint64(res.IPAmin))
+	binary.LittleEndian.PutUint64(buf[34:], uint64(res.IPAavg))
+	binary.LittleEndian.PutUint64(buf[42:], uint64(res.IPAmax))
+	binary.LittleEndian.PutUint64(buf[50:], uint64(res.ExpectedFinishTime.UnixNano()))
+	buf[58] = byte(len(res.PrgKey))
+	copy(buf[59:], res.PrgKey)
+	o := bwtestResultV1Len + len(res.PrgKey)
+	for i, v := range []int64{res.OWDmin, res.OWDavg, res.OWDmax, res.Jitter,
+		res.Reordered, res.Duplicates, res.LossBursts, res.MaxLossBurst} {
+		binary.LittleEndian.PutUint64(buf[o+8*i:], uint64(v))
+	}
+	o += bwtestResultStatsLen
+	copy(buf[o:], hists)
+	o += len(hists)
+	binary.LittleEndian.PutUint64(buf[o:], uint64(res.NumPacketsSent))
+	binary.LittleEndian.PutUint64(buf[o+8:], uint64(res.CorruptedPackets))
+	binary.LittleEndian.PutUint64(buf[o+16:], uint64(res.WrongSizePackets))
+	copy(buf[o+24:], ranges)
+	return l, nil
 }
 
-func HandleDCConnSend(bwp *BwtestParameters, udpConnection *snet.Conn) {
-	sb := make([]byte, bwp.PacketSize)
+// Decode BwtestResult from byte buffer that is passed in, returns BwtestResult structure and number of bytes consumed
+func DecodeBwtestResult(buf []byte) (*BwtestResult, int, error) {
+	l, err := decodeLength(buf, bwtestResultV1Len)
+	if err != nil {
+		return nil, 0, &DecodeError{"BwtestResult", err.Error()}
+	}
+	var v BwtestResult
+	v.NumPacketsReceived = int64(binary.LittleEndian.Uint64(buf[2:]))
+	v.CorrectlyReceived = int64(binary.LittleEndian.Uint64(buf[10:]))
+	v.IPAvar = int64(binary.LittleEndian.Uint64(buf[18:]))
+	v.IPAmin = int64(binary.LittleEndian.Uint64(buf[26:]))
+	v.IPAavg = int64(binary.LittleEndian.Uint64(buf[34:]))
+	v.IPAmax = int64(binary.LittleEndian.Uint64(buf[42:]))
+	v.ExpectedFinishTime = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[50:])))
+	keyLen := int(buf[58])
+	if bwtestResultV1Len+keyLen > l {
+		return nil, 0, &DecodeError{"BwtestResult",
+			fmt.Sprintf("Invalid PrgKey length %d in BwtestResult of length %d", keyLen, l)}
+	}
+	v.PrgKey = make([]byte, keyLen)
+	copy(v.PrgKey, buf[59:])
+	stats := []*int64{&v.OWDmin, &v.OWDavg, &v.OWDmax, &v.Jitter,
+		&v.Reordered, &v.Duplicates, &v.LossBursts, &v.MaxLossBurst}
+	o := bwtestResultV1Len + keyLen
+	for i, f := range stats {
+		*f = -1
+		if o+bwtestResultStatsLen <= l {
+			*f = int64(binary.LittleEndian.Uint64(buf[o+8*i:]))
+		}
+	}
+	o += bwtestResultStatsLen
+	if o < l {
+		for _, h := range []**Histogram{&v.IPAHist, &v.OWDHist} {
+			hist, n, err := decodeHistogram(buf[o:l])
+			if err != nil {
+				return nil, 0, &DecodeError{"BwtestResult", err.Error()}
+			}
+			*h = hist
+			o += n
+		}
+	}
+	v.NumPacketsSent = -1
+	if o+8 <= l {
+		v.NumPacketsSent = int64(binary.LittleEndian.Uint64(buf[o:]))
+	}
+	o += 8
+	v.CorruptedPackets, v.WrongSizePackets = -1, -1
+	if o+16 <= l {
+		v.CorruptedPackets = int64(binary.LittleEndian.Uint64(buf[o:]))
+		v.WrongSizePackets = int64(binary.LittleEndian.Uint64(buf[o+8:]))
+		ranges, err := decodeCorruptedRanges(buf[o+16 : l])
+		if err != nil {
+			return nil, 0, &DecodeError{"BwtestResult", err.Error()}
+		}
+		v.CorruptedRanges = ranges
+	}
+	return &v, l, nil
+}
+
+// Write the header of a response to an 'N' or 'R' request into buf, return the number of bytes written
+// The header consists of the message type, the response code and the version, which is
+// omitted in responses to legacy clients
+func EncodeResponseHeader(buf []byte, msgType byte, code byte, version byte) int {
+	buf[0] = msgType
+	buf[1] = code
+	if version == LegacyVersion {
+		return 2
+	}
+	buf[2] = version
+	return 3
+}
+
+// Write the response to an accepted 'N' request into buf, return the number of bytes written
+// From version 10 on, the header is followed by the parameters of the client->server and the
+// server->client direction that the server applies. They differ from the requested ones if the
+// server reduced them to its limits.
+func EncodeAcceptResponse(buf []byte, version byte, clientBwp, serverBwp *BwtestParameters) (int, error) {
+	l := EncodeResponseHeader(buf, 'N', 0, version)
+	if version < effectiveVersion {
+		return l, nil
+	}
+	for _, bwp := range []*BwtestParameters{clientBwp, serverBwp} {
+		n, err := EncodeBwtestParameters(bwp, buf[l:])
+		if err != nil {
+			return 0, err
+		}
+		l += n
+	}
+	return l, nil
+}
+
+// Decodes the parameters of the client->server and the server->client direction in the
+// response to an accepted 'N' request of the given version, buf starts after the header.
+// Before version 10, the response contains no parameters and nil is returned for both.
+func DecodeAcceptResponse(buf []byte, version byte) (*BwtestParameters, *BwtestParameters, error) {
+	if version < effectiveVersion {
+		return nil, nil, nil
+	}
+	clientBwp, n, err := DecodeBwtestParameters(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverBwp, _, err := DecodeBwtestParameters(buf[n:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientBwp, serverBwp, nil
+}
+
+// Write the response to a rejected 'N' request into buf, return the number of bytes written
+// Clients that predate version 2 do not know the rejection response, they are asked to wait
+// for retryAfter, or for the longest possible time if trying again does not help
+func EncodeRejectResponse(buf []byte, version byte, reason byte, retryAfter time.Duration) int {
+	retrySeconds := DurationToWaitSeconds(retryAfter)
+	if version < 2 {
+		if retrySeconds == 0 {
+			retrySeconds = RejectedCode
+		}
+		return EncodeResponseHeader(buf, 'N', retrySeconds, version)
+	}
+	l := EncodeResponseHeader(buf, 'N', RejectedCode, version)
+	buf[l] = reason
+	buf[l+1] = retrySeconds
+	return l + 2
+}
+
+// Converts a duration to the number of seconds sent in responses, rounded up and limited so
+// that it cannot be mistaken for RejectedCode
+func DurationToWaitSeconds(d time.Duration) byte {
+	if d <= 0 {
+		return 0
+	}
+	if d >= time.Second*time.Duration(RejectedCode-1) {
+		return RejectedCode - 1
+	}
+	return byte((d + time.Second - 1) / time.Second)
+}
+
+// Returns the length field at the start of an encoded structure, after checking that it is
+// at least minLen and that buf contains the entire encoding
+func decodeLength(buf []byte, minLen int) (int, error) {
+	if len(buf) < 2 {
+		return 0, fmt.Errorf("Insufficient number of bytes: %d", len(buf))
+	}
+	l := int(binary.LittleEndian.Uint16(buf))
+	if l < minLen {
+		return 0, fmt.Errorf("Encoded length too short: %d instead of at least %d", l, minLen)
+	}
+	if len(buf) < l {
+		return 0, fmt.Errorf("Insufficient number of bytes: %d instead of %d", len(buf), l)
+	}
+	return l, nil
+}
+
+// Sends the data packets of the bwtest bwp in the format of the given version. Returns a
+// ShortWriteError or the error of the connection if a packet cannot be sent, except if there is
+// no path to the client, in which case the packet is skipped. If no packet could be sent at all
+// because of that, ErrPathNotFound is returned. With adaptive pacing, the sender takes the
+// feedback of the receiver from fb, which must also be passed to the receive function of the DC.
+// From ScheduleVersion on, the first packet is sent after the start offset of bwp.
+func HandleDCConnSend(bwp *BwtestParameters, udpConnection transport.Conn, version byte, fb *Feedback) error {
+	return sendDataPackets(context.Background(), bwp, udpConnection, version, fb)
+}
+
+// Sends the data packets of the bwtest bwp like HandleDCConnSend, returns ctx.Err() if ctx is
+// done before all packets are sent
+func sendDataPackets(ctx context.Context, bwp *BwtestParameters, udpConnection transport.Conn, version byte, fb *Feedback) error {
+	if bwp.NumPackets == 0 {
+		return nil
+	}
+	if version >= ScheduleVersion && bwp.StartOffset > 0 {
+		if err := sleepContext(ctx, bwp.StartOffset); err != nil {
+			return err
+		}
+	}
+	if bwp.Pacing != PacingFixed && version >= pacingVersion {
+		return sendDataPacketsAdaptive(ctx, bwp, udpConnection, version, fb)
+	}
+	dc, err := newDataCodec(bwp, version)
+	if err != nil {
+		return err
+	}
+	bufs := batchBuffers(bwp.PacketSize)
 	var i int64 = 0
 	t0 := time.Now()
 	finish := t0.Add(bwp.BwtestDuration + GracePeriodSend)
@@ -173,48 +538,172 @@ func HandleDCConnSend(bwp *BwtestParameters, udpConnection *snet.Conn) {
 	} else {
 		interPktInterval = bwp.BwtestDuration
 	}
+	// Number of packets that were skipped because there was no path
+	var noPath int64
 	for i < bwp.NumPackets {
-		// Compute how long to wait
-		t1 := time.Now()
-		if t1.After(finish) {
+		if time.Now().After(finish) {
 			// We've been sending for too long, sending bandwidth must be insufficient. Abort sending.
-			return
+			break
 		}
-		t2 := t0.Add(interPktInterval * time.Duration(i))
-		if t1.Before(t2) {
-			time.Sleep(t2.Sub(t1))
+		if err := waitUntil(ctx, t0.Add(interPktInterval*time.Duration(i))); err != nil {
+			return err
 		}
-		// Send packet now
-		PrgFill(bwp.PrgKey, int(i*bwp.PacketSize), sb)
-		// Place packet number at the beginning of the packet, overwriting some PRG data
-		binary.LittleEndian.PutUint32(sb, uint32(i*bwp.PacketSize))
-		n, err := udpConnection.Write(sb)
+		// Send packet i now, together with the following packets that are due within batchWindow
+		batch := bufs[:1]
+		due := time.Now().Add(batchWindow)
+		for j := i + 1; j < bwp.NumPackets && len(batch) < len(bufs) &&
+			!t0.Add(interPktInterval*time.Duration(j)).After(due); j++ {
+			batch = bufs[:len(batch)+1]
+		}
+		for k, buf := range batch {
+			dc.fill(i+int64(k), buf)
+		}
+		ts := time.Now().UnixNano()
+		for _, buf := range batch {
+			dc.stamp(buf, ts)
+		}
+		np, err := writeBatch(udpConnection, batch)
 		if err != nil {
-			if common.GetErrorMsg(err) == "Path not found" { // TODO: add const error string to snet/conn and use that
-				// Do not handle "Path not found" as fatal, log and skip
-				log.Debug("No path to remote found", "err", common.FmtError(err))
-			} else {
-				Check(err)
-			}
-		} else if int64(n) < bwp.PacketSize {
-			Check(fmt.Errorf("Insufficient number of bytes written:", n, "instead of:", bwp.PacketSize))
+			return err
 		}
-		i++
+		noPath += np
+		i += int64(len(batch))
+	}
+	if noPath > 0 && noPath == i {
+		return ErrPathNotFound
 	}
+	return nil
+}
+
+const (
+	// Maximum number of packets that are kept while the version of the data packets is unknown
+	maxPendingPackets = 4096
+	// Minimum size of the receive buffers while the version of the data packets is unknown,
+	// enough for jumbo frames
+	minReceiveBuffer int64 = 9216
+)
+
+type pendingPacket struct {
+	data    []byte
+	arrival int64
 }
 
-func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *snet.Conn, res *BwtestResult, resLock *sync.Mutex, done *sync.Mutex) {
+// Receives the data packets of the bwtest bwp and writes the result into res. The version of
+// the data packets is taken from dv, packets that arrive before it is known are kept until then.
+// If dv also has effective parameters, they replace bwp.
+// Feedback packets for the sender on the same DC are passed on to fb. If bwp uses adaptive
+// pacing, the receive function sends feedback packets to the remote sender.
+func HandleDCConnReceive(bwp *BwtestParameters, udpConnection transport.Conn, res *BwtestResult, resLock *sync.Mutex, done *sync.Mutex, dv *DataVersion, fb *Feedback) {
+	receiveDataPackets(context.Background(), bwp, udpConnection, res, resLock, done, dv, fb)
+}
+
+// Receives the data packets like HandleDCConnReceive, but stops early if ctx is done
+func receiveDataPackets(ctx context.Context, bwp *BwtestParameters, udpConnection transport.Conn, res *BwtestResult, resLock *sync.Mutex, done *sync.Mutex, dv *DataVersion, fb *Feedback) {
 	resLock.Lock()
 	finish := res.ExpectedFinishTime
 	resLock.Unlock()
 	var numPacketsReceived, correctlyReceived int64 = 0, 0
-	InterPacketArrivalTime := make(map[int]int64)
+	InterPacketArrivalTime := make(map[int64]int64)
+	// The parameters are replaced by the effective ones once the version is known, see DataVersion
+	params := *bwp
+	bwp = &params
+	stats := newReceiveStats(bwp.NumPackets)
 	_ = udpConnection.SetReadDeadline(finish)
-	// Make the receive buffer a bit larger to enable detection of packets that are too large
-	recBuf := make([]byte, bwp.PacketSize+1000)
-	cmpBuf := make([]byte, bwp.PacketSize)
-	for time.Now().Before(finish) && correctlyReceived < bwp.NumPackets {
-		n, err := udpConnection.Read(recBuf)
+	// Created once the version is known
+	var dc *dataCodec
+	var pending []pendingPacket
+	var version byte
+	var versionKnown bool
+	learnVersion := func() {
+		var effective *BwtestParameters
+		version, effective, versionKnown = dv.get()
+		if versionKnown && effective != nil {
+			// No packet was processed yet, so the statistics can start anew
+			bwp = effective
+			stats = newReceiveStats(bwp.NumPackets)
+		}
+	}
+	learnVersion()
+	// Make the receive buffers a bit larger to enable detection of packets that are too large.
+	// Until the version is known, the server may still increase the packet size, so the buffers
+	// also fit packets of up to minReceiveBuffer bytes.
+	var recBufs [][]byte
+	var sizes []int
+	allocBuffers := func() {
+		l := bwp.PacketSize + 1000
+		if !versionKnown && l < minReceiveBuffer {
+			l = minReceiveBuffer
+		}
+		recBufs = [][]byte{make([]byte, l)}
+		if _, ok := udpConnection.(transport.BatchConn); ok {
+			recBufs = batchBuffers(l)
+		}
+		sizes = make([]int, len(recBufs))
+	}
+	allocBuffers()
+	fw := newFeedbackWriter(udpConnection)
+	adaptive := func() bool {
+		return bwp.Pacing != PacingFixed && versionKnown && version >= pacingVersion
+	}
+
+	// Checks a received packet and updates the statistics
+	process := func(pkt []byte, arrival int64) {
+		if dc == nil {
+			var err error
+			if dc, err = newDataCodec(bwp, version); err != nil {
+				// Without a valid key, no packet is correct
+				numPacketsReceived++
+				return
+			}
+		}
+		seq, sendTs, status := dc.check(pkt)
+		if status == packetForeign {
+			// A straggler of an earlier bwtest on the same port, not counted as received
+			log.Debug("Data packet of another session", "seq", seq)
+			return
+		}
+		numPacketsReceived++
+		switch status {
+		case packetWrongSize:
+			stats.addWrongSize()
+			return
+		case packetCorrupted:
+			ranges := dc.corruptedRanges(seq, sendTs, pkt)
+			log.Debug("Corrupted data packet", "seq", seq, "ranges", ranges)
+			stats.addCorrupted(ranges)
+			return
+		}
+		if !stats.add(seq, sendTs, arrival) {
+			// Duplicates are not counted as correct packets
+			return
+		}
+		InterPacketArrivalTime[seq] = arrival
+		fw.add(seq, sendTs, arrival)
+		if correctlyReceived == 0 {
+			// Adjust finish time after first correctly received packet
+			// Note that we should check that we're not too far away from the beginning of the
+			// bwtest, otherwise we're extending the time for too long. If the server's 'N' response
+			// packet was not dropped, then sending should start within MaxRTT at most.
+			newFinish := time.Now().Add(bwp.BwtestDuration + StragglerWaitPeriod)
+			if newFinish.After(finish) {
+				finish = newFinish
+				_ = udpConnection.SetReadDeadline(finish)
+				resLock.Lock()
+				if res.ExpectedFinishTime.Before(finish) {
+					// Most likely what happened is that the server's 'N' response packet got dropped (in case this
+					// is the receive function on the server side) or the client's request packet got dropped (in
+					// case this is the receive function on the client side). In both cases the ExpectedFinishTime
+					// needs to be updated
+					res.ExpectedFinishTime = finish
+				}
+				resLock.Unlock()
+			}
+		}
+		correctlyReceived++
+	}
+
+	for time.Now().Before(finish) && correctlyReceived < bwp.NumPackets && ctx.Err() == nil {
+		n, err := readBatch(udpConnection, recBufs, sizes)
 		// Ignore errors, todo: detect type of error and quit if it was because of a SetReadDeadline
 		if err != nil {
 			// If the ReadDeadline expired, then we should extend the finish time, which is
@@ -224,54 +713,46 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *snet.Conn, res *B
 			resLock.Lock()
 			finish = res.ExpectedFinishTime
 			resLock.Unlock()
+			_ = udpConnection.SetReadDeadline(finish)
 			continue
 		}
-		numPacketsReceived++
-		if int64(n) != bwp.PacketSize {
-			// The packet has incorrect size, do not count as a correct packet
-			// fmt.Println("Incorrect size.", n, "bytes instead of", bwp.PacketSize)
-			continue
-		}
-		// Could consider pre-computing all the packets in a separate goroutine
-		// but since computation is usually much higher than bandwidth, this is
-		// not necessary
-		// Todo: create separate verif function which only compares the packet
-		// so that a discrepancy is noticed immediately without generating the
-		// entire packet
-		iv := int64(binary.LittleEndian.Uint32(recBuf))
-		seqNo := int(iv / bwp.PacketSize)
-		InterPacketArrivalTime[seqNo] = time.Now().UnixNano()
-		PrgFill(bwp.PrgKey, int(iv), cmpBuf)
-		binary.LittleEndian.PutUint32(cmpBuf, uint32(iv))
-		if bytes.Equal(recBuf[:bwp.PacketSize], cmpBuf) {
-			if correctlyReceived == 0 {
-				// Adjust finish time after first correctly received packet
-				// Note that we should check that we're not too far away from the beginning of the
-				// bwtest, otherwise we're extending the time for too long. If the server's 'N' response
-				// packet was not dropped, then sending should start within MaxRTT at most.
-				newFinish := time.Now().Add(bwp.BwtestDuration + StragglerWaitPeriod)
-				if newFinish.After(finish) {
-					finish = newFinish
-					_ = udpConnection.SetReadDeadline(finish)
-					resLock.Lock()
-					if res.ExpectedFinishTime.Before(finish) {
-						// Most likely what happened is that the server's 'N' response packet got dropped (in case this
-						// is the receive function on the server side) or the client's request packet got dropped (in
-						// case this is the receive function on the client side). In both cases the ExpectedFinishTime
-						// needs to be updated
-						res.ExpectedFinishTime = finish
+		arrival := time.Now().UnixNano()
+		for k := 0; k < n; k++ {
+			pkt := recBufs[k][:sizes[k]]
+			if r, ok := decodeFeedback(pkt); ok {
+				// Feedback for the sender on this DC, not a data packet
+				fb.deliver(r)
+				continue
+			}
+			if !versionKnown {
+				learnVersion()
+				if !versionKnown {
+					if len(pending) < maxPendingPackets {
+						pending = append(pending, pendingPacket{append([]byte(nil), pkt...), arrival})
 					}
-					resLock.Unlock()
+					continue
+				}
+				for _, p := range pending {
+					process(p.data, p.arrival)
 				}
+				pending = nil
 			}
-			correctlyReceived++
+			process(pkt, arrival)
+		}
+		if int64(len(recBufs[0])) < bwp.PacketSize+1000 {
+			// The server increased the packet size
+			allocBuffers()
+		}
+		if adaptive() {
+			fw.maybeSend(time.Now())
 		}
 	}
 
 	resLock.Lock()
 	res.NumPacketsReceived = numPacketsReceived
 	res.CorrectlyReceived = correctlyReceived
-	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax = aggrInterArrivalTime(InterPacketArrivalTime)
+	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax, res.IPAHist = aggrInterArrivalTime(InterPacketArrivalTime)
+	stats.finish(res, adaptive())
 
 	// We're done here, let's see if we need to wait for the send function to complete so we can close the connection
 	// Note: the locking here is not strictly necessary, since ExpectedFinishTime is only updated right after
@@ -282,37 +763,47 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *snet.Conn, res *B
 		// Signal that we're done
 		done.Unlock()
 	}
-	if time.Now().Before(eft) {
-		time.Sleep(eft.Sub(time.Now()))
+	if fb != nil {
+		// The sender on this DC may still need feedback
+		readFeedback(udpConnection, fb, eft)
+	} else if time.Now().Before(eft) {
+		_ = sleepContext(ctx, eft.Sub(time.Now()))
 	}
 	_ = udpConnection.Close()
 }
 
-func aggrInterArrivalTime(bwr map[int]int64) (IPAvar, IPAmin, IPAavg, IPAmax int64) {
-	// reverse map, mapping timestamps to sequence numbers
-	revMap := make(map[int64]int)
-	var keys []int64 // keys are the timestamps of the received packets
-	// fill the reverse map and the keep track of the timestamps
-	for k, v := range bwr {
-		revMap[v] = k
-		keys = append(keys, v)
+func aggrInterArrivalTime(bwr map[int64]int64) (IPAvar, IPAmin, IPAavg, IPAmax int64, IPAHist *Histogram) {
+	// The received packets in order of arrival, packets that arrived at the same time (e.g., in
+	// the same batch) in order of their sequence numbers
+	type arrival struct {
+		seq int64
+		ts  int64
+	}
+	var arrivals []arrival
+	for seq, ts := range bwr {
+		arrivals = append(arrivals, arrival{seq, ts})
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] }) // sorted timestamps of the received packets
+	sort.Slice(arrivals, func(i, j int) bool {
+		if arrivals[i].ts != arrivals[j].ts {
+			return arrivals[i].ts < arrivals[j].ts
+		}
+		return arrivals[i].seq < arrivals[j].seq
+	})
 
 	// We keep only the interarrival times of successive packets with no drops
 	var iat []int64
-	i := 1
-	for i < len(keys) {
-		if revMap[keys[i-1]]+1 == revMap[keys[i]] { // valid measurement without reordering, include
-			iat = append(iat, keys[i]-keys[i-1]) // resulting interarrival time
+	for i := 1; i < len(arrivals); i++ {
+		if arrivals[i-1].seq+1 == arrivals[i].seq { // valid measurement without reordering, include
+			iat = append(iat, arrivals[i].ts-arrivals[i-1].ts) // resulting interarrival time
 		}
-		i += 1
 	}
 
 	// Compute variance and average
 	var average float64 = 0
 	IPAmin = -1
+	IPAHist = NewHistogram(DefaultSubBucketBits)
 	for _, v := range iat {
+		IPAHist.Record(v)
 		if v > IPAmax {
 			IPAmax = v
 		}
@@ -326,106 +817,134 @@ func aggrInterArrivalTime(bwr map[int]int64) (IPAvar, IPAmin, IPAavg, IPAmax int
 	return
 }
 
-func ChoosePath(interactive bool, pathAlgo string, local snet.Addr, remote snet.Addr) *sciond.PathReplyEntry {
-	pathMgr := snet.DefNetwork.PathResolver()
+// Prints the paths to remote, listed by pathpolicy.List with their rank under the policy
+func PrintPaths(remote addr.IA, paths []*pathpolicy.ListedPath) {
+	fmt.Printf("Available paths to %v\n", remote)
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+}
+
+// Prints the paths from local to remote with their fingerprints, hop count, MTU, expiration
+// time, next hop and rank under the policy, and returns the one the user chooses in
+// interactive mode, otherwise the one the policy prefers. Returns nil if there is no path, if
+// the policy accepts none of them, or if the input ends before the user chose a path.
+func ChoosePath(interactive bool, policy pathpolicy.PathPolicy, local snet.Addr, remote snet.Addr) *sciond.PathReplyEntry {
+	pathMgr := transport.DefNetwork.PathResolver()
 	pathSet := pathMgr.Query(local.IA, remote.IA)
-	var appPaths []*spathmeta.AppPath
-	var selectedPath *spathmeta.AppPath
+	var selectedPath *pathpolicy.ListedPath
 
 	if len(pathSet) == 0 {
 		return nil
 	}
 
-	fmt.Printf("Available paths to %v\n", remote.IA)
-	i := 0
-	for _, path := range pathSet {
-		appPaths = append(appPaths, path)
-		fmt.Printf("[%2d] %s\n", i, path.Entry.Path.String())
-		i++
-	}
+	listed := pathpolicy.List(policy, pathSet)
+	PrintPaths(remote.IA, listed)
 
 	if interactive {
 		scanner := bufio.NewScanner(os.Stdin)
 		for {
 			fmt.Printf("Choose path: ")
-			scanner.Scan()
+			if !scanner.Scan() {
+				// stdin was closed before the user chose a path
+				fmt.Println()
+				return nil
+			}
 			pathIndexStr := scanner.Text()
 			pathIndex, err := strconv.Atoi(pathIndexStr)
-			if err == nil && 0 <= pathIndex && pathIndex < len(appPaths) {
-				selectedPath = appPaths[pathIndex]
+			if err == nil && 0 <= pathIndex && pathIndex < len(listed) {
+				selectedPath = listed[pathIndex]
 				break
 			}
-			fmt.Printf("ERROR: Invalid path index %v, valid indices range: [0, %v]\n", pathIndex, len(appPaths)-1)
+			fmt.Printf("ERROR: Invalid path index %v, valid indices range: [0, %v]\n", pathIndex, len(listed)-1)
 		}
 	} else {
-		// when in non-interactive mode, use path selection function to choose path
-		selectedPath = pathSelection(pathSet, pathAlgo)
+		// when in non-interactive mode, use the path the policy ranks first
+		for _, path := range listed {
+			if path.Rank == 1 {
+				selectedPath = path
+			}
+		}
+		if selectedPath == nil {
+			fmt.Printf("None of the paths to %v matches the path policy\n", remote.IA)
+			return nil
+		}
 	}
 	entry := selectedPath.Entry
-	fmt.Printf("Using path:\n  %s\n", entry.Path.String())
+	fmt.Printf("Using path:\n  %s\n", pathpolicy.Describe(entry))
 	return entry
 }
 
-func pathSelection(pathSet spathmeta.AppPathSet, pathAlgo string) *spathmeta.AppPath {
-	var selectedPath *spathmeta.AppPath
-	var metric float64
-	// A path selection algorithm consists of a simple comparision function selecting the best path according
-	// to some path property and a metric function normalizing that property to a value in [0,1], where larger is better
-	// Available path selection algorithms, the metric returned must be normalized between [0,1]:
-	pathAlgos := map[string](func(spathmeta.AppPathSet) (*spathmeta.AppPath, float64)){
-		"shortest": selectShortestPath,
-		"mtu":      selectLargestMTUPath,
-	}
-	switch pathAlgo {
-	case "shortest":
-		log.Debug("Path selection algorithm", "pathAlgo", "shortest")
-		selectedPath, metric = pathAlgos[pathAlgo](pathSet)
-	case "mtu":
-		log.Debug("Path selection algorithm", "pathAlgo", "MTU")
-		selectedPath, metric = pathAlgos[pathAlgo](pathSet)
-	default:
-		// Default is to take result with best score
-		for _, algo := range pathAlgos {
-			cadidatePath, cadidateMetric := algo(pathSet)
-			if cadidateMetric > metric {
-				selectedPath = cadidatePath
-				metric = cadidateMetric
+// Returns up to numPaths paths to remote for a multipath bwtest, or all paths if numPaths is 0.
+// If disjoint is set, a path is only used if it does not share any interface with the paths
+// chosen before it. In non-interactive mode, only the paths the policy accepts are used, the
+// ones it prefers first. Returns nil if the input ends before the user chose the paths.
+func ChoosePaths(interactive bool, policy pathpolicy.PathPolicy, local snet.Addr, remote snet.Addr, numPaths int, disjoint bool) []*sciond.PathReplyEntry {
+	pathMgr := transport.DefNetwork.PathResolver()
+	pathSet := pathMgr.Query(local.IA, remote.IA)
+	if len(pathSet) == 0 {
+		return nil
+	}
+	listed := pathpolicy.List(policy, pathSet)
+	PrintPaths(remote.IA, listed)
+
+	var candidates []*sciond.PathReplyEntry
+	if interactive {
+		scanner := bufio.NewScanner(os.Stdin)
+		for candidates == nil {
+			fmt.Printf("Choose paths (comma separated indices): ")
+			if !scanner.Scan() {
+				fmt.Println()
+				return nil
 			}
+			for _, pathIndexStr := range strings.Split(scanner.Text(), ",") {
+				pathIndex, err := strconv.Atoi(strings.TrimSpace(pathIndexStr))
+				if err != nil || pathIndex < 0 || pathIndex >= len(listed) {
+					fmt.Printf("ERROR: Invalid path index %v, valid indices range: [0, %v]\n",
+						pathIndexStr, len(listed)-1)
+					candidates = nil
+					break
+				}
+				candidates = append(candidates, listed[pathIndex].Entry)
+			}
+		}
+	} else {
+		for _, path := range pathpolicy.Rank(policy, pathSet) {
+			candidates = append(candidates, path.Entry)
+		}
+		if len(candidates) == 0 {
+			fmt.Printf("None of the paths to %v matches the path policy\n", remote.IA)
+			return nil
 		}
 	}
-	log.Debug("Path selection algorithm choice", "path", selectedPath.Entry.Path.String(), "score", metric)
-	return selectedPath
-}
 
-func selectShortestPath(pathSet spathmeta.AppPathSet) (selectedPath *spathmeta.AppPath, metric float64) {
-	// Selects shortest path by number of hops
-	for _, appPath := range pathSet {
-		if selectedPath == nil || len(appPath.Entry.Path.Interfaces) < len(selectedPath.Entry.Path.Interfaces) {
-			selectedPath = appPath
+	var entries []*sciond.PathReplyEntry
+	used := make(map[sciond.PathInterface]bool)
+	for _, path := range candidates {
+		if numPaths > 0 && len(entries) == numPaths {
+			break
 		}
+		if disjoint && sharesInterface(path.Path.Interfaces, used) {
+			log.Debug("Skipping path that is not disjoint", "path", path.Path.String())
+			continue
+		}
+		for _, iface := range path.Path.Interfaces {
+			used[iface] = true
+		}
+		entries = append(entries, path)
 	}
-	metric_fn := func(rawMetric []sciond.PathInterface) (result float64) {
-		hopCount := float64(len(rawMetric))
-		midpoint := 7.0
-		result = math.Exp(-(hopCount - midpoint)) / (1 + math.Exp(-(hopCount - midpoint)))
-		return result
+	fmt.Printf("Using paths:\n")
+	for _, entry := range entries {
+		fmt.Printf("  %s\n", pathpolicy.Describe(entry))
 	}
-	return selectedPath, metric_fn(selectedPath.Entry.Path.Interfaces)
+	return entries
 }
 
-func selectLargestMTUPath(pathSet spathmeta.AppPathSet) (selectedPath *spathmeta.AppPath, metric float64) {
-	// Selects path with largest MTU
-	for _, appPath := range pathSet {
-		if selectedPath == nil || appPath.Entry.Path.Mtu > selectedPath.Entry.Path.Mtu {
-			selectedPath = appPath
+func sharesInterface(ifaces []sciond.PathInterface, used map[sciond.PathInterface]bool) bool {
+	for _, iface := range ifaces {
+		if used[iface] {
+			return true
 		}
 	}
-	metric_fn := func(rawMetric uint16) (result float64) {
-		mtu := float64(rawMetric)
-		midpoint := 1500.0
-		tilt := 0.004
-		result = 1 / (1 + math.Exp(-tilt*(mtu-midpoint)))
-		return result
-	}
-	return selectedPath, metric_fn(selectedPath.Entry.Path.Mtu)
+	return false
 }
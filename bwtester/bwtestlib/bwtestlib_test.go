@@ -0,0 +1,344 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testPrgKey = bytes.Repeat([]byte{0x42}, 16)
+
+// Returns the first l bytes of the encoding enc with the length field set to l, i.e., the
+// encoding an older version would produce, or enc followed by unknown fields if l is longer
+func withLength(enc []byte, l int) []byte {
+	b := make([]byte, l)
+	copy(b, enc)
+	binary.LittleEndian.PutUint16(b, uint16(l))
+	return b
+}
+
+func TestBwtestParametersVersions(t *testing.T) {
+	bwp := BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, PacingAIMD,
+		1500 * time.Millisecond}
+	buf := make([]byte, 100)
+	n, err := EncodeBwtestParameters(&bwp, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Len := bwtestParametersV1Len + len(testPrgKey)
+	if n != v1Len+1+8 {
+		t.Fatalf("Encoded %d bytes, expected %d", n, v1Len+1+8)
+	}
+
+	tests := []struct {
+		name string
+		l    int
+		want BwtestParameters
+	}{
+		{"version 1", v1Len, BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, PacingFixed, 0}},
+		{"version 5", v1Len + 1, BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, PacingAIMD, 0}},
+		{"version 6", v1Len + 1 + 8, bwp},
+		{"unknown fields", v1Len + 1 + 8 + 5, bwp},
+	}
+	for _, tc := range tests {
+		got, m, err := DecodeBwtestParameters(withLength(buf[:n], tc.l))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if m != tc.l {
+			t.Errorf("%s: consumed %d bytes, expected %d", tc.name, m, tc.l)
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: decoded %+v, expected %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestBwtestParametersClamped(t *testing.T) {
+	bwp := BwtestParameters{MaxDuration + time.Second, MaxPacketSize + 1, -1, testPrgKey, 1, 200,
+		-time.Second}
+	buf := make([]byte, 100)
+	n, err := EncodeBwtestParameters(&bwp, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := DecodeBwtestParameters(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BwtestParameters{MaxDuration, MaxPacketSize, 0, testPrgKey, MinPort, PacingFixed, 0}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("Decoded %+v, expected %+v", *got, want)
+	}
+}
+
+func TestBwtestParametersErrors(t *testing.T) {
+	bwp := BwtestParameters{time.Second, 100, 10, testPrgKey, 40002, PacingFixed, 0}
+	buf := make([]byte, 100)
+	n, err := EncodeBwtestParameters(&bwp, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Len := bwtestParametersV1Len + len(testPrgKey)
+
+	encodeTests := []struct {
+		name   string
+		bwp    BwtestParameters
+		bufLen int
+		check  func(error) bool
+	}{
+		{"short buffer", bwp, n - 1, isBufferError},
+		{"empty buffer", bwp, 0, isBufferError},
+		{"invalid key", BwtestParameters{PrgKey: make([]byte, 15)}, 100, isKeyError},
+	}
+	for _, tc := range encodeTests {
+		if _, err := EncodeBwtestParameters(&tc.bwp, make([]byte, tc.bufLen)); !tc.check(err) {
+			t.Errorf("Encoding with %s: unexpected error %v", tc.name, err)
+		}
+	}
+
+	badKeyLen := withLength(buf[:n], v1Len)
+	badKeyLen[28] = 17
+	shortKey := withLength(buf[:n], bwtestParametersV1Len+8)
+	shortKey[28] = 8
+	decodeTests := []struct {
+		name  string
+		buf   []byte
+		check func(error) bool
+	}{
+		{"no bytes", nil, isDecodeError},
+		{"1 byte", buf[:1], isDecodeError},
+		{"truncated", buf[:n-1], isDecodeError},
+		{"truncated version 1", buf[:v1Len-1], isDecodeError},
+		{"length below version 1", withLength(buf[:n], bwtestParametersV1Len-1), isDecodeError},
+		{"key beyond length", badKeyLen, isDecodeError},
+		{"invalid key", shortKey, isKeyError},
+	}
+	for _, tc := range decodeTests {
+		if _, _, err := DecodeBwtestParameters(tc.buf); !tc.check(err) {
+			t.Errorf("Decoding with %s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func testResult() BwtestResult {
+	ipa, owd := NewHistogram(DefaultSubBucketBits), NewHistogram(DefaultSubBucketBits)
+	for _, v := range []int64{0, 5, 1000, 1000, 123456789} {
+		ipa.Record(v)
+		owd.Record(2 * v)
+	}
+	return BwtestResult{100, 95, 3, 1000, 2000, 3000, testPrgKey, time.Unix(0, 1500000000123456789),
+		-7, 8, 9, 10, 11, 12, 13, 14, ipa, owd, 120, 4, 1, []CorruptedRange{{20, 3, 5}, {0, 1500, 1}}}
+}
+
+func TestBwtestResultVersions(t *testing.T) {
+	res := testResult()
+	buf := make([]byte, 2000)
+	n, err := EncodeBwtestResult(&res, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Len := bwtestResultV1Len + len(testPrgKey)
+	v3Len := v1Len + bwtestResultStatsLen
+	histLen := len(appendHistogram(appendHistogram(nil, res.IPAHist), res.OWDHist))
+	v4Len := v3Len + histLen
+	v5Len := v4Len + 8
+	if want := v5Len + 16 + len(appendCorruptedRanges(nil, res.CorruptedRanges)); n != want {
+		t.Fatalf("Encoded %d bytes, expected %d", n, want)
+	}
+
+	v1 := res
+	v1.OWDmin, v1.OWDavg, v1.OWDmax, v1.Jitter = -1, -1, -1, -1
+	v1.Reordered, v1.Duplicates, v1.LossBursts, v1.MaxLossBurst = -1, -1, -1, -1
+	v1.IPAHist, v1.OWDHist = nil, nil
+	v1.NumPacketsSent, v1.CorruptedPackets, v1.WrongSizePackets = -1, -1, -1
+	v1.CorruptedRanges = nil
+	v3 := res
+	v3.IPAHist, v3.OWDHist = nil, nil
+	v3.NumPacketsSent, v3.CorruptedPackets, v3.WrongSizePackets = -1, -1, -1
+	v3.CorruptedRanges = nil
+	v4 := v3
+	v4.IPAHist, v4.OWDHist = res.IPAHist, res.OWDHist
+	v5 := v4
+	v5.NumPacketsSent = res.NumPacketsSent
+	v8NoRanges := res
+	v8NoRanges.CorruptedRanges = nil
+
+	tests := []struct {
+		name string
+		l    int
+		want BwtestResult
+	}{
+		{"version 1", v1Len, v1},
+		{"version 3", v3Len, v3},
+		{"version 4", v4Len, v4},
+		{"version 5", v5Len, v5},
+		{"version 8 without ranges", v5Len + 16, v8NoRanges},
+		{"version 8", n, res},
+		{"unknown fields", n + 5, res},
+	}
+	for _, tc := range tests {
+		got, m, err := DecodeBwtestResult(withLength(buf[:n], tc.l))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if m != tc.l {
+			t.Errorf("%s: consumed %d bytes, expected %d", tc.name, m, tc.l)
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: decoded %+v, expected %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestBwtestResultErrors(t *testing.T) {
+	res := testResult()
+	buf := make([]byte, 2000)
+	n, err := EncodeBwtestResult(&res, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Len := bwtestResultV1Len + len(testPrgKey)
+	v3Len := v1Len + bwtestResultStatsLen
+
+	longKey := res
+	longKey.PrgKey = make([]byte, 256)
+	encodeTests := []struct {
+		name   string
+		res    BwtestResult
+		bufLen int
+		check  func(error) bool
+	}{
+		{"short buffer", res, n - 1, isBufferError},
+		{"empty buffer", res, 0, isBufferError},
+		{"long key", longKey, 2000, isKeyError},
+	}
+	for _, tc := range encodeTests {
+		if _, err := EncodeBwtestResult(&tc.res, make([]byte, tc.bufLen)); !tc.check(err) {
+			t.Errorf("Encoding with %s: unexpected error %v", tc.name, err)
+		}
+	}
+
+	badKeyLen := withLength(buf[:n], v1Len)
+	badKeyLen[58] = 17
+	badHist := withLength(buf[:n], n)
+	badHist[v3Len] = maxSubBucketBits + 1
+	badRanges := withLength(buf[:n], n)
+	badRanges[n-1] = 0x80
+	decodeTests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"no bytes", nil},
+		{"1 byte", buf[:1]},
+		{"truncated", buf[:n-1]},
+		{"length below version 1", withLength(buf[:n], bwtestResultV1Len-1)},
+		{"key beyond length", badKeyLen},
+		{"truncated histogram", withLength(buf[:n], v3Len+3)},
+		{"invalid histogram", badHist},
+		{"invalid ranges", badRanges},
+	}
+	for _, tc := range decodeTests {
+		if _, _, err := DecodeBwtestResult(tc.buf); !isDecodeError(err) {
+			t.Errorf("Decoding with %s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestAcceptResponse(t *testing.T) {
+	cs := BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, PacingFixed, 0}
+	sc := BwtestParameters{2 * time.Second, 500, 0, testPrgKey, 40003, PacingBBR, time.Second}
+	tests := []struct {
+		version byte
+		l       int // Length of the response
+		params  bool
+	}{
+		{LegacyVersion, 2, false},
+		{1, 3, false},
+		{effectiveVersion - 1, 3, false},
+		{effectiveVersion, 3 + 2*(bwtestParametersV1Len+len(testPrgKey)+9), true},
+		{WireVersion, 3 + 2*(bwtestParametersV1Len+len(testPrgKey)+9), true},
+	}
+	for _, tc := range tests {
+		buf := make([]byte, 200)
+		l, err := EncodeAcceptResponse(buf, tc.version, &cs, &sc)
+		if err != nil {
+			t.Errorf("Version %d: %v", tc.version, err)
+			continue
+		}
+		if l != tc.l || buf[0] != 'N' || buf[1] != 0 {
+			t.Errorf("Version %d: response %v, expected %d bytes", tc.version, buf[:l], tc.l)
+			continue
+		}
+		if tc.version == LegacyVersion {
+			continue
+		}
+		if buf[2] != tc.version {
+			t.Errorf("Version %d: response has version %d", tc.version, buf[2])
+		}
+		gotCS, gotSC, err := DecodeAcceptResponse(buf[3:l], tc.version)
+		if err != nil {
+			t.Errorf("Version %d: %v", tc.version, err)
+			continue
+		}
+		if !tc.params {
+			if gotCS != nil || gotSC != nil {
+				t.Errorf("Version %d: decoded parameters %v and %v", tc.version, gotCS, gotSC)
+			}
+			continue
+		}
+		if gotCS == nil || gotSC == nil || !reflect.DeepEqual(*gotCS, cs) || !reflect.DeepEqual(*gotSC, sc) {
+			t.Errorf("Version %d: decoded parameters %v and %v", tc.version, gotCS, gotSC)
+		}
+		if _, _, err := DecodeAcceptResponse(buf[3:l-1], tc.version); !isDecodeError(err) {
+			t.Errorf("Version %d: unexpected error %v for a truncated response", tc.version, err)
+		}
+	}
+	if _, err := EncodeAcceptResponse(make([]byte, 50), WireVersion, &cs, &sc); !isBufferError(err) {
+		t.Errorf("Unexpected error %v for a short buffer", err)
+	}
+}
+
+func TestRejectResponse(t *testing.T) {
+	tests := []struct {
+		version    byte
+		reason     byte
+		retryAfter time.Duration
+		want       []byte
+	}{
+		{LegacyVersion, RejectRequestRate, 1500 * time.Millisecond, []byte{'N', 2}},
+		{LegacyVersion, RejectAuthFailed, 0, []byte{'N', RejectedCode}},
+		{1, RejectRequestRate, 10 * time.Second, []byte{'N', 10, 1}},
+		{1, RejectNotAllowed, 0, []byte{'N', RejectedCode, 1}},
+		{2, RejectRequestRate, 10 * time.Second, []byte{'N', RejectedCode, 2, RejectRequestRate, 10}},
+		{2, RejectByteRate, time.Hour, []byte{'N', RejectedCode, 2, RejectByteRate, RejectedCode - 1}},
+		{WireVersion, RejectShutdown, 0, []byte{'N', RejectedCode, WireVersion, RejectShutdown, 0}},
+	}
+	for _, tc := range tests {
+		buf := make([]byte, 10)
+		l := EncodeRejectResponse(buf, tc.version, tc.reason, tc.retryAfter)
+		if !bytes.Equal(buf[:l], tc.want) {
+			t.Errorf("Version %d, reason %d: response %v, expected %v", tc.version, tc.reason,
+				buf[:l], tc.want)
+		}
+	}
+}
+
+func isDecodeError(err error) bool {
+	_, ok := err.(*DecodeError)
+	return ok
+}
+
+func isBufferError(err error) bool {
+	_, ok := err.(*BufferError)
+	return ok
+}
+
+func isKeyError(err error) bool {
+	_, ok := err.(*KeyError)
+	return ok
+}
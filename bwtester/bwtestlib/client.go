@@ -0,0 +1,536 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+var (
+	// The server did not respond to the 'N' request
+	ErrNoResponse = errors.New("Could not receive a server response, MaxTries attempted without success")
+	// The server did not return the result of the client->server direction
+	ErrNoServerResult = errors.New("Could not fetch server results, MaxTries attempted without success")
+	// The server does not have the result, or the PRG key was incorrect
+	ErrResultNotFound = errors.New("Results could not be found or PRG key was incorrect")
+)
+
+// RejectedError is returned if the server refuses to run the bwtest
+type RejectedError struct {
+	Reason     byte
+	RetryAfter time.Duration // 0 if the server gave no time
+}
+
+func (e *RejectedError) Error() string {
+	msg := fmt.Sprintf("The server rejected the bwtest: %s", RejectReasonString(e.Reason))
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", try again in %d seconds", int(e.RetryAfter/time.Second))
+	}
+	return msg
+}
+
+// Client runs bwtests against a bwtestserver. The transport needs to be initialized with
+// transport.Init before.
+type Client struct {
+	// Address of the control connection (CC), the data connection (DC) uses the next port
+	Local *snet.Addr
+	// Path to the server, if nil it is the one PathPolicy prefers, or pathpolicy.Default if
+	// PathPolicy is nil. It is not used if client and server are in the same AS.
+	Path       *sciond.PathReplyEntry
+	PathPolicy pathpolicy.PathPolicy
+	// Key to authenticate with servers that require it, nil to not authenticate
+	PSK *PSK
+	// If set, the DC switches to another path that PathPolicy accepts when its path fails, and
+	// the CC follows it, see failover.go. It is not used if client and server are in the same AS.
+	Failover bool
+	// If set, Logf is called with messages about the progress of the bwtest, such as retries
+	Logf func(format string, a ...interface{})
+}
+
+// Result of a bwtest run by a Client
+type Result struct {
+	// Parameters as sent to the server, with the ports and PRG keys filled in. From version 10
+	// on, they are replaced by the parameters the server applies, which are lower than the
+	// requested ones if the server reduced them to its limits.
+	CSParams BwtestParameters
+	SCParams BwtestParameters
+	// The client->server direction is measured by the server, nil if it could not be fetched
+	// or if the direction has no packets
+	CS *BwtestResult
+	// The server->client direction is measured by the client, nil if it has no packets
+	SC *BwtestResult
+	// Path of the bwtest, nil if client and server are in the same AS
+	Path *sciond.PathReplyEntry
+	// Paths the DC used with Client.Failover, the first one is Path. Nil without failover.
+	Segments []PathSegment
+	// Wire version used by the server
+	Version byte
+}
+
+// Returns a new random PRG key
+func NewPrgKey() ([]byte, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Runs a bwtest with the server whose CC listens on server, csParams and scParams are the
+// parameters of the client->server and server->client directions. The ports of the parameters
+// are set from the addresses and missing PRG keys are generated. One of the directions may
+// have no packets, it is then skipped. If the result of the
+// client->server direction cannot be fetched, the result is returned along with
+// ErrNoServerResult. The bwtest stops when ctx is done, Run then returns ctx.Err(). Run returns
+// once the connections are closed, so that the ports can be used again.
+func (c *Client) Run(ctx context.Context, server *snet.Addr, csParams, scParams BwtestParameters) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r := &Result{CSParams: csParams, SCParams: scParams}
+	for _, bwp := range []*BwtestParameters{&r.CSParams, &r.SCParams} {
+		if err := validateParameters(bwp); err != nil {
+			return nil, err
+		}
+		if len(bwp.PrgKey) == 0 {
+			key, err := NewPrgKey()
+			if err != nil {
+				return nil, err
+			}
+			bwp.PrgKey = key
+		}
+	}
+	if r.CSParams.NumPackets == 0 && r.SCParams.NumPackets == 0 {
+		return nil, errors.New("Invalid number of packets, at least one direction needs packets")
+	}
+	r.CSParams.Port = c.Local.L4Port + 1
+	r.SCParams.Port = server.L4Port + 1
+
+	if !server.IA.Eq(c.Local.IA) {
+		path, err := c.choosePath(server)
+		if err != nil {
+			return nil, err
+		}
+		r.Path = path
+	}
+
+	serverCCAddr, serverDCAddr := *server, *server
+	serverDCAddr.L4Port = r.SCParams.Port
+	clientDCAddr := *c.Local
+	clientDCAddr.L4Port = r.CSParams.Port
+	if r.Path != nil {
+		pathpolicy.SetPath(&serverCCAddr, r.Path)
+		pathpolicy.SetPath(&serverDCAddr, r.Path)
+		c.logf("Client DC \tNext Hop %v\tServer Host %v\t Server Port %v",
+			serverDCAddr.NextHopHost, serverDCAddr.Host, serverDCAddr.L4Port)
+	}
+	var CCConn, DCConn transport.Conn
+	var err error
+	var fc *failoverConn
+	if c.Failover && r.Path != nil {
+		// The connections are not connected to the server, so that they can send along any path
+		conn, err := transport.ListenSCION("udp4", &clientDCAddr)
+		if err != nil {
+			return nil, err
+		}
+		fc = newFailoverConn(conn, c.Local.IA, &serverDCAddr, r.Path, c.PathPolicy, c.logf)
+		DCConn = fc
+		if conn, err = transport.ListenSCION("udp4", c.Local); err != nil {
+			_ = DCConn.Close()
+			return nil, err
+		}
+		CCConn = &followConn{Conn: conn, dc: fc, remote: &serverCCAddr}
+	} else {
+		if CCConn, err = transport.DialSCION("udp4", c.Local, &serverCCAddr); err != nil {
+			return nil, err
+		}
+		if DCConn, err = transport.DialSCION("udp4", &clientDCAddr, &serverDCAddr); err != nil {
+			_ = CCConn.Close()
+			return nil, err
+		}
+	}
+	defer CCConn.Close()
+
+	// Closing the connections on cancellation interrupts all reads and writes
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-runCtx.Done()
+		_ = CCConn.Close()
+		_ = DCConn.Close()
+	}()
+
+	err = c.run(runCtx, cancel, r, CCConn, DCConn)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if fc != nil {
+		r.Segments = fc.pathSegments()
+	}
+	return r, err
+}
+
+// Fetch fetches the result of the client->server direction of an earlier bwtest from the
+// server whose CC listens on server, the bwtest is identified by the PRG key of that direction.
+// Servers keep the results for a short time after the bwtest, or for longer and across
+// restarts if they record them in a results file. Returns ErrResultNotFound if the server does
+// not have the result.
+func (c *Client) Fetch(ctx context.Context, server *snet.Addr, prgKey []byte) (*BwtestResult, error) {
+	if err := checkPrgKey(prgKey); err != nil {
+		return nil, err
+	}
+	serverCCAddr := *server
+	if !server.IA.Eq(c.Local.IA) {
+		path, err := c.choosePath(server)
+		if err != nil {
+			return nil, err
+		}
+		pathpolicy.SetPath(&serverCCAddr, path)
+	}
+	CCConn, err := transport.DialSCION("udp4", c.Local, &serverCCAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer CCConn.Close()
+
+	// Closing the connection on cancellation interrupts the reads
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-fetchCtx.Done()
+		_ = CCConn.Close()
+	}()
+	res, err := c.fetch(fetchCtx, CCConn, WireVersion, prgKey)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+// Returns the path to server: c.Path if set, otherwise the path c.PathPolicy prefers
+func (c *Client) choosePath(server *snet.Addr) (*sciond.PathReplyEntry, error) {
+	if c.Path != nil {
+		return c.Path, nil
+	}
+	path, err := pathpolicy.Choose(c.PathPolicy, c.Local.IA, server.IA)
+	if err == pathpolicy.ErrNoPath {
+		return nil, ErrPathNotFound
+	}
+	return path, err
+}
+
+// Returns an error if bwp cannot be sent to the server
+func validateParameters(bwp *BwtestParameters) error {
+	switch {
+	case bwp.BwtestDuration <= 0 || bwp.BwtestDuration > MaxDuration:
+		return fmt.Errorf("Invalid duration %v, must be positive and at most %v", bwp.BwtestDuration, MaxDuration)
+	case bwp.PacketSize < MinPacketSize || bwp.PacketSize > MaxPacketSize:
+		return fmt.Errorf("Invalid packet size %d, must be between %d and %d", bwp.PacketSize,
+			MinPacketSize, MaxPacketSize)
+	case bwp.NumPackets < 0 || bwp.NumPackets > MaxNumPackets:
+		return fmt.Errorf("Invalid number of packets %d, must not be negative and at most %d", bwp.NumPackets,
+			MaxNumPackets)
+	case bwp.StartOffset < 0 || bwp.StartOffset > MaxStartOffset:
+		return fmt.Errorf("Invalid start offset %v, must not be negative and at most %v", bwp.StartOffset,
+			MaxStartOffset)
+	case len(bwp.PrgKey) != 0:
+		return checkPrgKey(bwp.PrgKey)
+	}
+	return nil
+}
+
+// Returns true if the parameters returned by the server belong to the direction with the
+// requested parameters bwp, i.e., if they have the same PRG key and port
+func sameBwtest(bwp, effective *BwtestParameters) bool {
+	return bytes.Equal(bwp.PrgKey, effective.PrgKey) && bwp.Port == effective.Port
+}
+
+func (c *Client) logf(format string, a ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, a...)
+	}
+}
+
+// Requests the bwtest, sends and receives the data packets and fetches the server's result.
+// Returns once DCConn is closed, which happens when the data packets have been received and
+// sent, or right away if an error occurs, in which case cancel is called.
+func (c *Client) run(ctx context.Context, cancel context.CancelFunc, r *Result, CCConn, DCConn transport.Conn) (err error) {
+	var (
+		tzero time.Time // initialized to "zero" time
+
+		receiveDone sync.Mutex // used to signal when the receive goroutine has computed the result
+	)
+	clientBwp, serverBwp := &r.CSParams, &r.SCParams
+
+	// The receiver will close the DC connection, so it waits until the sender is also done
+	res := NewBwtestResult(clientBwp.PrgKey, ExpectedFinishTime(time.Now(), clientBwp, serverBwp, MaxRTT))
+	var resLock sync.Mutex
+
+	// The version of the data packets is only known once the server responds
+	var dataVersion DataVersion
+	// Feedback of the server for the adaptive pacing of the client->server direction
+	fb := NewFeedback()
+	// Closed once the receive goroutine has closed the DC
+	dcClosed := make(chan struct{})
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+		<-dcClosed
+	}()
+	receiveDone.Lock()
+	go func() {
+		receiveDataPackets(ctx, serverBwp, DCConn, res, &resLock, &receiveDone, &dataVersion, fb)
+		close(dcClosed)
+	}()
+
+	pktbuf := make([]byte, 2000)
+	pktbuf[0] = 'N' // Request for new bwtest
+	pktbuf[1] = WireVersion
+	n, err := EncodeBwtestParameters(clientBwp, pktbuf[2:])
+	if err != nil {
+		return err
+	}
+	l := n + 2
+	n, err = EncodeBwtestParameters(serverBwp, pktbuf[l:])
+	if err != nil {
+		return err
+	}
+	l = l + n
+
+	// Version of the wire format used by the server, which it returns in its response
+	var version byte
+	// Parameters of the server->client direction that the server applies, nil if unknown
+	var scEffective *BwtestParameters
+
+	// The response is read into a separate buffer, so that the request can be sent again
+	respbuf := make([]byte, 2000)
+
+	var numtries int64 = 0
+	for numtries < MaxTries {
+		reqLen := l
+		if c.PSK != nil {
+			// Authenticate each request anew, since the timestamp must be recent
+			if reqLen, err = EncodeAuthPSK(pktbuf, l, c.PSK, time.Now()); err != nil {
+				return err
+			}
+		}
+		if _, err := CCConn.Write(pktbuf[:reqLen]); err != nil {
+			return err
+		}
+
+		if err := CCConn.SetReadDeadline(time.Now().Add(MaxRTT)); err != nil {
+			return err
+		}
+		n, err := CCConn.Read(respbuf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// A timeout likely happened, see if we should adjust the expected finishing time
+			eft := ExpectedFinishTime(time.Now(), clientBwp, serverBwp, MaxRTT)
+			resLock.Lock()
+			if res.ExpectedFinishTime.Before(eft) {
+				res.ExpectedFinishTime = eft
+			}
+			resLock.Unlock()
+
+			numtries++
+			continue
+		}
+		// Remove read deadline
+		if err := CCConn.SetReadDeadline(tzero); err != nil {
+			return err
+		}
+
+		if n == 5 && respbuf[0] == 'N' && respbuf[1] == RejectedCode {
+			// The server refuses to run the bwtest
+			return &RejectedError{respbuf[3], time.Duration(respbuf[4]) * time.Second}
+		}
+		if n < 3 || respbuf[0] != 'N' {
+			c.logf("Incorrect server response, trying again")
+			if err := sleepContext(ctx, Timeout); err != nil {
+				return err
+			}
+			numtries++
+			continue
+		}
+		if respbuf[1] != 0 {
+			// The server asks us to wait for some amount of time
+			wait := time.Second * time.Duration(int(respbuf[1]))
+			// The bwtest starts after the wait, so the receive function needs to wait longer as well
+			eft := ExpectedFinishTime(time.Now(), clientBwp, serverBwp, wait+MaxRTT)
+			resLock.Lock()
+			if res.ExpectedFinishTime.Before(eft) {
+				res.ExpectedFinishTime = eft
+			}
+			resLock.Unlock()
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			// Don't increase numtries in this case
+			continue
+		}
+
+		// From version 10 on, the response contains the parameters the server applies
+		version = NegotiateVersion(respbuf[2])
+		var csEffective *BwtestParameters
+		csEffective, scEffective, err = DecodeAcceptResponse(respbuf[3:n], version)
+		if err == nil && csEffective != nil &&
+			!(sameBwtest(clientBwp, csEffective) && sameBwtest(serverBwp, scEffective)) {
+			err = errors.New("Parameters do not belong to the bwtest")
+		}
+		if err != nil {
+			c.logf("Incorrect server response, trying again: %v", err)
+			if err := sleepContext(ctx, Timeout); err != nil {
+				return err
+			}
+			numtries++
+			continue
+		}
+
+		// Everything was successful, exit the loop
+		if csEffective != nil {
+			// The sender has not started yet, the receive function learns the parameters of its
+			// direction from dataVersion
+			*clientBwp = *csEffective
+		}
+		dataVersion.SetEffective(version, scEffective)
+		break
+	}
+
+	if numtries == MaxTries {
+		return ErrNoResponse
+	}
+	r.Version = version
+	if fc, ok := DCConn.(*failoverConn); ok {
+		scBwp := *serverBwp
+		if scEffective != nil {
+			scBwp = *scEffective
+		}
+		fc.start(version, *clientBwp, scBwp)
+	}
+
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- sendDataPackets(ctx, clientBwp, DCConn, version, fb) }()
+
+	receiveDone.Lock()
+	if scEffective != nil {
+		*serverBwp = *scEffective
+	}
+	if serverBwp.NumPackets > 0 {
+		r.SC = res
+	}
+	if err := <-sendErr; err != nil {
+		return err
+	}
+	if clientBwp.NumPackets == 0 {
+		// There is no result to fetch
+		return nil
+	}
+
+	// Fetch results from server
+	sres, err := c.fetch(ctx, CCConn, version, clientBwp.PrgKey)
+	if err != nil {
+		return err
+	}
+	r.CS = sres
+	return nil
+}
+
+// Fetches the result of the client->server direction with the given PRG key over CCConn,
+// the request is sent in the given version
+func (c *Client) fetch(ctx context.Context, CCConn transport.Conn, version byte, prgKey []byte) (*BwtestResult, error) {
+	var tzero time.Time
+	pktbuf := make([]byte, 2000)
+	var numtries int64 = 0
+	for numtries < MaxTries {
+		pktbuf[0] = 'R'
+		pktbuf[1] = version
+		copy(pktbuf[2:], prgKey)
+		if _, err := CCConn.Write(pktbuf[:2+len(prgKey)]); err != nil {
+			return nil, err
+		}
+
+		if err := CCConn.SetReadDeadline(time.Now().Add(MaxRTT)); err != nil {
+			return nil, err
+		}
+		n, err := CCConn.Read(pktbuf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			numtries++
+			continue
+		}
+		// Remove read deadline
+		if err := CCConn.SetReadDeadline(tzero); err != nil {
+			return nil, err
+		}
+
+		if n < 2 || pktbuf[0] != 'R' {
+			numtries++
+			continue
+		}
+		if pktbuf[1] != byte(0) {
+			// Error case
+			if pktbuf[1] == byte(127) {
+				return nil, ErrResultNotFound
+			}
+			// pktbuf[1] contains number of seconds to wait for results
+			c.logf("We need to sleep for %d seconds before we can get the results", pktbuf[1])
+			if err := sleepContext(ctx, time.Duration(pktbuf[1])*time.Second); err != nil {
+				return nil, err
+			}
+			// We don't increment numtries as this was not a lost packet or other communication error
+			continue
+		}
+
+		if n < 3 {
+			numtries++
+			continue
+		}
+		sres, n1, err := DecodeBwtestResult(pktbuf[3:n])
+		if err != nil {
+			c.logf("Decoding error, try again")
+			numtries++
+			continue
+		}
+		if n1+3 < n {
+			c.logf("Insufficient number of bytes received, try again")
+			if err := sleepContext(ctx, Timeout); err != nil {
+				return nil, err
+			}
+			numtries++
+			continue
+		}
+		if !bytes.Equal(prgKey, sres.PrgKey) {
+			c.logf("PRG Key returned from server incorrect, this should never happen")
+			numtries++
+			continue
+		}
+		return sres, nil
+	}
+	return nil, ErrNoServerResult
+}
+
+// Waits for d, returns ctx.Err() if ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
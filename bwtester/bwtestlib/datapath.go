@@ -0,0 +1,520 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"runtime"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/scionproto/scion/go/lib/common"
+)
+
+// Data packets of version 3 and later start with a header that contains the sequence number
+// and the time the packet was sent, all integers are little endian:
+//
+//	0: uint32 sequence number
+//	4: int64  send timestamp in ns since epoch
+//	12: PRG data
+//
+// Packets that are too short for the timestamp only carry the sequence number. Data packets
+// of earlier versions start with the uint32 offset of the packet in the PRG stream, which is
+// the sequence number times the packet size.
+//
+// From version 7 on, the payload is not generated per packet anymore. Packet seq is a copy of
+// payload template seq % numTemplates, where template i is the AES-CTR stream of the PRG key
+// starting at counter i, and the header is followed by a keyed checksum:
+//
+//	12: uint64 first 8 bytes of the AES encryption of the sequence number and the timestamp
+//	20: template data
+//
+// From version 9 on, the sequence number has 64 bits and is followed by the session ID, so
+// that packets of another bwtest are not taken for packets of this one:
+//
+//	 0: uint64 sequence number
+//	 8: uint32 session ID, the first 4 bytes of the AES encryption of a block of 15 zeros and 0xfe
+//	12: int64  send timestamp in ns since epoch
+//	20: uint64 first 8 bytes of the AES CBC-MAC of bytes 0-19, padded with zeros and 0xff
+//	28: template data
+//
+// The counter of the AES-CTR stream of template i is the session ID followed by zeros and i.
+// A header field is only present if the packet is long enough for it, packets of fewer than
+// 8 bytes carry the low bytes of the sequence number.
+//
+// The receiver checks the checksum and payloadSamples samples of the payload, at offsets that
+// depend on the sequence number. Packets that are too short for the checksum are compared with
+// the template entirely.
+const (
+	dataHeaderLen       = 12
+	dataTimestampOffset = 4
+	// Version in which the data packet header was introduced
+	dataHeaderVersion byte = 3
+
+	// Version in which the payload templates and the checksum were introduced
+	templateVersion    byte = 7
+	dataChecksumOffset      = 12
+	dataChecksumLen         = 8
+	numTemplates            = 8
+	payloadSamples          = 4
+	payloadSampleLen        = 16
+
+	// Version in which the 64-bit sequence number and the session ID were introduced
+	seqVersion         byte = 9
+	seqLen                  = 8
+	sessionIDOffset         = 8
+	seqTimestampOffset      = 12
+	seqChecksumOffset       = 20
+	sessionIDMarker    byte = 0xfe
+	checksumMarker     byte = 0xff
+)
+
+// dataCodec generates and checks the data packets of one direction of a bwtest. It keeps the
+// AES cipher and the templates, so that they are not recomputed for every packet. A dataCodec
+// must only be used by one goroutine.
+type dataCodec struct {
+	bwp       *BwtestParameters
+	version   byte
+	block     cipher.Block
+	templates [][]byte // From templateVersion on
+	sessionID uint32   // From seqVersion on
+	// Offsets of the header fields, which depend on the version
+	tsOffset  int
+	sumOffset int
+	zeros     []byte
+	expBuf    []byte // Expected packet, to find the corrupted bytes
+	sumIn     []byte
+	sumOut    []byte
+	prgIn     []byte
+	prgOut    []byte
+}
+
+// Returns the codec of the data packets of bwp in the format of the given version, or a
+// KeyError if the PRG key is not a valid AES key
+func newDataCodec(bwp *BwtestParameters, version byte) (*dataCodec, error) {
+	block, err := aes.NewCipher(bwp.PrgKey)
+	if err != nil {
+		return nil, &KeyError{len(bwp.PrgKey)}
+	}
+	dc := &dataCodec{
+		bwp:       bwp,
+		version:   version,
+		block:     block,
+		tsOffset:  dataTimestampOffset,
+		sumOffset: dataChecksumOffset,
+		zeros:     make([]byte, bwp.PacketSize),
+		expBuf:    make([]byte, bwp.PacketSize),
+		sumIn:     make([]byte, aes.BlockSize),
+		sumOut:    make([]byte, aes.BlockSize),
+		prgIn:     make([]byte, aes.BlockSize),
+		prgOut:    make([]byte, aes.BlockSize),
+	}
+	if version < templateVersion {
+		return dc, nil
+	}
+	var session uint32
+	if version >= seqVersion {
+		dc.sessionID = sessionID(block)
+		dc.tsOffset, dc.sumOffset = seqTimestampOffset, seqChecksumOffset
+		session = dc.sessionID
+	}
+	dc.templates = make([][]byte, numTemplates)
+	for i := range dc.templates {
+		dc.templates[i] = make([]byte, bwp.PacketSize)
+		cipher.NewCTR(block, counterBlock(session, uint32(i))).XORKeyStream(dc.templates[i], dc.templates[i])
+	}
+	return dc, nil
+}
+
+// SessionID returns the session ID of the direction with parameters bwp, which its data packets
+// carry from version 9 on, or a KeyError if the PRG key is not a valid AES key
+func SessionID(bwp *BwtestParameters) (uint32, error) {
+	block, err := aes.NewCipher(bwp.PrgKey)
+	if err != nil {
+		return 0, &KeyError{len(bwp.PrgKey)}
+	}
+	return sessionID(block), nil
+}
+
+// Returns the session ID of the PRG key of block
+func sessionID(block cipher.Block) uint32 {
+	in, out := make([]byte, aes.BlockSize), make([]byte, aes.BlockSize)
+	in[aes.BlockSize-1] = sessionIDMarker
+	block.Encrypt(out, in)
+	return binary.LittleEndian.Uint32(out)
+}
+
+func counterBlock(session uint32, i uint32) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv, session)
+	binary.BigEndian.PutUint32(iv[aes.BlockSize-4:], i)
+	return iv
+}
+
+// Returns the number of bytes of the header that are present in a packet of length n
+func (dc *dataCodec) headerLen(n int) int {
+	switch {
+	case dc.version >= templateVersion && n >= dc.sumOffset+dataChecksumLen:
+		return dc.sumOffset + dataChecksumLen
+	case dc.version >= dataHeaderVersion && n >= dc.tsOffset+8:
+		return dc.tsOffset + 8
+	case dc.version >= seqVersion && n >= seqLen:
+		if n >= sessionIDOffset+4 {
+			return sessionIDOffset + 4
+		}
+		return seqLen
+	case dc.version >= seqVersion:
+		return n
+	}
+	return 4
+}
+
+// Fills buf with data packet seq, except for the send timestamp and the checksum, which are
+// set right before sending with stamp
+func (dc *dataCodec) fill(seq int64, buf []byte) {
+	if dc.version >= seqVersion {
+		copy(buf, dc.templates[uint64(seq)%numTemplates])
+		var b [seqLen]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(seq))
+		copy(buf, b[:])
+		if len(buf) >= sessionIDOffset+4 {
+			binary.LittleEndian.PutUint32(buf[sessionIDOffset:], dc.sessionID)
+		}
+		return
+	}
+	if dc.version >= templateVersion {
+		copy(buf, dc.templates[uint64(seq)%numTemplates])
+		binary.LittleEndian.PutUint32(buf, uint32(seq))
+		return
+	}
+	// The PRG counter and the offset wrap around after 4 GB
+	prgFill(dc.block, int(seq*dc.bwp.PacketSize), buf)
+	if dc.version < dataHeaderVersion {
+		binary.LittleEndian.PutUint32(buf, uint32(seq*dc.bwp.PacketSize))
+		return
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(seq))
+}
+
+// Sets the send timestamp ts of the packet in buf, and its checksum from templateVersion on
+func (dc *dataCodec) stamp(buf []byte, ts int64) {
+	if dc.version < dataHeaderVersion || len(buf) < dc.tsOffset+8 {
+		return
+	}
+	binary.LittleEndian.PutUint64(buf[dc.tsOffset:], uint64(ts))
+	if dc.version >= templateVersion && len(buf) >= dc.sumOffset+dataChecksumLen {
+		binary.LittleEndian.PutUint64(buf[dc.sumOffset:], dc.checksum(buf))
+	}
+}
+
+// Keyed checksum of the header of the packet in buf up to the checksum. The last input block is
+// padded with checksumMarker, so that it never matches a PRG counter block.
+func (dc *dataCodec) checksum(buf []byte) uint64 {
+	in := dc.sumIn
+	h := buf[:dc.sumOffset]
+	if len(h) >= aes.BlockSize {
+		dc.block.Encrypt(dc.sumOut, h[:aes.BlockSize])
+		h = h[aes.BlockSize:]
+		for i := range in {
+			in[i] = 0
+		}
+		copy(in, h)
+		in[aes.BlockSize-1] = checksumMarker
+		for i := range in {
+			in[i] ^= dc.sumOut[i]
+		}
+	} else {
+		for i := range in {
+			in[i] = 0
+		}
+		copy(in, h)
+		in[aes.BlockSize-1] = checksumMarker
+	}
+	dc.block.Encrypt(dc.sumOut, in)
+	return binary.LittleEndian.Uint64(dc.sumOut)
+}
+
+// Result of the check of a data packet
+type packetStatus int
+
+const (
+	packetCorrect   packetStatus = iota
+	packetCorrupted              // The packet has the expected size, but not the expected content
+	packetWrongSize
+	packetForeign // The packet belongs to another bwtest
+)
+
+// Checks the data packet pkt. Returns the sequence number, the send timestamp (0 if the packet
+// does not contain one) and the status of the packet. The packet is checked from the front,
+// starting with the header and the first block, and the check stops at the first mismatch.
+func (dc *dataCodec) check(pkt []byte) (int64, int64, packetStatus) {
+	bwp := dc.bwp
+	if int64(len(pkt)) != bwp.PacketSize {
+		return 0, 0, packetWrongSize
+	}
+	var seq, ts int64
+	switch {
+	case dc.version >= seqVersion:
+		var b [seqLen]byte
+		copy(b[:], pkt)
+		seq = int64(binary.LittleEndian.Uint64(b[:]))
+		if len(pkt) >= sessionIDOffset+4 && binary.LittleEndian.Uint32(pkt[sessionIDOffset:]) != dc.sessionID {
+			return seq, 0, packetForeign
+		}
+	case dc.version >= dataHeaderVersion:
+		seq = int64(binary.LittleEndian.Uint32(pkt))
+	default:
+		off := int64(binary.LittleEndian.Uint32(pkt))
+		seq = off / bwp.PacketSize
+		if off%bwp.PacketSize != 0 {
+			return seq, ts, packetCorrupted
+		}
+	}
+	if dc.version >= dataHeaderVersion && len(pkt) >= dc.tsOffset+8 {
+		ts = int64(binary.LittleEndian.Uint64(pkt[dc.tsOffset:]))
+	}
+	if seq < 0 || seq >= bwp.NumPackets {
+		return seq, ts, packetCorrupted
+	}
+	var ok bool
+	if dc.version >= templateVersion {
+		ok = dc.checkTemplate(seq, pkt)
+	} else {
+		ok = dc.checkPRG(seq, pkt, dc.headerLen(len(pkt)))
+	}
+	if !ok {
+		return seq, ts, packetCorrupted
+	}
+	return seq, ts, packetCorrect
+}
+
+// Checks the packet pkt with sequence number seq against its template
+func (dc *dataCodec) checkTemplate(seq int64, pkt []byte) bool {
+	tmpl := dc.templates[uint64(seq)%numTemplates]
+	hl := dc.headerLen(len(pkt))
+	if hl < dc.sumOffset+dataChecksumLen {
+		// Too short for a checksum
+		return bytes.Equal(pkt[hl:], tmpl[hl:])
+	}
+	if binary.LittleEndian.Uint64(pkt[dc.sumOffset:]) != dc.checksum(pkt) {
+		return false
+	}
+	payload, ref := pkt[hl:], tmpl[hl:]
+	if len(payload) <= payloadSamples*payloadSampleLen {
+		return bytes.Equal(payload, ref)
+	}
+	if !bytes.Equal(payload[:aes.BlockSize], ref[:aes.BlockSize]) {
+		return false
+	}
+	// The samples are spread over the payload, at offsets that vary with the sequence number
+	stride := len(payload) / payloadSamples
+	shift := int(seq*payloadSampleLen) % (stride - payloadSampleLen + 1)
+	for i := 0; i < payloadSamples; i++ {
+		o := i*stride + shift
+		if !bytes.Equal(payload[o:o+payloadSampleLen], ref[o:o+payloadSampleLen]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the packet pkt of a version before templateVersion with sequence number seq and header
+// length hl. Instead of regenerating the whole packet, the blocks are computed one at a time,
+// see prgFill for their content: the first block is the PRG output of the last full block, it
+// is followed by zeros and the PRG output of the final partial block.
+func (dc *dataCodec) checkPRG(seq int64, pkt []byte, hl int) bool {
+	iv := uint32(seq * dc.bwp.PacketSize)
+	full := len(pkt) / aes.BlockSize
+	if full == 0 {
+		return bytes.Equal(pkt[hl:], dc.prgBlock(iv)[hl:len(pkt)])
+	}
+	if !bytes.Equal(pkt[hl:aes.BlockSize], dc.prgBlock(iv + uint32((full-1)*aes.BlockSize))[hl:]) {
+		return false
+	}
+	end := full * aes.BlockSize
+	if !bytes.Equal(pkt[aes.BlockSize:end], dc.zeros[:end-aes.BlockSize]) {
+		return false
+	}
+	if end < len(pkt) {
+		return bytes.Equal(pkt[end:], dc.prgBlock(iv + uint32(end))[:len(pkt)-end])
+	}
+	return true
+}
+
+// Returns the PRG output for the counter i, which is only valid until the next call
+func (dc *dataCodec) prgBlock(i uint32) []byte {
+	for k := range dc.prgIn {
+		dc.prgIn[k] = 0
+	}
+	binary.LittleEndian.PutUint32(dc.prgIn, i)
+	dc.block.Encrypt(dc.prgOut, dc.prgIn)
+	return dc.prgOut
+}
+
+// Runs of corrupted bytes that are fewer than this many bytes apart are reported as one range,
+// since a corrupted byte can have the expected value by chance
+const corruptedRangeGap = 4
+
+// Returns the ranges of bytes, as offset and length, in which the corrupted packet pkt differs
+// from the data packet with its sequence number seq and timestamp ts. Since the checksum covers
+// the header, a modified sequence number or timestamp of a packet from templateVersion on shows
+// as a corrupted checksum. If seq is not a sequence number of the bwtest, the whole packet is
+// a single corrupted range.
+func (dc *dataCodec) corruptedRanges(seq int64, ts int64, pkt []byte) [][2]int64 {
+	if seq < 0 || seq >= dc.bwp.NumPackets {
+		return [][2]int64{{0, int64(len(pkt))}}
+	}
+	exp := dc.expBuf
+	copy(exp, dc.zeros)
+	dc.fill(seq, exp)
+	dc.stamp(exp, ts)
+	var ranges [][2]int64
+	start, last := -1, -1
+	for i := range pkt {
+		if pkt[i] == exp[i] {
+			continue
+		}
+		if start >= 0 && i-last > corruptedRangeGap {
+			ranges = append(ranges, [2]int64{int64(start), int64(last - start + 1)})
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+		last = i
+	}
+	if start >= 0 {
+		ranges = append(ranges, [2]int64{int64(start), int64(last - start + 1)})
+	}
+	return ranges
+}
+
+// Fills data like PrgFill with the cipher block. For compatibility with earlier versions,
+// every full block is encrypted into the first block of data, so only the first and the last
+// block of data are PRG output and the bytes in between are left untouched.
+func prgFill(block cipher.Block, iv int, data []byte) {
+	i := uint32(iv)
+	pt := make([]byte, aes.BlockSize)
+	j := 0
+	for j <= len(data)-aes.BlockSize {
+		binary.LittleEndian.PutUint32(pt, i)
+		block.Encrypt(data, pt)
+		j = j + aes.BlockSize
+		i = i + uint32(aes.BlockSize)
+	}
+	// Check if fewer than BlockSize bytes are required for the final block
+	if j < len(data) {
+		binary.LittleEndian.PutUint32(pt, i)
+		block.Encrypt(pt, pt)
+		copy(data[j:], pt[:len(data)-j])
+	}
+}
+
+const (
+	// Maximum number of packets sent or received with one call
+	maxBatch = 32
+	// Limit of the buffer memory of a batch, large packets are sent in smaller batches
+	maxBatchBytes = 1 << 20
+	// Packets that are due within this time after the first packet of a batch are sent with it
+	batchWindow = time.Microsecond * 100
+	// Waits longer than this sleep, shorter ones spin, since a sleep can overshoot by tens of
+	// microseconds or more
+	spinThreshold = time.Microsecond * 200
+)
+
+// Returns maxBatch buffers of length l, or fewer for large packets
+func batchBuffers(l int64) [][]byte {
+	n := int64(maxBatch)
+	if n*l > maxBatchBytes {
+		n = maxBatchBytes / l
+	}
+	if n < 1 {
+		n = 1
+	}
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, l)
+	}
+	return bufs
+}
+
+// Waits until t, sleeping for most of a long wait and spinning for the rest. Returns
+// ctx.Err() if ctx is done before.
+func waitUntil(ctx context.Context, t time.Time) error {
+	for {
+		d := time.Until(t)
+		if d <= 0 {
+			return ctx.Err()
+		}
+		if d > spinThreshold {
+			if err := sleepContext(ctx, d-spinThreshold); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		runtime.Gosched()
+	}
+}
+
+// Sends pkts on conn, with a single call if conn is a transport.BatchConn. Packets that cannot
+// be sent because the path to the remote host failed (see transport.IsPathError) are skipped,
+// their number is returned.
+func writeBatch(conn transport.Conn, pkts [][]byte) (int64, error) {
+	var noPath int64
+	bc, batch := conn.(transport.BatchConn)
+	for len(pkts) > 0 {
+		var n int
+		var err error
+		if batch {
+			n, err = bc.WriteBatch(pkts)
+		} else {
+			n, err = writeEach(conn, pkts)
+		}
+		if err == nil {
+			return noPath, nil
+		}
+		if !transport.IsPathError(err) {
+			return noPath, err
+		}
+		// Do not handle a failed path as fatal, log and skip
+		log.Debug("No usable path to remote", "err", common.FmtError(err))
+		noPath++
+		pkts = pkts[n+1:]
+	}
+	return noPath, nil
+}
+
+// Sends pkts one by one, returns the number of packets sent before an error
+func writeEach(conn transport.Conn, pkts [][]byte) (int, error) {
+	for i, pkt := range pkts {
+		n, err := conn.Write(pkt)
+		if err != nil {
+			return i, err
+		}
+		if n < len(pkt) {
+			return i, &ShortWriteError{n, len(pkt)}
+		}
+	}
+	return len(pkts), nil
+}
+
+// Reads at least one packet into bufs and their lengths into sizes, with a single call if conn
+// is a transport.BatchConn. Returns the number of packets read.
+func readBatch(conn transport.Conn, bufs [][]byte, sizes []int) (int, error) {
+	if bc, ok := conn.(transport.BatchConn); ok {
+		return bc.ReadBatch(bufs, sizes)
+	}
+	n, err := conn.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
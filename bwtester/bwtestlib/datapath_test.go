@@ -0,0 +1,79 @@
+package bwtestlib
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet"
+)
+
+// A packet with a sequence number outside of the bwtest, including a negative one, counts as
+// corrupted as a whole
+func TestReceiveSequenceOutOfRange(t *testing.T) {
+	defNetwork := transport.DefNetwork
+	defer func() { transport.DefNetwork = defNetwork }()
+	n := memnet.New(1)
+	defer n.Close()
+	transport.DefNetwork = n
+
+	local, _ := snet.AddrFromString("1-11,[10.0.0.1]:30001")
+	remote, _ := snet.AddrFromString("1-11,[10.0.0.2]:30001")
+	recvConn, err := transport.ListenSCION("udp4", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendConn, err := transport.DialSCION("udp4", remote, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+
+	bwp := BwtestParameters{BwtestDuration: time.Second, PacketSize: 100, NumPackets: 2, PrgKey: testPrgKey}
+	dc, err := newDataCodec(&bwp, WireVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().UnixNano()
+	for _, seq := range []int64{0, -5, 1 << 40, 1} {
+		pkt := make([]byte, bwp.PacketSize)
+		dc.fill(seq, pkt)
+		dc.stamp(pkt, ts)
+		if _, err := sendConn.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The top bit of the sequence number set by a bit flip
+	pkt := make([]byte, bwp.PacketSize)
+	dc.fill(1, pkt)
+	dc.stamp(pkt, ts)
+	pkt[seqLen-1] ^= 0x80
+	if _, err := sendConn.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	res := NewBwtestResult(bwp.PrgKey, time.Now().Add(time.Second))
+	var resLock sync.Mutex
+	var dv DataVersion
+	dv.Set(WireVersion)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	receiveDataPackets(ctx, &bwp, recvConn, res, &resLock, nil, &dv, nil)
+
+	if res.CorrectlyReceived != 2 || res.NumPacketsReceived != 5 || res.CorruptedPackets != 3 {
+		t.Errorf("Received %d packets, %d correct and %d corrupted, expected 5, 2 and 3",
+			res.NumPacketsReceived, res.CorrectlyReceived, res.CorruptedPackets)
+	}
+	whole := CorruptedRange{Offset: 0, Length: bwp.PacketSize, Count: 3}
+	if len(res.CorruptedRanges) != 1 || res.CorruptedRanges[0] != whole {
+		t.Errorf("Corrupted ranges %+v, expected %+v", res.CorruptedRanges, whole)
+	}
+	if seq := int64(binary.LittleEndian.Uint64(pkt)); seq >= 0 {
+		t.Errorf("Flipped sequence number %d is not negative", seq)
+	}
+}
@@ -0,0 +1,61 @@
+package bwtestlib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by bwtestlib instead of exiting the application, so that a server can log
+// them and continue with the next request. They can be told apart with a type switch.
+
+// DecodeError is returned if a message cannot be decoded
+type DecodeError struct {
+	What string // Name of the structure, e.g. "BwtestParameters"
+	Msg  string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode %s: %s", e.What, e.Msg)
+}
+
+// BufferError is returned if a buffer is too short to encode a message into it
+type BufferError struct {
+	What string
+	Len  int // Length of the buffer
+	Need int // Length of the encoding
+}
+
+func (e *BufferError) Error() string {
+	return fmt.Sprintf("Buffer too short to encode %s: %d bytes instead of %d", e.What, e.Len, e.Need)
+}
+
+// ShortWriteError is returned if a data packet was only partially written
+type ShortWriteError struct {
+	Written int
+	Len     int
+}
+
+func (e *ShortWriteError) Error() string {
+	return fmt.Sprintf("Insufficient number of bytes written: %d instead of %d", e.Written, e.Len)
+}
+
+// KeyError is returned for a PRG key that is not a valid AES key
+type KeyError struct {
+	Len int
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("Invalid PRG key length %d, must be 16, 24 or 32 bytes", e.Len)
+}
+
+// ErrPathNotFound is returned if there is no path to the remote host
+var ErrPathNotFound = errors.New("No paths available to remote destination")
+
+// Returns a KeyError if key is not a valid AES key
+func checkPrgKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return &KeyError{len(key)}
+}
@@ -0,0 +1,465 @@
+package bwtestlib
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Path failover of the DC, see Client.Failover
+//
+// The client switches the DC to another path when the current one fails: when sending or
+// receiving reports a failed path (no path, or an SCMP error of a router, see
+// transport.IsPathError), when the server->client direction sees sustained loss, or shortly
+// before the path expires. The new path is the one the path policy prefers among the paths that
+// have not failed yet. From FailoverVersion on, the server follows the client: when a path probe
+// or a data packet of the session arrives over a path the session has not used before, the
+// server sends its packets back along that path. After a switch, the client sends a path probe,
+// so that the server learns the new path even if the client->server direction has no packets.
+// Probes and data packets carry the session ID of the client->server direction, so stragglers
+// of an earlier bwtest on the same client DC do not change the path. The CC follows the
+// path of the DC, see followConn.
+//
+// Path probes of version 11, all integers are little endian:
+//
+//	0: uint32 feedbackMarker, which is never a valid sequence number of a data packet
+//	4: uint32 magic "BWPP"
+//	8: uint32 session ID of the client->server direction, see SessionID
+const (
+	probeLen   = 12
+	probeMagic = 0x42575050 // "BWPP"
+
+	// Version from which the server follows the path changes of the client and drops path probes
+	FailoverVersion byte = 11
+
+	// The path is switched when it expires within this time
+	failoverExpiryMargin = time.Second * 2
+	// Interval at which the path is checked
+	failoverTick = time.Millisecond * 100
+	// The loss of the server->client direction is measured over windows of this length, or of
+	// 10 packets if that is longer
+	failoverWindow = time.Millisecond * 500
+	// The path fails if the loss of this many consecutive windows exceeds failoverMaxLoss
+	failoverLossWindows = 2
+	failoverMaxLoss     = 0.5
+	// Time after the start of the direction and after a switch during which the loss is not
+	// measured, so that the packets can arrive over the new path
+	failoverGrace = time.Millisecond * 500
+)
+
+// Reasons for switching the path, see PathSegment
+const (
+	FailoverPathError = "path error"
+	FailoverLoss      = "sustained loss"
+	FailoverExpiry    = "path expiry"
+)
+
+// PathSegment is the part of a bwtest during which the DC used one path
+type PathSegment struct {
+	Path  *sciond.PathReplyEntry
+	Start time.Time
+	End   time.Time
+	// Failure of the previous path that caused the switch to this one, empty for the first path
+	Reason string
+	// Data packets the client sent along the path, and data packets it received while it used
+	// the path
+	Sent     int64
+	Received int64
+}
+
+// Returns a path probe of the session with the given ID
+func encodePathProbe(session uint32) []byte {
+	buf := make([]byte, probeLen)
+	binary.LittleEndian.PutUint32(buf[0:], feedbackMarker)
+	binary.LittleEndian.PutUint32(buf[4:], probeMagic)
+	binary.LittleEndian.PutUint32(buf[8:], session)
+	return buf
+}
+
+// IsPathProbe returns true if pkt is a path probe of any session, which the server drops after
+// it has followed the path of the probe
+func IsPathProbe(pkt []byte) bool {
+	return len(pkt) == probeLen && binary.LittleEndian.Uint32(pkt) == feedbackMarker &&
+		binary.LittleEndian.Uint32(pkt[4:]) == probeMagic
+}
+
+// IsPathChange returns true if the server follows the path of pkt, a packet from the client DC
+// of the session whose client->server direction has the given ID: if pkt is a path probe or a
+// data packet of the session
+func IsPathChange(pkt []byte, session uint32) bool {
+	if IsPathProbe(pkt) {
+		return binary.LittleEndian.Uint32(pkt[8:]) == session
+	}
+	return isDataPacket(pkt) && len(pkt) >= sessionIDOffset+4 &&
+		binary.LittleEndian.Uint32(pkt[sessionIDOffset:]) == session
+}
+
+// Returns true if pkt is a data packet, and not a feedback packet or a path probe
+func isDataPacket(pkt []byte) bool {
+	_, feedback := decodeFeedback(pkt)
+	return !feedback && !IsPathProbe(pkt)
+}
+
+// failoverConn is the DC of a client that switches its path to the server DC when the path
+// fails. It wraps a connection that is not connected to the server, so that the packets can be
+// sent along any path, and implements transport.BatchConn.
+type failoverConn struct {
+	conn   transport.Conn
+	local  addr.IA
+	policy pathpolicy.PathPolicy
+	logf   func(format string, a ...interface{})
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu       sync.Mutex
+	remote   *snet.Addr // Server DC with the current path
+	path     *sciond.PathReplyEntry
+	failed   map[string]bool // Fingerprints of the paths that failed
+	segments []PathSegment
+	received int64  // Data packets received over all paths
+	probe    []byte // Path probe of the session, nil if the server does not follow path probes
+	noPath   bool   // Set once no path is left to switch to, so that this is logged once
+}
+
+// Returns a failoverConn that sends along path to remote, which is the address of the server DC
+func newFailoverConn(conn transport.Conn, local addr.IA, remote *snet.Addr, path *sciond.PathReplyEntry,
+	policy pathpolicy.PathPolicy, logf func(format string, a ...interface{})) *failoverConn {
+
+	c := &failoverConn{
+		conn:     conn,
+		local:    local,
+		policy:   policy,
+		logf:     logf,
+		closed:   make(chan struct{}),
+		failed:   make(map[string]bool),
+		segments: []PathSegment{{Path: path, Start: time.Now()}},
+	}
+	c.setPath(remote, path)
+	return c
+}
+
+// Sets the current path, c.mu must be held unless c is new
+func (c *failoverConn) setPath(remote *snet.Addr, path *sciond.PathReplyEntry) {
+	c.remote = remote.Copy()
+	pathpolicy.SetPath(c.remote, path)
+	c.path = path
+}
+
+// Starts to monitor the path once the bwtest is accepted, with the parameters csBwp and scBwp of
+// the directions and the version of the server. Returns right away, the monitoring ends when c
+// is closed.
+func (c *failoverConn) start(version byte, csBwp, scBwp BwtestParameters) {
+	if session, err := SessionID(&csBwp); err == nil && version >= FailoverVersion {
+		c.mu.Lock()
+		c.probe = encodePathProbe(session)
+		c.mu.Unlock()
+	}
+	go c.monitor(scBwp, time.Now())
+}
+
+// Switches from the path failed to the path the policy prefers among those that have not
+// failed yet, reason is the failure. Returns false if there is no such path. If the path was
+// already switched from failed, it returns true right away.
+func (c *failoverConn) switchPath(failed *sciond.PathReplyEntry, reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if failed != c.path {
+		return true
+	}
+	if c.noPath {
+		return false
+	}
+	c.failed[pathpolicy.Fingerprint(failed)] = true
+	var next *sciond.PathReplyEntry
+	pathSet := transport.DefNetwork.PathResolver().Query(c.local, c.remote.IA)
+	for _, p := range pathpolicy.Rank(c.policy, pathSet) {
+		if !c.failed[pathpolicy.Fingerprint(p.Entry)] &&
+			time.Until(p.Entry.Path.Expiry()) > failoverExpiryMargin {
+			next = p.Entry
+			break
+		}
+	}
+	if next == nil {
+		if !c.noPath {
+			c.noPath = true
+			c.logf("Path failover: %s, but no other path is left", reason)
+		}
+		return false
+	}
+	now := time.Now()
+	c.segments[len(c.segments)-1].End = now
+	c.segments = append(c.segments, PathSegment{Path: next, Start: now, Reason: reason})
+	c.setPath(c.remote, next)
+	c.logf("Path failover: %s, switching to path %s %s", reason, pathpolicy.Fingerprint(next), next.Path.String())
+	if c.probe != nil {
+		// If the probe is lost, the server learns the path from the next data packet
+		_, _ = c.conn.WriteToSCION(c.probe, c.remote)
+	}
+	return true
+}
+
+// Checks the current path until c is closed, and switches it if it is about to expire or if
+// the server->client direction with parameters scBwp, which started at start, sees sustained
+// loss. With adaptive pacing, the rate of the direction is not known, so only windows without
+// any packets count as loss.
+func (c *failoverConn) monitor(scBwp BwtestParameters, start time.Time) {
+	ticker := time.NewTicker(failoverTick)
+	defer ticker.Stop()
+	begin := start.Add(scBwp.StartOffset + failoverGrace)
+	end := start.Add(scBwp.StartOffset + scBwp.BwtestDuration)
+	window := failoverWindow
+	// Packets expected per window, 0 if unknown
+	var expected float64
+	if scBwp.NumPackets > 0 {
+		interval := scBwp.BwtestDuration / time.Duration(scBwp.NumPackets)
+		if 10*interval > window {
+			window = 10 * interval
+		}
+		if scBwp.Pacing == PacingFixed {
+			expected = float64(window) / float64(interval)
+		}
+	}
+	var windowStart time.Time
+	var windowReceived int64
+	lossy := 0
+	for {
+		var now time.Time
+		select {
+		case <-c.closed:
+			return
+		case now = <-ticker.C:
+		}
+		c.mu.Lock()
+		path, received := c.path, c.received
+		c.mu.Unlock()
+		if time.Until(path.Path.Expiry()) < failoverExpiryMargin {
+			if c.switchPath(path, FailoverExpiry) {
+				begin, windowStart, lossy = now.Add(failoverGrace), time.Time{}, 0
+			}
+			continue
+		}
+		if scBwp.NumPackets == 0 || now.Before(begin) || now.After(end) {
+			windowStart, lossy = time.Time{}, 0
+			continue
+		}
+		if windowStart.IsZero() {
+			windowStart, windowReceived = now, received
+			continue
+		}
+		if now.Sub(windowStart) < window {
+			continue
+		}
+		loss := 1.0
+		if got := received - windowReceived; got > 0 {
+			loss = 0
+			if expected > 0 {
+				loss = 1 - float64(got)/(expected*float64(now.Sub(windowStart))/float64(window))
+			}
+		}
+		windowStart, windowReceived = now, received
+		if loss <= failoverMaxLoss {
+			lossy = 0
+			continue
+		}
+		lossy++
+		if lossy < failoverLossWindows {
+			continue
+		}
+		lossy = 0
+		if c.switchPath(path, FailoverLoss) {
+			begin, windowStart = now.Add(failoverGrace), time.Time{}
+		}
+	}
+}
+
+// Returns the paths used so far, the last one ends now
+func (c *failoverConn) pathSegments() []PathSegment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	segments := append([]PathSegment(nil), c.segments...)
+	segments[len(segments)-1].End = time.Now()
+	return segments
+}
+
+// Counts the data packets among the n packets in bufs that were received
+func (c *failoverConn) countReceived(bufs [][]byte, sizes []int, n int) {
+	var data int64
+	for k := 0; k < n; k++ {
+		if isDataPacket(bufs[k][:sizes[k]]) {
+			data++
+		}
+	}
+	c.mu.Lock()
+	c.received += data
+	c.segments[len(c.segments)-1].Received += data
+	c.mu.Unlock()
+}
+
+// Reads the next packets like readBatch. A path error, i.e., an SCMP error that a router sent
+// for the path, switches the path, and reading continues. The error is returned if there is no
+// path left to switch to.
+func (c *failoverConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	for {
+		c.mu.Lock()
+		path := c.path
+		c.mu.Unlock()
+		n, err := readBatch(c.conn, bufs, sizes)
+		if transport.IsPathError(err) && c.switchPath(path, FailoverPathError) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.countReceived(bufs, sizes, n)
+		return n, nil
+	}
+}
+
+func (c *failoverConn) Read(b []byte) (int, error) {
+	sizes := make([]int, 1)
+	_, err := c.ReadBatch([][]byte{b}, sizes)
+	return sizes[0], err
+}
+
+func (c *failoverConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, a, err := c.ReadFromSCION(b)
+	if a == nil {
+		return n, nil, err
+	}
+	return n, a, err
+}
+
+func (c *failoverConn) ReadFromSCION(b []byte) (int, *snet.Addr, error) {
+	n, err := c.Read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, c.RemoteAddr().(*snet.Addr), nil
+}
+
+// Sends the packets along the current path. If the path fails, the path is switched and the
+// remaining packets are sent along the new path. The error of a failed path is only returned
+// if there is no path left to switch to.
+func (c *failoverConn) WriteBatch(pkts [][]byte) (int, error) {
+	sent := 0
+	for sent < len(pkts) {
+		c.mu.Lock()
+		remote, path := c.remote, c.path
+		c.mu.Unlock()
+		n, err := c.writeTo(pkts[sent:], remote)
+		c.countSent(pkts[sent : sent+n])
+		sent += n
+		if err == nil {
+			break
+		}
+		if !transport.IsPathError(err) || !c.switchPath(path, FailoverPathError) {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Sends pkts to remote one by one, returns the number of packets sent before an error
+func (c *failoverConn) writeTo(pkts [][]byte, remote *snet.Addr) (int, error) {
+	for i, pkt := range pkts {
+		n, err := c.conn.WriteToSCION(pkt, remote)
+		if err != nil {
+			return i, err
+		}
+		if n < len(pkt) {
+			return i, &ShortWriteError{n, len(pkt)}
+		}
+	}
+	return len(pkts), nil
+}
+
+// Counts the data packets among pkts that were sent along the current path
+func (c *failoverConn) countSent(pkts [][]byte) {
+	var data int64
+	for _, pkt := range pkts {
+		if isDataPacket(pkt) {
+			data++
+		}
+	}
+	if data == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.segments[len(c.segments)-1].Sent += data
+	c.mu.Unlock()
+}
+
+func (c *failoverConn) Write(b []byte) (int, error) {
+	if _, err := c.WriteBatch([][]byte{b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Only sends to the server DC, along the current path
+func (c *failoverConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *failoverConn) WriteToSCION(b []byte, raddr *snet.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// followConn is the CC of a bwtest with failover. It sends along the current path of the DC, so
+// that the CC keeps working after the DC switched paths, and switches the path of the DC if it
+// fails.
+type followConn struct {
+	transport.Conn // Not connected to the server
+	dc             *failoverConn
+	remote         *snet.Addr // Server CC
+}
+
+func (c *followConn) Write(b []byte) (int, error) {
+	for {
+		c.dc.mu.Lock()
+		remote, path := c.remote.Copy(), c.dc.path
+		c.dc.mu.Unlock()
+		pathpolicy.SetPath(remote, path)
+		n, err := c.Conn.WriteToSCION(b, remote)
+		if err == nil || !transport.IsPathError(err) || !c.dc.switchPath(path, FailoverPathError) {
+			return n, err
+		}
+	}
+}
+
+// Closes the connection and ends the monitoring of the path
+func (c *failoverConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.conn.Close()
+}
+
+func (c *failoverConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Returns the address of the server DC with the current path
+func (c *failoverConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+func (c *failoverConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *failoverConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *failoverConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,49 @@
+package bwtestlib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+)
+
+// Fails every read with a path error
+type pathErrorConn struct {
+	transport.Conn
+}
+
+func (c pathErrorConn) Read(b []byte) (int, error) {
+	return 0, memnet.ErrPathFailed
+}
+
+// Without another path to switch to, ReadBatch returns the path error rather than reading again
+func TestReadBatchNoPathLeft(t *testing.T) {
+	tp := memnettest.NewTopology(30100, 0, 1000)
+	defer tp.Close()
+	client := tp.Client(memnettest.SameISD)
+	conn, err := tp.Dial(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fc := newFailoverConn(pathErrorConn{conn}, client.Addr.IA, tp.Server, client.Path, nil, t.Logf)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fc.ReadBatch([][]byte{make([]byte, 100)}, make([]int, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != memnet.ErrPathFailed {
+			t.Errorf("ReadBatch returned %v, expected %v", err, memnet.ErrPathFailed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadBatch did not return")
+	}
+	if segments := fc.pathSegments(); len(segments) != 1 {
+		t.Errorf("%d path segments, expected the path not to be switched", len(segments))
+	}
+}
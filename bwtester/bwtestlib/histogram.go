@@ -0,0 +1,214 @@
+package bwtestlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision of the histograms of a BwtestResult, the width of a bucket is at most 1/16 of the
+	// values it contains
+	DefaultSubBucketBits uint8 = 4
+	maxSubBucketBits     uint8 = 8
+	// Maximum length of an encoded histogram, histograms with more buckets are encoded with a
+	// lower precision, so that the result still fits into a single packet
+	maxHistogramLen = 400
+)
+
+// Histogram counts non-negative values, such as durations in ns, in buckets whose width grows
+// with the values, like an HDR histogram. Values below 2^SubBucketBits have a bucket of their
+// own, above that each power of two is split into 2^SubBucketBits buckets of equal width.
+type Histogram struct {
+	SubBucketBits uint8
+	Counts        []int64 // Indexed by bucket, trailing empty buckets are omitted
+	Total         int64
+}
+
+func NewHistogram(subBucketBits uint8) *Histogram {
+	if subBucketBits > maxSubBucketBits {
+		subBucketBits = maxSubBucketBits
+	}
+	return &Histogram{SubBucketBits: subBucketBits}
+}
+
+// Adds the value v, negative values are counted as 0
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := h.bucket(v)
+	if i >= len(h.Counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.Counts)
+		h.Counts = counts
+	}
+	h.Counts[i]++
+	h.Total++
+}
+
+// Returns the value below which p percent of the values lie, -1 if the histogram is empty. The
+// value is the middle of the bucket that contains it.
+func (h *Histogram) Percentile(p float64) int64 {
+	if h == nil || h.Total == 0 {
+		return -1
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.Total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var sum int64
+	for i, c := range h.Counts {
+		sum += c
+		if sum >= rank {
+			low, high := h.bucketRange(i)
+			return low + (high-low)/2
+		}
+	}
+	low, high := h.bucketRange(len(h.Counts) - 1)
+	return low + (high-low)/2
+}
+
+// Returns the index of the bucket of v
+func (h *Histogram) bucket(v int64) int {
+	s := uint(h.SubBucketBits)
+	if v < 1<<s {
+		return int(v)
+	}
+	shift := uint(bits.Len64(uint64(v))) - 1 - s
+	return int((uint64(shift)+1)<<s + uint64(v)>>shift - 1<<s)
+}
+
+// Returns the smallest value of bucket i and the smallest value of the next bucket
+func (h *Histogram) bucketRange(i int) (int64, int64) {
+	s := uint(h.SubBucketBits)
+	q, r := uint(i)>>s, int64(i)&(1<<s-1)
+	if q == 0 {
+		return r, r + 1
+	}
+	low := (1<<s + r) << (q - 1)
+	return low, low + 1<<(q-1)
+}
+
+// Returns the histogram with one sub-bucket bit less, every bucket of it contains the values
+// of two buckets of h
+func (h *Histogram) coarsen() *Histogram {
+	c := NewHistogram(h.SubBucketBits - 1)
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		low, _ := h.bucketRange(i)
+		j := c.bucket(low)
+		if j >= len(c.Counts) {
+			counts := make([]int64, j+1)
+			copy(counts, c.Counts)
+			c.Counts = counts
+		}
+		c.Counts[j] += n
+	}
+	c.Total = h.Total
+	return c
+}
+
+// Wire format of a Histogram, lengths and counts are unsigned varints as in encoding/binary:
+//
+//	0: uint8  SubBucketBits
+//	1: varint number of non-empty buckets
+//	.: for each non-empty bucket in increasing order, the difference between its index and the
+//	   index of the previous non-empty bucket (its index for the first one), and its count
+//
+// A nil histogram is encoded as an empty one. If the encoding is longer than maxHistogramLen,
+// the precision is reduced until it fits.
+func appendHistogram(buf []byte, h *Histogram) []byte {
+	if h == nil {
+		h = NewHistogram(DefaultSubBucketBits)
+	}
+	for {
+		enc := encodeHistogram(h)
+		if len(enc) <= maxHistogramLen || h.SubBucketBits == 0 {
+			return append(buf, enc...)
+		}
+		h = h.coarsen()
+	}
+}
+
+func encodeHistogram(h *Histogram) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	enc := []byte{h.SubBucketBits}
+	var n uint64
+	for _, c := range h.Counts {
+		if c > 0 {
+			n++
+		}
+	}
+	enc = append(enc, tmp[:binary.PutUvarint(tmp[:], n)]...)
+	prev := 0
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		enc = append(enc, tmp[:binary.PutUvarint(tmp[:], uint64(i-prev))]...)
+		enc = append(enc, tmp[:binary.PutUvarint(tmp[:], uint64(c))]...)
+		prev = i
+	}
+	return enc
+}
+
+// Decodes a histogram from buf, returns the histogram and the number of bytes consumed
+func decodeHistogram(buf []byte) (*Histogram, int, error) {
+	if len(buf) < 1 || buf[0] > maxSubBucketBits {
+		return nil, 0, fmt.Errorf("Invalid histogram")
+	}
+	h := NewHistogram(buf[0])
+	o := 1
+	n, l := binary.Uvarint(buf[o:])
+	if l <= 0 {
+		return nil, 0, fmt.Errorf("Invalid histogram length")
+	}
+	o += l
+	// The largest index is that of the bucket of math.MaxInt64
+	maxIndex := uint64(h.bucket(math.MaxInt64))
+	var index uint64
+	for k := uint64(0); k < n; k++ {
+		d, l1 := binary.Uvarint(buf[o:])
+		if l1 <= 0 {
+			return nil, 0, fmt.Errorf("Truncated histogram")
+		}
+		c, l2 := binary.Uvarint(buf[o+l1:])
+		if l2 <= 0 || c > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("Truncated histogram")
+		}
+		o += l1 + l2
+		if d > maxIndex-index || (k > 0 && d == 0) {
+			return nil, 0, fmt.Errorf("Invalid histogram bucket")
+		}
+		index += d
+		for uint64(len(h.Counts)) <= index {
+			h.Counts = append(h.Counts, 0)
+		}
+		h.Counts[index] = int64(c)
+		h.Total += int64(c)
+	}
+	return h, o, nil
+}
+
+// Adds the values counted by o to h. If o has a lower precision than h, h is reduced to it.
+func (h *Histogram) Merge(o *Histogram) {
+	for o.SubBucketBits < h.SubBucketBits {
+		*h = *h.coarsen()
+	}
+	for o.SubBucketBits > h.SubBucketBits {
+		o = o.coarsen()
+	}
+	if len(o.Counts) > len(h.Counts) {
+		counts := make([]int64, len(o.Counts))
+		copy(counts, h.Counts)
+		h.Counts = counts
+	}
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	h.Total += o.Total
+}
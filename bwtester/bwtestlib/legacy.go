@@ -0,0 +1,77 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Compatibility with clients that use the gob encoding of BwtestParameters and BwtestResult,
+// which predates WireVersion 1. Legacy clients send the encoded parameters right after the
+// message type. A gob stream starts with the length of the type definition of
+// BwtestParameters, which is always larger than this limit, so the version byte of the
+// current format can be told apart from it.
+const versionByteLimit byte = 0x0f
+
+// Legacy clients always use a 16-byte PRG key, which they send right after the message type
+// of 'R' requests
+const legacyPrgKeyLen = 16
+
+// Returns the version of the 'N' request in buf, or LegacyVersion if the request was sent by a
+// legacy client
+func RequestVersion(buf []byte) byte {
+	if len(buf) < 2 || buf[1] == LegacyVersion || buf[1] > versionByteLimit {
+		return LegacyVersion
+	}
+	return buf[1]
+}
+
+// Returns the version of the 'R' request in buf, or LegacyVersion if the request was sent by a
+// legacy client
+func ResultRequestVersion(buf []byte) byte {
+	if len(buf) < 2 || len(buf) == 1+legacyPrgKeyLen {
+		return LegacyVersion
+	}
+	return buf[1]
+}
+
+// Returns the version used to answer a client, the highest version supported by both sides
+func NegotiateVersion(clientVersion byte) byte {
+	if clientVersion < WireVersion {
+		return clientVersion
+	}
+	return WireVersion
+}
+
+// Decode gob encoded BwtestParameters sent by a legacy client, returns BwtestParameters structure and number of bytes consumed
+func DecodeBwtestParametersLegacy(buf []byte) (*BwtestParameters, int, error) {
+	bb := bytes.NewBuffer(buf)
+	is := bb.Len()
+	dec := gob.NewDecoder(bb)
+	var v BwtestParameters
+	if err := dec.Decode(&v); err != nil {
+		return nil, 0, &DecodeError{"BwtestParameters", err.Error()}
+	}
+	if err := checkPrgKey(v.PrgKey); err != nil {
+		return nil, 0, err
+	}
+	clampBwtestParameters(&v)
+	return &v, is - bb.Len(), nil
+}
+
+// Encode BwtestResult for a legacy client into a sufficiently large byte buffer that is passed in, return the number of bytes written
+func EncodeBwtestResultLegacy(res *BwtestResult, buf []byte) (int, error) {
+	var bb bytes.Buffer
+	enc := gob.NewEncoder(&bb)
+	// Legacy clients do not know the histograms and the corrupted ranges, which may not fit
+	// into the response
+	v := *res
+	v.IPAHist, v.OWDHist = nil, nil
+	v.CorruptedRanges = nil
+	if err := enc.Encode(v); err != nil {
+		return 0, err
+	}
+	if len(buf) < bb.Len() {
+		return 0, &BufferError{"BwtestResult", len(buf), bb.Len()}
+	}
+	return copy(buf, bb.Bytes()), nil
+}
@@ -0,0 +1,150 @@
+package bwtestlib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the gob encoding of v, as sent by legacy clients and servers
+func gobEncode(t *testing.T, v interface{}) []byte {
+	var bb bytes.Buffer
+	if err := gob.NewEncoder(&bb).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return bb.Bytes()
+}
+
+func TestRequestVersion(t *testing.T) {
+	bwp := BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, 0, 0}
+	legacy := append([]byte{'N'}, gobEncode(t, bwp)...)
+	tests := []struct {
+		name string
+		req  []byte
+		want byte
+	}{
+		{"gob encoded parameters", legacy, LegacyVersion},
+		{"message type only", []byte{'N'}, LegacyVersion},
+		{"version 0", []byte{'N', 0, 0}, LegacyVersion},
+		{"version 1", []byte{'N', 1, 0}, 1},
+		{"current version", []byte{'N', WireVersion, 0}, WireVersion},
+		{"highest version", []byte{'N', versionByteLimit, 0}, versionByteLimit},
+		{"above the version limit", []byte{'N', versionByteLimit + 1, 0}, LegacyVersion},
+	}
+	for _, tc := range tests {
+		if got := RequestVersion(tc.req); got != tc.want {
+			t.Errorf("%s: version %d, expected %d", tc.name, got, tc.want)
+		}
+	}
+	if legacy[1] <= versionByteLimit {
+		t.Errorf("Gob encoding starts with %d, which is a valid version", legacy[1])
+	}
+}
+
+func TestResultRequestVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		want byte
+	}{
+		{"legacy", append([]byte{'R'}, testPrgKey...), LegacyVersion},
+		{"message type only", []byte{'R'}, LegacyVersion},
+		{"version 1", append([]byte{'R', 1}, testPrgKey...), 1},
+		{"current version", append([]byte{'R', WireVersion}, testPrgKey...), WireVersion},
+	}
+	for _, tc := range tests {
+		if got := ResultRequestVersion(tc.req); got != tc.want {
+			t.Errorf("%s: version %d, expected %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		client, want byte
+	}{
+		{LegacyVersion, LegacyVersion},
+		{1, 1},
+		{WireVersion - 1, WireVersion - 1},
+		{WireVersion, WireVersion},
+		{WireVersion + 1, WireVersion},
+		{versionByteLimit, WireVersion},
+	}
+	for _, tc := range tests {
+		if got := NegotiateVersion(tc.client); got != tc.want {
+			t.Errorf("Client version %d: negotiated %d, expected %d", tc.client, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeBwtestParametersLegacy(t *testing.T) {
+	bwp := BwtestParameters{3 * time.Second, 1000, 30, testPrgKey, 40002, 0, 0}
+	enc := gobEncode(t, bwp)
+	// Legacy clients send both directions in the same request
+	both := append(append([]byte(nil), enc...), gobEncode(t, bwp)...)
+	got, n, err := DecodeBwtestParametersLegacy(both)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(enc) || !reflect.DeepEqual(*got, bwp) {
+		t.Errorf("Decoded %+v from %d bytes, expected %+v from %d bytes", *got, n, bwp, len(enc))
+	}
+
+	clamped, _, err := DecodeBwtestParametersLegacy(gobEncode(t,
+		BwtestParameters{time.Hour, 1, -1, testPrgKey, 80, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BwtestParameters{MaxDuration, MinPacketSize, 0, testPrgKey, MinPort, 0, 0}
+	if !reflect.DeepEqual(*clamped, want) {
+		t.Errorf("Decoded %+v, expected %+v", *clamped, want)
+	}
+
+	tests := []struct {
+		name  string
+		buf   []byte
+		check func(error) bool
+	}{
+		{"no bytes", nil, isDecodeError},
+		{"truncated", enc[:len(enc)-1], isDecodeError},
+		{"garbage", []byte{'x', 'y', 'z'}, isDecodeError},
+		{"invalid key", gobEncode(t, BwtestParameters{PrgKey: []byte{1, 2, 3}}), isKeyError},
+	}
+	for _, tc := range tests {
+		if _, _, err := DecodeBwtestParametersLegacy(tc.buf); !tc.check(err) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestEncodeBwtestResultLegacy(t *testing.T) {
+	res := testResult()
+	buf := make([]byte, 2000)
+	n, err := EncodeBwtestResultLegacy(&res, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got BwtestResult
+	if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// The fields legacy clients do not know are left out
+	want := res
+	want.IPAHist, want.OWDHist, want.CorruptedRanges = nil, nil, nil
+	if !got.ExpectedFinishTime.Equal(want.ExpectedFinishTime) {
+		t.Errorf("Decoded expected finish time %v, expected %v", got.ExpectedFinishTime,
+			want.ExpectedFinishTime)
+	}
+	got.ExpectedFinishTime = want.ExpectedFinishTime
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decoded %+v, expected %+v", got, want)
+	}
+	if res.IPAHist == nil || res.CorruptedRanges == nil {
+		t.Error("Encoding modified the result")
+	}
+	if _, err := EncodeBwtestResultLegacy(&res, buf[:n-1]); !isBufferError(err) {
+		t.Errorf("Unexpected error %v for a short buffer", err)
+	}
+}
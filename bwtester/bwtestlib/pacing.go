@@ -0,0 +1,556 @@
+package bwtestlib
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+// Pacing modes of the sender, see BwtestParameters.Pacing. With adaptive pacing, the receiver
+// periodically sends feedback packets on the DC, and the sender adjusts its rate to the loss
+// and receive rate they report. The rate given by the parameters is the maximum rate, and the
+// sender stops after BwtestDuration even if it has not sent all packets.
+const (
+	PacingFixed byte = 0 // Packets are sent at the fixed interval given by the parameters
+	PacingAIMD  byte = 1 // Additive increase and multiplicative decrease, like TCP Reno
+	PacingBBR   byte = 2 // The rate follows the estimated bottleneck bandwidth, like BBR
+
+	// Version in which adaptive pacing was introduced
+	pacingVersion byte = 5
+)
+
+// Returns the name of a pacing mode
+func PacingString(pacing byte) string {
+	switch pacing {
+	case PacingFixed:
+		return "fixed"
+	case PacingAIMD:
+		return "aimd"
+	case PacingBBR:
+		return "bbr"
+	default:
+		return fmt.Sprintf("unknown (%d)", pacing)
+	}
+}
+
+// Returns the pacing mode with the given name
+func ParsePacing(s string) (byte, error) {
+	for _, p := range []byte{PacingFixed, PacingAIMD, PacingBBR} {
+		if s == PacingString(p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown pacing mode %q, must be fixed, aimd or bbr", s)
+}
+
+// Feedback packets of version 5, all integers are little endian:
+//
+//	 0: uint32 feedbackMarker, which is never a valid sequence number of a data packet
+//	 4: uint32 feedbackMagic
+//	 8: uint32 number of the report, which lets the sender ignore reordered reports
+//	12: int64  time of the report in ns since epoch, on the receiver's clock
+//	20: int64  highest sequence number received, -1 if none
+//	28: int64  number of distinct packets correctly received
+//	36: int64  send timestamp of the most recently received packet, 0 if none
+//	44: int64  time in ns between the arrival of that packet and the report
+const (
+	feedbackLen    = 52
+	feedbackMarker = 0xffffffff
+	feedbackMagic  = 0x42574642 // "BWFB"
+
+	// Interval between the feedback packets of the receiver
+	feedbackInterval = time.Millisecond * 20
+	// The sender reduces its rate if it receives no feedback for this long, or for 3 RTTs
+	minFeedbackTimeout = time.Millisecond * 500
+
+	// Congestion windows of the adaptive senders in packets
+	initialWindow = 10
+	minWindow     = 2
+	// Minimum rate of the adaptive senders in packets per second
+	minPacingRate = 10
+	// RTT assumed until the first measurement
+	defaultPacingRTT = time.Millisecond * 100
+)
+
+type feedbackReport struct {
+	num        uint32
+	time       int64
+	highestSeq int64
+	received   int64
+	echoTs     int64
+	echoDelay  int64
+}
+
+func encodeFeedback(r *feedbackReport, buf []byte) int {
+	binary.LittleEndian.PutUint32(buf[0:], feedbackMarker)
+	binary.LittleEndian.PutUint32(buf[4:], feedbackMagic)
+	binary.LittleEndian.PutUint32(buf[8:], r.num)
+	binary.LittleEndian.PutUint64(buf[12:], uint64(r.time))
+	binary.LittleEndian.PutUint64(buf[20:], uint64(r.highestSeq))
+	binary.LittleEndian.PutUint64(buf[28:], uint64(r.received))
+	binary.LittleEndian.PutUint64(buf[36:], uint64(r.echoTs))
+	binary.LittleEndian.PutUint64(buf[44:], uint64(r.echoDelay))
+	return feedbackLen
+}
+
+// Returns the report in pkt, or false if pkt is not a feedback packet
+func decodeFeedback(pkt []byte) (feedbackReport, bool) {
+	if len(pkt) != feedbackLen || binary.LittleEndian.Uint32(pkt) != feedbackMarker ||
+		binary.LittleEndian.Uint32(pkt[4:]) != feedbackMagic {
+		return feedbackReport{}, false
+	}
+	return feedbackReport{
+		num:        binary.LittleEndian.Uint32(pkt[8:]),
+		time:       int64(binary.LittleEndian.Uint64(pkt[12:])),
+		highestSeq: int64(binary.LittleEndian.Uint64(pkt[20:])),
+		received:   int64(binary.LittleEndian.Uint64(pkt[28:])),
+		echoTs:     int64(binary.LittleEndian.Uint64(pkt[36:])),
+		echoDelay:  int64(binary.LittleEndian.Uint64(pkt[44:])),
+	}, true
+}
+
+// Feedback connects the sending and the receive function on the same DC: the receive function
+// reads the feedback packets that the remote receiver sends for the local sender, and passes them
+// on. A nil Feedback drops the feedback packets.
+type Feedback struct {
+	reports chan feedbackReport
+}
+
+func NewFeedback() *Feedback {
+	return &Feedback{reports: make(chan feedbackReport, 64)}
+}
+
+func (fb *Feedback) deliver(r feedbackReport) {
+	if fb == nil {
+		return
+	}
+	select {
+	case fb.reports <- r:
+	default:
+		// The sender only needs the latest reports, which are cumulative
+	}
+}
+
+// Returns the channel of the reports, which is nil (and blocks forever) for a nil Feedback
+func (fb *Feedback) channel() <-chan feedbackReport {
+	if fb == nil {
+		return nil
+	}
+	return fb.reports
+}
+
+// Reads packets from udpConnection until it is closed or the deadline passes, and passes the
+// feedback packets on to fb
+func readFeedback(udpConnection transport.Conn, fb *Feedback, deadline time.Time) {
+	_ = udpConnection.SetReadDeadline(deadline)
+	buf := make([]byte, feedbackLen+1)
+	for time.Now().Before(deadline) {
+		n, err := udpConnection.Read(buf)
+		if err != nil {
+			return
+		}
+		if r, ok := decodeFeedback(buf[:n]); ok {
+			fb.deliver(r)
+		}
+	}
+}
+
+// feedbackWriter sends the feedback packets of the receive function
+type feedbackWriter struct {
+	conn        transport.Conn
+	buf         []byte
+	report      feedbackReport
+	last        time.Time
+	lastArrival int64
+}
+
+func newFeedbackWriter(conn transport.Conn) *feedbackWriter {
+	return &feedbackWriter{conn: conn, buf: make([]byte, feedbackLen), report: feedbackReport{highestSeq: -1}}
+}
+
+// Records a correctly received packet
+func (fw *feedbackWriter) add(seq, sendTs, arrival int64) {
+	if seq > fw.report.highestSeq {
+		fw.report.highestSeq = seq
+	}
+	fw.report.received++
+	if sendTs != 0 {
+		fw.report.echoTs = sendTs
+		fw.lastArrival = arrival
+	}
+}
+
+// Sends a report if the last one was sent at least feedbackInterval ago
+func (fw *feedbackWriter) maybeSend(now time.Time) {
+	if now.Sub(fw.last) < feedbackInterval {
+		return
+	}
+	fw.last = now
+	fw.report.num++
+	fw.report.time = now.UnixNano()
+	fw.report.echoDelay = 0
+	if fw.report.echoTs != 0 {
+		fw.report.echoDelay = now.UnixNano() - fw.lastArrival
+	}
+	l := encodeFeedback(&fw.report, fw.buf)
+	// Lost feedback is made up for by the next report
+	_, _ = fw.conn.Write(fw.buf[:l])
+}
+
+// pacingSample is the information the sender derives from a feedback report
+type pacingSample struct {
+	now          time.Time
+	delivered    int64         // Packets received since the previous report
+	lost         int64         // Packets lost since the previous report
+	deliveryRate float64       // Received packets per second, 0 if unknown
+	rtt          time.Duration // 0 if unknown
+}
+
+// rateController determines the sending rate of adaptive pacing
+type rateController interface {
+	// Updates the rate with the feedback of the receiver
+	update(s pacingSample)
+	// Reduces the rate when the feedback stops
+	timeout()
+	// Current rate in packets per second
+	rate() float64
+	// Maximum number of packets in flight
+	window() float64
+	// Smoothed round-trip time, or the default before the first measurement
+	rtt() time.Duration
+}
+
+func newRateController(pacing byte, maxRate float64) rateController {
+	if pacing == PacingBBR {
+		return newBBRController(maxRate)
+	}
+	return newAIMDController(maxRate)
+}
+
+// Sends the data packets of bwp at the rate determined by the feedback of the receiver
+func sendDataPacketsAdaptive(ctx context.Context, bwp *BwtestParameters, udpConnection transport.Conn, version byte, fb *Feedback) error {
+	dc, err := newDataCodec(bwp, version)
+	if err != nil {
+		return err
+	}
+	sb := make([]byte, bwp.PacketSize)
+	pkts := [][]byte{sb}
+	t0 := time.Now()
+	finish := t0.Add(bwp.BwtestDuration)
+	maxRate := float64(bwp.NumPackets) / bwp.BwtestDuration.Seconds()
+	rc := newRateController(bwp.Pacing, maxRate)
+	// Time at which the next packet is due
+	next := t0
+	lastFeedback := t0
+	var last feedbackReport
+	last.highestSeq = -1
+	// Packets after the highest acknowledged sequence number are in flight
+	acked := int64(-1)
+	handle := func(r feedbackReport, now time.Time) {
+		if r.num > last.num {
+			rc.update(feedbackSample(&last, &r, now))
+			last = r
+			lastFeedback = now
+			if r.highestSeq > acked {
+				acked = r.highestSeq
+			}
+		}
+	}
+	var i, noPath int64
+	for i < bwp.NumPackets {
+		now := time.Now()
+		if !now.Before(finish) {
+			break
+		}
+		for done := false; !done; {
+			select {
+			case r := <-fb.channel():
+				handle(r, now)
+			default:
+				done = true
+			}
+		}
+		if timeout := 3 * rc.rtt(); now.Sub(lastFeedback) > timeout && now.Sub(lastFeedback) > minFeedbackTimeout {
+			// The packets in flight are considered lost
+			rc.timeout()
+			lastFeedback = now
+			acked = i - 1
+		}
+		if float64(i-1-acked) >= rc.window() {
+			// The window is full, wait for feedback
+			t := time.NewTimer(feedbackInterval)
+			select {
+			case r := <-fb.channel():
+				handle(r, time.Now())
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+			t.Stop()
+			next = time.Now()
+			continue
+		}
+		if now.Before(next) {
+			// Wake up at least once per feedback interval to process the feedback
+			d := next.Sub(now)
+			if d > feedbackInterval {
+				d = feedbackInterval
+			}
+			if err := waitUntil(ctx, now.Add(d)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dc.fill(i, sb)
+		dc.stamp(sb, time.Now().UnixNano())
+		np, err := writeBatch(udpConnection, pkts)
+		if err != nil {
+			return err
+		}
+		noPath += np
+		i++
+		next = next.Add(time.Duration(float64(time.Second) / rc.rate()))
+		// Do not catch up on more than a feedback interval when the sender fell behind
+		if next.Before(now.Add(-feedbackInterval)) {
+			next = now.Add(-feedbackInterval)
+		}
+	}
+	log.Debug("Adaptive sending done", "pacing", PacingString(bwp.Pacing), "packets", i,
+		"rate", rc.rate(), "rtt", rc.rtt())
+	if noPath > 0 && noPath == i {
+		return ErrPathNotFound
+	}
+	return nil
+}
+
+// Returns the sample of report r, which follows report prev
+func feedbackSample(prev, r *feedbackReport, now time.Time) pacingSample {
+	s := pacingSample{now: now}
+	s.delivered = r.received - prev.received
+	// Packets up to the highest sequence number that did not arrive are counted as lost,
+	// reordered packets that arrive later make up for it
+	if sent := r.highestSeq - prev.highestSeq; sent > s.delivered {
+		s.lost = sent - s.delivered
+	}
+	if prev.num > 0 && r.time > prev.time {
+		s.deliveryRate = float64(s.delivered) / time.Duration(r.time-prev.time).Seconds()
+	}
+	if r.echoTs != 0 {
+		if rtt := time.Duration(now.UnixNano() - r.echoTs - r.echoDelay); rtt > 0 {
+			s.rtt = rtt
+		}
+	}
+	return s
+}
+
+func clampRate(r, maxRate float64) float64 {
+	return math.Max(math.Min(r, maxRate), math.Min(minPacingRate, maxRate))
+}
+
+// aimdController emulates the congestion window of TCP Reno: the window grows by one packet
+// per delivered packet in slow start, and by one packet per window in congestion avoidance. It
+// is halved at most once per RTT when packets are lost. The packets are paced at twice the
+// window per RTT in slow start and 1.2 times in congestion avoidance.
+type aimdController struct {
+	maxRate      float64
+	cwnd         float64
+	ssthresh     float64
+	srtt         time.Duration
+	lastDecrease time.Time
+}
+
+func newAIMDController(maxRate float64) *aimdController {
+	return &aimdController{
+		maxRate:  maxRate,
+		cwnd:     initialWindow,
+		ssthresh: math.Inf(1),
+	}
+}
+
+func (c *aimdController) update(s pacingSample) {
+	if s.rtt > 0 {
+		if c.srtt == 0 {
+			c.srtt = s.rtt
+		} else {
+			c.srtt = (7*c.srtt + s.rtt) / 8
+		}
+	}
+	if s.lost > 0 {
+		if s.now.Sub(c.lastDecrease) > c.rtt() {
+			c.cwnd = math.Max(c.cwnd/2, minWindow)
+			c.ssthresh = c.cwnd
+			c.lastDecrease = s.now
+		}
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(s.delivered)
+	} else {
+		c.cwnd += float64(s.delivered) / c.cwnd
+	}
+	// The window does not grow beyond what the maximum rate can fill
+	c.cwnd = math.Min(c.cwnd, math.Max(2*c.maxRate*c.rtt().Seconds(), initialWindow))
+}
+
+func (c *aimdController) timeout() {
+	c.ssthresh = math.Max(c.cwnd/2, minWindow)
+	c.cwnd = minWindow
+}
+
+func (c *aimdController) rate() float64 {
+	gain := 1.2
+	if c.cwnd < c.ssthresh {
+		gain = 2
+	}
+	return clampRate(gain*c.cwnd/c.rtt().Seconds(), c.maxRate)
+}
+
+func (c *aimdController) window() float64 {
+	return c.cwnd
+}
+
+func (c *aimdController) rtt() time.Duration {
+	if c.srtt == 0 {
+		return defaultPacingRTT
+	}
+	return c.srtt
+}
+
+// States of the BBR-like controller
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+)
+
+var (
+	bbrStartupGain = 2 / math.Ln2
+	// Gains of the phases of the ProbeBW state, each phase lasts one round trip
+	bbrProbeGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+)
+
+type rateSample struct {
+	t    time.Time
+	rate float64
+}
+
+// bbrController sends at a multiple of the bottleneck bandwidth, which is estimated as the
+// maximum delivery rate over the last 10 round trips. In the startup state, the rate grows by
+// the startup gain every round trip until the bandwidth estimate stops growing. The drain state
+// then empties the queue built up during startup, and the ProbeBW state cycles through gains
+// that probe for more bandwidth and drain the queue again. The packets in flight are limited to
+// twice the estimated bandwidth-delay product.
+type bbrController struct {
+	maxRate     float64
+	r           float64
+	btlBw       float64
+	samples     []rateSample
+	minRTT      time.Duration
+	state       int
+	roundStart  time.Time
+	fullBw      float64
+	fullBwCount int
+	cycle       int
+}
+
+func newBBRController(maxRate float64) *bbrController {
+	return &bbrController{
+		maxRate: maxRate,
+		r:       clampRate(bbrStartupGain*initialWindow/defaultPacingRTT.Seconds(), maxRate),
+	}
+}
+
+func (c *bbrController) update(s pacingSample) {
+	if s.rtt > 0 && (c.minRTT == 0 || s.rtt < c.minRTT) {
+		c.minRTT = s.rtt
+	}
+	rtt := c.rtt()
+	if s.deliveryRate > 0 {
+		c.samples = append(c.samples, rateSample{s.now, s.deliveryRate})
+	}
+	// Windowed maximum of the delivery rate
+	c.btlBw = 0
+	samples := c.samples[:0]
+	for _, rs := range c.samples {
+		if s.now.Sub(rs.t) <= 10*rtt {
+			samples = append(samples, rs)
+			c.btlBw = math.Max(c.btlBw, rs.rate)
+		}
+	}
+	c.samples = samples
+	if c.btlBw == 0 {
+		return
+	}
+	if c.roundStart.IsZero() {
+		c.roundStart = s.now
+	}
+	newRound := s.now.Sub(c.roundStart) >= rtt
+	if newRound {
+		c.roundStart = s.now
+	}
+	gain := 1.0
+	switch c.state {
+	case bbrStartup:
+		gain = bbrStartupGain
+		if newRound {
+			if c.btlBw >= c.fullBw*1.25 {
+				c.fullBw = c.btlBw
+				c.fullBwCount = 0
+			} else if c.fullBwCount++; c.fullBwCount >= 3 {
+				c.state = bbrDrain
+				gain = 1 / bbrStartupGain
+			}
+		}
+	case bbrDrain:
+		gain = 1 / bbrStartupGain
+		if newRound {
+			c.state = bbrProbeBW
+			c.cycle = 0
+			gain = bbrProbeGains[0]
+		}
+	case bbrProbeBW:
+		if newRound {
+			c.cycle = (c.cycle + 1) % len(bbrProbeGains)
+		}
+		gain = bbrProbeGains[c.cycle]
+	}
+	c.r = clampRate(gain*c.btlBw, c.maxRate)
+}
+
+func (c *bbrController) timeout() {
+	c.samples = nil
+	c.btlBw = 0
+	c.r = clampRate(c.r/2, c.maxRate)
+}
+
+func (c *bbrController) rate() float64 {
+	return c.r
+}
+
+func (c *bbrController) window() float64 {
+	if c.btlBw == 0 {
+		return initialWindow
+	}
+	gain := 2.0
+	if c.state == bbrStartup {
+		gain = bbrStartupGain
+	}
+	return math.Max(gain*c.btlBw*c.rtt().Seconds(), 2*minWindow)
+}
+
+func (c *bbrController) rtt() time.Duration {
+	if c.minRTT == 0 {
+		return defaultPacingRTT
+	}
+	return c.minRTT
+}
@@ -0,0 +1,272 @@
+package bwtestlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// Maximum number of CorruptedRanges of a BwtestResult
+	MaxCorruptedRanges = 16
+	// Maximum number of distinct corrupted ranges the receiver counts, further ranges are only
+	// counted if they were seen before
+	maxTrackedRanges = 1024
+)
+
+// DataVersion is the version of the data packets of a bwtest. The client only learns it from
+// the server's response, which may arrive after the first data packets, so the receive
+// function keeps those packets until the version is set. From version 10 on, the response also
+// contains the parameters the server applies to the received direction, which replace the
+// requested ones once the version is set.
+type DataVersion struct {
+	mu      sync.Mutex
+	version byte
+	known   bool
+	params  *BwtestParameters // nil if the requested parameters apply
+}
+
+func (dv *DataVersion) Set(version byte) {
+	dv.SetEffective(version, nil)
+}
+
+// Sets the version along with the effective parameters of the received direction, nil if the
+// requested parameters apply
+func (dv *DataVersion) SetEffective(version byte, bwp *BwtestParameters) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	dv.version = version
+	dv.known = true
+	dv.params = nil
+	if bwp != nil {
+		p := *bwp
+		dv.params = &p
+	}
+}
+
+func (dv *DataVersion) Get() (byte, bool) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	return dv.version, dv.known
+}
+
+// Returns the version, the effective parameters or nil, and whether the version is known
+func (dv *DataVersion) get() (byte, *BwtestParameters, bool) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	return dv.version, dv.params, dv.known
+}
+
+// receiveStats computes the delay, jitter, loss and reordering statistics of the correctly
+// received packets of a bwtest, and counts the packets that were not received correctly
+type receiveStats struct {
+	numPackets int64
+	received   []uint64 // Bit set of the received sequence numbers
+	highestSeq int64
+	reordered  int64
+	duplicates int64
+	corrupted  int64
+	wrongSize  int64
+	ranges     map[[2]int64]int64 // Number of corrupted packets per range of offset and length
+
+	// One-way delays are only relative, since the clocks of sender and receiver are not synchronized
+	owdCount int64
+	owdMin   int64
+	owdMax   int64
+	owdSum   float64
+	owds     []int64 // Kept for the histogram, which is relative to the smallest one-way delay
+
+	// Interarrival jitter as in RFC 3550, section 6.4.1
+	jitter      float64
+	prevTransit int64
+	hasPrev     bool
+}
+
+func newReceiveStats(numPackets int64) *receiveStats {
+	return &receiveStats{
+		numPackets: numPackets,
+		received:   make([]uint64, (numPackets+63)/64),
+		highestSeq: -1,
+		ranges:     make(map[[2]int64]int64),
+	}
+}
+
+// Counts a packet with the expected size whose content differed from the expected one in the
+// given ranges
+func (s *receiveStats) addCorrupted(ranges [][2]int64) {
+	s.corrupted++
+	for _, r := range ranges {
+		if _, ok := s.ranges[r]; ok || len(s.ranges) < maxTrackedRanges {
+			s.ranges[r]++
+		}
+	}
+}
+
+// Counts a packet of the wrong size
+func (s *receiveStats) addWrongSize() {
+	s.wrongSize++
+}
+
+// Adds a correctly received packet with sequence number seq, which was sent at sendTs (0 if
+// unknown) and received at arrival. Returns false if the packet is a duplicate.
+func (s *receiveStats) add(seq int64, sendTs int64, arrival int64) bool {
+	word, bit := seq/64, uint64(1)<<uint(seq%64)
+	if s.received[word]&bit != 0 {
+		s.duplicates++
+		return false
+	}
+	s.received[word] |= bit
+	if seq < s.highestSeq {
+		s.reordered++
+	} else {
+		s.highestSeq = seq
+	}
+	if sendTs == 0 {
+		return true
+	}
+	owd := arrival - sendTs
+	if s.owdCount == 0 || owd < s.owdMin {
+		s.owdMin = owd
+	}
+	if s.owdCount == 0 || owd > s.owdMax {
+		s.owdMax = owd
+	}
+	s.owdCount++
+	s.owdSum += float64(owd)
+	s.owds = append(s.owds, owd)
+	// The transit time is the one-way delay, the jitter is the smoothed difference between
+	// the transit times of successive packets
+	if s.hasPrev {
+		d := math.Abs(float64(owd - s.prevTransit))
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.prevTransit = owd
+	s.hasPrev = true
+	return true
+}
+
+// Writes the statistics into res. With adaptive pacing, the sender stops after the duration of
+// the bwtest even if it has not sent all packets, so only the packets up to the highest
+// sequence number received are taken into account for the losses.
+func (s *receiveStats) finish(res *BwtestResult, adaptive bool) {
+	res.Reordered = s.reordered
+	res.Duplicates = s.duplicates
+	res.CorruptedPackets = s.corrupted
+	res.WrongSizePackets = s.wrongSize
+	res.CorruptedRanges = topCorruptedRanges(s.ranges)
+	res.LossBursts = 0
+	res.MaxLossBurst = 0
+	res.NumPacketsSent = -1
+	numPackets := s.numPackets
+	if adaptive {
+		numPackets = s.highestSeq + 1
+		res.NumPacketsSent = numPackets
+	}
+	var burst int64
+	for seq := int64(0); seq < numPackets; seq++ {
+		if s.received[seq/64]&(uint64(1)<<uint(seq%64)) == 0 {
+			if burst == 0 {
+				res.LossBursts++
+			}
+			burst++
+			if burst > res.MaxLossBurst {
+				res.MaxLossBurst = burst
+			}
+		} else {
+			burst = 0
+		}
+	}
+	if s.owdCount == 0 {
+		res.OWDmin, res.OWDavg, res.OWDmax, res.Jitter = -1, -1, -1, -1
+		return
+	}
+	res.OWDmin = s.owdMin
+	res.OWDavg = int64(s.owdSum / float64(s.owdCount))
+	res.OWDmax = s.owdMax
+	res.Jitter = int64(s.jitter)
+	res.OWDHist = NewHistogram(DefaultSubBucketBits)
+	for _, owd := range s.owds {
+		res.OWDHist.Record(owd - s.owdMin)
+	}
+}
+
+// Returns the MaxCorruptedRanges ranges with the highest counts, ordered by count and offset
+func topCorruptedRanges(counts map[[2]int64]int64) []CorruptedRange {
+	if len(counts) == 0 {
+		return nil
+	}
+	ranges := make([]CorruptedRange, 0, len(counts))
+	for r, c := range counts {
+		ranges = append(ranges, CorruptedRange{r[0], r[1], c})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].Count != ranges[j].Count {
+			return ranges[i].Count > ranges[j].Count
+		}
+		if ranges[i].Offset != ranges[j].Offset {
+			return ranges[i].Offset < ranges[j].Offset
+		}
+		return ranges[i].Length < ranges[j].Length
+	})
+	if len(ranges) > MaxCorruptedRanges {
+		ranges = ranges[:MaxCorruptedRanges]
+	}
+	return ranges
+}
+
+// MergeCorruptedRanges returns the ranges of a and b, with the counts of equal ranges added up,
+// limited to the MaxCorruptedRanges ranges with the highest counts
+func MergeCorruptedRanges(a, b []CorruptedRange) []CorruptedRange {
+	counts := make(map[[2]int64]int64)
+	for _, ranges := range [][]CorruptedRange{a, b} {
+		for _, r := range ranges {
+			counts[[2]int64{r.Offset, r.Length}] += r.Count
+		}
+	}
+	return topCorruptedRanges(counts)
+}
+
+// Appends the encoding of the corrupted ranges to buf: the number of ranges and the offset,
+// length and count of each range, all as unsigned varints. At most MaxCorruptedRanges ranges
+// are encoded.
+func appendCorruptedRanges(buf []byte, ranges []CorruptedRange) []byte {
+	if len(ranges) > MaxCorruptedRanges {
+		ranges = ranges[:MaxCorruptedRanges]
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(ranges)))]...)
+	for _, r := range ranges {
+		for _, v := range []int64{r.Offset, r.Length, r.Count} {
+			buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(v))]...)
+		}
+	}
+	return buf
+}
+
+// Decodes the corrupted ranges encoded by appendCorruptedRanges, an empty buffer contains no
+// ranges
+func decodeCorruptedRanges(buf []byte) ([]CorruptedRange, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	n, o := binary.Uvarint(buf)
+	if o <= 0 || n > MaxCorruptedRanges {
+		return nil, fmt.Errorf("Invalid number of corrupted ranges")
+	}
+	var ranges []CorruptedRange
+	for k := uint64(0); k < n; k++ {
+		var v [3]int64
+		for i := range v {
+			x, l := binary.Uvarint(buf[o:])
+			if l <= 0 || x > math.MaxInt64 {
+				return nil, fmt.Errorf("Truncated corrupted ranges")
+			}
+			v[i] = int64(x)
+			o += l
+		}
+		ranges = append(ranges, CorruptedRange{v[0], v[1], v[2]})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// accessControl decides which clients may run bwtests. If pre-shared keys or an allowlist are
+// configured, a request must either be authenticated with one of the keys or come from an
+// allowed ISD-AS. Admitted bwtests are subject to the rate limits of the client's ISD-AS, and
+// their parameters to the limits of the policy.
+type accessControl struct {
+	mu        sync.RWMutex      // Protects keys, allowlist and policy, which are replaced on reload
+	keys      map[string][]byte // Indexed by key name, nil if there are no pre-shared keys
+	allowlist []string          // ISD-AS patterns, nil if there is no allowlist
+	policy    *testPolicy       // nil if there is no policy
+	limits    *rateLimiter
+	replays   *ReplayCache // Authenticated requests, nil if replays are not detected
+}
+
+// Returns 0 if the 'N' request in buf from ia is allowed, otherwise the reason for rejecting
+// it. The authentication of the request starts at buf[l:].
+func (ac *accessControl) authorize(ia addr.IA, buf []byte, l int, t time.Time) byte {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	if ac.keys == nil && ac.allowlist == nil {
+		return 0
+	}
+	if ac.keys != nil {
+		auth, err := VerifyAuth(buf, l, ac.keys, t, ac.replays)
+		if err != nil {
+			log.Debug("Authentication failed", "ia", ia, "err", err)
+			return RejectAuthFailed
+		}
+		if auth == AuthPSK {
+			return 0
+		}
+	}
+	if ac.allowlist != nil && iaAllowed(ac.allowlist, ia) {
+		return 0
+	}
+	if ac.keys != nil {
+		return RejectAuthRequired
+	}
+	return RejectNotAllowed
+}
+
+// Reduces the parameters of a bwtest of a client in ia to the limits of the policy, or to
+// DefaultMaxPackets without a policy, returns true if they were changed
+func (ac *accessControl) applyPolicy(ia addr.IA, clientBwp, serverBwp *BwtestParameters) bool {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	if ac.policy == nil {
+		l := testLimits{MaxPackets: DefaultMaxPackets}
+		return l.apply(clientBwp)
+	}
+	l := ac.policy.limits(ia)
+	cs := l.apply(clientBwp)
+	sc := l.apply(serverBwp)
+	return cs || sc
+}
+
+// Loads the pre-shared keys, the allowlist and the policy from the given files, an empty file
+// name disables the respective check. On error, the previous configuration stays in place.
+func (ac *accessControl) load(pskFile, allowFile, policyFile string) error {
+	var keys map[string][]byte
+	if len(pskFile) > 0 {
+		psks, err := LoadPSKFile(pskFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load pre-shared keys: %v", err)
+		}
+		keys = make(map[string][]byte)
+		for _, k := range psks {
+			keys[k.Name] = k.Key
+		}
+	}
+	var allowlist []string
+	if len(allowFile) > 0 {
+		var err error
+		allowlist, err = loadAllowlist(allowFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load ISD-AS allowlist: %v", err)
+		}
+	}
+	var policy *testPolicy
+	if len(policyFile) > 0 {
+		var err error
+		policy, err = loadPolicy(policyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load policy: %v", err)
+		}
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.keys = keys
+	ac.allowlist = allowlist
+	ac.policy = policy
+	return nil
+}
+
+// Loads the ISD-AS allowlist from a file with one pattern per line. A pattern is an ISD-AS
+// (17-ffaa:0:1102), an ISD (17 or 17-*), an AS prefix ending at a colon (17-ffaa:0:*), or *
+// for all ISD-ASes. Empty lines and lines starting with '#' are ignored.
+func loadAllowlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	allowlist := []string{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pattern, err := parseIAPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		allowlist = append(allowlist, pattern)
+	}
+	return allowlist, scanner.Err()
+}
+
+// Returns the pattern in canonical form: "*", an ISD-AS, or a prefix ending with '-' or ':'
+// followed by '*'
+func parseIAPattern(s string) (string, error) {
+	if s == "*" {
+		return s, nil
+	}
+	if !strings.Contains(s, "-") {
+		s += "-*"
+	}
+	if strings.HasSuffix(s, "*") {
+		prefix := s[:len(s)-1]
+		if !strings.HasSuffix(prefix, "-") && !strings.HasSuffix(prefix, ":") {
+			return "", fmt.Errorf("Invalid ISD-AS prefix %q, must end with '-' or ':'", s)
+		}
+		isd := prefix[:strings.Index(prefix, "-")]
+		if _, err := strconv.ParseUint(isd, 10, 16); err != nil {
+			return "", fmt.Errorf("Invalid ISD in %q", s)
+		}
+		return s, nil
+	}
+	ia, err := addr.IAFromString(s)
+	if err != nil {
+		return "", fmt.Errorf("Invalid ISD-AS %q: %v", s, err)
+	}
+	return ia.String(), nil
+}
+
+func iaAllowed(allowlist []string, ia addr.IA) bool {
+	s := ia.String()
+	for _, pattern := range allowlist {
+		if iaMatches(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the ISD-AS string ia matches the pattern, see parseIAPattern
+func iaMatches(pattern, ia string) bool {
+	if pattern == "*" || pattern == ia {
+		return true
+	}
+	return strings.HasSuffix(pattern, "*") && strings.HasPrefix(ia, pattern[:len(pattern)-1])
+}
+
+// rateLimiter limits the number of bwtest requests and the number of bytes sent by the server
+// per ISD-AS within a sliding window. All requests count, also the ones that are rejected or
+// told to try again later, so that a client cannot keep the server busy with requests.
+type rateLimiter struct {
+	mu          sync.Mutex
+	window      time.Duration
+	maxRequests int                    // 0 means unlimited
+	maxBytes    int64                  // 0 means unlimited
+	requests    map[string][]rateEvent // Indexed by ISD-AS, ordered by time, without bytes
+	history     map[string][]rateEvent // Admitted bwtests indexed by ISD-AS, ordered by time
+}
+
+type rateEvent struct {
+	t     time.Time
+	bytes int64
+}
+
+func newRateLimiter(window time.Duration, maxRequests int, maxBytes int64) *rateLimiter {
+	return &rateLimiter{
+		window:      window,
+		maxRequests: maxRequests,
+		maxBytes:    maxBytes,
+		requests:    make(map[string][]rateEvent),
+		history:     make(map[string][]rateEvent),
+	}
+}
+
+// Records a bwtest request from ia, before it is checked
+func (rl *rateLimiter) request(ia string, t time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.requests[ia] = append(currentEvents(rl.requests, ia, t, rl.window), rateEvent{t: t})
+}
+
+// Returns 0 if a bwtest in which the server sends the given number of bytes to ia is within
+// the limits, otherwise the reason for rejecting it and when the limits allow it again (0 if
+// never). The request for the bwtest is expected to be recorded already.
+func (rl *rateLimiter) check(ia string, bytes int64, t time.Time) (byte, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// The earlier requests, without the one being checked
+	requests := currentEvents(rl.requests, ia, t, rl.window)
+	if len(requests) > 0 {
+		requests = requests[:len(requests)-1]
+	}
+	if rl.maxRequests > 0 && len(requests) >= rl.maxRequests {
+		return RejectRequestRate, requests[len(requests)-rl.maxRequests].t.Add(rl.window).Sub(t)
+	}
+	events := currentEvents(rl.history, ia, t, rl.window)
+	if rl.maxBytes > 0 {
+		if bytes > rl.maxBytes {
+			return RejectByteRate, 0
+		}
+		var sum int64
+		for _, e := range events {
+			sum += e.bytes
+		}
+		// Wait until enough of the earlier bwtests leave the window
+		for i := 0; sum+bytes > rl.maxBytes; i++ {
+			sum -= events[i].bytes
+			if sum+bytes <= rl.maxBytes {
+				return RejectByteRate, events[i].t.Add(rl.window).Sub(t)
+			}
+		}
+	}
+	return 0, 0
+}
+
+// Records a bwtest in which the server sends the given number of bytes to ia
+func (rl *rateLimiter) record(ia string, bytes int64, t time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.history[ia] = append(currentEvents(rl.history, ia, t, rl.window), rateEvent{t, bytes})
+}
+
+// Deletes the events that are outside of the window
+func (rl *rateLimiter) purge(t time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, m := range []map[string][]rateEvent{rl.requests, rl.history} {
+		for ia := range m {
+			if len(currentEvents(m, ia, t, rl.window)) == 0 {
+				delete(m, ia)
+			}
+		}
+	}
+}
+
+// Returns the events of ia in m within the window, removing older ones
+func currentEvents(m map[string][]rateEvent, ia string, t time.Time, window time.Duration) []rateEvent {
+	events := m[ia]
+	i := 0
+	for i < len(events) && !events[i].t.After(t.Add(-window)) {
+		i++
+	}
+	events = events[i:]
+	m[ia] = events
+	return events
+}
@@ -11,13 +11,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/kormat/fmt15"
 
 	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -28,25 +28,34 @@ func printUsage() {
 	fmt.Println("Example SCION address 17-ffaa:0:1102,[192.33.93.173]:42002")
 }
 
+func Check(e error) {
+	if e != nil {
+		LogFatal("Fatal error. Exiting.", "err", e)
+	}
+}
+
+func LogFatal(msg string, a ...interface{}) {
+	log.Crit(msg, a...)
+	os.Exit(1)
+}
+
 var (
-	resultsMap     map[string]*BwtestResult
-	resultsMapLock sync.Mutex
-	currentBwtest  string // Contains connection parameters, in case server's ack packet was lost
+	sessions *sessionTable
+	dcConns  *dcMux // Data connections of the sessions, which share the server's DC sockets
+	access   *accessControl
+	metrics  *serverMetrics
+	store    *resultStore // nil if the results are not persisted
 )
 
-// Deletes the old entries in resultsMap
+// Deletes the old sessions and their results, the expired rate limit records and the MACs of
+// requests that can no longer be replayed
 func purgeOldResults() {
 	for {
 		time.Sleep(time.Minute * time.Duration(5))
-		resultsMapLock.Lock()
-		// Erase entries that are older than 1 minute
-		t := time.Now().Add(-time.Minute)
-		for k, v := range resultsMap {
-			if v.ExpectedFinishTime.Before(t) {
-				delete(resultsMap, k)
-			}
-		}
-		resultsMapLock.Unlock()
+		sessions.purge(time.Now())
+		access.limits.purge(time.Now())
+		access.replays.Purge(time.Now())
+		store.purge(time.Now())
 	}
 }
 
@@ -54,16 +63,17 @@ var (
 	serverCCAddrStr string
 	serverCCAddr    *snet.Addr
 	err             error
-	CCConn          *snet.Conn
+	CCConn          transport.Conn
 	sciondPath      *string
 	sciondFromIA    *bool
 	dispatcherPath  *string
+	pskFile         *string
+	allowFile       *string
+	policyFile      *string
+	shutdownTimeout *time.Duration
 )
 
 func main() {
-	resultsMap = make(map[string]*BwtestResult)
-	go purgeOldResults()
-
 	// Fetch arguments from command line
 	flag.StringVar(&serverCCAddrStr, "s", "", "Server SCION Address")
 	id := flag.String("id", "bwtester", "Element ID")
@@ -72,8 +82,50 @@ func main() {
 	sciondFromIA = flag.Bool("sciondFromIA", false, "SCIOND socket path from IA address:ISD-AS")
 	dispatcherPath = flag.String("dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
+	maxSessions := flag.Int("max_sessions", DefaultMaxSessions, "Maximum number of concurrent bwtests")
+	maxBandwidth := flag.Float64("max_bandwidth", 0,
+		"Aggregate bandwidth budget of the concurrent bwtests in Mbps, 0 for unlimited")
+	pskFile = flag.String("psk_file", "", "File with pre-shared keys, clients need to authenticate with one of them")
+	allowFile = flag.String("allow_file", "", "File with the ISD-ASes that may run bwtests without authentication")
+	policyFile = flag.String("policy_file", "", "JSON file with the limits of the bwtest parameters, per ISD-AS")
+	rateWindow := flag.Duration("rate_window", time.Minute, "Time window of the rate limits")
+	rateRequests := flag.Int("rate_requests", 0, "Maximum number of bwtest requests per ISD-AS and rate window, 0 for unlimited")
+	rateBytes := flag.Int64("rate_bytes", 0, "Maximum number of bytes sent per ISD-AS and rate window, 0 for unlimited")
+	metricsAddr := flag.String("metrics", "", "Address of the HTTP listener for the Prometheus metrics, e.g. :9100")
+	shutdownTimeout = flag.Duration("shutdown_timeout", DefaultShutdownTimeout,
+		"Maximum time to wait for running bwtests on SIGINT or SIGTERM")
+	resultsFile := flag.String("results_file", "", "File to which a record of each bwtest is appended")
+	resultsRetention := flag.Duration("results_retention", DefaultResultsRetention,
+		"Time for which clients can fetch results from the results file, also after a restart")
+	query := flag.Bool("query", false, "List the bwtests in the results file and exit")
+	querySince := flag.Duration("query_since", time.Hour*24, "Only list the bwtests that finished within this time")
+	queryIA := flag.String("query_ia", "*", "Only list the bwtests of clients in ISD-ASes matching this pattern")
+	queryJSON := flag.Bool("query_json", false, "List the records of the bwtests as JSON, one per line")
 	flag.Parse()
 
+	if *query {
+		if len(*resultsFile) == 0 {
+			LogFatal("Error, the results file needs to be specified with -results_file")
+		}
+		Check(runQuery(*resultsFile, time.Now().Add(-*querySince), *queryIA, *queryJSON))
+		os.Exit(0)
+	}
+
+	sessions = newSessionTable(*maxSessions, int64(*maxBandwidth*1e6))
+	dcConns = newDCMux()
+	access = &accessControl{limits: newRateLimiter(*rateWindow, *rateRequests, *rateBytes),
+		replays: NewReplayCache()}
+	metrics = newServerMetrics()
+	if err := access.load(*pskFile, *allowFile, *policyFile); err != nil {
+		LogFatal("Unable to load access configuration", "err", err)
+	}
+	if len(*resultsFile) > 0 {
+		if store, err = openResultStore(*resultsFile, *resultsRetention); err != nil {
+			LogFatal("Unable to open results file", "err", err)
+		}
+	}
+	go purgeOldResults()
+
 	// Setup logging
 	if _, err := os.Stat(*logDir); os.IsNotExist(err) {
 		os.Mkdir(*logDir, 0744)
@@ -86,12 +138,19 @@ func main() {
 				fmt15.Fmt15Format(nil)))))
 	log.Debug("Setup info:", "id", *id)
 
+	if len(*metricsAddr) > 0 {
+		if err := serveMetrics(*metricsAddr); err != nil {
+			LogFatal("Unable to start metrics listener", "err", err)
+		}
+	}
+
 	if len(serverCCAddrStr) > 0 {
-		runServer(serverCCAddrStr)
+		status := runServer(serverCCAddrStr)
 		if err != nil {
 			printUsage()
 			LogFatal("Unable to start server", "err", err)
 		}
+		os.Exit(status)
 	} else {
 		printUsage()
 		LogFatal("Error, server address needs to be specified with -s")
@@ -99,7 +158,8 @@ func main() {
 
 }
 
-func runServer(serverCCAddrStr string) {
+// Runs the server until it is stopped by a signal, returns the exit status
+func runServer(serverCCAddrStr string) int {
 	// Create the SCION UDP socket
 	serverCCAddr, err = snet.AddrFromString(serverCCAddrStr)
 	if err != nil {
@@ -116,7 +176,8 @@ func runServer(serverCCAddrStr string) {
 		*sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
 	log.Info("Starting server")
-	snet.Init(serverCCAddr.IA, *sciondPath, *dispatcherPath)
+	err = transport.Init(serverCCAddr.IA, *sciondPath, *dispatcherPath)
+	Check(err)
 
 	ci := strings.LastIndex(serverCCAddrStr, ":")
 	if ci < 0 {
@@ -125,21 +186,55 @@ func runServer(serverCCAddrStr string) {
 	}
 	serverISDASIP := serverCCAddrStr[:ci]
 
-	CCConn, err = snet.ListenSCION("udp4", serverCCAddr)
+	CCConn, err = transport.ListenSCION("udp4", serverCCAddr)
 	Check(err)
 
+	status := make(chan int, 1)
+	go handleSignals(CCConn, *shutdownTimeout, *pskFile, *allowFile, *policyFile, status)
+
 	receivePacketBuffer := make([]byte, 2500)
 	sendPacketBuffer := make([]byte, 2500)
 	handleClients(CCConn, serverISDASIP, receivePacketBuffer, sendPacketBuffer)
+
+	s := <-status
+	if err := store.close(); err != nil {
+		log.Error("Unable to close results file", "err", err)
+	}
+	if s == 0 {
+		fmt.Println("Server stopped, all bwtests finished")
+	} else {
+		fmt.Println("Server stopped, bwtests were interrupted")
+	}
+	log.Info("Server stopped", "status", s)
+	return s
 }
 
-func handleClients(CCConn *snet.Conn, serverISDASIP string, receivePacketBuffer []byte, sendPacketBuffer []byte) {
-	defer LogPanicAndRestart(handleClients, CCConn, serverISDASIP, receivePacketBuffer, sendPacketBuffer)
+// Sends the response to an accepted 'N' request, which contains the effective parameters
+func sendAcceptResponse(CCConn transport.Conn, clientCCAddr *snet.Addr, buf []byte, version byte,
+	clientBwp, serverBwp *BwtestParameters) {
+
+	l, err := EncodeAcceptResponse(buf, version, clientBwp, serverBwp)
+	if err != nil {
+		// This should never happen, the parameters were decoded from the request
+		log.Error("Unable to encode response", "client", clientCCAddr, "err", err)
+		return
+	}
+	_, _ = CCConn.WriteTo(buf[:l], clientCCAddr)
+	// Ignore error
+}
 
+// Handles the requests of all clients, errors of a request are logged and only affect that
+// request or session. Returns when the CC is closed on shutdown.
+func handleClients(CCConn transport.Conn, serverISDASIP string, receivePacketBuffer []byte, sendPacketBuffer []byte) {
 	for {
 		// Handle client requests
 		n, clientCCAddr, err := CCConn.ReadFromSCION(receivePacketBuffer)
 		if err != nil {
+			select {
+			case <-ccClosed:
+				return
+			default:
+			}
 			// Todo: check error in detail, but for now simply continue
 			continue
 		}
@@ -148,97 +243,127 @@ func handleClients(CCConn *snet.Conn, serverISDASIP string, receivePacketBuffer
 		}
 
 		t := time.Now()
-		// Check if a current test is ongoing, and if it completed
-		if len(currentBwtest) > 0 {
-			v, ok := resultsMap[currentBwtest]
-			if !ok {
-				// This can only happen if client aborted and never picked up results
-				// then information got removed by purgeOldResults goroutine
-				currentBwtest = ""
-			} else if t.After(v.ExpectedFinishTime) {
-				// The bwtest should be finished by now, check if results are written
-				if v.NumPacketsReceived >= 0 {
-					// Indeed, the bwtest has completed
-					currentBwtest = ""
-				}
-			}
-		}
 		clientCCAddrStr := clientCCAddr.String()
 		fmt.Println("Received request:", clientCCAddrStr)
 
 		if receivePacketBuffer[0] == 'N' {
 			// New bwtest request
-			if len(currentBwtest) != 0 {
-				fmt.Println("A bwtest is already ongoing")
-				if clientCCAddrStr == currentBwtest {
-					// The request is from the same client for which the current test is already ongoing
-					// If the response packet was dropped, then the client would send another request
-					// We simply send another response packet, indicating success
-					fmt.Println("error, clientCCAddrStr == currentBwtest")
-					sendPacketBuffer[0] = 'N'
-					sendPacketBuffer[1] = byte(0)
-					_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-					// Ignore error
-					continue
-				}
-
-				// The request is from a different client
-				// A bwtest is currently ongoing, so send back remaining duration
-				resultsMapLock.Lock()
-				v, ok := resultsMap[currentBwtest]
-				if !ok {
-					// This should never happen
-					resultsMapLock.Unlock()
-					continue
-				}
-				resultsMapLock.Unlock()
-
-				// Compute for how much longer the current test is running
-				remTime := t.Sub(v.ExpectedFinishTime)
-				sendPacketBuffer[0] = 'N'
-				sendPacketBuffer[1] = byte(remTime/time.Second) + 1
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-				// Ignore error
-				continue
+			metrics.request(clientCCAddr.IA.I)
+			version := NegotiateVersion(RequestVersion(receivePacketBuffer[:n]))
+			// Legacy clients send the gob encoded parameters right after the message type
+			decodeBwtestParameters := DecodeBwtestParameters
+			hl := 2
+			if version == LegacyVersion {
+				decodeBwtestParameters = DecodeBwtestParametersLegacy
+				hl = 1
 			}
-
-			// This is a new request
-			clientBwp, n1, err := DecodeBwtestParameters(receivePacketBuffer[1:])
+			clientBwp, n1, err := decodeBwtestParameters(receivePacketBuffer[hl:n])
 			if err != nil {
 				fmt.Println("Decoding error")
+				metrics.decodeError()
+				log.Debug("Invalid request", "client", clientCCAddrStr, "err", err)
 				// Decoding error, continue
 				continue
 			}
-			serverBwp, n2, err := DecodeBwtestParameters(receivePacketBuffer[n1+1:])
+			serverBwp, n2, err := decodeBwtestParameters(receivePacketBuffer[hl+n1 : n])
 			if err != nil {
 				fmt.Println("Decoding error")
+				metrics.decodeError()
+				log.Debug("Invalid request", "client", clientCCAddrStr, "err", err)
 				// Decoding error, continue
 				continue
 			}
-			if n != 1+n1+n2 {
+			// Starting with version 2, the parameters can be followed by the authentication
+			if n < hl+n1+n2 || (version < 2 && n != hl+n1+n2) {
 				fmt.Println("Error, packet size incorrect")
+				metrics.decodeError()
 				// Do not send a response packet for malformed request
 				continue
 			}
-
-			ci := strings.LastIndex(clientCCAddrStr, ":")
-			if ci < 0 {
-				// This should never happen
-				LogFatal("Malformed client address")
+			// Every request counts towards the request rate of the client's ISD-AS, whether it is
+			// admitted or not
+			access.limits.request(clientCCAddr.IA.String(), t)
+			if reason := access.authorize(clientCCAddr.IA, receivePacketBuffer[:n], hl+n1+n2, t); reason != 0 {
+				fmt.Println("Rejected request:", RejectReasonString(reason))
+				metrics.reject(reason)
+				l := EncodeRejectResponse(sendPacketBuffer, version, reason, 0)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
+				// Ignore error
+				continue
+			}
+			// The client learns the reduced parameters from the response
+			reduced := access.applyPolicy(clientCCAddr.IA, clientBwp, serverBwp)
+			if reduced {
+				log.Debug("Reduced the parameters to the policy", "client", clientCCAddrStr,
+					"cs_duration", clientBwp.BwtestDuration, "cs_size", clientBwp.PacketSize,
+					"cs_packets", clientBwp.NumPackets, "sc_duration", serverBwp.BwtestDuration,
+					"sc_size", serverBwp.PacketSize, "sc_packets", serverBwp.NumPackets)
 			}
-			clientISDASIP := clientCCAddrStr[:ci]
 
-			// Address of client Data Connection (DC)
-			ca := clientISDASIP + ":" + strconv.Itoa(int(clientBwp.Port))
-			clientDCAddr, err := snet.AddrFromString(ca)
-			if err != nil {
-				LogFatal("Cannot convert string to address", err)
+			// Nothing needs to be added to account for network delay, since sending starts right
+			// away. The receiver will close the DC connection, so it waits until the sender is
+			// also done.
+			// We use the lock of the session table also for the bres variable
+			bres := NewBwtestResult(clientBwp.PrgKey, ExpectedFinishTime(t, serverBwp, clientBwp, 0))
+			// The random PRG key of the client->server direction identifies the session, the
+			// client sends it again when it fetches the results
+			s := &session{
+				id:        string(clientBwp.PrgKey),
+				ia:        clientCCAddr.IA.String(),
+				bandwidth: sessionBandwidth(clientBwp, serverBwp),
+				result:    bres,
+				// Without packets from the client, there is no result for it to fetch
+				fetched:   clientBwp.NumPackets == 0,
+				client:    clientCCAddrStr,
+				start:     t,
+				version:   version,
+				reduced:   reduced,
+				clientBwp: *clientBwp,
+				serverBwp: *serverBwp,
+			}
+			if _, known := sessions.result(s.id); known {
+				// The request is from a client whose bwtest is already ongoing
+				// If the response packet was dropped, then the client would send another request
+				// We simply send another response packet, indicating success
+				sendAcceptResponse(CCConn, clientCCAddr, sendPacketBuffer, version, clientBwp, serverBwp)
+				continue
+			}
+			if isStopping() {
+				// Running sessions may still finish, but no new ones are started
+				fmt.Println("Rejected request:", RejectReasonString(RejectShutdown))
+				metrics.reject(RejectShutdown)
+				l := EncodeRejectResponse(sendPacketBuffer, version, RejectShutdown, 0)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
+				// Ignore error
+				continue
+			}
+			// Number of bytes the server sends, which counts towards the rate limit of the client's ISD-AS
+			sendBytes := serverBwp.PacketSize * serverBwp.NumPackets
+			if reason, retryAfter := access.limits.check(s.ia, sendBytes, t); reason != 0 {
+				fmt.Println("Rejected request:", RejectReasonString(reason))
+				metrics.reject(reason)
+				l := EncodeRejectResponse(sendPacketBuffer, version, reason, retryAfter)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
+				// Ignore error
+				continue
+			}
+			admitted, wait := sessions.admit(s, t)
+			if !admitted {
+				// The server is busy, send back how long to wait until the next request
+				fmt.Println("Server busy, client has to wait", wait)
+				metrics.deferTest(deferBusy)
+				l := EncodeResponseHeader(sendPacketBuffer, 'N', DurationToWaitSeconds(wait), version)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
+				// Ignore error
+				continue
 			}
 
-			// Address of server Data Connection (DC)
-			serverDCAddr, err := snet.AddrFromString(serverISDASIP + ":" + strconv.Itoa(int(serverBwp.Port)))
+			clientDCAddr, serverDCAddr, err := dcAddrs(clientCCAddrStr, clientBwp.Port, serverISDASIP, serverBwp.Port)
 			if err != nil {
-				LogFatal("Cannot convert string to address", err)
+				// This should never happen, the client's address was parsed when it was received
+				log.Error("Unable to determine the DC addresses", "client", clientCCAddrStr, "err", err)
+				sessions.cancel(s.id)
+				continue
 			}
 
 			// Set path on data connection as reverse of client path (received address is already Reversed)
@@ -247,80 +372,121 @@ func handleClients(CCConn *snet.Conn, serverISDASIP string, receivePacketBuffer
 			clientDCAddr.NextHopPort = clientCCAddr.NextHopPort
 			log.Debug("Server DC", "Next Hop", clientDCAddr.NextHopHost, "Client Host", clientDCAddr.Host, "Client Port", clientDCAddr.L4Port)
 
-			// Open Data Connection
-			DCConn, err := snet.DialSCION("udp4", serverDCAddr, clientDCAddr)
+			// From FailoverVersion on, the DC follows the path changes of the client
+			var isPathChange func(pkt []byte) bool
+			if session, err := SessionID(clientBwp); err == nil && version >= FailoverVersion {
+				isPathChange = func(pkt []byte) bool { return IsPathChange(pkt, session) }
+			}
+
+			// Open Data Connection, the session is running until the receive function closes it
+			id := s.id
+			DCConn, err := dcConns.Dial(serverDCAddr, clientDCAddr, isPathChange, func() {
+				sessions.finish(id)
+				metrics.complete()
+				if res, ok := sessions.result(id); ok {
+					store.add(s, res, time.Now())
+				}
+			})
 			if err != nil {
-				// An error happened, ask the client to try again in 1 second (perhaps no path to client was found)
-				sendPacketBuffer[0] = 'N'
-				sendPacketBuffer[1] = byte(1)
-				n, err = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+				// An error happened, ask the client to try again in 1 second (perhaps no path to client
+				// was found, or the client DC is still used by a previous session)
+				log.Debug("Unable to open server DC", "err", err)
+				sessions.cancel(s.id)
+				metrics.deferTest(deferDCUnavailable)
+				l := EncodeResponseHeader(sendPacketBuffer, 'N', 1, version)
+				n, err = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
 				// Ignore error
 				continue
 			}
 
-			// Nothing needs to be added to account for network delay, since sending starts right away
-			expFinishTimeSend := t.Add(serverBwp.BwtestDuration + GracePeriodSend)
-			expFinishTimeReceive := t.Add(clientBwp.BwtestDuration + StragglerWaitPeriod)
-			// We use resultsMapLock also for the bres variable
-			bres := BwtestResult{-1, -1, -1, -1, -1, -1, clientBwp.PrgKey, expFinishTimeReceive}
-			if expFinishTimeReceive.Before(expFinishTimeSend) {
-				// The receiver will close the DC connection, so it will wait long enough until the
-				// sender is also done
-				bres.ExpectedFinishTime = expFinishTimeSend
+			access.limits.record(s.ia, sendBytes, t)
+			metrics.start()
+			if reduced {
+				metrics.reduce()
 			}
-			resultsMapLock.Lock()
-			resultsMap[clientCCAddrStr] = &bres
-			resultsMapLock.Unlock()
 
-			// go HandleDCConnReceive(clientBwp, DCConn, resChan)
-			go HandleDCConnReceive(clientBwp, DCConn, &bres, &resultsMapLock, nil)
-			go HandleDCConnSend(serverBwp, DCConn)
+			// The server knows the version of the data packets right away
+			dataVersion := &DataVersion{}
+			dataVersion.Set(version)
+			// The receive function passes the client's feedback on to the sender
+			fb := NewFeedback()
+			go HandleDCConnReceive(clientBwp, DCConn, bres, &sessions.mu, nil, dataVersion, fb)
+			go func() {
+				// The session ends when the receive function closes the DC
+				if err := HandleDCConnSend(serverBwp, DCConn, version, fb); err != nil {
+					log.Error("Unable to send data packets", "client", clientCCAddrStr, "err", err)
+				}
+			}()
 
 			// Send back success
-			sendPacketBuffer[0] = 'N'
-			sendPacketBuffer[1] = byte(0)
-			n, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-			// Ignore error
-			// Everything succeeded, now set variable that bwtest is ongoing
-			currentBwtest = clientCCAddrStr
+			sendAcceptResponse(CCConn, clientCCAddr, sendPacketBuffer, version, clientBwp, serverBwp)
 		} else if receivePacketBuffer[0] == 'R' {
 			// This is a request for the results
-			sendPacketBuffer[0] = 'R'
-			// Make sure that the client is known and that the results are ready
-			v, ok := resultsMap[clientCCAddrStr]
+			// Legacy clients send the PRG key right after the message type
+			version := NegotiateVersion(ResultRequestVersion(receivePacketBuffer[:n]))
+			hl := 2
+			if version == LegacyVersion {
+				hl = 1
+			}
+			// Make sure that the session is known, it is identified by the PRG key
+			v, ok := sessions.result(string(receivePacketBuffer[hl:n]))
 			if !ok {
-				// There are no results for this client, return an error
-				sendPacketBuffer[1] = byte(127)
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
-				continue
+				// The session may have been purged, or run before a restart of the server
+				v, ok = store.result(receivePacketBuffer[hl:n])
 			}
-			// Make sure the PRG key is correct
-			if n != 1+len(v.PrgKey) || !bytes.Equal(v.PrgKey, receivePacketBuffer[1:1+len(v.PrgKey)]) {
-				// Error, the sent PRG is incorrect
-				sendPacketBuffer[1] = byte(127)
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:2], clientCCAddr)
+			if !ok || !bytes.Equal(v.PrgKey, receivePacketBuffer[hl:n]) {
+				// There are no results for this client, return an error
+				metrics.fetch(fetchUnknown)
+				l := EncodeResponseHeader(sendPacketBuffer, 'R', 127, version)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
 				continue
 			}
-			// Note: it would be better to have the resultsMap key consist only of the PRG key,
-			// so that a repeated bwtest from the same client with the same port gets a
-			// different resultsMap entry. However, in practice, a client would not run concurrent
-			// bwtests, as long as the results are fetched before a new bwtest is initiated, this
-			// code will work fine.
 			if v.NumPacketsReceived == -1 {
 				// The results are not yet ready
-				if t.After(v.ExpectedFinishTime) {
-					// The results should be ready, but are not yet written into the data
-					// structure, so let's let client wait for 1 second
-					sendPacketBuffer[1] = byte(1)
-				} else {
-					sendPacketBuffer[1] = byte(v.ExpectedFinishTime.Sub(t)/time.Second) + 1
+				metrics.fetch(fetchNotReady)
+				waitSeconds := byte(1)
+				if !t.After(v.ExpectedFinishTime) {
+					waitSeconds = byte(v.ExpectedFinishTime.Sub(t)/time.Second) + 1
 				}
-				_, _ = CCConn.WriteTo(sendPacketBuffer[:n], clientCCAddr)
+				// If the results should be ready, but are not yet written into the data
+				// structure, let the client wait for 1 second
+				l := EncodeResponseHeader(sendPacketBuffer, 'R', waitSeconds, version)
+				_, _ = CCConn.WriteTo(sendPacketBuffer[:l], clientCCAddr)
+				continue
+			}
+			l := EncodeResponseHeader(sendPacketBuffer, 'R', 0, version)
+			if version == LegacyVersion {
+				n, err = EncodeBwtestResultLegacy(&v, sendPacketBuffer[l:])
+			} else {
+				n, err = EncodeBwtestResult(&v, sendPacketBuffer[l:])
+			}
+			if err != nil {
+				log.Error("Unable to encode result", "client", clientCCAddrStr, "err", err)
 				continue
 			}
-			sendPacketBuffer[1] = byte(0)
-			n = EncodeBwtestResult(v, sendPacketBuffer[2:])
-			_, _ = CCConn.WriteTo(sendPacketBuffer[:n+2], clientCCAddr)
+			if _, err = CCConn.WriteTo(sendPacketBuffer[:l+n], clientCCAddr); err == nil {
+				sessions.fetched(string(v.PrgKey))
+				metrics.fetch(fetchOK)
+			}
 		}
 	}
 }
+
+// Returns the addresses of the client DC, with the ISD-AS and IP address of the client CC and
+// clientPort, and of the server DC
+func dcAddrs(clientCCAddrStr string, clientPort uint16, serverISDASIP string, serverPort uint16) (*snet.Addr, *snet.Addr, error) {
+	ci := strings.LastIndex(clientCCAddrStr, ":")
+	if ci < 0 {
+		return nil, nil, fmt.Errorf("Malformed client address %s", clientCCAddrStr)
+	}
+	clientISDASIP := clientCCAddrStr[:ci]
+	clientDCAddr, err := snet.AddrFromString(clientISDASIP + ":" + strconv.Itoa(int(clientPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	serverDCAddr, err := snet.AddrFromString(serverISDASIP + ":" + strconv.Itoa(int(serverPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientDCAddr, serverDCAddr, nil
+}
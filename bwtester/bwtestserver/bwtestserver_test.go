@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestBwtest(t *testing.T) {
+	// Data packets of 1000 bytes do not fit into the path of memnettest.SmallMTU, the control
+	// messages do
+	tp := memnettest.NewTopology(30100, 0.1, 600)
+	defer tp.Close()
+
+	prevSessions, prevDCConns, prevAccess, prevMetrics := sessions, dcConns, access, metrics
+	prevCCClosed := ccClosed
+	defer func() {
+		sessions, dcConns, access, metrics = prevSessions, prevDCConns, prevAccess, prevMetrics
+		ccClosed = prevCCClosed
+	}()
+	sessions = newSessionTable(DefaultMaxSessions, 0)
+	dcConns = newDCMux()
+	access = &accessControl{limits: newRateLimiter(time.Minute, 0, 0), replays: NewReplayCache()}
+	metrics = newServerMetrics()
+	ccClosed = make(chan struct{})
+
+	conn, err := transport.ListenSCION("udp4", tp.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		handleClients(conn, "1-11,[10.0.0.11]", make([]byte, 2500), make([]byte, 2500))
+		close(served)
+	}()
+	// Stops the server like the shutdown does
+	defer func() {
+		close(ccClosed)
+		conn.Close()
+		<-served
+	}()
+
+	const numPackets = 100
+	tests := []struct {
+		client     string
+		packetSize int64
+		// Expected number of correctly received packets, -1 if some but not all packets are lost
+		received int64
+	}{
+		{memnettest.SameAS, 1000, numPackets},
+		{memnettest.SameISD, 1000, numPackets},
+		{memnettest.OtherISD, 1000, numPackets},
+		{memnettest.Lossy, 1000, -1},
+		{memnettest.SmallMTU, 500, numPackets},
+		{memnettest.SmallMTU, 1000, 0},
+	}
+	for _, tc := range tests {
+		client := tp.Client(tc.client)
+		// The DC of the client uses the port after the one of the CC
+		local := client.Addr.Copy()
+		local.L4Port = 30200
+		c := &Client{Local: local, Path: client.Path, Logf: t.Logf}
+		bwp := BwtestParameters{BwtestDuration: time.Second, PacketSize: tc.packetSize, NumPackets: numPackets}
+		r, err := c.Run(context.Background(), tp.Server, bwp, bwp)
+		if err != nil {
+			t.Errorf("%s: %v", tc.client, err)
+			continue
+		}
+		if r.CS == nil || r.SC == nil {
+			t.Errorf("%s: missing results %+v", tc.client, r)
+			continue
+		}
+		if r.Path != client.Path {
+			t.Errorf("%s: the bwtest did not use the path of the client", tc.client)
+		}
+		for dir, res := range map[string]*BwtestResult{"cs": r.CS, "sc": r.SC} {
+			got := res.CorrectlyReceived
+			if tc.received >= 0 && got != tc.received ||
+				tc.received < 0 && (got == 0 || got == numPackets) {
+				t.Errorf("%s: %d packets of %d bytes received in the %s direction", tc.client, got,
+					tc.packetSize, dir)
+			}
+		}
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.completed != int64(len(tests)) {
+		t.Errorf("%d bwtests completed, expected %d", metrics.completed, len(tests))
+	}
+	if metrics.requests["1"] == 0 || metrics.requests["2"] == 0 {
+		t.Errorf("Requests by ISD %v, expected requests from ISD 1 and 2", metrics.requests)
+	}
+}
+
+// Without a policy, only the packets the server receives are limited
+func TestApplyPolicyWithoutPolicy(t *testing.T) {
+	ac := &accessControl{}
+	clientBwp := BwtestParameters{BwtestDuration: time.Second, PacketSize: 64, NumPackets: MaxNumPackets}
+	serverBwp := clientBwp
+	if !ac.applyPolicy(addr.IA{}, &clientBwp, &serverBwp) {
+		t.Error("The parameters were not reduced")
+	}
+	if clientBwp.NumPackets != DefaultMaxPackets || serverBwp.NumPackets != MaxNumPackets {
+		t.Errorf("%d client->server and %d server->client packets, expected %d and %d",
+			clientBwp.NumPackets, serverBwp.NumPackets, DefaultMaxPackets, MaxNumPackets)
+	}
+	clientBwp.NumPackets = 100
+	if ac.applyPolicy(addr.IA{}, &clientBwp, &serverBwp) || clientBwp.NumPackets != 100 {
+		t.Errorf("Reduced %d packets", clientBwp.NumPackets)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Number of packets that are buffered per session before packets are dropped
+const dcQueueLen = 1024
+
+// Time to wait before reading from a DC socket again after an error
+const readErrorBackoff = 10 * time.Millisecond
+
+// dcMux shares the server's Data Connection (DC) sockets between concurrent bwtest sessions.
+// All clients send their data to the same server DC port, so the server listens once per
+// local address and demultiplexes the incoming packets by the address of the client DC.
+type dcMux struct {
+	mu        sync.Mutex
+	listeners map[string]*dcListener
+}
+
+type dcListener struct {
+	mux   *dcMux
+	key   string
+	conn  transport.Conn
+	conns map[string]*dcConn // Indexed by the address of the client DC, protected by mux.mu
+}
+
+func newDCMux() *dcMux {
+	return &dcMux{listeners: make(map[string]*dcListener)}
+}
+
+// addrKey identifies a DC endpoint, the path and next hop are not part of the key since
+// the path of the packets from the client can differ from the path to the client
+func addrKey(a *snet.Addr) string {
+	return fmt.Sprintf("%s,[%s]:%d", a.IA, a.Host, a.L4Port)
+}
+
+// Dial returns a connection to remote on the shared socket of local. It fails if a
+// connection from local to remote is already open. If isPathChange is not nil, the connection
+// follows the path of the packets from remote for which it returns true, see follow.
+func (m *dcMux) Dial(local, remote *snet.Addr, isPathChange func(pkt []byte) bool,
+	onClose func()) (transport.Conn, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lk := addrKey(local)
+	l, ok := m.listeners[lk]
+	if !ok {
+		conn, err := transport.ListenSCION("udp4", local)
+		if err != nil {
+			return nil, err
+		}
+		l = &dcListener{mux: m, key: lk, conn: conn, conns: make(map[string]*dcConn)}
+		m.listeners[lk] = l
+		go l.receive()
+	}
+	rk := addrKey(remote)
+	if _, ok := l.conns[rk]; ok {
+		return nil, fmt.Errorf("Data connection already in use: %s -> %s", lk, rk)
+	}
+	c := &dcConn{
+		listener:     l,
+		key:          rk,
+		remote:       remote,
+		inbox:        make(chan []byte, dcQueueLen),
+		closed:       make(chan struct{}),
+		onClose:      onClose,
+		isPathChange: isPathChange,
+		used:         make(map[string]bool),
+	}
+	if remote.Path != nil {
+		c.used[string(remote.Path.Raw)] = true
+	}
+	l.conns[rk] = c
+	return c, nil
+}
+
+// closeAll closes the connections of all sessions, which also closes the shared sockets
+func (m *dcMux) closeAll() {
+	m.mu.Lock()
+	var conns []*dcConn
+	for _, l := range m.listeners {
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+	}
+	m.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Reads packets from the shared socket and hands them to the connection of the sender,
+// returns when the socket is closed, which happens after the last connection on it was closed
+func (l *dcListener) receive() {
+	buf := make([]byte, MaxPacketSize+1000)
+	for {
+		n, srcAddr, err := l.conn.ReadFromSCION(buf)
+		if err != nil {
+			l.mux.mu.Lock()
+			done := len(l.conns) == 0 && l.mux.listeners[l.key] != l
+			l.mux.mu.Unlock()
+			if done || transport.IsClosedError(err) {
+				return
+			}
+			// Do not spin if the socket keeps failing
+			time.Sleep(readErrorBackoff)
+			continue
+		}
+		if srcAddr == nil {
+			continue
+		}
+		l.mux.mu.Lock()
+		c, ok := l.conns[addrKey(srcAddr)]
+		l.mux.mu.Unlock()
+		if !ok {
+			// Straggler packet of a session that already ended, or a packet from an unknown source
+			continue
+		}
+		if c.isPathChange != nil && c.isPathChange(buf[:n]) {
+			c.follow(srcAddr)
+		}
+		if IsPathProbe(buf[:n]) {
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case c.inbox <- pkt:
+			metrics.received(n)
+		default:
+			// The session does not keep up, drop the packet like a full socket buffer would
+			metrics.drop()
+		}
+	}
+}
+
+// Removes c from the listener and closes the shared socket if c was the last connection
+func (l *dcListener) remove(c *dcConn) {
+	l.mux.mu.Lock()
+	defer l.mux.mu.Unlock()
+	delete(l.conns, c.key)
+	if len(l.conns) > 0 {
+		return
+	}
+	// Close the socket while holding the lock, so that no new listener binds the address before it is closed
+	delete(l.mux.listeners, l.key)
+	if err := l.conn.Close(); err != nil {
+		log.Debug("Unable to close server DC", "addr", l.key, "err", err)
+	}
+}
+
+// dcConn is the connection of a single session on a shared DC socket, it implements
+// transport.BatchConn. The packets to the client are sent along the path of the client's most
+// recent path change, see follow, or along a path of the server's path resolver if that path
+// fails, see failover.
+type dcConn struct {
+	listener     *dcListener
+	key          string
+	inbox        chan []byte
+	onClose      func()
+	isPathChange func(pkt []byte) bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	remote       *snet.Addr      // Client DC with the current path, replaced when the path changes
+	used         map[string]bool // Raw paths the session has used
+	noPath       bool            // Set once the server's path resolver has no unused path left
+	readDeadline time.Time
+}
+
+// dcTimeoutError is returned when the read deadline expires, it implements net.Error
+type dcTimeoutError struct{}
+
+func (dcTimeoutError) Error() string   { return "Data connection read timeout" }
+func (dcTimeoutError) Timeout() bool   { return true }
+func (dcTimeoutError) Temporary() bool { return true }
+
+var errDCClosed = fmt.Errorf("Use of closed data connection")
+
+func (c *dcConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromSCION(b)
+	return n, err
+}
+
+func (c *dcConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, a, err := c.ReadFromSCION(b)
+	if a == nil {
+		return n, nil, err
+	}
+	return n, a, err
+}
+
+func (c *dcConn) ReadFromSCION(b []byte) (int, *snet.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, dcTimeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pkt := <-c.inbox:
+		return copy(b, pkt), c.remoteAddr(), nil
+	case <-c.closed:
+		return 0, nil, errDCClosed
+	case <-timeout:
+		return 0, nil, dcTimeoutError{}
+	}
+}
+
+func (c *dcConn) Write(b []byte) (int, error) {
+	for {
+		remote := c.remoteAddr()
+		n, err := c.WriteToSCION(b, remote)
+		if !transport.IsPathError(err) || !c.failover(remote) {
+			return n, err
+		}
+	}
+}
+
+func (c *dcConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	sa, ok := raddr.(*snet.Addr)
+	if !ok {
+		return 0, fmt.Errorf("Unsupported address type %T", raddr)
+	}
+	return c.WriteToSCION(b, sa)
+}
+
+func (c *dcConn) WriteToSCION(b []byte, raddr *snet.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errDCClosed
+	default:
+	}
+	n, err := c.listener.conn.WriteToSCION(b, raddr)
+	if err == nil {
+		metrics.sent(n)
+	}
+	return n, err
+}
+
+// ReadBatch reads the next packet like ReadFromSCION, followed by the packets that are
+// already in the inbox, up to len(bufs) packets
+func (c *dcConn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, _, err := c.ReadFromSCION(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	i := 1
+	for ; i < len(bufs); i++ {
+		select {
+		case pkt := <-c.inbox:
+			sizes[i] = copy(bufs[i], pkt)
+			continue
+		default:
+		}
+		break
+	}
+	return i, nil
+}
+
+// WriteBatch sends the packets to the client. The shared socket is not connected to the client,
+// so the packets are sent one after the other.
+func (c *dcConn) WriteBatch(pkts [][]byte) (int, error) {
+	for i, b := range pkts {
+		if _, err := c.Write(b); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// Returns the address of the client DC with the current path
+func (c *dcConn) remoteAddr() *snet.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// Sends the packets to the client along the path of src, the address of a path probe or data
+// packet of the session, if the client switched to a path the session has not used before.
+// Packets that arrive late over an earlier path do not switch the path back.
+func (c *dcConn) follow(src *snet.Addr) {
+	if src.Path == nil || len(src.Path.Raw) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := string(src.Path.Raw)
+	if c.used[key] {
+		return
+	}
+	c.used[key] = true
+	remote := c.remote.Copy()
+	// The path of a received packet is already reversed
+	remote.Path = src.Path.Copy()
+	remote.NextHopHost = src.NextHopHost
+	remote.NextHopPort = src.NextHopPort
+	c.remote = remote
+	log.Debug("Client switched the path of the DC", "client", c.key)
+	metrics.pathSwitch(pathSwitchClient)
+}
+
+// Switches to the path of the server's path resolver that the policy prefers among those the
+// session has not used yet, after the path of failed failed. Returns false if there is none.
+// If the path was already switched from failed, it returns true right away.
+func (c *dcConn) failover(failed *snet.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != failed {
+		return true
+	}
+	if c.noPath {
+		return false
+	}
+	local, ok := c.listener.conn.LocalAddr().(*snet.Addr)
+	if !ok {
+		return false
+	}
+	pathSet := transport.DefNetwork.PathResolver().Query(local.IA, c.remote.IA)
+	for _, p := range pathpolicy.Rank(nil, pathSet) {
+		key := string(p.Entry.Path.FwdPath)
+		if c.used[key] {
+			continue
+		}
+		c.used[key] = true
+		remote := c.remote.Copy()
+		pathpolicy.SetPath(remote, p.Entry)
+		c.remote = remote
+		log.Debug("Path to the client failed, switched the path of the DC", "client", c.key,
+			"path", pathpolicy.Fingerprint(p.Entry))
+		metrics.pathSwitch(pathSwitchFailover)
+		return true
+	}
+	c.noPath = true
+	return false
+}
+
+// Close detaches the connection from the shared socket and calls the onClose callback
+func (c *dcConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *dcConn) LocalAddr() net.Addr {
+	return c.listener.conn.LocalAddr()
+}
+
+func (c *dcConn) RemoteAddr() net.Addr {
+	return c.remoteAddr()
+}
+
+func (c *dcConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *dcConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// Writes on the shared socket never block for long, so write deadlines are ignored
+func (c *dcConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
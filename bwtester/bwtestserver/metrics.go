@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// serverMetrics counts the events of the server, they are exported in the Prometheus text
+// format on the optional HTTP listener
+type serverMetrics struct {
+	// Data packets and bytes, updated with atomic operations since they are counted per packet
+	csPackets int64 // Received from clients
+	csBytes   int64
+	scPackets int64 // Sent to clients
+	scBytes   int64
+	dropped   int64 // Received packets dropped because a session did not keep up
+
+	mu           sync.Mutex // Protects the fields below
+	started      int64
+	completed    int64
+	reduced      int64
+	decodeErrors int64
+	rejected     map[string]int64 // Indexed by reason
+	deferred     map[string]int64 // Indexed by reason
+	fetches      map[string]int64 // Indexed by outcome
+	pathSwitches map[string]int64 // Indexed by cause
+	requests     map[string]int64 // Indexed by client ISD
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		rejected:     make(map[string]int64),
+		deferred:     make(map[string]int64),
+		fetches:      make(map[string]int64),
+		pathSwitches: make(map[string]int64),
+		requests:     make(map[string]int64),
+	}
+}
+
+// Label values of the deferred bwtests, the client is told to try again later
+const (
+	deferBusy          = "busy"
+	deferDCUnavailable = "dc_unavailable"
+)
+
+// Label values of the result fetches
+const (
+	fetchOK       = "ok"
+	fetchNotReady = "not_ready"
+	fetchUnknown  = "unknown"
+)
+
+// Label values of the path switches of the DCs: the client switched the path and the server
+// followed, or the server's path to the client failed
+const (
+	pathSwitchClient   = "client"
+	pathSwitchFailover = "failover"
+)
+
+// Returns the label value of a reason for rejecting a request
+func rejectLabel(reason byte) string {
+	switch reason {
+	case RejectAuthRequired:
+		return "auth_required"
+	case RejectAuthFailed:
+		return "auth_failed"
+	case RejectNotAllowed:
+		return "not_allowed"
+	case RejectRequestRate:
+		return "request_rate"
+	case RejectByteRate:
+		return "byte_rate"
+	case RejectShutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("%d", reason)
+	}
+}
+
+func (m *serverMetrics) request(isd addr.ISD) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[strconv.Itoa(int(isd))]++
+}
+
+func (m *serverMetrics) decodeError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decodeErrors++
+}
+
+func (m *serverMetrics) reject(reason byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[rejectLabel(reason)]++
+}
+
+func (m *serverMetrics) deferTest(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred[reason]++
+}
+
+func (m *serverMetrics) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+}
+
+func (m *serverMetrics) complete() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.completed++
+}
+
+func (m *serverMetrics) reduce() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reduced++
+}
+
+func (m *serverMetrics) fetch(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches[outcome]++
+}
+
+func (m *serverMetrics) pathSwitch(cause string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pathSwitches[cause]++
+}
+
+// Counts a data packet received from a client
+func (m *serverMetrics) received(n int) {
+	atomic.AddInt64(&m.csPackets, 1)
+	atomic.AddInt64(&m.csBytes, int64(n))
+}
+
+// Counts a data packet sent to a client
+func (m *serverMetrics) sent(n int) {
+	atomic.AddInt64(&m.scPackets, 1)
+	atomic.AddInt64(&m.scBytes, int64(n))
+}
+
+func (m *serverMetrics) drop() {
+	atomic.AddInt64(&m.dropped, 1)
+}
+
+// Serves the metrics in the Prometheus text format
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	running, waiting := sessions.counts()
+	writeMetric(w, "bwtestserver_active_sessions", "gauge",
+		"Number of running bwtests.", "", single(int64(running)))
+	writeMetric(w, "bwtestserver_waiting_clients", "gauge",
+		"Number of clients waiting to be admitted.", "", single(int64(waiting)))
+	writeMetric(w, "bwtestserver_data_packets_total", "counter",
+		"Data packets received (cs) and sent (sc) by the server.", "direction", map[string]int64{
+			"cs": atomic.LoadInt64(&m.csPackets),
+			"sc": atomic.LoadInt64(&m.scPackets),
+		})
+	writeMetric(w, "bwtestserver_data_bytes_total", "counter",
+		"Data bytes received (cs) and sent (sc) by the server.", "direction", map[string]int64{
+			"cs": atomic.LoadInt64(&m.csBytes),
+			"sc": atomic.LoadInt64(&m.scBytes),
+		})
+	writeMetric(w, "bwtestserver_data_packets_dropped_total", "counter",
+		"Received data packets dropped because a session did not keep up.", "",
+		single(atomic.LoadInt64(&m.dropped)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetric(w, "bwtestserver_requests_total", "counter",
+		"Bwtest requests by client ISD, including repeated requests.", "isd", m.requests)
+	writeMetric(w, "bwtestserver_tests_started_total", "counter",
+		"Bwtests that were started.", "", single(m.started))
+	writeMetric(w, "bwtestserver_tests_completed_total", "counter",
+		"Bwtests that ended.", "", single(m.completed))
+	writeMetric(w, "bwtestserver_tests_reduced_total", "counter",
+		"Bwtests whose parameters were reduced to the limits of the policy.", "", single(m.reduced))
+	writeMetric(w, "bwtestserver_tests_rejected_total", "counter",
+		"Bwtest requests that were rejected, by reason.", "reason", m.rejected)
+	writeMetric(w, "bwtestserver_tests_deferred_total", "counter",
+		"Bwtest requests that were told to try again later, by reason.", "reason", m.deferred)
+	writeMetric(w, "bwtestserver_decode_errors_total", "counter",
+		"Malformed requests.", "", single(m.decodeErrors))
+	writeMetric(w, "bwtestserver_result_fetches_total", "counter",
+		"Result requests, by outcome.", "outcome", m.fetches)
+	writeMetric(w, "bwtestserver_path_switches_total", "counter",
+		"Path switches of the data connections, by cause.", "cause", m.pathSwitches)
+}
+
+func single(v int64) map[string]int64 {
+	return map[string]int64{"": v}
+}
+
+// Writes a metric in the Prometheus text format, with one sample per entry of values. Without
+// a label name, values contains a single entry.
+func writeMetric(w io.Writer, name, typ, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(label) == 0 {
+			fmt.Fprintf(w, "%s %d\n", name, values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(k), values[k])
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Starts the HTTP listener for the metrics on addr, it serves them on /metrics
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go http.Serve(l, mux)
+	return nil
+}
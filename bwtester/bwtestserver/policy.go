@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// Without a policy, the number of packets of the client->server direction is limited to this,
+// since the server keeps receive state for each of them
+const DefaultMaxPackets = 1 << 20
+
+// testLimits are the limits of the parameters of each direction of a bwtest, on top of the
+// limits of the protocol. Requested parameters beyond the limits are reduced, and the client
+// learns the effective parameters from the response. A value of 0 means no limit.
+type testLimits struct {
+	MaxDuration   duration `json:"max_duration"`
+	MaxBandwidth  float64  `json:"max_bandwidth"` // Mbps
+	MaxPackets    int64    `json:"max_packets"`
+	MinPacketSize int64    `json:"min_packet_size"`
+	MaxPacketSize int64    `json:"max_packet_size"`
+}
+
+// testPolicy is the content of the policy file: the default limits and the overrides for
+// ISD-ASes. The first override whose pattern matches the client's ISD-AS replaces the limits
+// it sets, the others keep their default.
+type testPolicy struct {
+	testLimits
+	Overrides []policyOverride `json:"overrides"`
+}
+
+type policyOverride struct {
+	IA string `json:"ia"` // ISD-AS pattern as in the allowlist
+	testLimits
+}
+
+// duration is a time.Duration that is written as a string in the policy file, e.g. "5s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Invalid duration %s, must be a string such as \"5s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Loads the policy from a JSON file, see the README for its format
+func loadPolicy(path string) (*testPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p testPolicy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := p.testLimits.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range p.Overrides {
+		o := &p.Overrides[i]
+		if o.IA, err = parseIAPattern(o.IA); err != nil {
+			return nil, fmt.Errorf("%s: override %d: %v", path, i, err)
+		}
+		if err := o.testLimits.check(); err != nil {
+			return nil, fmt.Errorf("%s: override %s: %v", path, o.IA, err)
+		}
+	}
+	return &p, nil
+}
+
+func (l *testLimits) check() error {
+	switch {
+	case l.MaxDuration < 0:
+		return fmt.Errorf("Invalid max_duration %v", time.Duration(l.MaxDuration))
+	case l.MaxDuration > 0 && time.Duration(l.MaxDuration)%time.Second != 0:
+		// Includes durations under 1s, clients compute the bandwidth from the duration in seconds
+		return fmt.Errorf("Invalid max_duration %v, must be a whole number of seconds",
+			time.Duration(l.MaxDuration))
+	case l.MaxBandwidth < 0:
+		return fmt.Errorf("Invalid max_bandwidth %v", l.MaxBandwidth)
+	case l.MaxPackets < 0:
+		return fmt.Errorf("Invalid max_packets %d", l.MaxPackets)
+	case l.MinPacketSize < 0 || l.MaxPacketSize < 0:
+		return fmt.Errorf("Invalid packet size limits %d and %d", l.MinPacketSize, l.MaxPacketSize)
+	case l.MaxPacketSize > 0 && l.MinPacketSize > l.MaxPacketSize:
+		return fmt.Errorf("min_packet_size %d is larger than max_packet_size %d", l.MinPacketSize,
+			l.MaxPacketSize)
+	}
+	return nil
+}
+
+// Returns the limits that apply to bwtests of clients in ia
+func (p *testPolicy) limits(ia addr.IA) testLimits {
+	l := p.testLimits
+	for _, o := range p.Overrides {
+		if !iaAllowed([]string{o.IA}, ia) {
+			continue
+		}
+		if o.MaxDuration > 0 {
+			l.MaxDuration = o.MaxDuration
+		}
+		if o.MaxBandwidth > 0 {
+			l.MaxBandwidth = o.MaxBandwidth
+		}
+		if o.MaxPackets > 0 {
+			l.MaxPackets = o.MaxPackets
+		}
+		if o.MinPacketSize > 0 {
+			l.MinPacketSize = o.MinPacketSize
+		}
+		if o.MaxPacketSize > 0 {
+			l.MaxPacketSize = o.MaxPacketSize
+		}
+		break
+	}
+	return l
+}
+
+// Reduces the parameters of a direction to the limits, returns true if they were changed. The
+// number of packets is reduced last, so that the bandwidth stays within its limit also with
+// the reduced duration and packet size. A direction with packets keeps at least one.
+func (l *testLimits) apply(bwp *BwtestParameters) bool {
+	orig := *bwp
+	if l.MaxDuration > 0 && bwp.BwtestDuration > time.Duration(l.MaxDuration) {
+		bwp.BwtestDuration = time.Duration(l.MaxDuration)
+	}
+	if l.MinPacketSize > 0 && bwp.PacketSize < l.MinPacketSize {
+		bwp.PacketSize = l.MinPacketSize
+	}
+	if l.MaxPacketSize > 0 && bwp.PacketSize > l.MaxPacketSize {
+		bwp.PacketSize = l.MaxPacketSize
+	}
+	if bwp.NumPackets > 0 {
+		if l.MaxPackets > 0 && bwp.NumPackets > l.MaxPackets {
+			bwp.NumPackets = l.MaxPackets
+		}
+		if l.MaxBandwidth > 0 {
+			maxPackets := int64(l.MaxBandwidth * 1e6 * bwp.BwtestDuration.Seconds() / float64(8*bwp.PacketSize))
+			if maxPackets < 1 {
+				maxPackets = 1
+			}
+			if bwp.NumPackets > maxPackets {
+				bwp.NumPackets = maxPackets
+			}
+		}
+	}
+	return bwp.BwtestDuration != orig.BwtestDuration || bwp.PacketSize != orig.PacketSize ||
+		bwp.NumPackets != orig.NumPackets
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+)
+
+const (
+	// Default maximum number of concurrently running bwtests
+	DefaultMaxSessions = 4
+	// A waiting client is forgotten if it does not send another request within the time it
+	// was told to wait plus this grace period
+	waiterGracePeriod = time.Second * 3
+	// Results are kept this long after the bwtest finished
+	resultRetention = time.Minute
+	// When the server shuts down, it waits this long after a bwtest finished for the client to
+	// fetch the result
+	resultFetchPeriod = time.Second * 5
+)
+
+// session is a bwtest that is running or finished, identified by the PRG key of the
+// client->server direction. The key is random and sent again in the client's 'R' request.
+type session struct {
+	id        string
+	ia        string // ISD-AS of the client, used to share the server fairly among ASes
+	bandwidth int64  // Peak bandwidth of both directions, in bps, see sessionBandwidth
+	result    *BwtestResult
+	running   bool
+	fetched   bool // The client received the result, or there is none
+
+	// Description of the bwtest for the results file, see resultStore
+	client    string // Address of the client CC
+	start     time.Time
+	version   byte
+	reduced   bool // The parameters were reduced to the policy
+	clientBwp BwtestParameters
+	serverBwp BwtestParameters
+}
+
+// waiter is a client whose request was not admitted yet
+type waiter struct {
+	id        string
+	ia        string
+	bandwidth int64
+	arrival   time.Time
+	expires   time.Time
+}
+
+// sessionTable admits bwtests as long as the number of running sessions and their aggregate
+// bandwidth stay within the configured limits. Clients that cannot be admitted are queued and
+// admitted in turn: the queued client from the ISD-AS that was served least recently goes first,
+// clients from the same ISD-AS are admitted in order of arrival.
+type sessionTable struct {
+	// Protects all fields and the results, it is also passed to HandleDCConnReceive
+	mu           sync.Mutex
+	maxSessions  int
+	maxBandwidth int64 // In bps, 0 means unlimited
+	sessions     map[string]*session
+	numRunning   int
+	bandwidth    int64 // Aggregate bandwidth of the running sessions
+	waiting      []*waiter
+	lastAdmitted map[string]time.Time // Indexed by ISD-AS
+}
+
+func newSessionTable(maxSessions int, maxBandwidth int64) *sessionTable {
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+	return &sessionTable{
+		maxSessions:  maxSessions,
+		maxBandwidth: maxBandwidth,
+		sessions:     make(map[string]*session),
+		lastAdmitted: make(map[string]time.Time),
+	}
+}
+
+// Bandwidth of the bwtest described by bwp, in bps
+func bwtestBandwidth(bwp *BwtestParameters) int64 {
+	if bwp.BwtestDuration <= 0 {
+		return 0
+	}
+	return int64(float64(bwp.PacketSize*bwp.NumPackets*8) / bwp.BwtestDuration.Seconds())
+}
+
+// Peak bandwidth of a bwtest with the parameters of both directions, in bps. The bandwidths of
+// the directions only add up if they overlap in time.
+func sessionBandwidth(clientBwp, serverBwp *BwtestParameters) int64 {
+	cs, sc := bwtestBandwidth(clientBwp), bwtestBandwidth(serverBwp)
+	if clientBwp.StartOffset < serverBwp.StartOffset+serverBwp.BwtestDuration &&
+		serverBwp.StartOffset < clientBwp.StartOffset+clientBwp.BwtestDuration {
+		return cs + sc
+	}
+	if cs > sc {
+		return cs
+	}
+	return sc
+}
+
+// admit starts session s if the limits allow it and it is the turn of s. Otherwise s is
+// queued and the time the client should wait before its next request is returned.
+func (st *sessionTable) admit(s *session, t time.Time) (bool, time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.expireWaiters(t)
+	w := st.enqueue(s, t)
+	if st.next() == w && st.fits(s.bandwidth) {
+		st.dequeue(w)
+		s.running = true
+		st.sessions[s.id] = s
+		st.numRunning++
+		st.bandwidth += s.bandwidth
+		st.lastAdmitted[s.ia] = t
+		return true, 0
+	}
+	wait := time.Second
+	if !st.fits(st.next().bandwidth) {
+		// Nobody can be admitted before the first running bwtest finishes
+		if ft, ok := st.firstFinishTime(); ok && ft.Sub(t) > wait {
+			wait = ft.Sub(t)
+		}
+	}
+	w.expires = t.Add(wait + waiterGracePeriod)
+	return false, wait
+}
+
+// cancel removes a session which was admitted but could not be started
+func (st *sessionTable) cancel(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s, ok := st.sessions[id]; ok {
+		st.stop(s)
+		delete(st.sessions, id)
+	}
+}
+
+// finish marks the session as done, its result stays available for the client
+func (st *sessionTable) finish(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s, ok := st.sessions[id]; ok {
+		st.stop(s)
+	}
+}
+
+// result returns a copy of the result of the session with the given id
+func (st *sessionTable) result(id string) (BwtestResult, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if !ok {
+		return BwtestResult{}, false
+	}
+	return *s.result, true
+}
+
+// fetched records that the client received the result of the session with the given id
+func (st *sessionTable) fetched(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s, ok := st.sessions[id]; ok {
+		s.fetched = true
+	}
+}
+
+// pending returns the number of sessions that are still running, or whose client may still
+// fetch the result
+func (st *sessionTable) pending(t time.Time) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := 0
+	for _, s := range st.sessions {
+		if s.running || (!s.fetched && t.Before(s.result.ExpectedFinishTime.Add(resultFetchPeriod))) {
+			n++
+		}
+	}
+	return n
+}
+
+// counts returns the number of running sessions and of waiting clients
+func (st *sessionTable) counts() (int, int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.numRunning, len(st.waiting)
+}
+
+// purge deletes the sessions that finished longer than resultRetention ago
+func (st *sessionTable) purge(t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k, s := range st.sessions {
+		if !s.running && s.result.ExpectedFinishTime.Before(t.Add(-resultRetention)) {
+			delete(st.sessions, k)
+		}
+	}
+	for ia, at := range st.lastAdmitted {
+		if at.Before(t.Add(-resultRetention)) {
+			delete(st.lastAdmitted, ia)
+		}
+	}
+	st.expireWaiters(t)
+}
+
+func (st *sessionTable) stop(s *session) {
+	if !s.running {
+		return
+	}
+	s.running = false
+	st.numRunning--
+	st.bandwidth -= s.bandwidth
+}
+
+// fits returns whether a session with the given bandwidth can be started now. A single
+// session is always allowed, so that tests exceeding the budget are not starved.
+func (st *sessionTable) fits(bandwidth int64) bool {
+	if st.numRunning == 0 {
+		return true
+	}
+	if st.numRunning >= st.maxSessions {
+		return false
+	}
+	return st.maxBandwidth == 0 || st.bandwidth+bandwidth <= st.maxBandwidth
+}
+
+func (st *sessionTable) firstFinishTime() (time.Time, bool) {
+	var first time.Time
+	found := false
+	for _, s := range st.sessions {
+		if s.running && (!found || s.result.ExpectedFinishTime.Before(first)) {
+			first = s.result.ExpectedFinishTime
+			found = true
+		}
+	}
+	return first, found
+}
+
+// enqueue returns the waiter of s, adding it to the queue if it is not yet waiting
+func (st *sessionTable) enqueue(s *session, t time.Time) *waiter {
+	for _, w := range st.waiting {
+		if w.id == s.id {
+			return w
+		}
+	}
+	w := &waiter{id: s.id, ia: s.ia, bandwidth: s.bandwidth, arrival: t}
+	st.waiting = append(st.waiting, w)
+	return w
+}
+
+func (st *sessionTable) dequeue(w *waiter) {
+	for i, v := range st.waiting {
+		if v == w {
+			st.waiting = append(st.waiting[:i], st.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns the waiter whose turn it is
+func (st *sessionTable) next() *waiter {
+	var first *waiter
+	for _, w := range st.waiting {
+		if first == nil {
+			first = w
+			continue
+		}
+		tw, tf := st.lastAdmitted[w.ia], st.lastAdmitted[first.ia]
+		if tw.Before(tf) || (tw.Equal(tf) && w.arrival.Before(first.arrival)) {
+			first = w
+		}
+	}
+	return first
+}
+
+func (st *sessionTable) expireWaiters(t time.Time) {
+	waiting := st.waiting[:0]
+	for _, w := range st.waiting {
+		if w.expires.IsZero() || t.Before(w.expires) {
+			waiting = append(waiting, w)
+		}
+	}
+	st.waiting = waiting
+}
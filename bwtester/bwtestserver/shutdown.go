@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+// Default time the server waits for running bwtests when it shuts down
+const DefaultShutdownTimeout = time.Second * 30
+
+var (
+	// Closed when the server starts shutting down, new bwtests are rejected from then on
+	stopping = make(chan struct{})
+	// Closed right before the CC is closed, so that handleClients returns instead of retrying
+	ccClosed = make(chan struct{})
+)
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handles the signals of the server until it shuts down. SIGHUP reloads the pre-shared keys,
+// the allowlist and the policy. SIGINT and SIGTERM stop the server: new bwtests are rejected, and the
+// running sessions get up to timeout to finish and hand out their results before the
+// connections are closed. A second SIGINT or SIGTERM stops the server right away. The exit
+// status is sent on status: 0 if all sessions finished, 1 otherwise.
+func handleSignals(CCConn transport.Conn, timeout time.Duration, pskFile, allowFile, policyFile string, status chan<- int) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigs
+	for sig == syscall.SIGHUP {
+		reloadAccess(pskFile, allowFile, policyFile)
+		sig = <-sigs
+	}
+	fmt.Println("Shutting down, waiting for running bwtests:", sig)
+	log.Info("Shutting down", "signal", sig, "timeout", timeout)
+	close(stopping)
+	s := drain(sigs, timeout, pskFile, allowFile, policyFile)
+	close(ccClosed)
+	if err := CCConn.Close(); err != nil {
+		log.Debug("Unable to close server CC", "err", err)
+	}
+	dcConns.closeAll()
+	signal.Stop(sigs)
+	status <- s
+}
+
+// Waits until no session is pending, returns the exit status
+func drain(sigs <-chan os.Signal, timeout time.Duration, pskFile, allowFile, policyFile string) int {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for {
+		n := sessions.pending(time.Now())
+		if n == 0 {
+			return 0
+		}
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reloadAccess(pskFile, allowFile, policyFile)
+				continue
+			}
+			log.Warn("Stopping right away", "signal", sig, "sessions", n)
+			return 1
+		case <-deadline.C:
+			log.Warn("Shutdown timeout expired", "sessions", n)
+			return 1
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reloads the access configuration, on error the previous configuration is kept
+func reloadAccess(pskFile, allowFile, policyFile string) {
+	if err := access.load(pskFile, allowFile, policyFile); err != nil {
+		log.Error("Unable to reload configuration, keeping the previous one", "err", err)
+		return
+	}
+	fmt.Println("Reloaded configuration")
+	log.Info("Reloaded configuration", "psk_file", pskFile, "allow_file", allowFile, "policy_file", policyFile)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	. "github.com/perrig/scionlab/bwtester/bwtestlib"
+)
+
+// Default time for which clients can fetch results from the results file
+const DefaultResultsRetention = time.Hour * 24
+
+// storeRecord is the record of a finished session in the results file. The PRG keys are not
+// stored, the session is identified by the hash of the key of the client->server direction,
+// so that only the client can fetch the result.
+type storeRecord struct {
+	Session  string           `json:"session"` // Hex encoded SHA-256 of the PRG key
+	Client   string           `json:"client"`  // Address of the client CC
+	IA       string           `json:"ia"`
+	Version  byte             `json:"version"`
+	Start    time.Time        `json:"start"`
+	Finish   time.Time        `json:"finish"`
+	Reduced  bool             `json:"reduced"` // The parameters were reduced to the policy
+	CSParams BwtestParameters `json:"cs_parameters"`
+	SCParams BwtestParameters `json:"sc_parameters"`
+	CSResult *BwtestResult    `json:"cs_result"` // nil if the direction had no packets
+}
+
+func sessionHash(prgKey []byte) string {
+	h := sha256.Sum256(prgKey)
+	return hex.EncodeToString(h[:])
+}
+
+// resultStore appends a record of each finished session to the results file, one JSON
+// document per line. It also keeps the results of the sessions that finished within the
+// retention time, including those in the file from before a restart of the server, so that
+// clients can still fetch them after the session table forgot them.
+type resultStore struct {
+	mu        sync.Mutex
+	f         *os.File
+	retention time.Duration
+	recent    map[string]*storeRecord // Indexed by session hash
+}
+
+// Opens the results file at path, creating it if needed, and loads the results of the
+// sessions that finished within retention
+func openResultStore(path string, retention time.Duration) (*resultStore, error) {
+	rs := &resultStore{retention: retention, recent: make(map[string]*storeRecord)}
+	records, err := readRecords(path, time.Now().Add(-retention))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, r := range records {
+		rs.recent[r.Session] = r
+	}
+	rs.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Reads the records of the sessions that finished after since from the results file, in the
+// order of the file. Lines that cannot be decoded, e.g. a line that was cut off when the
+// server stopped, are skipped.
+func readRecords(path string, since time.Time) ([]*storeRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*storeRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		var r storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warn("Skipping invalid record in results file", "file", path, "line", lineNo, "err", err)
+			continue
+		}
+		if r.Finish.After(since) {
+			records = append(records, &r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Records session s, which finished at t with the result res. A store that is nil records
+// nothing.
+func (rs *resultStore) add(s *session, res BwtestResult, t time.Time) {
+	if rs == nil {
+		return
+	}
+	r := &storeRecord{
+		Session:  sessionHash([]byte(s.id)),
+		Client:   s.client,
+		IA:       s.ia,
+		Version:  s.version,
+		Start:    s.start,
+		Finish:   t,
+		Reduced:  s.reduced,
+		CSParams: s.clientBwp,
+		SCParams: s.serverBwp,
+	}
+	r.CSParams.PrgKey, r.SCParams.PrgKey = nil, nil
+	if s.clientBwp.NumPackets > 0 {
+		res.PrgKey = nil
+		r.CSResult = &res
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Error("Unable to encode session record", "client", s.client, "err", err)
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, err := rs.f.Write(append(b, '\n')); err != nil {
+		log.Error("Unable to write to results file", "err", err)
+	}
+	rs.recent[r.Session] = r
+}
+
+// Returns the result of the session whose client->server direction has the given PRG key
+func (rs *resultStore) result(prgKey []byte) (BwtestResult, bool) {
+	if rs == nil {
+		return BwtestResult{}, false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.recent[sessionHash(prgKey)]
+	if !ok || r.CSResult == nil {
+		return BwtestResult{}, false
+	}
+	res := *r.CSResult
+	res.PrgKey = append([]byte(nil), prgKey...)
+	return res, true
+}
+
+// Forgets the results of the sessions that finished longer than the retention time ago, they
+// stay in the file
+func (rs *resultStore) purge(t time.Time) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for k, r := range rs.recent {
+		if r.Finish.Before(t.Add(-rs.retention)) {
+			delete(rs.recent, k)
+		}
+	}
+}
+
+func (rs *resultStore) close() error {
+	if rs == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.f.Close()
+}
+
+// Prints the sessions in the results file that finished after since and whose client is in
+// an ISD-AS that matches iaPattern, one line per session. With jsonOutput, the records are
+// printed as they are in the file.
+func runQuery(path string, since time.Time, iaPattern string, jsonOutput bool) error {
+	pattern, err := parseIAPattern(iaPattern)
+	if err != nil {
+		return err
+	}
+	records, err := readRecords(path, since)
+	if err != nil {
+		return err
+	}
+	if !jsonOutput {
+		fmt.Printf("%-20s %-40s %-22s %-22s %s\n", "Start", "Client", "C->S", "S->C", "C->S received")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range records {
+		if !iaMatches(pattern, r.IA) {
+			continue
+		}
+		if jsonOutput {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			continue
+		}
+		received := "-"
+		if r.CSResult != nil {
+			received = fmt.Sprintf("%d/%d", r.CSResult.CorrectlyReceived, r.CSParams.NumPackets)
+		}
+		if r.Reduced {
+			received += " (reduced)"
+		}
+		fmt.Printf("%-20s %-40s %-22s %-22s %s\n", r.Start.Local().Format("2006-01-02 15:04:05"), r.Client,
+			formatRecordDirection(&r.CSParams), formatRecordDirection(&r.SCParams), received)
+	}
+	return nil
+}
+
+// Formats the parameters of a direction as duration, packet size and bandwidth
+func formatRecordDirection(bwp *BwtestParameters) string {
+	if bwp.NumPackets == 0 {
+		return "skipped"
+	}
+	return fmt.Sprintf("%v %dB %.2fMbps", bwp.BwtestDuration, bwp.PacketSize,
+		float64(bwtestBandwidth(bwp))/1e6)
+}
@@ -12,6 +12,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -39,7 +41,7 @@ func printUsage() {
 	fmt.Println("Example SCION address 1-1011,[192.33.93.166]:42002")
 }
 
-func fetchFileInfo(udpConnection *snet.Conn) (string, uint32, time.Duration, error) {
+func fetchFileInfo(udpConnection transport.Conn) (string, uint32, time.Duration, error) {
 	numRetries := 0
 	packetBuffer := make([]byte, 2500)
 
@@ -95,7 +97,7 @@ func fetchFileInfo(udpConnection *snet.Conn) (string, uint32, time.Duration, err
 	return "", 0, 0, fmt.Errorf("Error: could not obtain file information")
 }
 
-func blockFetcher(fetchBlockChan chan uint32, udpConnection *snet.Conn, fileName string, fileSize uint32) {
+func blockFetcher(fetchBlockChan chan uint32, udpConnection transport.Conn, fileName string, fileSize uint32) {
 	packetBuffer := make([]byte, 512)
 	packetBuffer[0] = 'G'
 	packetBuffer[1] = byte(len(fileName))
@@ -114,11 +116,14 @@ func blockFetcher(fetchBlockChan chan uint32, udpConnection *snet.Conn, fileName
 	}
 }
 
-func blockReceiver(receivedBlockChan chan uint32, udpConnection *snet.Conn, fileBuffer []byte, fileSize uint32) {
+func blockReceiver(receivedBlockChan chan uint32, udpConnection transport.Conn, fileBuffer []byte, fileSize uint32) {
 	packetBuffer := make([]byte, 2500)
 	for {
 		n, _, err := udpConnection.ReadFrom(packetBuffer)
 		if err != nil {
+			if transport.IsClosedError(err) {
+				return
+			}
 			continue
 			// Uncomment and remove "continue" on previous line once the new version of snet is part of the SCIONLab branch
 			// if operr, ok := err.(*snet.OpError); ok {
@@ -163,12 +168,14 @@ func main() {
 		sciondPath     string
 		sciondFromIA   bool
 		dispatcherPath string
+		pathAlgo       string
+		policyFile     string
 
 		err    error
 		local  *snet.Addr
 		remote *snet.Addr
 
-		udpConnection *snet.Conn
+		udpConnection transport.Conn
 	)
 
 	flag.StringVar(&clientAddress, "c", "", "Client SCION Address")
@@ -177,6 +184,8 @@ func main() {
 	flag.BoolVar(&sciondFromIA, "sciondFromIA", false, "SCIOND socket path from IA address:ISD-AS")
 	flag.StringVar(&dispatcherPath, "dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path policy, e.g. \"shortest\", \"mtu\" or \"expiry\"")
+	flag.StringVar(&policyFile, "path_policy_file", "", "File with the path policy, instead of -pathAlgo")
 	flag.Parse()
 
 	// Create SCION UDP socket
@@ -203,14 +212,34 @@ func main() {
 	} else if sciondPath == "" {
 		sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
-	snet.Init(local.IA, sciondPath, dispatcherPath)
-	udpConnection, err = snet.DialSCION("udp4", local, remote)
+	err = transport.Init(local.IA, sciondPath, dispatcherPath)
+	check(err)
+	policy, err := pathpolicy.New(pathAlgo, policyFile)
+	check(err)
+	err = pathpolicy.Apply(policy, local, remote)
+	check(err)
+	udpConnection, err = transport.DialSCION("udp4", local, remote)
 	check(err)
 
-	fileName, fileSize, rttApprox, err := fetchFileInfo(udpConnection)
+	fileName, fileBuffer, err := fetchImage(udpConnection)
 	check(err)
 
+	// Write file to disk
+	err = ioutil.WriteFile(fileName, fileBuffer, 0600)
+	check(err)
+	fmt.Println("\nDone, exiting. Total duration", time.Now().Sub(startTime))
+}
+
+// Fetches the most recent image from the server udpConnection is connected to, returns its
+// name and contents
+func fetchImage(udpConnection transport.Conn) (string, []byte, error) {
+	fileName, fileSize, rttApprox, err := fetchFileInfo(udpConnection)
+	if err != nil {
+		return "", nil, err
+	}
+
 	fetchBlockChan := make(chan uint32, 2)
+	defer close(fetchBlockChan)
 	receivedBlockChan := make(chan uint32, 2)
 
 	fileBuffer := make([]byte, fileSize)
@@ -272,13 +301,9 @@ func main() {
 			numTimeouts++
 			if numTimeouts > maxRetries {
 				fmt.Println(requestedBlockMap)
-				check(fmt.Errorf("Too many missing packets, aborting"))
+				return "", nil, fmt.Errorf("Too many missing packets, aborting")
 			}
 		}
 	}
-
-	// Write file to disk
-	err = ioutil.WriteFile(fileName, fileBuffer, 0600)
-	check(err)
-	fmt.Println("\nDone, exiting. Total duration", time.Now().Sub(startTime))
+	return fileName, fileBuffer, nil
 }
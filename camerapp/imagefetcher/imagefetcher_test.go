@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+)
+
+// Answers the LIST and GET requests on conn for a single image, like the imageserver
+func serveImage(conn transport.Conn, name string, content []byte) {
+	buf := make([]byte, 2500)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n == 1 && buf[0] == 'L' {
+			reply := append([]byte{'L', byte(len(name))}, name...)
+			reply = append(reply, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(reply[len(reply)-4:], uint32(len(content)))
+			conn.WriteTo(reply, client)
+		} else if n == 2+len(name)+8 && buf[0] == 'G' && string(buf[2:2+len(name)]) == name {
+			start := binary.LittleEndian.Uint32(buf[2+len(name):])
+			end := binary.LittleEndian.Uint32(buf[6+len(name):])
+			if start < end && end <= uint32(len(content)) {
+				reply := append([]byte{'G'}, buf[2+len(name):n]...)
+				conn.WriteTo(append(reply, content[start:end]...), client)
+			}
+		}
+	}
+}
+
+func TestFetchImage(t *testing.T) {
+	// Lost requests and blocks are requested again. A block with its 9 byte header does not fit
+	// into the path of memnettest.SmallMTU.
+	tp := memnettest.NewTopology(42002, 0.1, uint16(blockSize)+8)
+	defer tp.Close()
+
+	name := "camera-20171116-212949.jpg"
+	content := make([]byte, 20*int(blockSize)+500)
+	rand.New(rand.NewSource(1)).Read(content)
+	sconn, err := transport.ListenSCION("udp4", tp.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	go serveImage(sconn, name, content)
+
+	for _, c := range tp.Clients {
+		conn, err := tp.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileName, fileBuffer, err := fetchImage(conn)
+		conn.Close()
+		if c.Name == memnettest.SmallMTU {
+			if err == nil {
+				t.Errorf("%s: fetched the image, expected an error", c.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+		if fileName != name || !bytes.Equal(fileBuffer, content) {
+			t.Errorf("%s: fetched %q with %d bytes, expected %q with %d bytes", c.Name, fileName,
+				len(fileBuffer), name, len(content))
+		}
+	}
+}
@@ -11,10 +11,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/perrig/scionlab/transport"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -49,9 +52,16 @@ var (
 	currentFiles     map[string]*imageFileType
 	mostRecentFile   string
 	currentFilesLock sync.Mutex
+
+	// Closed on SIGINT or SIGTERM
+	stopping = make(chan struct{})
+	// Triggers reading the directory right away, on SIGHUP
+	rescan = make(chan struct{}, 1)
 )
 
-func HandleImageFiles() {
+// Reads new images and deletes old ones until the server is stopped, then closes done
+func HandleImageFiles(done chan<- struct{}) {
+	defer close(done)
 	for {
 		// Read the directory and look for new .jpg images
 		direntries, err := ioutil.ReadDir(".")
@@ -93,7 +103,33 @@ func HandleImageFiles() {
 		}
 		currentFilesLock.Unlock()
 
-		time.Sleep(imageReadInterval)
+		select {
+		case <-stopping:
+			return
+		case <-rescan:
+		case <-time.After(imageReadInterval):
+		}
+	}
+}
+
+// SIGHUP makes the server read the directory for new images right away. On SIGINT or SIGTERM,
+// the server stops reading requests once the current request is answered.
+func handleSignals(udpConnection transport.Conn) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			select {
+			case rescan <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		log.Println("Shutting down:", sig)
+		close(stopping)
+		// Unblock the pending read, the connection is closed by main
+		udpConnection.SetReadDeadline(time.Now())
+		return
 	}
 }
 
@@ -106,7 +142,8 @@ func printUsage() {
 func main() {
 	currentFiles = make(map[string]*imageFileType)
 
-	go HandleImageFiles()
+	filesDone := make(chan struct{})
+	go HandleImageFiles(filesDone)
 
 	var (
 		serverAddress  string
@@ -117,7 +154,7 @@ func main() {
 		err    error
 		server *snet.Addr
 
-		udpConnection *snet.Conn
+		udpConnection transport.Conn
 	)
 
 	// Fetch arguments from command line
@@ -145,15 +182,32 @@ func main() {
 	} else if sciondPath == "" {
 		sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
-	snet.Init(server.IA, sciondPath, dispatcherPath)
-	udpConnection, err = snet.ListenSCION("udp4", server)
+	err = transport.Init(server.IA, sciondPath, dispatcherPath)
+	check(err)
+	udpConnection, err = transport.ListenSCION("udp4", server)
 	check(err)
 
+	go handleSignals(udpConnection)
+	handleClients(udpConnection)
+
+	// Let the file handler finish a pending read or delete of the images
+	<-filesDone
+	udpConnection.Close()
+	log.Println("Server stopped")
+}
+
+// Serves client requests arriving on udpConnection until the server is stopped
+func handleClients(udpConnection transport.Conn) {
 	receivePacketBuffer := make([]byte, 2500)
 	sendPacketBuffer := make([]byte, 2500)
 	for {
 		// Handle client requests
 		n, remoteUDPaddress, err := udpConnection.ReadFrom(receivePacketBuffer)
+		select {
+		case <-stopping:
+			return
+		default:
+		}
 		if err != nil {
 			continue
 			// Uncomment and remove "continue" on previous line once the new version of snet is part of the SCIONLab branch
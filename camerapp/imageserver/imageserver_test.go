@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+)
+
+// Returns a GET request for the bytes from start to end of the image
+func getRequest(name string, start, end uint32) []byte {
+	req := append([]byte{'G', byte(len(name))}, name...)
+	req = append(req, make([]byte, 8)...)
+	binary.LittleEndian.PutUint32(req[len(req)-8:], start)
+	binary.LittleEndian.PutUint32(req[len(req)-4:], end)
+	return req
+}
+
+// Fetches the image in blocks of blockSize bytes, like the imagefetcher
+func fetch(conn transport.Conn, name string, size, blockSize uint32) ([]byte, error) {
+	var content []byte
+	for start := uint32(0); start < size; start += blockSize {
+		end := start + blockSize
+		if end > size {
+			end = size
+		}
+		req := getRequest(name, start, end)
+		reply, err := memnettest.Request(conn, req, 10, 100*time.Millisecond)
+		if err != nil {
+			return content, err
+		}
+		if len(reply) < 9 || reply[0] != 'G' || !bytes.Equal(reply[1:9], req[len(req)-8:]) {
+			return content, fmt.Errorf("Unexpected reply %q to %q", reply, req)
+		}
+		content = append(content, reply[9:]...)
+	}
+	return content, nil
+}
+
+// Stops the server like handleSignals does, waits until handleClients has returned and closes
+// conn
+func stopServer(conn transport.Conn, served <-chan struct{}) {
+	close(stopping)
+	conn.SetReadDeadline(time.Now())
+	<-served
+	conn.Close()
+	stopping = make(chan struct{})
+}
+
+func TestHandleClients(t *testing.T) {
+	// The replies carry a block after a 9 byte header, blocks of 500 bytes just fit
+	tp := memnettest.NewTopology(42002, 0.3, 509)
+	defer tp.Close()
+
+	name := "camera-20171116-212949.jpg"
+	content := make([]byte, 5500)
+	rand.New(rand.NewSource(1)).Read(content)
+	currentFiles = map[string]*imageFileType{
+		name: {name, uint32(len(content)), content, time.Now()},
+	}
+	mostRecentFile = name
+
+	conn, err := transport.ListenSCION("udp4", tp.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		handleClients(conn)
+		close(served)
+	}()
+	defer stopServer(conn, served)
+
+	listReply := append([]byte{'L', byte(len(name))}, name...)
+	listReply = append(listReply, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(listReply[len(listReply)-4:], uint32(len(content)))
+	for _, c := range tp.Clients {
+		cconn, err := tp.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := memnettest.Request(cconn, []byte("L"), 10, 100*time.Millisecond)
+		if err != nil || !bytes.Equal(reply, listReply) {
+			t.Errorf("%s: listed %q, %v, expected %q", c.Name, reply, err, listReply)
+		}
+		for _, blockSize := range []uint32{500, 1000} {
+			fetched, err := fetch(cconn, name, uint32(len(content)), blockSize)
+			if c.Name == memnettest.SmallMTU && blockSize > 500 {
+				if err == nil {
+					t.Errorf("%s: fetched blocks of %d bytes, expected them to be dropped", c.Name, blockSize)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(fetched, content) {
+				t.Errorf("%s: fetched %d of %d bytes in blocks of %d bytes: %v", c.Name, len(fetched),
+					len(content), blockSize, err)
+			}
+		}
+		cconn.Close()
+	}
+
+	// Requests for unknown images and invalid ranges are not answered
+	cconn, err := tp.Dial(tp.Client(memnettest.SameAS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	for _, req := range [][]byte{
+		getRequest("unknown.jpg", 0, 1000),
+		getRequest(name, 1000, 1000),
+		getRequest(name, 0, uint32(len(content))+2),
+		[]byte("G"),
+		[]byte("X"),
+	} {
+		if reply, err := memnettest.Request(cconn, req, 1, 100*time.Millisecond); err == nil {
+			t.Errorf("Request %q was answered with %q", req, reply)
+		}
+	}
+}
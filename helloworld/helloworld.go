@@ -15,10 +15,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/perrig/scionlab/transport/pathpolicy"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/spath"
@@ -36,11 +38,17 @@ func main() {
 	var err error
 	var clientCCAddrStr string
 	var serverCCAddrStr string
+	var jsonOutput bool
 	dispatcherPath := "/run/shm/dispatcher/default.sock"
 	// get local and remote addresses from program arguments:
 	flag.StringVar(&clientCCAddrStr, "local", "", "Local SCION Address (e.g. 17-ffaa:1:1,[127.0.0.1]:0)")
 	flag.StringVar(&serverCCAddrStr, "remote", "", "Remote SCION Address (e.g. 17-ffaa:1:1,[127.0.0.1]:12345)")
+	flag.BoolVar(&jsonOutput, "json", false, "Write the list of paths as JSON to stdout, and the other output to stderr")
 	flag.Parse()
+	out := os.Stdout
+	if jsonOutput {
+		out = os.Stderr
+	}
 	if len(clientCCAddrStr) == 0 {
 		Check(fmt.Errorf("Error, local address needs to be specified with -local"))
 	}
@@ -62,19 +70,26 @@ func main() {
 	if len(pathSet) == 0 {
 		Check(fmt.Errorf("No paths"))
 	}
-	// print all paths. Also pick one path. Here we chose the path with less hops:
-	i := 0
-	minLength, argMinPath := 999, (*sciond.PathReplyEntry)(nil)
-	fmt.Println("Available paths:")
-	for _, path := range pathSet {
-		fmt.Printf("[%2d] %d %s\n", i, len(path.Entry.Path.Interfaces)/2, path.Entry.Path.String())
-		if len(path.Entry.Path.Interfaces) < minLength {
-			minLength = len(path.Entry.Path.Interfaces)
+	// print all paths with their fingerprint, hop count, MTU, expiration time and next hop. Also
+	// pick one path. Here we chose the path with less hops, which the "shortest" policy ranks first:
+	paths := pathpolicy.List(pathpolicy.MustParse("shortest"), pathSet)
+	var argMinPath *sciond.PathReplyEntry
+	for _, path := range paths {
+		if path.Rank == 1 {
 			argMinPath = path.Entry
 		}
-		i++
 	}
-	fmt.Println("Chosen path:", argMinPath.Path.String())
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		Check(enc.Encode(paths))
+	} else {
+		fmt.Println("Available paths:")
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+	}
+	fmt.Fprintln(out, "Chosen path:", pathpolicy.Describe(argMinPath))
 	// we need to copy the path to the destination (destination is the whole selected path)
 	serverCCAddr.Path = spath.New(argMinPath.Path.FwdPath)
 	serverCCAddr.Path.InitOffsets()
@@ -88,5 +103,5 @@ func main() {
 	// you could visualize the packet(s) with e.g. sudo tcpdump -i any -n -A -w - |grep -a 'hello world'
 	nBytes, err := conn.Write([]byte("hello world"))
 	Check(err)
-	fmt.Printf("Done. Wrote %d bytes.\n", nBytes)
+	fmt.Fprintf(out, "Done. Wrote %d bytes.\n", nBytes)
 }
@@ -19,6 +19,8 @@ import (
     "github.com/scionproto/scion/go/lib/snet"
 
     "github.com/perrig/scionlab/roughtime/utils"
+    "github.com/perrig/scionlab/transport"
+    "github.com/perrig/scionlab/transport/pathpolicy"
 )
 
 const (
@@ -66,6 +68,10 @@ type Client struct {
     // will be used.
     NumQueries int
 
+    // PathPolicy chooses the path to each server, see the pathpolicy
+    // package. If nil, the path is left to the SCION library.
+    PathPolicy pathpolicy.PathPolicy
+
     // now returns a monotonic duration from some unspecified epoch. If
     // nil, the system monotonic time will be used.
     nowFunc func() time.Duration
@@ -200,7 +206,11 @@ func (c *Client) query(server *config.Server, chain *config.Chain, localAddr *sn
             return nil, err
         }
 
-        conn, err := snet.DialSCION("udp4" /*Change to read this from config */, localAddr ,serverAddr)
+        if err := pathpolicy.Apply(c.PathPolicy, localAddr, serverAddr); err != nil {
+            return nil, err
+        }
+
+        conn, err := transport.DialSCION("udp4" /*Change to read this from config */, localAddr ,serverAddr)
         if err != nil {
             return nil, err
         }
@@ -10,6 +10,7 @@ import (
     "gopkg.in/alecthomas/kingpin.v2"
     "github.com/perrig/scionlab/roughtime/utils"
     "github.com/perrig/scionlab/roughtime/timeclient/lib"
+    "github.com/perrig/scionlab/transport/pathpolicy"
     "roughtime.googlesource.com/go/client/monotime"
 )
 
@@ -20,6 +21,8 @@ var (
     chainFile = app.Flag("chain-file", "Name of a file in which the query chain will be maintained").Default("query-chain.json").String()
     maxChainSize = app.Flag("max-chain-size", "Maximum number of entries in chain file").Default("128").Int()
     serversFile = app.Flag("servers", "Name of the file with server configuration").Default("servers.json").String()
+    pathAlgo = app.Flag("path-algo", "Path policy, e.g. \"shortest\", \"mtu\" or \"expiry\"").String()
+    pathPolicyFile = app.Flag("path-policy-file", "Name of the file with the path policy, instead of --path-algo").String()
 )
 
 const (
@@ -53,7 +56,10 @@ func main(){
         quorum = len(servers)
     }
 
-    var client lib.Client
+    policy, err := pathpolicy.New(*pathAlgo, *pathPolicyFile)
+    checkErr("Loading path policy", err)
+
+    client := lib.Client{PathPolicy: policy}
     result, err := client.EstablishTime(chain, quorum, servers, cAddr)
     checkErr("Establishing time", err)
 
@@ -3,12 +3,15 @@ package main
 import (
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
     "crypto/rand"
     "time"
 
     "golang.org/x/crypto/ed25519"
 	"github.com/perrig/scionlab/roughtime/utils"
-	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/perrig/scionlab/transport"
 	"roughtime.googlesource.com/go/protocol"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -29,6 +32,20 @@ var (
 	gpsTimeDaemon =   runCommand.Flag("gps_timed", "Unix socket location of time daemon").String()
 )
 
+// Keys used to sign the replies, replaced when the private key is reloaded
+type signingKeys struct {
+	cert             []byte
+	onlinePrivateKey ed25519.PrivateKey
+}
+
+var (
+	keys     *signingKeys
+	keysLock sync.Mutex
+
+	// Closed on SIGINT or SIGTERM
+	stopping = make(chan struct{})
+)
+
 func checkErr(action string, err error){
 	if err!=nil {
 		log.Panicf("%s caused an error: %v", action, err)
@@ -55,31 +72,85 @@ func runServers(configurationFile, privateKeyFile string){
 	privateKey, err := utils.ReadPrivateKey(privateKeyFile)
 	checkErr("Loading private key", err)
 
+	keys, err = newSigningKeys(privateKey)
+	checkErr("Generating certificate", err)
+
 	for _, addr := range serverConfig.Addresses{
 		//TODO: run in goroutine
-		serveRequests(addr.Address, addr.Protocol, *gpsTimeDaemon, privateKey)
+		sAddr, err := utils.InitSCIONConnection(addr.Address)
+		checkErr("Initializing SCION connection", err)
+
+		conn, err := transport.ListenSCION(addr.Protocol, sAddr)
+		checkErr("Starting to listen", err)
+
+		go handleSignals(conn, privateKeyFile)
+		serveRequests(conn, *gpsTimeDaemon)
+		conn.Close()
+		select {
+		case <-stopping:
+			log.Printf("Server stopped")
+			return
+		default:
+		}
 	}
 }
 
-func serveRequests(bindAddress, connectionProtocol, timedLocation string, privateKey []byte){
-	sAddr, err := utils.InitSCIONConnection(bindAddress)
-	checkErr("Initializing SCION connection", err)
-
-	conn, err := snet.ListenSCION(connectionProtocol, sAddr)
-	checkErr("Starting to listen", err)
-
+// Creates a temporary key pair and the certificate for it, signed with privateKey
+func newSigningKeys(privateKey []byte) (*signingKeys, error) {
 	onlinePublicKey, onlinePrivateKey, err := ed25519.GenerateKey(rand.Reader)
-	checkErr("Generate temp private key", err)
-	
+	if err != nil {
+		return nil, err
+	}
 	// As this is just an example, the certificate is created covering the
 	// maximum possible range.
 	cert, err := protocol.CreateCertificate(0, ^uint64(0), onlinePublicKey, privateKey)
-	checkErr("Generating certificate", err)
-	
+	if err != nil {
+		return nil, err
+	}
+	return &signingKeys{cert, onlinePrivateKey}, nil
+}
+
+// Reloads the private key on SIGHUP and creates a new certificate with it. On SIGINT or
+// SIGTERM, the server stops reading requests and exits once the current request is answered.
+func handleSignals(conn transport.Conn, privateKeyFile string){
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Shutting down: %v", sig)
+			close(stopping)
+			// Unblock the pending read, the connection is closed by runServers
+			conn.SetReadDeadline(time.Now())
+			return
+		}
+		privateKey, err := utils.ReadPrivateKey(privateKeyFile)
+		if err != nil {
+			log.Printf("Reloading private key caused an error, keeping the previous one: %v", err)
+			continue
+		}
+		k, err := newSigningKeys(privateKey)
+		if err != nil {
+			log.Printf("Generating certificate caused an error, keeping the previous one: %v", err)
+			continue
+		}
+		keysLock.Lock()
+		keys = k
+		keysLock.Unlock()
+		log.Printf("Reloaded private key")
+	}
+}
+
+// Serves the requests arriving on conn until the server is stopped
+func serveRequests(conn transport.Conn, timedLocation string){
 	var packetBuf [protocol.MinRequestSize]byte
 
 	for {
 		n, sourceAddr, err := conn.ReadFrom(packetBuf[:])
+		select {
+		case <-stopping:
+			return
+		default:
+		}
 		if err != nil {
 			log.Print(err)
 		}
@@ -110,7 +181,10 @@ func serveRequests(bindAddress, connectionProtocol, timedLocation string, privat
 		}
 		radius := uint32(1000000)
 
-		replies, err := protocol.CreateReplies([][]byte{nonce}, midpoint, radius, cert, onlinePrivateKey)
+		keysLock.Lock()
+		k := keys
+		keysLock.Unlock()
+		replies, err := protocol.CreateReplies([][]byte{nonce}, midpoint, radius, k.cert, k.onlinePrivateKey)
 		if err != nil {
 			log.Print(err)
 			continue
@@ -122,4 +196,4 @@ func serveRequests(bindAddress, connectionProtocol, timedLocation string, privat
 
 		conn.WriteTo(replies[0], sourceAddr)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+	"golang.org/x/crypto/ed25519"
+	"roughtime.googlesource.com/go/client/monotime"
+	"roughtime.googlesource.com/go/config"
+
+	"github.com/perrig/scionlab/roughtime/timeclient/lib"
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+)
+
+// Queries the servers in the order they are listed
+func inOrder(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	return perm
+}
+
+// Stops the servers like handleSignals does and closes their connections once serveRequests has
+// returned
+func stopServers(conns []transport.Conn, served <-chan struct{}) {
+	close(stopping)
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	for range conns {
+		<-served
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	stopping = make(chan struct{})
+}
+
+// Requests are protocol.MinRequestSize bytes long, so they are dropped on paths with a smaller MTU
+func TestEstablishTime(t *testing.T) {
+	n := memnet.New(1)
+	defer memnettest.Use(n)()
+
+	rootPublicKey, rootPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err = newSigningKeys(rootPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := snet.AddrFromString("1-10,[10.0.0.1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPaths := []struct {
+		name, address string
+		paths         []memnet.PathConfig
+	}{
+		{"direct", "1-11,[10.0.0.11]:2002",
+			[]memnet.PathConfig{{Latency: 5 * time.Millisecond}}},
+		{"lossy", "1-12,[10.0.0.12]:2002",
+			[]memnet.PathConfig{{Latency: 10 * time.Millisecond, Loss: 0.2}}},
+		{"small-mtu-first", "2-21,[10.0.0.21]:2002",
+			[]memnet.PathConfig{{Latency: 5 * time.Millisecond, MTU: 1000}, {Latency: 20 * time.Millisecond}}},
+		{"small-mtu", "2-22,[10.0.0.22]:2002",
+			[]memnet.PathConfig{{Latency: 5 * time.Millisecond, MTU: 1000}}},
+	}
+	var servers []config.Server
+	var conns []transport.Conn
+	served := make(chan struct{}, len(serverPaths))
+	defer func() { stopServers(conns, served) }()
+	for _, s := range serverPaths {
+		sAddr, err := snet.AddrFromString(s.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cfg := range s.paths {
+			n.AddPath(local.IA, sAddr.IA, cfg)
+		}
+		conn, err := transport.ListenSCION("udp4", sAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		go func() {
+			serveRequests(conn, "")
+			served <- struct{}{}
+		}()
+		servers = append(servers, config.Server{
+			Name:          s.name,
+			PublicKeyType: "ed25519",
+			PublicKey:     rootPublicKey,
+			Addresses:     []config.ServerAddress{{Protocol: "udp4", Address: s.address}},
+		})
+	}
+
+	tests := []struct {
+		name     string
+		policy   pathpolicy.PathPolicy
+		quorum   int
+		answered []string
+		failed   []string
+	}{
+		// Without a policy, the first path to each server is used
+		{"first paths", nil, 4, []string{"direct", "lossy"}, []string{"small-mtu-first", "small-mtu"}},
+		{"min_mtu policy", pathpolicy.MustParse("min_mtu 1100"), 3,
+			[]string{"direct", "lossy", "small-mtu-first"}, nil},
+		{"no quorum", pathpolicy.MustParse("min_mtu 1100"), 4,
+			[]string{"direct", "lossy", "small-mtu-first"}, []string{"small-mtu"}},
+	}
+	for _, tc := range tests {
+		client := lib.Client{
+			Permutation:  inOrder,
+			QueryTimeout: 200 * time.Millisecond,
+			NumQueries:   5,
+			PathPolicy:   tc.policy,
+		}
+		chain := &config.Chain{}
+		result, err := client.EstablishTime(chain, tc.quorum, servers, local)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, name := range tc.answered {
+			if _, ok := result.ServerInfo[name]; !ok {
+				t.Errorf("%s: no answer from %s: %v", tc.name, name, result.ServerErrors[name])
+			}
+		}
+		for _, name := range tc.failed {
+			if _, ok := result.ServerErrors[name]; !ok {
+				t.Errorf("%s: expected an error for %s", tc.name, name)
+			}
+		}
+		if len(result.ServerInfo) != len(tc.answered) || len(result.ServerErrors) != len(tc.failed) {
+			t.Errorf("%s: answers %v, errors %v", tc.name, result.ServerInfo, result.ServerErrors)
+		}
+		if len(chain.Links) != len(tc.answered) {
+			t.Errorf("%s: %d links in the chain, expected %d", tc.name, len(chain.Links), len(tc.answered))
+		}
+		if len(tc.answered) < tc.quorum {
+			if result.MonoUTCDelta != nil {
+				t.Errorf("%s: established the time without a quorum", tc.name)
+			}
+			continue
+		}
+		if result.MonoUTCDelta == nil || result.OutOfRangeAnswer {
+			t.Errorf("%s: servers did not agree on the time", tc.name)
+			continue
+		}
+		established := time.Unix(0, int64(monotime.Now()+*result.MonoUTCDelta))
+		if d := time.Since(established); d < -time.Second || d > time.Second {
+			t.Errorf("%s: established time is off by %v", tc.name, d)
+		}
+	}
+}
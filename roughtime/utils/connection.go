@@ -3,6 +3,7 @@ package utils;
 import (
     "log"
 
+    "github.com/perrig/scionlab/transport"
     "github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -20,7 +21,7 @@ func InitSCIONConnection(scionAddressString string)(*snet.Addr, error){
         return nil, err
     }
 
-    err = snet.Init(scionAddress.IA, sciond.GetDefaultSCIONDPath(nil),
+    err = transport.Init(scionAddress.IA, sciond.GetDefaultSCIONDPath(nil),
     	getDispatcherAddr(scionAddress))
     if err != nil {
         return scionAddress, err
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/pathpolicy"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -31,12 +33,14 @@ func main() {
 		sciondPath     string
 		sciondFromIA   bool
 		dispatcherPath string
+		pathAlgo       string
+		policyFile     string
 
 		err    error
 		local  *snet.Addr
 		remote *snet.Addr
 
-		udpConnection *snet.Conn
+		udpConnection transport.Conn
 	)
 
 	// Fetch arguments from command line
@@ -46,6 +50,8 @@ func main() {
 	flag.BoolVar(&sciondFromIA, "sciondFromIA", false, "SCIOND socket path from IA address:ISD-AS")
 	flag.StringVar(&dispatcherPath, "dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path policy, e.g. \"shortest\", \"mtu\" or \"expiry\"")
+	flag.StringVar(&policyFile, "path_policy_file", "", "File with the path policy, instead of -pathAlgo")
 	flag.Parse()
 
 	// Create the SCION UDP socket
@@ -72,18 +78,34 @@ func main() {
 	} else if sciondPath == "" {
 		sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
-	snet.Init(local.IA, sciondPath, dispatcherPath)
-	udpConnection, err = snet.DialSCION("udp4", local, remote)
+	err = transport.Init(local.IA, sciondPath, dispatcherPath)
 	check(err)
+	policy, err := pathpolicy.New(pathAlgo, policyFile)
+	check(err)
+	err = pathpolicy.Apply(policy, local, remote)
+	check(err)
+	udpConnection, err = transport.DialSCION("udp4", local, remote)
+	check(err)
+
+	sensorValues, err := fetchSensorData(udpConnection)
+	check(err)
+
+	fmt.Print(sensorValues)
+}
 
+// Requests the sensor values from the server udpConnection is connected to
+func fetchSensorData(udpConnection transport.Conn) (string, error) {
 	receivePacketBuffer := make([]byte, 2500)
 	sendPacketBuffer := make([]byte, 0)
 
-	n, err := udpConnection.Write(sendPacketBuffer)
-	check(err)
-
-	n, _, err = udpConnection.ReadFrom(receivePacketBuffer)
-	check(err)
+	_, err := udpConnection.Write(sendPacketBuffer)
+	if err != nil {
+		return "", err
+	}
 
-	fmt.Print(string(receivePacketBuffer[:n]))
+	n, _, err := udpConnection.ReadFrom(receivePacketBuffer)
+	if err != nil {
+		return "", err
+	}
+	return string(receivePacketBuffer[:n]), nil
 }
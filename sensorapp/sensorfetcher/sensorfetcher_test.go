@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+)
+
+const sensorValues = "2017/11/16 21:29:49\nTemperature: 21.50 °C\nHumidity: 40.10 %RH\n"
+
+// Answers every request on conn with sensorValues, like the sensorserver
+func serveSensorData(conn transport.Conn) {
+	buf := make([]byte, 2500)
+	for {
+		_, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo([]byte(sensorValues), client)
+	}
+}
+
+// The fetcher uses the path the path policy chooses, the replies do not fit into the first path
+func TestFetchSensorData(t *testing.T) {
+	tp := memnettest.NewTopology(42003, 0, 32)
+	defer tp.Close()
+	sconn, err := transport.ListenSCION("udp4", tp.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	go serveSensorData(sconn)
+
+	local := tp.Client(memnettest.SmallMTU).Addr
+	tp.Net.AddPath(local.IA, tp.Server.IA, memnet.PathConfig{Latency: 20 * time.Millisecond})
+
+	tests := []struct {
+		name   string
+		policy pathpolicy.PathPolicy
+		ok     bool
+	}{
+		{"first path", nil, false},
+		{"min_mtu policy", pathpolicy.MustParse("min_mtu 1000"), true},
+		{"mtu preference", pathpolicy.MustParse("mtu"), true},
+	}
+	for _, tc := range tests {
+		remote := tp.Server.Copy()
+		if err := pathpolicy.Apply(tc.policy, local, remote); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := transport.DialSCION("udp4", local, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		values, err := fetchSensorData(conn)
+		conn.Close()
+		if !tc.ok {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Errorf("%s: expected a timeout, got %q, %v", tc.name, values, err)
+			}
+			continue
+		}
+		if err != nil || values != sensorValues {
+			t.Errorf("%s: fetched %q, %v", tc.name, values, err)
+		}
+	}
+}
@@ -7,11 +7,16 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/perrig/scionlab/transport"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/sciond"
 )
@@ -32,13 +37,16 @@ func check(e error) {
 var sensorData map[string]string
 var sensorDataLock sync.Mutex
 
+// Closed on SIGINT or SIGTERM
+var stopping = make(chan struct{})
+
 func init() {
 	sensorData = make(map[string]string)
 }
 
-// Obtains input from sensor observation application
-func parseInput() {
-	input := bufio.NewScanner(os.Stdin)
+// Obtains input from sensor observation application, which writes to r
+func parseInput(r io.Reader) {
+	input := bufio.NewScanner(r)
 	for input.Scan() {
 		line := input.Text()
 		index := strings.Index(line, TIMEANDSEPARATORSTRING)
@@ -67,7 +75,7 @@ func printUsage() {
 }
 
 func main() {
-	go parseInput()
+	go parseInput(os.Stdin)
 
 	var (
 		serverAddress string
@@ -78,7 +86,7 @@ func main() {
 		err    error
 		server *snet.Addr
 
-		udpConnection *snet.Conn
+		udpConnection transport.Conn
 	)
 
 	// Fetch arguments from command line
@@ -106,14 +114,46 @@ func main() {
 	} else if sciondPath == "" {
 		sciondPath = sciond.GetDefaultSCIONDPath(nil)
 	}
-	snet.Init(server.IA, sciondPath, dispatcherPath)
-	udpConnection, err = snet.ListenSCION("udp4", server)
+	err = transport.Init(server.IA, sciondPath, dispatcherPath)
+	check(err)
+	udpConnection, err = transport.ListenSCION("udp4", server)
 	check(err)
 
+	go handleSignals(udpConnection)
+	handleClients(udpConnection)
+
+	udpConnection.Close()
+	log.Println("Server stopped")
+}
+
+// On SIGINT or SIGTERM, the server stops reading requests once the current request is answered.
+// The server has no configuration to reload, SIGHUP is ignored.
+func handleSignals(udpConnection transport.Conn) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			continue
+		}
+		log.Println("Shutting down:", sig)
+		close(stopping)
+		// Unblock the pending read, the connection is closed by main
+		udpConnection.SetReadDeadline(time.Now())
+		return
+	}
+}
+
+// Serves client requests arriving on udpConnection until the server is stopped
+func handleClients(udpConnection transport.Conn) {
 	receivePacketBuffer := make([]byte, 2500)
 	sendPacketBuffer := make([]byte, 2500)
 	for {
 		_, clientAddress, err := udpConnection.ReadFrom(receivePacketBuffer)
+		select {
+		case <-stopping:
+			return
+		default:
+		}
 		check(err)
 
 		// Packet received, send back response to same client
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet/memnettest"
+)
+
+const sensorInput = `Time: 2017/11/16 21:29:49
+Temperature: 21.50 °C
+Humidity: 40.10 %RH
+a line without a sensor value
+Illuminance: 320.00 lux
+`
+
+// Reply lines after the time, sorted as the server sends them in any order
+var sensorLines = []string{"Humidity: 40.10 %RH", "Illuminance: 320.00 lux", "Temperature: 21.50 °C"}
+
+// Stops the server like handleSignals does, waits until handleClients has returned and closes
+// conn
+func stopServer(conn transport.Conn, served <-chan struct{}) {
+	close(stopping)
+	conn.SetReadDeadline(time.Now())
+	<-served
+	conn.Close()
+	stopping = make(chan struct{})
+}
+
+func TestHandleClients(t *testing.T) {
+	// The requests are empty, but the replies do not fit into the path of memnettest.SmallMTU
+	tp := memnettest.NewTopology(42003, 0.5, 32)
+	defer tp.Close()
+
+	parseInput(strings.NewReader(sensorInput))
+	conn, err := transport.ListenSCION("udp4", tp.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		handleClients(conn)
+		close(served)
+	}()
+	defer stopServer(conn, served)
+
+	for _, c := range tp.Clients {
+		cconn, err := tp.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Lost requests and replies are retried
+		reply, err := memnettest.Request(cconn, nil, 10, 100*time.Millisecond)
+		cconn.Close()
+		if c.Name == memnettest.SmallMTU {
+			if err == nil {
+				t.Errorf("%s: unexpected reply %q", c.Name, reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(string(reply), "\n"), "\n")
+		if lines[0] != "2017/11/16 21:29:49" {
+			t.Errorf("%s: reply starts with %q, expected the time", c.Name, lines[0])
+		}
+		sort.Strings(lines[1:])
+		if strings.Join(lines[1:], "\n") != strings.Join(sensorLines, "\n") {
+			t.Errorf("%s: unexpected sensor values %q", c.Name, lines[1:])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package memnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+// Conn is a connection on an in-memory network. It implements transport.BatchConn.
+type Conn struct {
+	net    *Network
+	local  *snet.Addr
+	remote *snet.Addr
+	ep     endpoint
+	inbox  chan *packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// Closed and replaced when the read deadline changes, to wake up blocked reads
+	readDeadlineChanged chan struct{}
+}
+
+// timeoutError is returned when a deadline expires, it implements net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "memnet: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ErrClosed is returned by the reads and writes of a closed connection. It is
+// transport.ErrClosed, so that transport.IsClosedError recognizes it by identity.
+var ErrClosed = transport.ErrClosed
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromSCION(b)
+	return n, err
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, a, err := c.ReadFromSCION(b)
+	if a == nil {
+		return n, nil, err
+	}
+	return n, a, err
+}
+
+// ReadFromSCION reads the next packet, blocking until one arrives, the read deadline
+// expires or the connection is closed. A read deadline that is set while the read blocks
+// applies to it. Like with UDP, the rest of a packet which does not fit into b is discarded.
+func (c *Conn) ReadFromSCION(b []byte) (int, *snet.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.readDeadlineChanged
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, timeoutError{}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case pkt := <-c.inbox:
+			stopTimer(timer)
+			return copy(b, pkt.data), pkt.src, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, ErrClosed
+		case <-timeout:
+			return 0, nil, timeoutError{}
+		case <-changed:
+			// Wait again with the new deadline
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, fmt.Errorf("memnet: connection has no remote address")
+	}
+	return c.WriteToSCION(b, c.remote)
+}
+
+func (c *Conn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	sa, ok := raddr.(*snet.Addr)
+	if !ok {
+		return 0, fmt.Errorf("memnet: unsupported address type %T", raddr)
+	}
+	return c.WriteToSCION(b, sa)
+}
+
+// WriteToSCION sends b to raddr. Packets that are lost or dropped in the network do not
+// cause an error, only a missing path does.
+func (c *Conn) WriteToSCION(b []byte, raddr *snet.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, timeoutError{}
+	}
+	if err := c.net.send(b, c.local, raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadBatch reads the next packet like ReadFromSCION, followed by the packets that are
+// already queued, up to len(bufs) packets
+func (c *Conn) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, _, err := c.ReadFromSCION(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	i := 1
+	for ; i < len(bufs); i++ {
+		select {
+		case pkt := <-c.inbox:
+			sizes[i] = copy(bufs[i], pkt.data)
+			continue
+		default:
+		}
+		break
+	}
+	return i, nil
+}
+
+// WriteBatch sends the packets to the remote address one after the other
+func (c *Conn) WriteBatch(pkts [][]byte) (int, error) {
+	for i, b := range pkts {
+		if _, err := c.Write(b); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// Close removes the connection from the network, blocked reads return an error
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.net.removeConn(c)
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setReadDeadline(t)
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setReadDeadline(t)
+	return nil
+}
+
+// Sets the read deadline and wakes up the blocked reads, c.mu must be held
+func (c *Conn) setReadDeadline(t time.Time) {
+	c.readDeadline = t
+	close(c.readDeadlineChanged)
+	c.readDeadlineChanged = make(chan struct{})
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,127 @@
+package memnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+// Returns a connection listening on address and one sending to it, in the same AS
+func connPair(t *testing.T, n *Network, address string) (*Conn, *Conn) {
+	laddr, err := snet.AddrFromString(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err := n.ListenSCION("udp4", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saddr := laddr.Copy()
+	saddr.L4Port = 0
+	send, err := n.DialSCION("udp4", saddr, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recv.(*Conn), send.(*Conn)
+}
+
+type readResult struct {
+	n   int
+	err error
+	at  time.Time
+}
+
+// Starts a read on c and returns the channel its result is sent to
+func startRead(c *Conn) <-chan readResult {
+	res := make(chan readResult, 1)
+	go func() {
+		n, _, err := c.ReadFrom(make([]byte, 100))
+		res <- readResult{n, err, time.Now()}
+	}()
+	// Let the read block
+	time.Sleep(20 * time.Millisecond)
+	return res
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestReadDeadlineDuringRead(t *testing.T) {
+	n := New(1)
+	defer n.Close()
+	recv, send := connPair(t, n, "1-11,[10.0.0.1]:4000")
+	defer recv.Close()
+	defer send.Close()
+
+	// A deadline in the past unblocks the read right away, as servers do to shut down
+	res := startRead(recv)
+	recv.SetReadDeadline(time.Now())
+	select {
+	case r := <-res:
+		if !isTimeout(r.err) {
+			t.Errorf("Read returned %d, %v, expected a timeout", r.n, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read was not unblocked by the deadline")
+	}
+
+	// A later deadline replaces an earlier one
+	recv.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	res = startRead(recv)
+	start := time.Now()
+	recv.SetReadDeadline(start.Add(200 * time.Millisecond))
+	r := <-res
+	if !isTimeout(r.err) || r.at.Sub(start) < 150*time.Millisecond {
+		t.Errorf("Read returned %v after %v, expected a timeout after 200ms", r.err, r.at.Sub(start))
+	}
+
+	// Without a deadline, the read waits for the next packet
+	recv.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	res = startRead(recv)
+	recv.SetReadDeadline(time.Time{})
+	time.Sleep(100 * time.Millisecond)
+	if _, err := send.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res; r.err != nil || r.n != 4 {
+		t.Errorf("Read returned %d, %v, expected the packet", r.n, r.err)
+	}
+
+	// Closing the connection unblocks the read
+	res = startRead(recv)
+	recv.Close()
+	if r := <-res; r.err != ErrClosed {
+		t.Errorf("Read returned %v, expected %v", r.err, ErrClosed)
+	}
+}
+
+// The errors of memnet are recognized by transport.IsPathError and transport.IsClosedError
+func TestErrors(t *testing.T) {
+	n := New(1)
+	defer n.Close()
+	local, _ := snet.AddrFromString("1-11,[10.0.0.1]:4000")
+	remote, _ := snet.AddrFromString("1-12,[10.0.0.2]:4000")
+	c, err := n.DialSCION("udp4", local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrPathNotFound || !transport.IsPathError(err) {
+		t.Errorf("Write without a path returned %v", err)
+	}
+	entry := n.AddPath(local.IA, remote.IA, PathConfig{})
+	n.BreakPath(entry, true)
+	if _, err := c.Write([]byte("x")); err != ErrPathFailed || !transport.IsPathError(err) {
+		t.Errorf("Write along a broken path returned %v", err)
+	}
+	c.Close()
+	if _, err := c.Write([]byte("x")); err != ErrClosed || !transport.IsClosedError(err) ||
+		transport.IsPathError(err) {
+		t.Errorf("Write on a closed connection returned %v", err)
+	}
+}
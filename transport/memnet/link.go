@@ -0,0 +1,87 @@
+package memnet
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// link carries the packets of one direction of a path. Packets are delivered in the order
+// they were sent, after the serialization delay (if the bandwidth is limited) and the
+// latency of the path.
+type link struct {
+	net *Network
+	cfg *PathConfig
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	freeAt time.Time // time at which the link has sent all queued packets
+	lastAt time.Time // delivery time of the most recently queued packet
+	queue  chan *packet
+}
+
+func newLink(n *Network, cfg *PathConfig, seed int64) *link {
+	l := &link{
+		net:   n,
+		cfg:   cfg,
+		rnd:   rand.New(rand.NewSource(seed)),
+		queue: make(chan *packet, LinkQueueLen),
+	}
+	go l.run()
+	return l
+}
+
+func (l *link) enqueue(pkt *packet) {
+	now := time.Now()
+	l.mu.Lock()
+	if l.cfg.Loss > 0 && l.rnd.Float64() < l.cfg.Loss {
+		l.mu.Unlock()
+		l.net.count(&l.net.stats.Lost)
+		return
+	}
+	sent := now
+	if l.cfg.Bandwidth > 0 {
+		start := now
+		if l.freeAt.After(start) {
+			start = l.freeAt
+		}
+		if start.Sub(now) > MaxQueueDelay {
+			// The queue in front of the link is full
+			l.mu.Unlock()
+			l.net.count(&l.net.stats.Dropped)
+			return
+		}
+		sent = start.Add(time.Duration(int64(len(pkt.data)) * 8 * int64(time.Second) / l.cfg.Bandwidth))
+		l.freeAt = sent
+	}
+	pkt.at = sent.Add(l.cfg.Latency)
+	if pkt.at.Before(l.lastAt) {
+		pkt.at = l.lastAt
+	}
+	select {
+	case l.queue <- pkt:
+		l.lastAt = pkt.at
+		l.mu.Unlock()
+	default:
+		l.mu.Unlock()
+		l.net.count(&l.net.stats.Dropped)
+	}
+}
+
+func (l *link) run() {
+	for {
+		select {
+		case pkt := <-l.queue:
+			if d := time.Until(pkt.at); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-l.net.done:
+					return
+				}
+			}
+			l.net.deliver(pkt)
+		case <-l.net.done:
+			return
+		}
+	}
+}
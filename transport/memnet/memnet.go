@@ -0,0 +1,417 @@
+// Package memnet implements an in-memory SCION network, which allows running the scionlab
+// applications without a dispatcher or sciond, e.g., to test them end-to-end on a laptop.
+//
+// A Network simulates any number of ISD-ASes. Hosts are identified by their SCION address
+// (ISD-AS, host and port), packets within the same AS are delivered right away. Packets between
+// ASes are sent along paths which are added with AddPath, each with its own latency, loss rate,
+// MTU and bandwidth. Packets on a path are delivered in order, and the losses on a path are
+// drawn from a PRG seeded from the network seed, so that a given sequence of packets on a path
+// always sees the same losses.
+//
+// To use it in place of SCION, set transport.DefNetwork before the applications initialize
+// the network:
+//
+//	n := memnet.New(1)
+//	n.AddPath(clientIA, serverIA, memnet.PathConfig{Latency: 10 * time.Millisecond})
+//	n.AddPath(serverIA, clientIA, memnet.PathConfig{Latency: 10 * time.Millisecond})
+//	transport.DefNetwork = n
+package memnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+const (
+	// MTU of paths that do not specify one
+	DefaultMTU uint16 = 1472
+	// Lifetime of paths that do not specify an expiry time
+	DefaultPathLifetime time.Duration = time.Hour * 6
+	// Number of packets that can be waiting in the receive queue of a connection
+	ReceiveQueueLen int = 4096
+	// Number of packets that can be in flight on a path
+	LinkQueueLen int = 65536
+	// Packets that would wait longer than this to be sent on a bandwidth limited path are dropped
+	MaxQueueDelay time.Duration = time.Millisecond * 100
+
+	// Port the fake border routers listen on
+	nextHopPort uint16 = 30041
+	// Ports assigned to connections which do not specify a local port
+	firstEphemeralPort uint16 = 32768
+	// Length of the info and hop fields in the raw paths
+	lineLen = 8
+	// Flag set in the info field of paths in construction direction
+	flagConsDir byte = 0x01
+)
+
+var nextHopHost = addr.HostFromIP(net.IPv4(127, 0, 0, 1))
+
+// Errors of writes along paths that do not work, which transport.IsPathError recognizes by
+// identity
+var (
+	// No path to the destination was added
+	ErrPathNotFound = transport.ErrPathNotFound
+	// The path was broken with BreakPath and an SCMP error
+	ErrPathFailed = transport.ErrPathFailed
+)
+
+// PathConfig describes a path between two ISD-ASes
+type PathConfig struct {
+	// Interfaces traversed by the path. If empty, one interface in the source and one in the
+	// destination AS is used.
+	Interfaces []sciond.PathInterface
+	// One-way delay of the path
+	Latency time.Duration
+	// Probability in [0,1] that a packet is lost
+	Loss float64
+	// Packets larger than the MTU are dropped. If 0, DefaultMTU is used.
+	MTU uint16
+	// Bandwidth of the path in bits per second, 0 means unlimited
+	Bandwidth int64
+	// Expiration time of the path, after which packets on it are dropped. If zero, the
+	// path expires DefaultPathLifetime after it was added.
+	Expiry time.Time
+}
+
+// Stats counts the packets handled by a Network
+type Stats struct {
+	Sent      int64 // Packets written to a connection
+	Delivered int64 // Packets placed in the receive queue of a connection
+	Lost      int64 // Packets lost according to the loss rate of the path
+	Dropped   int64 // Packets dropped because of the MTU, full queues, expired or broken paths or missing receivers
+}
+
+// Network is an in-memory SCION network. It implements transport.Network.
+type Network struct {
+	seed int64
+
+	mu       sync.Mutex
+	conns    map[endpoint]*Conn
+	paths    map[iaPair][]*path
+	pathByID map[uint32]*path
+	nextID   uint32
+	nextPort uint16
+	stats    Stats
+	done     chan struct{}
+}
+
+type endpoint struct {
+	ia   addr.IA
+	host string
+	port uint16
+}
+
+type iaPair struct {
+	src, dst addr.IA
+}
+
+type path struct {
+	id       uint32
+	src, dst addr.IA
+	cfg      PathConfig
+	raw      common.RawBytes
+	entry    *sciond.PathReplyEntry
+	// links for the forward and the reverse direction
+	links [2]*link
+	// Set by BreakPath, protected by Network.mu
+	broken     bool
+	brokenSCMP bool
+}
+
+type packet struct {
+	data []byte
+	src  *snet.Addr
+	dst  endpoint
+	at   time.Time
+}
+
+// New creates an empty network, the seed determines the packet losses on all paths
+func New(seed int64) *Network {
+	return &Network{
+		seed:     seed,
+		conns:    make(map[endpoint]*Conn),
+		paths:    make(map[iaPair][]*path),
+		pathByID: make(map[uint32]*path),
+		nextID:   1,
+		nextPort: firstEphemeralPort,
+		done:     make(chan struct{}),
+	}
+}
+
+// AddPath adds a path from src to dst and returns the entry that is returned for it by the
+// path resolver. Replies to packets sent along the path travel along the same path in
+// reverse direction, but the path is not returned for queries from dst to src.
+func (n *Network) AddPath(src, dst addr.IA, cfg PathConfig) *sciond.PathReplyEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id := n.nextID
+	n.nextID++
+	if cfg.MTU == 0 {
+		cfg.MTU = DefaultMTU
+	}
+	if cfg.Expiry.IsZero() {
+		cfg.Expiry = time.Now().Add(DefaultPathLifetime)
+	}
+	if len(cfg.Interfaces) == 0 {
+		cfg.Interfaces = []sciond.PathInterface{
+			{RawIsdas: src.IAInt(), IfID: common.IFIDType(id)},
+			{RawIsdas: dst.IAInt(), IfID: common.IFIDType(id)},
+		}
+	}
+	p := &path{id: id, src: src, dst: dst, cfg: cfg, raw: rawPath(id, len(cfg.Interfaces))}
+	p.entry = &sciond.PathReplyEntry{
+		Path: &sciond.FwdPathMeta{
+			FwdPath:    p.raw,
+			Mtu:        cfg.MTU,
+			Interfaces: cfg.Interfaces,
+			ExpTime:    uint32(cfg.Expiry.Unix()),
+		},
+	}
+	p.entry.HostInfo.Port = nextHopPort
+	p.entry.HostInfo.Addrs.Ipv4 = nextHopHost.IP()
+	for dir := range p.links {
+		p.links[dir] = newLink(n, &p.cfg, n.seed^int64(id<<1|uint32(dir)))
+	}
+	key := iaPair{src, dst}
+	n.paths[key] = append(n.paths[key], p)
+	n.pathByID[id] = p
+	return p.entry
+}
+
+// BreakPath makes the path of entry unusable in both directions, as if one of its links went
+// down: packets sent along it are dropped. If scmp is set, the write of each such packet
+// returns ErrPathFailed, as if a router had reported the failure right away with an SCMP
+// error, otherwise the packets disappear without notice.
+func (n *Network) BreakPath(entry *sciond.PathReplyEntry, scmp bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range n.pathByID {
+		if p.entry == entry {
+			p.broken, p.brokenSCMP = true, scmp
+		}
+	}
+}
+
+// rawPath creates a raw path consisting of an info field followed by one hop field per hop.
+// The path id is stored in the timestamp of the info field.
+func rawPath(id uint32, hops int) common.RawBytes {
+	raw := make(common.RawBytes, lineLen*(hops+1))
+	raw[0] = flagConsDir
+	binary.BigEndian.PutUint32(raw[1:], id)
+	raw[lineLen-1] = byte(hops)
+	return raw
+}
+
+// reversePath returns a copy of raw for the opposite direction
+func reversePath(raw common.RawBytes) common.RawBytes {
+	rev := make(common.RawBytes, len(raw))
+	copy(rev, raw)
+	rev[0] ^= flagConsDir
+	return rev
+}
+
+// PathResolver returns the network itself, which answers path queries
+func (n *Network) PathResolver() transport.PathResolver {
+	return n
+}
+
+// Query returns the paths from src to dst
+func (n *Network) Query(src, dst addr.IA) spathmeta.AppPathSet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	set := make(spathmeta.AppPathSet)
+	for _, p := range n.paths[iaPair{src, dst}] {
+		set[spathmeta.PathKey(fmt.Sprintf("memnet-%d", p.id))] = &spathmeta.AppPath{Entry: p.entry}
+	}
+	return set
+}
+
+// ListenSCION opens a connection on laddr, if the port is 0 a free port is chosen
+func (n *Network) ListenSCION(network string, laddr *snet.Addr) (transport.Conn, error) {
+	return n.newConn(laddr, nil)
+}
+
+// DialSCION opens a connection from laddr to raddr, if the local port is 0 a free port
+// is chosen
+func (n *Network) DialSCION(network string, laddr, raddr *snet.Addr) (transport.Conn, error) {
+	if raddr == nil {
+		return nil, fmt.Errorf("memnet: remote address required")
+	}
+	return n.newConn(laddr, raddr.Copy())
+}
+
+func (n *Network) newConn(laddr, raddr *snet.Addr) (*Conn, error) {
+	if laddr == nil {
+		return nil, fmt.Errorf("memnet: local address required")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	local := laddr.Copy()
+	if local.L4Port == 0 {
+		for {
+			local.L4Port = n.nextPort
+			n.nextPort++
+			if n.nextPort == 0 {
+				n.nextPort = firstEphemeralPort
+			}
+			if _, ok := n.conns[endpointOf(local)]; !ok {
+				break
+			}
+		}
+	}
+	ep := endpointOf(local)
+	if _, ok := n.conns[ep]; ok {
+		return nil, fmt.Errorf("memnet: address %v already in use", local)
+	}
+	c := &Conn{
+		net:    n,
+		local:  local,
+		remote: raddr,
+		ep:     ep,
+		inbox:  make(chan *packet, ReceiveQueueLen),
+		closed: make(chan struct{}),
+
+		readDeadlineChanged: make(chan struct{}),
+	}
+	n.conns[ep] = c
+	return c, nil
+}
+
+func endpointOf(a *snet.Addr) endpoint {
+	ep := endpoint{ia: a.IA, port: a.L4Port}
+	if a.Host != nil {
+		ep.host = a.Host.String()
+	}
+	return ep
+}
+
+// Stats returns the packet counters of the network
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Close stops the delivery of packets that are still in flight
+func (n *Network) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+}
+
+func (n *Network) count(counter *int64) {
+	n.mu.Lock()
+	*counter++
+	n.mu.Unlock()
+}
+
+// send routes b from the connection at src to dst
+func (n *Network) send(b []byte, src *snet.Addr, dst *snet.Addr) error {
+	n.count(&n.stats.Sent)
+	pkt := &packet{data: append([]byte(nil), b...), dst: endpointOf(dst)}
+	if src.IA.Eq(dst.IA) {
+		pkt.src = src.Copy()
+		n.deliver(pkt)
+		return nil
+	}
+	p, dir, err := n.route(src.IA, dst)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	broken, brokenSCMP := p.broken, p.brokenSCMP
+	n.mu.Unlock()
+	if broken {
+		n.count(&n.stats.Dropped)
+		if brokenSCMP {
+			return ErrPathFailed
+		}
+		return nil
+	}
+	if len(b) > int(p.cfg.MTU) || time.Now().After(p.cfg.Expiry) {
+		n.count(&n.stats.Dropped)
+		return nil
+	}
+	// The receiver sees the path in the reverse direction, as with snet
+	pkt.src = src.Copy()
+	if dir == 0 {
+		pkt.src.Path = spath.New(reversePath(p.raw))
+	} else {
+		pkt.src.Path = spath.New(p.raw)
+	}
+	pkt.src.NextHopHost = nextHopHost
+	pkt.src.NextHopPort = nextHopPort
+	p.links[dir].enqueue(pkt)
+	return nil
+}
+
+// route finds the path and its direction for a packet from srcIA to dst. If dst has no path
+// set, the first path to dst is used, as snet would do when querying sciond.
+func (n *Network) route(srcIA addr.IA, dst *snet.Addr) (*path, int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if dst.Path == nil || len(dst.Path.Raw) == 0 {
+		candidates := n.paths[iaPair{srcIA, dst.IA}]
+		if len(candidates) == 0 {
+			return nil, 0, ErrPathNotFound
+		}
+		// Paths are stored in the order they were added
+		return candidates[0], 0, nil
+	}
+	raw := dst.Path.Raw
+	if len(raw) < lineLen {
+		return nil, 0, fmt.Errorf("memnet: malformed path")
+	}
+	p, ok := n.pathByID[binary.BigEndian.Uint32(raw[1:])]
+	if !ok {
+		return nil, 0, fmt.Errorf("memnet: unknown path")
+	}
+	if raw[0]&flagConsDir != 0 && p.src.Eq(srcIA) && p.dst.Eq(dst.IA) {
+		return p, 0, nil
+	}
+	if raw[0]&flagConsDir == 0 && p.dst.Eq(srcIA) && p.src.Eq(dst.IA) {
+		return p, 1, nil
+	}
+	return nil, 0, fmt.Errorf("memnet: path does not connect %v and %v", srcIA, dst.IA)
+}
+
+// deliver places pkt into the receive queue of its destination connection
+func (n *Network) deliver(pkt *packet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.conns[pkt.dst]
+	if !ok {
+		n.stats.Dropped++
+		return
+	}
+	select {
+	case c.inbox <- pkt:
+		n.stats.Delivered++
+	default:
+		n.stats.Dropped++
+	}
+}
+
+func (n *Network) removeConn(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.ep] == c {
+		delete(n.conns, c.ep)
+	}
+}
@@ -0,0 +1,132 @@
+// Package memnettest provides the in-memory network that the tests of the scionlab applications
+// run their clients and servers on: a server with clients in several ISD-ASes, each with its own
+// path to the server.
+package memnettest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+
+	"github.com/perrig/scionlab/transport"
+	"github.com/perrig/scionlab/transport/memnet"
+	"github.com/perrig/scionlab/transport/pathpolicy"
+)
+
+// Names of the clients of a Topology
+const (
+	SameAS   = "same AS"   // In the AS of the server
+	SameISD  = "same ISD"  // In another AS of the ISD of the server
+	OtherISD = "other ISD" // In another ISD
+	Lossy    = "lossy"     // Its path loses packets
+	SmallMTU = "small MTU" // Its path has a small MTU
+)
+
+// Use sets transport.DefNetwork to n. The returned function closes n and restores the previous
+// DefNetwork.
+func Use(n *memnet.Network) func() {
+	prev := transport.DefNetwork
+	transport.DefNetwork = n
+	return func() {
+		n.Close()
+		transport.DefNetwork = prev
+	}
+}
+
+// Topology is a network with a server in 1-11 and the clients SameAS, SameISD, OtherISD, Lossy
+// and SmallMTU, in that order
+type Topology struct {
+	Net     *memnet.Network
+	Server  *snet.Addr
+	Clients []*Client
+	restore func()
+}
+
+// Client is a host of a Topology
+type Client struct {
+	Name string
+	// Address with port 0, so that the network chooses a free one
+	Addr *snet.Addr
+	// Path to the server, nil in the AS of the server
+	Path *sciond.PathReplyEntry
+}
+
+// NewTopology creates a Topology whose server listens on port, sets it as transport.DefNetwork
+// until Close, and adds the clients. The path of client Lossy loses the fraction loss of the
+// packets, the path of client SmallMTU has the MTU mtu.
+func NewTopology(port uint16, loss float64, mtu uint16) *Topology {
+	tp := &Topology{Net: memnet.New(1), Server: mustAddr(fmt.Sprintf("1-11,[10.0.0.11]:%d", port))}
+	tp.restore = Use(tp.Net)
+	clients := []struct {
+		name, addr string
+		path       *memnet.PathConfig
+	}{
+		{SameAS, "1-11,[10.0.0.2]:0", nil},
+		{SameISD, "1-12,[10.0.0.3]:0", &memnet.PathConfig{Latency: 5 * time.Millisecond}},
+		{OtherISD, "2-21,[10.0.0.4]:0", &memnet.PathConfig{Latency: 20 * time.Millisecond}},
+		{Lossy, "2-22,[10.0.0.5]:0", &memnet.PathConfig{Latency: 5 * time.Millisecond, Loss: loss}},
+		{SmallMTU, "2-23,[10.0.0.6]:0", &memnet.PathConfig{Latency: 5 * time.Millisecond, MTU: mtu}},
+	}
+	for _, c := range clients {
+		client := &Client{Name: c.name, Addr: mustAddr(c.addr)}
+		if c.path != nil {
+			client.Path = tp.Net.AddPath(client.Addr.IA, tp.Server.IA, *c.path)
+		}
+		tp.Clients = append(tp.Clients, client)
+	}
+	return tp
+}
+
+func mustAddr(s string) *snet.Addr {
+	a, err := snet.AddrFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Close closes the network and restores the previous transport.DefNetwork
+func (tp *Topology) Close() {
+	tp.restore()
+}
+
+// Client returns the client with the given name, nil if there is none
+func (tp *Topology) Client(name string) *Client {
+	for _, c := range tp.Clients {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Dial opens a connection from c to the server along the path of c
+func (tp *Topology) Dial(c *Client) (transport.Conn, error) {
+	remote := tp.Server.Copy()
+	if c.Path != nil {
+		pathpolicy.SetPath(remote, c.Path)
+	}
+	return transport.DialSCION("udp4", c.Addr, remote)
+}
+
+// Request sends req on conn and waits up to timeout for the reply, and sends it again if none
+// arrives, up to attempts times. Returns the reply or the error of the last read.
+func Request(conn transport.Conn, req []byte, attempts int, timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, 2500)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		var n int
+		if n, _, err = conn.ReadFrom(buf); err == nil {
+			return buf[:n], nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,128 @@
+package pathpolicy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+)
+
+// PathInfo describes a path in listings of the paths, so that users can tell the paths apart
+// and tools can consume them as JSON
+type PathInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Hops        []HopInfo `json:"hops"`
+	MTU         uint16    `json:"mtu"`
+	Expiry      time.Time `json:"expiry"`
+	NextHop     string    `json:"next_hop"` // Border router of the local AS, empty if unknown
+}
+
+// HopInfo is a hop of a path, i.e. an interface it traverses
+type HopInfo struct {
+	IA   string `json:"ia"`
+	IfID uint64 `json:"ifid"`
+}
+
+// Describe returns the description of path
+func Describe(path *sciond.PathReplyEntry) *PathInfo {
+	pi := &PathInfo{Fingerprint: Fingerprint(path), Hops: []HopInfo{}, MTU: path.Path.Mtu,
+		Expiry: path.Path.Expiry(), NextHop: nextHop(&path.HostInfo)}
+	for _, iface := range path.Path.Interfaces {
+		pi.Hops = append(pi.Hops, HopInfo{IA: iface.ISD_AS().String(), IfID: uint64(iface.IfID)})
+	}
+	return pi
+}
+
+// Returns the address of the next hop, or an empty string if the path has none
+func nextHop(h *sciond.HostInfo) string {
+	var ip net.IP
+	switch {
+	case len(h.Addrs.Ipv4) > 0:
+		ip = h.Addrs.Ipv4
+	case len(h.Addrs.Ipv6) > 0:
+		ip = h.Addrs.Ipv6
+	default:
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(h.Port)))
+}
+
+// String formats the description on one line, e.g.
+// "b871154a8b021210 4 hops, MTU 1472, expires 2018-10-18 18:04:05 (in 5h59m), next hop 10.0.0.1:30041"
+func (pi *PathInfo) String() string {
+	return pi.Fingerprint + " " + pi.details()
+}
+
+// Returns the description without the fingerprint
+func (pi *PathInfo) details() string {
+	s := fmt.Sprintf("%d hops, MTU %d, %s", len(pi.Hops), pi.MTU, formatExpiry(pi.Expiry))
+	if len(pi.NextHop) > 0 {
+		s += ", next hop " + pi.NextHop
+	}
+	return s
+}
+
+// Returns the expiration time with the time left until then, in minutes unless it is less
+func formatExpiry(t time.Time) string {
+	expiry := t.Format("2006-01-02 15:04:05")
+	left := time.Until(t)
+	switch {
+	case left <= 0:
+		return "expired " + expiry
+	case left < time.Minute:
+		return fmt.Sprintf("expires %s (in %s)", expiry, left.Round(time.Second))
+	}
+	return fmt.Sprintf("expires %s (in %s)", expiry, strings.TrimSuffix(left.Round(time.Minute).String(), "0s"))
+}
+
+// ListedPath is a path in a listing of the paths to a destination, with its rank under the path
+// policy of the listing
+type ListedPath struct {
+	*PathInfo
+	// Position in the listing, by which interactive applications let the user choose the path
+	Index int `json:"index"`
+	// 1 for the path the policy prefers, 0 if the policy does not accept the path
+	Rank  int                    `json:"rank"`
+	Entry *sciond.PathReplyEntry `json:"-"`
+}
+
+// List returns the paths of pathSet ordered by their key, so that the order does not change
+// between runs, with their description and their rank under p, see Rank. A nil policy accepts
+// all paths and uses the default preference.
+func List(p PathPolicy, pathSet spathmeta.AppPathSet) []*ListedPath {
+	rank := make(map[*spathmeta.AppPath]int)
+	for i, path := range Rank(p, pathSet) {
+		rank[path] = i + 1
+	}
+	var keys []string
+	for k := range pathSet {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+	var listed []*ListedPath
+	for i, k := range keys {
+		path := pathSet[spathmeta.PathKey(k)]
+		listed = append(listed, &ListedPath{PathInfo: Describe(path.Entry), Index: i, Rank: rank[path],
+			Entry: path.Entry})
+	}
+	return listed
+}
+
+// String formats the path for a listing, the description on the first line and the hops on the
+// second, e.g.
+//
+//	[ 0] b871154a8b021210 rank 1, 4 hops, MTU 1472, expires 2018-10-18 18:04:05 (in 5h59m), next hop 10.0.0.1:30041
+//	     Hops: [1-ff00:0:110 1>2 1-ff00:0:111 3>1 1-ff00:0:112] Mtu: 1472
+func (lp *ListedPath) String() string {
+	rank := "not accepted by the path policy"
+	if lp.Rank > 0 {
+		rank = fmt.Sprintf("rank %d", lp.Rank)
+	}
+	return fmt.Sprintf("[%2d] %s %s, %s\n     %s", lp.Index, lp.Fingerprint, rank, lp.details(),
+		lp.Entry.Path.String())
+}
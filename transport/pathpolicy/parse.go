@@ -0,0 +1,329 @@
+package pathpolicy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+)
+
+// Default is the policy used if none is given: it accepts all paths and weighs the number of
+// hops and the MTU equally
+var Default = MustParse("")
+
+// Preferences of a policy that has none
+var defaultWeights = map[string]float64{"shortest": 1, "mtu": 1}
+
+// Policy is a PathPolicy written in the policy language, see Parse
+type Policy struct {
+	expr     string
+	requires [][]HopPredicate
+	avoids   [][]HopPredicate
+	sequence []HopPredicate // nil if any sequence of hops is accepted
+	prefix   string         // Prefix of the fingerprint, empty if any path is accepted
+	minMTU   uint16
+	maxHops  int
+	weights  map[string]float64 // Weight of each preference, see metrics
+}
+
+// Parse parses a policy. A policy is a list of clauses, separated by semicolons or newlines:
+//
+//	require HOPS    the path traverses hops matching the hop predicates in this order
+//	avoid HOPS      the path does not traverse hops matching the hop predicates in this order
+//	min_mtu N       the MTU of the path is at least N bytes
+//	max_hops N      the path has at most N hops (interfaces)
+//	sequence HOPS   the hops of the path match the hop predicates, one predicate per hop
+//	fingerprint FP  the fingerprint of the path starts with FP, see Fingerprint
+//	PREFERENCE      the weighted sum of shortest, mtu and expiry, e.g. "2*shortest + expiry"
+//
+// HOPS are hop predicates separated by spaces, see ParseHopPredicate; the hops they match need
+// not be adjacent. A path is accepted if it satisfies all constraints, and its score is the sum
+// of the preferences; without a preference, "shortest + mtu" is used.
+func Parse(expr string) (*Policy, error) {
+	p := &Policy{expr: expr, weights: make(map[string]float64)}
+	for _, line := range strings.Split(expr, "\n") {
+		for _, clause := range strings.Split(line, ";") {
+			if err := p.parseClause(strings.TrimSpace(clause)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(p.weights) == 0 {
+		p.weights = defaultWeights
+	}
+	return p, nil
+}
+
+// MustParse is like Parse but panics if the policy is invalid
+func MustParse(expr string) *Policy {
+	p, err := Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Load reads a policy from a file, one clause per line. Empty lines and lines starting with
+// '#' are ignored.
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && line[0] != '#' {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	p, err := Parse(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) parseClause(clause string) error {
+	fields := strings.Fields(clause)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "require", "avoid":
+		if len(fields) == 1 {
+			return fmt.Errorf("Missing hops in %q", clause)
+		}
+		hops, err := ParseHopPredicates(strings.Join(fields[1:], " "))
+		if err != nil {
+			return err
+		}
+		if fields[0] == "require" {
+			p.requires = append(p.requires, hops)
+		} else {
+			p.avoids = append(p.avoids, hops)
+		}
+	case "sequence":
+		if len(fields) == 1 {
+			return fmt.Errorf("Missing hops in %q", clause)
+		}
+		hops, err := ParseHopPredicates(strings.Join(fields[1:], " "))
+		if err != nil {
+			return err
+		}
+		p.sequence = hops
+	case "fingerprint":
+		if len(fields) != 2 || !isFingerprint(fields[1]) {
+			return fmt.Errorf("Invalid clause %q, expected fingerprint followed by at least %d hex digits",
+				clause, minFingerprintLen)
+		}
+		p.prefix = strings.ToLower(fields[1])
+	case "min_mtu":
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid clause %q, expected min_mtu N", clause)
+		}
+		mtu, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return fmt.Errorf("Invalid MTU in %q", clause)
+		}
+		p.minMTU = uint16(mtu)
+	case "max_hops":
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid clause %q, expected max_hops N", clause)
+		}
+		hops, err := strconv.Atoi(fields[1])
+		if err != nil || hops < 1 {
+			return fmt.Errorf("Invalid number of hops in %q", clause)
+		}
+		p.maxHops = hops
+	default:
+		return p.parsePreference(clause)
+	}
+	return nil
+}
+
+// Parses a weighted sum of preferences, e.g. "2*shortest + 0.5*expiry"
+func (p *Policy) parsePreference(clause string) error {
+	for _, term := range strings.Split(clause, "+") {
+		term = strings.Replace(term, " ", "", -1)
+		weight := 1.0
+		if i := strings.Index(term, "*"); i >= 0 {
+			w, err := strconv.ParseFloat(term[:i], 64)
+			if err != nil || w < 0 {
+				return fmt.Errorf("Invalid weight in %q", clause)
+			}
+			weight, term = w, term[i+1:]
+		}
+		if _, ok := metrics[term]; !ok {
+			return fmt.Errorf("Unknown path policy %q, expected require, avoid, sequence, "+
+				"fingerprint, min_mtu, max_hops or a weighted sum of shortest, mtu and expiry", term)
+		}
+		p.weights[term] += weight
+	}
+	return nil
+}
+
+// Accept returns true if the path satisfies all constraints of the policy
+func (p *Policy) Accept(path *sciond.PathReplyEntry) bool {
+	ifaces := path.Path.Interfaces
+	if p.minMTU > 0 && path.Path.Mtu < p.minMTU {
+		return false
+	}
+	if p.maxHops > 0 && len(ifaces) > p.maxHops {
+		return false
+	}
+	if p.sequence != nil && !matchesSequence(ifaces, p.sequence) {
+		return false
+	}
+	if len(p.prefix) > 0 && !strings.HasPrefix(Fingerprint(path), p.prefix) {
+		return false
+	}
+	for _, hops := range p.requires {
+		if !containsHops(ifaces, hops) {
+			return false
+		}
+	}
+	for _, hops := range p.avoids {
+		if containsHops(ifaces, hops) {
+			return false
+		}
+	}
+	return true
+}
+
+// Score returns the weighted sum of the preferences of the policy
+func (p *Policy) Score(path *sciond.PathReplyEntry) float64 {
+	var score float64
+	for name, weight := range p.weights {
+		score += weight * metrics[name](path)
+	}
+	return score
+}
+
+func (p *Policy) String() string {
+	return p.expr
+}
+
+// Returns true if ifaces contains hops matching the predicates in the same order
+func containsHops(ifaces []sciond.PathInterface, hops []HopPredicate) bool {
+	i := 0
+	for _, iface := range ifaces {
+		if i < len(hops) && hops[i].Match(iface) {
+			i++
+		}
+	}
+	return i == len(hops)
+}
+
+// Returns true if each of the interfaces matches the predicate at the same position
+func matchesSequence(ifaces []sciond.PathInterface, hops []HopPredicate) bool {
+	if len(ifaces) != len(hops) {
+		return false
+	}
+	for i, iface := range ifaces {
+		if !hops[i].Match(iface) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSpecifier parses a path specifier, which selects paths independently of the order in
+// which the paths are listed: either a prefix of at least 8 hex digits of the fingerprint of
+// the path, or a sequence of hop predicates that match the hops of the path one by one, e.g.
+// "17-ffaa:0:1102#1 17-ffaa:0:1107#*". It returns a policy that only accepts those paths.
+func ParseSpecifier(s string) (*Policy, error) {
+	s = strings.TrimSpace(s)
+	if isFingerprint(s) {
+		return Parse("fingerprint " + s)
+	}
+	return Parse("sequence " + s)
+}
+
+// HopPredicate matches the hops, i.e. the interfaces, of a path by ISD-AS and interface ID
+type HopPredicate struct {
+	IA   string // ISD-AS pattern: an ISD-AS, an ISD prefix ("17-*"), an AS prefix ("17-ffaa:0:*") or "*"
+	IfID uint64 // Interface ID, 0 matches any interface
+}
+
+// ParseHopPredicate parses a hop predicate of the form ISD-AS#IF, where ISD-AS is a pattern as
+// in HopPredicate and IF is an interface ID or "*". Without "#IF", any interface matches, and
+// an ISD without AS, e.g. "17", matches all ASes of the ISD.
+func ParseHopPredicate(s string) (HopPredicate, error) {
+	var hp HopPredicate
+	iaStr, ifStr := s, "*"
+	if i := strings.Index(s, "#"); i >= 0 {
+		iaStr, ifStr = s[:i], s[i+1:]
+	}
+	if ifStr != "*" {
+		ifID, err := strconv.ParseUint(ifStr, 10, 64)
+		if err != nil {
+			return hp, fmt.Errorf("Invalid interface in hop predicate %q", s)
+		}
+		hp.IfID = ifID
+	}
+	if iaStr != "*" && !strings.Contains(iaStr, "-") {
+		iaStr += "-*"
+	}
+	if iaStr != "*" {
+		isd := iaStr[:strings.Index(iaStr, "-")]
+		if _, err := strconv.ParseUint(isd, 10, 16); err != nil {
+			return hp, fmt.Errorf("Invalid ISD in hop predicate %q", s)
+		}
+		if !strings.HasSuffix(iaStr, "*") {
+			ia, err := addr.IAFromString(iaStr)
+			if err != nil {
+				return hp, fmt.Errorf("Invalid ISD-AS in hop predicate %q: %v", s, err)
+			}
+			iaStr = ia.String()
+		} else if !strings.HasSuffix(iaStr, "-*") && !strings.HasSuffix(iaStr, ":*") {
+			return hp, fmt.Errorf("Invalid ISD-AS prefix in hop predicate %q, must end with '-' or ':'", s)
+		}
+	}
+	hp.IA = iaStr
+	return hp, nil
+}
+
+// ParseHopPredicates parses hop predicates separated by spaces
+func ParseHopPredicates(s string) ([]HopPredicate, error) {
+	var hops []HopPredicate
+	for _, f := range strings.Fields(s) {
+		hp, err := ParseHopPredicate(f)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hp)
+	}
+	return hops, nil
+}
+
+// Match returns true if the interface matches the predicate
+func (hp HopPredicate) Match(iface sciond.PathInterface) bool {
+	if hp.IfID != 0 && uint64(iface.IfID) != hp.IfID {
+		return false
+	}
+	if hp.IA == "*" {
+		return true
+	}
+	ia := iface.ISD_AS().String()
+	if strings.HasSuffix(hp.IA, "*") {
+		return strings.HasPrefix(ia, hp.IA[:len(hp.IA)-1])
+	}
+	return ia == hp.IA
+}
+
+func (hp HopPredicate) String() string {
+	if hp.IfID == 0 {
+		return hp.IA + "#*"
+	}
+	return fmt.Sprintf("%s#%d", hp.IA, hp.IfID)
+}
@@ -0,0 +1,231 @@
+// Package pathpolicy selects the paths of the scionlab applications according to a path policy.
+//
+// A PathPolicy decides which paths are acceptable and which of them is preferred. Policies are
+// written in a small language, see Parse, and can be given on the command line or loaded from
+// a file. The built-in policies are expressions of the same language:
+//
+//	shortest    prefers paths with fewer hops
+//	mtu         prefers paths with a larger MTU
+//	expiry      prefers paths that expire later
+//
+// A policy combining constraints and a weighted preference looks like this:
+//
+//	avoid 17-ffaa:0:1102; min_mtu 1400; max_hops 8; 2*shortest + expiry
+package pathpolicy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+
+	"github.com/perrig/scionlab/transport"
+)
+
+// PathPolicy decides which paths an application may use and which one it prefers
+type PathPolicy interface {
+	// Accept returns true if the path may be used
+	Accept(path *sciond.PathReplyEntry) bool
+	// Score returns the preference for the path, larger is better
+	Score(path *sciond.PathReplyEntry) float64
+}
+
+var (
+	// ErrNoPath is returned if there is no path to the destination at all
+	ErrNoPath = errors.New("No path to the destination")
+	// ErrNoMatch is returned if there are paths to the destination, but none that the policy
+	// accepts
+	ErrNoMatch = errors.New("No path to the destination matches the path policy")
+)
+
+// New returns the policy given by the expression expr, or the one in the file at path if path
+// is set. If both are empty, it returns nil, which leaves the choice of the path to the SCION
+// library, see Apply.
+func New(expr, path string) (PathPolicy, error) {
+	var (
+		p   *Policy
+		err error
+	)
+	switch {
+	case len(path) > 0 && len(expr) > 0:
+		return nil, errors.New("Only one of a path policy and a path policy file can be specified")
+	case len(path) > 0:
+		p, err = Load(path)
+	case len(expr) > 0:
+		p, err = Parse(expr)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Rank returns the paths of pathSet that p accepts, the preferred one first. Paths with the same
+// score are ordered by number of hops and MTU, and otherwise by their key in pathSet, so that
+// the order does not change between runs. A nil policy accepts all paths and uses the default
+// preference.
+func Rank(p PathPolicy, pathSet spathmeta.AppPathSet) []*spathmeta.AppPath {
+	if p == nil {
+		p = Default
+	}
+	var keys []string
+	for k := range pathSet {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+	var ranked []*spathmeta.AppPath
+	scores := make(map[*spathmeta.AppPath]float64)
+	for _, k := range keys {
+		path := pathSet[spathmeta.PathKey(k)]
+		if !p.Accept(path.Entry) {
+			continue
+		}
+		ranked = append(ranked, path)
+		scores[path] = p.Score(path.Entry)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		pi, pj := ranked[i].Entry.Path, ranked[j].Entry.Path
+		if len(pi.Interfaces) != len(pj.Interfaces) {
+			return len(pi.Interfaces) < len(pj.Interfaces)
+		}
+		return pi.Mtu > pj.Mtu
+	})
+	return ranked
+}
+
+// Choose returns the path from local to remote that p prefers. It returns ErrNoPath if there is
+// no path at all, and ErrNoMatch if p accepts none of them.
+func Choose(p PathPolicy, local, remote addr.IA) (*sciond.PathReplyEntry, error) {
+	pathSet := transport.DefNetwork.PathResolver().Query(local, remote)
+	if len(pathSet) == 0 {
+		return nil, ErrNoPath
+	}
+	ranked := Rank(p, pathSet)
+	if len(ranked) == 0 {
+		return nil, ErrNoMatch
+	}
+	return ranked[0].Entry, nil
+}
+
+// Apply sets the path p prefers on remote, so that connections dialed to it use that path. It
+// does nothing if p is nil or if local and remote are in the same AS.
+func Apply(p PathPolicy, local, remote *snet.Addr) error {
+	if p == nil || remote.IA.Eq(local.IA) {
+		return nil
+	}
+	entry, err := Choose(p, local.IA, remote.IA)
+	if err != nil {
+		return fmt.Errorf("Path to %v: %v", remote.IA, err)
+	}
+	SetPath(remote, entry)
+	return nil
+}
+
+// SetPath sets the path and next hop of a to the path entry
+func SetPath(a *snet.Addr, entry *sciond.PathReplyEntry) {
+	a.Path = spath.New(entry.Path.FwdPath)
+	a.Path.InitOffsets()
+	a.NextHopHost = entry.HostInfo.Host()
+	a.NextHopPort = entry.HostInfo.Port
+}
+
+// Restrict returns a policy that only accepts the paths that both p and filter accept, and
+// prefers them like p. A nil p prefers paths like Default.
+func Restrict(p PathPolicy, filter PathPolicy) PathPolicy {
+	if p == nil {
+		p = Default
+	}
+	return restricted{p, filter}
+}
+
+type restricted struct {
+	PathPolicy
+	filter PathPolicy
+}
+
+func (r restricted) Accept(path *sciond.PathReplyEntry) bool {
+	return r.filter.Accept(path) && r.PathPolicy.Accept(path)
+}
+
+// Length of the fingerprints in hex digits, and the minimum length of a prefix that selects a
+// path
+const (
+	fingerprintLen    = 16
+	minFingerprintLen = 8
+)
+
+// Fingerprint returns a short identifier of the path, which only depends on the interfaces it
+// traverses: the first 8 bytes of the SHA-256 hash of the ISD-AS and interface ID of each hop,
+// hex encoded. The fingerprint stays the same when the path is refreshed, so it identifies the
+// path across runs.
+func Fingerprint(path *sciond.PathReplyEntry) string {
+	h := sha256.New()
+	b := make([]byte, 16)
+	for _, iface := range path.Path.Interfaces {
+		binary.BigEndian.PutUint64(b, uint64(iface.RawIsdas))
+		binary.BigEndian.PutUint64(b[8:], uint64(iface.IfID))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:fingerprintLen]
+}
+
+// Returns true if s is a prefix of a fingerprint that is long enough to select a path
+func isFingerprint(s string) bool {
+	if len(s) < minFingerprintLen || len(s) > fingerprintLen {
+		return false
+	}
+	_, err := hex.DecodeString(s + strings.Repeat("0", len(s)%2))
+	return err == nil
+}
+
+// Scores of the preferences, each normalized to [0,1], where larger is better
+var metrics = map[string]func(path *sciond.PathReplyEntry) float64{
+	"shortest": shortestMetric,
+	"mtu":      mtuMetric,
+	"expiry":   expiryMetric,
+}
+
+// Number of hops at which the score of shortest is 0.5
+const hopsMidpoint = 7.0
+
+func shortestMetric(path *sciond.PathReplyEntry) float64 {
+	hopCount := float64(len(path.Path.Interfaces))
+	return math.Exp(-(hopCount - hopsMidpoint)) / (1 + math.Exp(-(hopCount - hopsMidpoint)))
+}
+
+// MTU at which the score of mtu is 0.5, and the steepness of the score around it
+const (
+	mtuMidpoint = 1500.0
+	mtuTilt     = 0.004
+)
+
+func mtuMetric(path *sciond.PathReplyEntry) float64 {
+	return 1 / (1 + math.Exp(-mtuTilt*(float64(path.Path.Mtu)-mtuMidpoint)))
+}
+
+// Remaining lifetime at which the score of expiry is 0.5
+const expiryMidpoint = time.Hour
+
+func expiryMetric(path *sciond.PathReplyEntry) float64 {
+	remaining := time.Until(path.Path.Expiry())
+	if remaining <= 0 {
+		return 0
+	}
+	return float64(remaining) / float64(remaining+expiryMidpoint)
+}
@@ -0,0 +1,153 @@
+// Package transport abstracts the SCION network used by the scionlab applications.
+//
+// The applications open connections and query paths through the Network interface instead
+// of calling snet directly. By default the network is backed by snet, i.e., a SCION dispatcher
+// and sciond. For offline testing, DefNetwork can be set to an in-memory network (see the
+// memnet package) before the applications initialize the network.
+package transport
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath/spathmeta"
+)
+
+// Conn is a SCION UDP connection. Its methods match those of snet.Conn.
+type Conn interface {
+	Read(b []byte) (int, error)
+	ReadFrom(b []byte) (int, net.Addr, error)
+	ReadFromSCION(b []byte) (int, *snet.Addr, error)
+	Write(b []byte) (int, error)
+	WriteTo(b []byte, raddr net.Addr) (int, error)
+	WriteToSCION(b []byte, raddr *snet.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// BatchConn is a Conn that sends and receives several packets with one call. The bwtester
+// data path uses these methods if a connection implements them.
+type BatchConn interface {
+	Conn
+	// WriteBatch sends the packets to the remote address of the connection. It returns the
+	// number of packets sent, which is less than len(pkts) only if an error occurred.
+	WriteBatch(pkts [][]byte) (int, error)
+	// ReadBatch blocks until at least one packet is available and reads up to len(bufs)
+	// packets into bufs, their lengths into sizes. It returns the number of packets read.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+}
+
+// PathResolver returns the set of paths between two ISD-ASes.
+type PathResolver interface {
+	Query(src, dst addr.IA) spathmeta.AppPathSet
+}
+
+// Network creates SCION UDP connections and resolves paths.
+type Network interface {
+	ListenSCION(network string, laddr *snet.Addr) (Conn, error)
+	DialSCION(network string, laddr, raddr *snet.Addr) (Conn, error)
+	PathResolver() PathResolver
+}
+
+// Errors returned by the networks other than snet, such as memnet. They are compared by
+// identity, see IsPathError and IsClosedError.
+var (
+	ErrClosed       = errors.New("use of closed connection")
+	ErrPathNotFound = errors.New("path not found")
+	// A router on the path reported that the path failed, like an SCMP error of snet
+	ErrPathFailed = errors.New("path failed")
+)
+
+// Messages of the snet errors that report a failed path, see IsPathError
+const (
+	ErrMsgPathNotFound = "Path not found"
+	ErrMsgSCMP         = "SCMP error"
+)
+
+// IsPathError returns true if err reports that packets cannot be sent along the path to the
+// remote host: no path was found, or a router on the path returned an SCMP error
+func IsPathError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrPathNotFound || err == ErrPathFailed {
+		return true
+	}
+	// snet has no error types or values for these, it only sets the message of a
+	// common.BasicError, so its errors are recognized by their messages
+	msg := common.GetErrorMsg(err)
+	return msg == ErrMsgPathNotFound || strings.HasPrefix(msg, ErrMsgSCMP)
+}
+
+// IsClosedError returns true if err reports that the connection was closed, so that reading
+// from it or writing to it again is pointless
+func IsClosedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrClosed {
+		return true
+	}
+	// snet passes on the error of the closed dispatcher socket, which only the net package
+	// creates and which has no exported value, so its message is matched
+	return strings.Contains(err.Error(), "use of closed")
+}
+
+// DefNetwork is the network used by the package level functions
+var DefNetwork Network
+
+// Init initializes DefNetwork as a SCION network, connected to the sciond and dispatcher
+// at the given paths. If DefNetwork was already set, for instance to an in-memory network
+// for testing, Init leaves it untouched.
+func Init(ia addr.IA, sciondPath string, dispatcherPath string) error {
+	if DefNetwork != nil {
+		return nil
+	}
+	if err := snet.Init(ia, sciondPath, dispatcherPath); err != nil {
+		return err
+	}
+	DefNetwork = scionNetwork{}
+	return nil
+}
+
+// ListenSCION opens a connection on DefNetwork listening on laddr
+func ListenSCION(network string, laddr *snet.Addr) (Conn, error) {
+	return DefNetwork.ListenSCION(network, laddr)
+}
+
+// DialSCION opens a connection on DefNetwork from laddr to raddr
+func DialSCION(network string, laddr, raddr *snet.Addr) (Conn, error) {
+	return DefNetwork.DialSCION(network, laddr, raddr)
+}
+
+// scionNetwork forwards all calls to the snet default network
+type scionNetwork struct{}
+
+func (scionNetwork) ListenSCION(network string, laddr *snet.Addr) (Conn, error) {
+	conn, err := snet.ListenSCION(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (scionNetwork) DialSCION(network string, laddr, raddr *snet.Addr) (Conn, error) {
+	conn, err := snet.DialSCION(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (scionNetwork) PathResolver() PathResolver {
+	return snet.DefNetwork.PathResolver()
+}
@@ -3,6 +3,7 @@ package lib
 import (
     "encoding/csv"
     "encoding/json"
+    "errors"
     "fmt"
     model "github.com/perrig/scionlab/webapp/models"
     "io"
@@ -27,18 +28,102 @@ var reItVar = `(?i:interarrival time variance:\s*)([0-9.-]*)(?:\s*ms)`
 var reItMin = `(?i:interarrival time min:\s*)([0-9.-]*)(?:\s*ms)`
 var reItAvg = `(?i:average interarrival time:\s*)([0-9.-]*)(?:\s*ms)`
 var reItMax = `(?i:interarrival time max:\s*)([0-9.-]*)(?:\s*ms)`
+var rePct = `(?i:p50\s*)([0-9.-]*)(?:ms,\s*p90\s*)([0-9.-]*)(?:ms,\s*p99\s*)([0-9.-]*)(?:ms,\s*p99\.9\s*)([0-9.-]*)(?:ms)`
+var reItPct = `(?i:interarrival time percentiles:\s*)` + rePct
+var reOwdPct = `(?i:one-way delay relative to min percentiles:\s*)` + rePct
+var pctNames = []string{"p50", "p90", "p99", "p999"}
 var reErr1 = `(?i:err=*)"(.*?)"`
 var reErr2 = `(?i:crit msg=*)"(.*?)"`
 var reErr3 = `(?i:error:\s*)([\s\S]*)`
 
-// ExtractBwtestRespData will parse cmd line output from bwtester for adding BwTestItem fields.
-func ExtractBwtestRespData(resp string, d *model.BwTestItem, start time.Time) {
+// bwtestReport holds the fields of the bwtestclient -json document stored in BwTestItem.
+// Durations are in ns and bandwidths in bps.
+type bwtestReport struct {
+    CS    *bwtestDirResult `json:"cs"`
+    SC    *bwtestDirResult `json:"sc"`
+    Error string           `json:"error"`
+}
+
+type bwtestDirResult struct {
+    AchievedBandwidth int                `json:"achieved_bandwidth"`
+    IPAvar            int64              `json:"interarrival_var"`
+    IPAmin            int64              `json:"interarrival_min"`
+    IPAavg            int64              `json:"interarrival_avg"`
+    IPAmax            int64              `json:"interarrival_max"`
+    IPAPercentiles    *bwtestPercentiles `json:"interarrival_percentiles"`
+    OWDPercentiles    *bwtestPercentiles `json:"owd_percentiles"`
+}
+
+type bwtestPercentiles struct {
+    P50  int64 `json:"p50"`
+    P90  int64 `json:"p90"`
+    P99  int64 `json:"p99"`
+    P999 int64 `json:"p99.9"`
+}
+
+// ExtractBwtestJSONData will parse the JSON document written by bwtester with -json for adding
+// BwTestItem fields, returns an error if out holds no such document.
+func ExtractBwtestJSONData(out []byte, d *model.BwTestItem, start time.Time) error {
+    var report bwtestReport
+    if err := json.Unmarshal(out, &report); err != nil {
+        return err
+    }
+    if report.CS == nil && report.SC == nil && report.Error == "" {
+        return errors.New("bwtester results missing")
+    }
+    setBwtestTimes(d, start)
+
+    if r := report.CS; r != nil {
+        d.CSThroughput = r.AchievedBandwidth
+        d.CSArrVar, d.CSArrAvg = int(r.IPAvar/1e6), int(r.IPAavg/1e6)
+        d.CSArrMin, d.CSArrMax = int(r.IPAmin/1e6), int(r.IPAmax/1e6)
+    }
+    if r := report.SC; r != nil {
+        d.SCThroughput = r.AchievedBandwidth
+        d.SCArrVar, d.SCArrAvg = int(r.IPAvar/1e6), int(r.IPAavg/1e6)
+        d.SCArrMin, d.SCArrMax = int(r.IPAmin/1e6), int(r.IPAmax/1e6)
+    }
+    csArr, csOwd, scArr, scOwd := percentilesToUs(nil), percentilesToUs(nil), percentilesToUs(nil), percentilesToUs(nil)
+    if report.CS != nil {
+        csArr, csOwd = percentilesToUs(report.CS.IPAPercentiles), percentilesToUs(report.CS.OWDPercentiles)
+    }
+    if report.SC != nil {
+        scArr, scOwd = percentilesToUs(report.SC.IPAPercentiles), percentilesToUs(report.SC.OWDPercentiles)
+    }
+    d.CSArrP50, d.CSArrP90, d.CSArrP99, d.CSArrP999 = csArr[0], csArr[1], csArr[2], csArr[3]
+    d.CSOwdP50, d.CSOwdP90, d.CSOwdP99, d.CSOwdP999 = csOwd[0], csOwd[1], csOwd[2], csOwd[3]
+    d.SCArrP50, d.SCArrP90, d.SCArrP99, d.SCArrP999 = scArr[0], scArr[1], scArr[2], scArr[3]
+    d.SCOwdP50, d.SCOwdP90, d.SCOwdP99, d.SCOwdP999 = scOwd[0], scOwd[1], scOwd[2], scOwd[3]
+
+    d.Error = report.Error
+    if d.Error == "" && (d.CSThroughput == 0 || d.SCThroughput == 0) {
+        d.Error = "bwtester results incomplete"
+    }
+    return nil
+}
+
+// percentilesToUs converts percentiles in ns to us, missing values are -1.
+func percentilesToUs(p *bwtestPercentiles) [4]int {
+    if p == nil {
+        return [4]int{-1, -1, -1, -1}
+    }
+    return [4]int{int((p.P50 + 500) / 1000), int((p.P90 + 500) / 1000), int((p.P99 + 500) / 1000),
+        int((p.P999 + 500) / 1000)}
+}
+
+// setBwtestTimes stores the duration of the test and the time of its insertion.
+func setBwtestTimes(d *model.BwTestItem, start time.Time) {
     // store duration in ms
     diff := time.Now().Sub(start)
     d.ActualDuration = int(diff.Nanoseconds() / 1e6)
 
     // store current epoch in ms
     d.Inserted = time.Now().UnixNano() / 1e6
+}
+
+// ExtractBwtestRespData will parse cmd line output from bwtester for adding BwTestItem fields.
+func ExtractBwtestRespData(resp string, d *model.BwTestItem, start time.Time) {
+    setBwtestTimes(d, start)
 
     var data = map[string]map[string]string{}
     var dir, err string
@@ -85,6 +170,22 @@ func ExtractBwtestRespData(resp string, d *model.BwTestItem, start time.Time) {
             re := regexp.MustCompile(reItMax)
             data[dir]["arrival_max"] = re.FindStringSubmatch(r[i])[1]
         }
+        match, _ = regexp.MatchString(reItPct, r[i])
+        if match {
+            re := regexp.MustCompile(reItPct)
+            m := re.FindStringSubmatch(r[i])
+            for j, name := range pctNames {
+                data[dir]["arrival_"+name] = m[j+1]
+            }
+        }
+        match, _ = regexp.MatchString(reOwdPct, r[i])
+        if match {
+            re := regexp.MustCompile(reOwdPct)
+            m := re.FindStringSubmatch(r[i])
+            for j, name := range pctNames {
+                data[dir]["owd_"+name] = m[j+1]
+            }
+        }
         // evaluate error message potential
         match1, _ := regexp.MatchString(reErr1, r[i])
         match2, _ := regexp.MatchString(reErr2, r[i])
@@ -118,6 +219,22 @@ func ExtractBwtestRespData(resp string, d *model.BwTestItem, start time.Time) {
     d.SCArrAvg, _ = strconv.Atoi(data["sc"]["arrival_avg"])
     d.SCArrMin, _ = strconv.Atoi(data["sc"]["arrival_min"])
     d.SCArrMax, _ = strconv.Atoi(data["sc"]["arrival_max"])
+    d.CSArrP50 = parseMsToUs(data["cs"]["arrival_p50"])
+    d.CSArrP90 = parseMsToUs(data["cs"]["arrival_p90"])
+    d.CSArrP99 = parseMsToUs(data["cs"]["arrival_p99"])
+    d.CSArrP999 = parseMsToUs(data["cs"]["arrival_p999"])
+    d.CSOwdP50 = parseMsToUs(data["cs"]["owd_p50"])
+    d.CSOwdP90 = parseMsToUs(data["cs"]["owd_p90"])
+    d.CSOwdP99 = parseMsToUs(data["cs"]["owd_p99"])
+    d.CSOwdP999 = parseMsToUs(data["cs"]["owd_p999"])
+    d.SCArrP50 = parseMsToUs(data["sc"]["arrival_p50"])
+    d.SCArrP90 = parseMsToUs(data["sc"]["arrival_p90"])
+    d.SCArrP99 = parseMsToUs(data["sc"]["arrival_p99"])
+    d.SCArrP999 = parseMsToUs(data["sc"]["arrival_p999"])
+    d.SCOwdP50 = parseMsToUs(data["sc"]["owd_p50"])
+    d.SCOwdP90 = parseMsToUs(data["sc"]["owd_p90"])
+    d.SCOwdP99 = parseMsToUs(data["sc"]["owd_p99"])
+    d.SCOwdP999 = parseMsToUs(data["sc"]["owd_p999"])
 
     if d.CSThroughput == 0 || d.SCThroughput == 0 {
         d.Error = err
@@ -169,6 +286,15 @@ func GetBwByTimeHandler(w http.ResponseWriter, r *http.Request, active bool, src
     fmt.Fprintf(w, strings.Replace(string(jsonBuf), "%", "%%", -1))
 }
 
+// parseMsToUs converts a value in ms with fractions to us, missing values are -1.
+func parseMsToUs(s string) int {
+    ms, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+        return -1
+    }
+    return int(ms*1000 + 0.5)
+}
+
 func removeOuterQuotes(s string) string {
     if len(s) >= 2 {
         if c := s[len(s)-1]; s[0] == c && (c == '"' || c == '\'') {
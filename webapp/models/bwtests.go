@@ -29,6 +29,14 @@ type BwTestItem struct {
     CSArrAvg       int // ms
     CSArrMin       int // ms
     CSArrMax       int // ms
+    CSArrP50       int // us
+    CSArrP90       int // us
+    CSArrP99       int // us
+    CSArrP999      int // us
+    CSOwdP50       int // us
+    CSOwdP90       int // us
+    CSOwdP99       int // us
+    CSOwdP999      int // us
     SCDuration     int // ms
     SCPackets      int // packets
     SCPktSize      int // bytes
@@ -38,6 +46,14 @@ type BwTestItem struct {
     SCArrAvg       int // ms
     SCArrMin       int // ms
     SCArrMax       int // ms
+    SCArrP50       int // us
+    SCArrP90       int // us
+    SCArrP99       int // us
+    SCArrP999      int // us
+    SCOwdP50       int // us
+    SCOwdP90       int // us
+    SCOwdP99       int // us
+    SCOwdP999      int // us
     Error          string
 }
 
@@ -96,6 +112,14 @@ func CreateBwTestTable() {
         CSArrAvg INT,
         CSArrMin INT,
         CSArrMax INT,
+        CSArrP50 INT,
+        CSArrP90 INT,
+        CSArrP99 INT,
+        CSArrP999 INT,
+        CSOwdP50 INT,
+        CSOwdP90 INT,
+        CSOwdP99 INT,
+        CSOwdP999 INT,
         SCDuration INT,
         SCPackets INT,
         SCPktSize INT,
@@ -105,6 +129,14 @@ func CreateBwTestTable() {
         SCArrAvg INT,
         SCArrMin INT,
         SCArrMax INT,
+        SCArrP50 INT,
+        SCArrP90 INT,
+        SCArrP99 INT,
+        SCArrP999 INT,
+        SCOwdP50 INT,
+        SCOwdP90 INT,
+        SCOwdP99 INT,
+        SCOwdP999 INT,
         Error TEXT
     );
     `
@@ -112,6 +144,43 @@ func CreateBwTestTable() {
     if err != nil {
         panic(err)
     }
+    // add the percentile columns to tables created by earlier versions
+    addMissingBwTestColumns([]string{
+        "CSArrP50", "CSArrP90", "CSArrP99", "CSArrP999",
+        "CSOwdP50", "CSOwdP90", "CSOwdP99", "CSOwdP999",
+        "SCArrP50", "SCArrP90", "SCArrP99", "SCArrP999",
+        "SCOwdP50", "SCOwdP90", "SCOwdP99", "SCOwdP999",
+    })
+}
+
+// addMissingBwTestColumns operates on the DB to add the INT columns that
+// do not exist yet to the bwtests table.
+func addMissingBwTestColumns(columns []string) {
+    rows, err := db.Query("PRAGMA table_info(bwtests)")
+    if err != nil {
+        panic(err)
+    }
+    existing := make(map[string]bool)
+    for rows.Next() {
+        var cid, notnull, pk int
+        var name, ctype string
+        var dflt interface{}
+        err2 := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+        if err2 != nil {
+            panic(err2)
+        }
+        existing[name] = true
+    }
+    rows.Close()
+    for _, column := range columns {
+        if existing[column] {
+            continue
+        }
+        _, err = db.Exec("ALTER TABLE bwtests ADD COLUMN " + column + " INT DEFAULT -1")
+        if err != nil {
+            panic(err)
+        }
+    }
 }
 
 // StoreBwTestItem operates on the DB to insert a BwTestItem.
@@ -135,6 +204,14 @@ func StoreBwTestItem(bwtest *BwTestItem) {
         CSArrAvg,
         CSArrMin,
         CSArrMax,
+        CSArrP50,
+        CSArrP90,
+        CSArrP99,
+        CSArrP999,
+        CSOwdP50,
+        CSOwdP90,
+        CSOwdP99,
+        CSOwdP999,
         SCDuration,
         SCPackets,
         SCPktSize,
@@ -144,8 +221,16 @@ func StoreBwTestItem(bwtest *BwTestItem) {
         SCArrAvg,
         SCArrMin,
         SCArrMax,
+        SCArrP50,
+        SCArrP90,
+        SCArrP99,
+        SCArrP999,
+        SCOwdP50,
+        SCOwdP90,
+        SCOwdP99,
+        SCOwdP999,
         Error
-    ) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    ) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `
     stmt, err := db.Prepare(sqlInsert)
     if err != nil {
@@ -171,6 +256,14 @@ func StoreBwTestItem(bwtest *BwTestItem) {
         bwtest.CSArrAvg,
         bwtest.CSArrMin,
         bwtest.CSArrMax,
+        bwtest.CSArrP50,
+        bwtest.CSArrP90,
+        bwtest.CSArrP99,
+        bwtest.CSArrP999,
+        bwtest.CSOwdP50,
+        bwtest.CSOwdP90,
+        bwtest.CSOwdP99,
+        bwtest.CSOwdP999,
         bwtest.SCDuration,
         bwtest.SCPackets,
         bwtest.SCPktSize,
@@ -180,6 +273,14 @@ func StoreBwTestItem(bwtest *BwTestItem) {
         bwtest.SCArrAvg,
         bwtest.SCArrMin,
         bwtest.SCArrMax,
+        bwtest.SCArrP50,
+        bwtest.SCArrP90,
+        bwtest.SCArrP99,
+        bwtest.SCArrP999,
+        bwtest.SCOwdP50,
+        bwtest.SCOwdP90,
+        bwtest.SCOwdP99,
+        bwtest.SCOwdP999,
         bwtest.Error)
     if err2 != nil {
         panic(err2)
@@ -207,6 +308,14 @@ func ReadBwTestItemsAll() []BwTestItem {
         CSArrAvg,
         CSArrMin,
         CSArrMax,
+        CSArrP50,
+        CSArrP90,
+        CSArrP99,
+        CSArrP999,
+        CSOwdP50,
+        CSOwdP90,
+        CSOwdP99,
+        CSOwdP999,
         SCDuration,
         SCPackets,
         SCPktSize,
@@ -216,6 +325,14 @@ func ReadBwTestItemsAll() []BwTestItem {
         SCArrAvg,
         SCArrMin,
         SCArrMax,
+        SCArrP50,
+        SCArrP90,
+        SCArrP99,
+        SCArrP999,
+        SCOwdP50,
+        SCOwdP90,
+        SCOwdP99,
+        SCOwdP999,
         Error
     FROM bwtests
     ORDER BY datetime(Inserted) DESC
@@ -247,6 +364,14 @@ func ReadBwTestItemsAll() []BwTestItem {
             &bwtest.CSArrAvg,
             &bwtest.CSArrMin,
             &bwtest.CSArrMax,
+            &bwtest.CSArrP50,
+            &bwtest.CSArrP90,
+            &bwtest.CSArrP99,
+            &bwtest.CSArrP999,
+            &bwtest.CSOwdP50,
+            &bwtest.CSOwdP90,
+            &bwtest.CSOwdP99,
+            &bwtest.CSOwdP999,
             &bwtest.SCDuration,
             &bwtest.SCPackets,
             &bwtest.SCPktSize,
@@ -256,6 +381,14 @@ func ReadBwTestItemsAll() []BwTestItem {
             &bwtest.SCArrAvg,
             &bwtest.SCArrMin,
             &bwtest.SCArrMax,
+            &bwtest.SCArrP50,
+            &bwtest.SCArrP90,
+            &bwtest.SCArrP99,
+            &bwtest.SCArrP999,
+            &bwtest.SCOwdP50,
+            &bwtest.SCOwdP90,
+            &bwtest.SCOwdP99,
+            &bwtest.SCOwdP999,
             &bwtest.Error)
         if err2 != nil {
             panic(err2)
@@ -3,6 +3,7 @@
 package main
 
 import (
+    "bytes"
     "flag"
     "fmt"
     _ "github.com/mattn/go-sqlite3"
@@ -129,7 +130,7 @@ func parseBwTest2Cmd(d *model.BwTestItem, appSel string) []string {
             d.CSPackets, d.CSBandwidth)
         bwSC := fmt.Sprintf("-sc=%d,%d,%d,%dbps", d.SCDuration/1000, d.SCPktSize,
             d.SCPackets, d.SCBandwidth)
-        command = append(command, []string{bwCS, bwSC}...)
+        command = append(command, []string{bwCS, bwSC, "-json"}...)
     }
     if len(lib.GetLocalIa()) == 0 {
         command = append(command, []string{"-sciondFromIA"}...)
@@ -179,7 +180,12 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
         pipeReader, pipeWriter := io.Pipe()
         cmd.Stdout = pipeWriter
         cmd.Stderr = pipeWriter
-        go writeCmdOutput(w, pipeReader, d, appSel)
+        // bwtester writes its results as JSON to stdout, its other output to stderr
+        var jsonOut bytes.Buffer
+        if appSel == "bwtester" {
+            cmd.Stdout = &jsonOut
+        }
+        go writeCmdOutput(w, pipeReader, &jsonOut, d, appSel)
         cmd.Run()
         pipeWriter.Close()
     }
@@ -209,8 +215,13 @@ func continuousBwTest() {
         pipeReader, pipeWriter := io.Pipe()
         cmd.Stdout = pipeWriter
         cmd.Stderr = pipeWriter
+        // bwtester writes its results as JSON to stdout, its other output to stderr
+        var jsonOut bytes.Buffer
+        if appSel == "bwtester" {
+            cmd.Stdout = &jsonOut
+        }
 
-        go writeCmdOutput(nil, pipeReader, d, appSel)
+        go writeCmdOutput(nil, pipeReader, &jsonOut, d, appSel)
         start := time.Now()
         cmd.Run()
         pipeWriter.Close()
@@ -275,7 +286,9 @@ func getClientLocationSrc(app string) string {
 }
 
 // Handles piping command line output to logs, database, and http response writer.
-func writeCmdOutput(w http.ResponseWriter, pr *io.PipeReader, d *model.BwTestItem, appSel string) {
+// The bwtester results are parsed from the JSON document in jsonOut, or from the output if
+// there is none.
+func writeCmdOutput(w http.ResponseWriter, pr *io.PipeReader, jsonOut *bytes.Buffer, d *model.BwTestItem, appSel string) {
     start := time.Now()
     logpath := path.Join(srcpath, "webapp.log")
     file, err := os.Create(logpath)
@@ -311,7 +324,10 @@ func writeCmdOutput(w http.ResponseWriter, pr *io.PipeReader, d *model.BwTestIte
     }
     if appSel == "bwtester" {
         // parse bwtester data/error
-        lib.ExtractBwtestRespData(string(jsonBuf), d, start)
+        if err := lib.ExtractBwtestJSONData(jsonOut.Bytes(), d, start); err != nil {
+            log.Println("No bwtester JSON results, parsing output:", err)
+            lib.ExtractBwtestRespData(string(jsonBuf), d, start)
+        }
         // store in database
         model.StoreBwTestItem(d)
         lib.WriteBwtestCsv(d, srcpath)